@@ -0,0 +1,101 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	log "github.com/sirupsen/logrus"
+)
+
+// ManagerProvider is implemented by RouteTableManagers which can make
+// managers for route tables in other regions, or in other accounts by
+// assuming a role.
+type ManagerProvider interface {
+	ManagerFor(region string, roleArn string, externalID string) (RouteTableManager, error)
+}
+
+// accountManagers holds the managers made for other regions and accounts,
+// which each have their own session and rate limit. A nil accountManagers
+// holds none.
+type accountManagers struct {
+	endpoint string
+	rate     float64
+	burst    int
+	lock     sync.Mutex
+	managers map[string]*RouteTableManagerEC2 // By region, role and external ID
+}
+
+func (a *accountManagers) each(f func(*RouteTableManagerEC2)) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, m := range a.managers {
+		f(m)
+	}
+}
+
+func (a *accountManagers) setRateLimit(rate float64, burst int) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.rate = rate
+	a.burst = burst
+	for _, m := range a.managers {
+		m.setRateLimit(rate, burst)
+	}
+}
+
+// ManagerFor returns the manager for route tables in region (this manager's
+// region if empty), using credentials from assuming roleArn (with externalID,
+// if set) rather than the ambient credentials, if roleArn is set. Managers
+// are made once, and then shared by every route table using them.
+func (r *RouteTableManagerEC2) ManagerFor(region string, roleArn string, externalID string) (RouteTableManager, error) {
+	if region == "" {
+		region = r.Region
+	}
+	if region == r.Region && roleArn == "" {
+		return r, nil
+	}
+	if r.accounts == nil {
+		return nil, errors.New(fmt.Sprintf("Cannot manage route tables in region %s with role '%s' from this manager", region, roleArn))
+	}
+	a := r.accounts
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	key := region + " " + roleArn + " " + externalID
+	if m, ok := a.managers[key]; ok {
+		return m, nil
+	}
+	sess := newSession(region)
+	if roleArn != "" {
+		creds := stscreds.NewCredentials(sess, roleArn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = "AWSnycast"
+			if externalID != "" {
+				p.ExternalID = aws.String(externalID)
+			}
+		})
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+	m := newRouteTableManagerEC2(region, a.endpoint, sess)
+	m.setRateLimit(a.rate, a.burst)
+	m.notifier = r.notifier
+	m.auditLog = r.auditLog
+	m.safety = r.safety
+	m.interrupted = r.interrupted
+	if r.clock != nil {
+		m.setClock(r.clock)
+	}
+	a.managers[key] = m
+	log.WithFields(log.Fields{
+		"region":          region,
+		"assume_role_arn": roleArn,
+	}).Info("Managing route tables in another region or account")
+	return m, nil
+}
@@ -0,0 +1,210 @@
+package aws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/bobtfish/AWSnycast/clock"
+	"github.com/bobtfish/AWSnycast/notify"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultAuditLogMaxSize = 10 * 1024 * 1024
+	DefaultAuditLogBackups = 5
+)
+
+// AuditRecord is one line of the audit log, recording an attempt to change
+// a route.
+type AuditRecord struct {
+	Time           time.Time            `json:"time"`
+	Instance       string               `json:"instance_id,omitempty"` // The instance making the change
+	Action         string               `json:"action"`                // CreateRoute, ReplaceRoute or DeleteRoute
+	DryRun         bool                 `json:"dry_run"`
+	RouteTable     string               `json:"rtb"`
+	Cidr           string               `json:"cidr"`
+	PreviousTarget string               `json:"previous_target,omitempty"`
+	NewTarget      string               `json:"new_target,omitempty"`
+	Reason         string               `json:"reason,omitempty"`
+	Healthcheck    *HealthcheckSnapshot `json:"healthcheck,omitempty"`
+	Result         string               `json:"result"` // ok or error
+	Error          string               `json:"error,omitempty"`
+	RequestID      string               `json:"request_id,omitempty"`
+}
+
+// HealthcheckSnapshot is the state of a route's healthcheck when the route
+// was changed.
+type HealthcheckSnapshot struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Ready   bool   `json:"ready"`
+}
+
+// AuditLog appends AuditRecords as JSON lines to a file, rotating it when
+// it would grow larger than MaxSize. Rotated files have .1 (the newest),
+// .2 etc appended to their names, and only Backups of them are kept.
+type AuditLog struct {
+	Path     string
+	MaxSize  int64
+	Backups  int
+	Instance string // Set as the Instance of every record
+	clock    clock.Clock
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+// AuditLogSetter is implemented by RouteTableManagers which can record
+// route changes in an AuditLog.
+type AuditLogSetter interface {
+	SetAuditLog(*AuditLog)
+}
+
+func NewAuditLog(path string, maxSize int64, backups int, c clock.Clock) (*AuditLog, error) {
+	a := &AuditLog{
+		Path:    path,
+		MaxSize: maxSize,
+		Backups: backups,
+		clock:   c,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error opening audit log: %s", err.Error()))
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.New(fmt.Sprintf("Error opening audit log: %s", err.Error()))
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	a.file = nil
+	if a.Backups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", a.Path, a.Backups))
+		for i := a.Backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.Path, i), fmt.Sprintf("%s.%d", a.Path, i+1))
+		}
+		if err := os.Rename(a.Path, a.Path+".1"); err != nil {
+			return errors.New(fmt.Sprintf("Error rotating audit log: %s", err.Error()))
+		}
+	} else if err := os.Remove(a.Path); err != nil {
+		return errors.New(fmt.Sprintf("Error rotating audit log: %s", err.Error()))
+	}
+	return a.open()
+}
+
+// Write appends a record to the log. A nil AuditLog can be used, and
+// records nothing.
+func (a *AuditLog) Write(record AuditRecord) error {
+	if a == nil {
+		return nil
+	}
+	record.Instance = a.Instance
+	if record.Time.IsZero() {
+		record.Time = a.clock.Now()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		// Rotating failed last time, so try again
+		if err := a.open(); err != nil {
+			return err
+		}
+	}
+	if a.MaxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.MaxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// saveRequestID is a request.Option for a route change, which saves its
+// request ID into id when it completes, as the outputs of route changes
+// don't include them.
+func saveRequestID(id *string) request.Option {
+	return func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			*id = r.RequestID
+		})
+	}
+}
+
+// auditRequestID returns the request ID of a route change, from either its
+// error or what saveRequestID saved.
+func auditRequestID(id string, err error) string {
+	if reqErr, isReqErr := err.(awserr.RequestFailure); isReqErr {
+		return reqErr.RequestID()
+	}
+	return id
+}
+
+// audit records an attempt to change a route, described by the
+// notification which would be sent about it, in the audit log (if there is
+// one). requestID is that of the EC2 API call.
+func (r RouteTableManagerEC2) audit(action string, noop bool, n notify.Notification, rs ManageRoutesSpec, requestID string, err error) {
+	record := AuditRecord{
+		Action:         action,
+		DryRun:         noop,
+		RouteTable:     n.RouteTable,
+		Cidr:           n.Cidr,
+		PreviousTarget: n.PreviousTarget,
+		NewTarget:      n.NewTarget,
+		Reason:         n.Reason,
+		Result:         "ok",
+		RequestID:      auditRequestID(requestID, err),
+	}
+	if rs.healthcheck != nil {
+		record.Healthcheck = &HealthcheckSnapshot{
+			Name:    rs.HealthcheckName,
+			Healthy: rs.healthcheck.IsHealthy(),
+			Ready:   rs.healthcheck.CanPassYet(),
+		}
+	}
+	if err != nil {
+		record.Result = "error"
+		record.Error = err.Error()
+	}
+	if err := r.auditLog.Write(record); err != nil {
+		log.WithFields(log.Fields{"err": err.Error()}).Error("Error writing to audit log")
+	}
+}
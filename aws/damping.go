@@ -0,0 +1,192 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bobtfish/AWSnycast/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+// The defaults for the penalty model, which work like BGP route flap
+// dampening: with them, a route released three times in a few minutes is
+// suppressed for around half an hour.
+const (
+	DefaultDampingPenalty    = 1000
+	DefaultDampingSuppress   = 2000
+	DefaultDampingReuse      = 750
+	DefaultDampingHalfLife   = 900
+	DefaultDampingMaxPenalty = 6000
+)
+
+// DampingConfig stops a route which keeps being released and acquired (e.g.
+// because its healthcheck is bouncing) from being changed every time.
+type DampingConfig struct {
+	HoldTime   uint `yaml:"hold_time"`   // Seconds after acquiring a route before it can be released
+	Cooldown   uint `yaml:"cooldown"`    // Seconds after releasing a route before it can be acquired
+	Penalty    uint `yaml:"penalty"`     // Added each time the route is released
+	Suppress   uint `yaml:"suppress"`    // The route is not acquired once the penalty is above this
+	Reuse      uint `yaml:"reuse"`       // until the penalty has decayed to below this
+	HalfLife   uint `yaml:"half_life"`   // Seconds for the penalty to decay by half
+	MaxPenalty uint `yaml:"max_penalty"` // The most the penalty can be
+}
+
+func (c *DampingConfig) Validate() error {
+	if c.Penalty == 0 {
+		c.Penalty = DefaultDampingPenalty
+	}
+	if c.Suppress == 0 {
+		c.Suppress = DefaultDampingSuppress
+	}
+	if c.Reuse == 0 {
+		c.Reuse = DefaultDampingReuse
+	}
+	if c.HalfLife == 0 {
+		c.HalfLife = DefaultDampingHalfLife
+	}
+	if c.MaxPenalty == 0 {
+		c.MaxPenalty = DefaultDampingMaxPenalty
+	}
+	if c.Reuse >= c.Suppress {
+		return errors.New(fmt.Sprintf("damping reuse (%d) must be less than suppress (%d)", c.Reuse, c.Suppress))
+	}
+	if c.MaxPenalty <= c.Suppress {
+		return errors.New(fmt.Sprintf("damping max_penalty (%d) must be more than suppress (%d)", c.MaxPenalty, c.Suppress))
+	}
+	return nil
+}
+
+// damping tracks when a route was acquired and released in each route
+// table, to decide if it can be changed. A nil damping allows every change.
+type damping struct {
+	DampingConfig
+	clock  clock.Clock
+	lock   sync.Mutex
+	routes map[string]*dampingState // By route table ID
+}
+
+type dampingState struct {
+	acquired   time.Time
+	released   time.Time
+	penalty    float64
+	updated    time.Time // When penalty was last decayed
+	suppressed bool
+}
+
+func newDamping(c DampingConfig) *damping {
+	return &damping{
+		DampingConfig: c,
+		clock:         clock.Real,
+		routes:        make(map[string]*dampingState),
+	}
+}
+
+func (d *damping) setClock(c clock.Clock) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.clock = c
+}
+
+// state returns the state of the route in a route table, with its penalty
+// decayed to now. It must be called with the lock held.
+func (d *damping) state(rtb string, contextLogger *log.Entry) *dampingState {
+	now := d.clock.Now()
+	s, ok := d.routes[rtb]
+	if !ok {
+		s = &dampingState{updated: now}
+		d.routes[rtb] = s
+	}
+	if s.penalty > 0 {
+		halfLives := now.Sub(s.updated).Seconds() / float64(d.HalfLife)
+		s.penalty = s.penalty * math.Pow(0.5, halfLives)
+		if s.penalty < 1 {
+			s.penalty = 0
+		}
+	}
+	s.updated = now
+	if s.suppressed && s.penalty < float64(d.Reuse) {
+		s.suppressed = false
+		contextLogger.WithFields(log.Fields{"damping_penalty": int(s.penalty)}).Info("Route flap damping penalty has decayed, no longer suppressing route")
+	}
+	return s
+}
+
+// fields returns the damping state of the route in a route table, for
+// logging.
+func (d *damping) fields(rtb string) log.Fields {
+	if d == nil {
+		return log.Fields{}
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s := d.state(rtb, log.WithFields(log.Fields{"rtb": rtb}))
+	return log.Fields{
+		"damping_penalty":    int(s.penalty),
+		"damping_suppressed": s.suppressed,
+	}
+}
+
+// canAcquire returns why the route cannot be acquired in a route table, or
+// an empty string if it can be.
+func (d *damping) canAcquire(rtb string, contextLogger *log.Entry) string {
+	if d == nil {
+		return ""
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s := d.state(rtb, contextLogger)
+	if s.suppressed {
+		return "route is suppressed by flap damping"
+	}
+	if cooldown := time.Duration(d.Cooldown) * time.Second; !s.released.IsZero() && d.clock.Now().Sub(s.released) < cooldown {
+		return fmt.Sprintf("route was released less than %s ago", cooldown)
+	}
+	return ""
+}
+
+// canRelease returns why the route cannot be released in a route table, or
+// an empty string if it can be.
+func (d *damping) canRelease(rtb string, contextLogger *log.Entry) string {
+	if d == nil {
+		return ""
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s := d.state(rtb, contextLogger)
+	if holdTime := time.Duration(d.HoldTime) * time.Second; !s.acquired.IsZero() && d.clock.Now().Sub(s.acquired) < holdTime {
+		return fmt.Sprintf("route was acquired less than %s ago", holdTime)
+	}
+	return ""
+}
+
+func (d *damping) acquired(rtb string, contextLogger *log.Entry) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.state(rtb, contextLogger).acquired = d.clock.Now()
+}
+
+// released records the route being released in a route table, penalising
+// it and suppressing it if it has been released too often.
+func (d *damping) released(rtb string, contextLogger *log.Entry) {
+	if d == nil {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	s := d.state(rtb, contextLogger)
+	s.released = d.clock.Now()
+	s.penalty = math.Min(s.penalty+float64(d.Penalty), float64(d.MaxPenalty))
+	contextLogger = contextLogger.WithFields(log.Fields{"damping_penalty": int(s.penalty)})
+	if !s.suppressed && s.penalty > float64(d.Suppress) {
+		s.suppressed = true
+		contextLogger.Warn("Route is flapping, suppressing it until the flap damping penalty decays")
+		return
+	}
+	contextLogger.Debug("Route released, flap damping penalty increased")
+}
@@ -0,0 +1,139 @@
+package aws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long each ReceiveMessage call waits for messages to arrive.
+	sqsWaitTimeSeconds = 20
+	// The detail type of events sent two minutes before a spot instance is
+	// interrupted.
+	SpotInterruptionWarning = "EC2 Spot Instance Interruption Warning"
+)
+
+type MySQSConn interface {
+	ReceiveMessage(*sqs.ReceiveMessageInput) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(*sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error)
+}
+
+// RouteEvent is something which has happened in EC2 which may mean that
+// routes need to be changed, for example a route being deleted or an
+// instance stopping.
+type RouteEvent struct {
+	DetailType    string
+	RouteTableIds []string
+	InstanceIds   []string
+}
+
+// EventSource delivers RouteEvents as they happen. ReceiveEvents blocks
+// until there are events, or for a while if there are none (in which case
+// no events and no error are returned).
+type EventSource interface {
+	ReceiveEvents() ([]RouteEvent, error)
+}
+
+// SQSEventSource reads events from an SQS queue which EventBridge rules
+// deliver EC2 events to.
+type SQSEventSource struct {
+	QueueURL string
+	conn     MySQSConn
+}
+
+func NewSQSEventSource(queueURL string, region string) *SQSEventSource {
+	return &SQSEventSource{
+		QueueURL: queueURL,
+		conn:     sqs.New(newSession(region)),
+	}
+}
+
+func (s *SQSEventSource) ReceiveEvents() ([]RouteEvent, error) {
+	events := make([]RouteEvent, 0)
+	out, err := s.conn.ReceiveMessage(&sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(s.QueueURL),
+		MaxNumberOfMessages: aws.Int64(10),
+		WaitTimeSeconds:     aws.Int64(sqsWaitTimeSeconds),
+	})
+	if err != nil {
+		return events, err
+	}
+	for _, message := range out.Messages {
+		contextLogger := log.WithFields(log.Fields{"message_id": aws.StringValue(message.MessageId)})
+		event, err := ParseRouteEvent(aws.StringValue(message.Body))
+		if err != nil {
+			contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Ignoring unparseable event message")
+		} else {
+			contextLogger.WithFields(log.Fields{
+				"detail_type":  event.DetailType,
+				"rtb":          event.RouteTableIds,
+				"instance_ids": event.InstanceIds,
+			}).Debug("Received event")
+			events = append(events, event)
+		}
+		// Messages which can't be parsed never will be, so are deleted too
+		if _, err := s.conn.DeleteMessage(&sqs.DeleteMessageInput{
+			QueueUrl:      aws.String(s.QueueURL),
+			ReceiptHandle: message.ReceiptHandle,
+		}); err != nil {
+			contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Error deleting event message")
+		}
+	}
+	return events, nil
+}
+
+// eventBridgeEvent is the parts of an EventBridge event which we look at,
+// for EC2 instance state changes, spot interruptions and (via CloudTrail)
+// route table API calls.
+type eventBridgeEvent struct {
+	DetailType string `json:"detail-type"`
+	Detail     struct {
+		InstanceId        string `json:"instance-id"`
+		RequestParameters struct {
+			RouteTableId string `json:"routeTableId"`
+			InstanceId   string `json:"instanceId"`
+		} `json:"requestParameters"`
+	} `json:"detail"`
+}
+
+// ParseRouteEvent parses an EventBridge event, which may have been
+// delivered via SNS.
+func ParseRouteEvent(body string) (RouteEvent, error) {
+	var e eventBridgeEvent
+	if err := json.Unmarshal([]byte(body), &e); err != nil {
+		return RouteEvent{}, err
+	}
+	if e.DetailType == "" {
+		var notification struct {
+			Type    string
+			Message string
+		}
+		if err := json.Unmarshal([]byte(body), &notification); err == nil && notification.Type == "Notification" {
+			return ParseRouteEvent(notification.Message)
+		}
+		return RouteEvent{}, errors.New("Message is not an EventBridge event")
+	}
+	event := RouteEvent{
+		DetailType:    e.DetailType,
+		RouteTableIds: make([]string, 0),
+		InstanceIds:   make([]string, 0),
+	}
+	if e.Detail.InstanceId != "" {
+		event.InstanceIds = append(event.InstanceIds, e.Detail.InstanceId)
+	}
+	if e.Detail.RequestParameters.RouteTableId != "" {
+		event.RouteTableIds = append(event.RouteTableIds, e.Detail.RequestParameters.RouteTableId)
+	}
+	if e.Detail.RequestParameters.InstanceId != "" {
+		event.InstanceIds = append(event.InstanceIds, e.Detail.RequestParameters.InstanceId)
+	}
+	if len(event.RouteTableIds) == 0 && len(event.InstanceIds) == 0 {
+		return event, errors.New(fmt.Sprintf("No route table or instance in '%s' event", e.DetailType))
+	}
+	return event, nil
+}
@@ -0,0 +1,195 @@
+package aws
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bobtfish/AWSnycast/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How many times another instance has to take a route from this
+	// instance for them to be fighting over it
+	fightThreshold = 3
+	// How long ago a route changing owner counts towards a fight
+	fightHistory = time.Hour
+	// The most changes of owner remembered for each route
+	maxOwnerHistory = 100
+)
+
+// ownerChange is a route being seen routed to a different target.
+type ownerChange struct {
+	time      time.Time
+	owner     string
+	contested bool // If this instance took it from an instance actively routing it
+}
+
+// routeFights remembers who has recently routed each route, by route table
+// and cidr, to detect instances fighting over them. It is what both backing
+// off from fights and the safety circuit breaker count fights with. Once a
+// fight has been resolved, the instance which lost it keeps backing off until
+// it is restarted. A nil routeFights detects nothing.
+type routeFights struct {
+	clock      clock.Clock
+	lock       sync.Mutex
+	history    map[string][]ownerChange
+	backingOff map[string]string // The instance this instance is backing off to
+}
+
+func newRouteFights(c clock.Clock) *routeFights {
+	return &routeFights{
+		clock:      c,
+		history:    make(map[string][]ownerChange),
+		backingOff: make(map[string]string),
+	}
+}
+
+func (f *routeFights) setClock(c clock.Clock) {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.clock = c
+}
+
+// routeOwner is who a route points to.
+func routeOwner(route *ec2.Route) string {
+	if route == nil {
+		return ""
+	}
+	if route.InstanceId != nil {
+		return *(route.InstanceId)
+	}
+	return aws.StringValue(route.NetworkInterfaceId)
+}
+
+// observe records who a route points to.
+func (f *routeFights) observe(rtbID string, cidr string, owner string) {
+	f.record(rtbID, cidr, owner, false)
+}
+
+// took records this instance changing a route to point to owner. contested
+// is if it was taken from an instance which was actively routing it.
+func (f *routeFights) took(rtbID string, cidr string, owner string, contested bool) {
+	f.record(rtbID, cidr, owner, contested)
+}
+
+func (f *routeFights) record(rtbID string, cidr string, owner string, contested bool) {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := rtbID + " " + cidr
+	history := f.history[key]
+	if len(history) > 0 && history[len(history)-1].owner == owner {
+		return
+	}
+	if len(history) >= maxOwnerHistory {
+		history = history[len(history)-maxOwnerHistory+1:]
+	}
+	f.history[key] = append(history, ownerChange{time: f.clock.Now(), owner: owner, contested: contested})
+}
+
+// takenBack counts how many times in the last window owner has taken a
+// route back from an instance which was actively routing it, after that
+// instance took it from owner.
+func (f *routeFights) takenBack(rtbID string, cidr string, owner string, window time.Duration) int {
+	if f == nil {
+		return 0
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	history := f.history[rtbID+" "+cidr]
+	now := f.clock.Now()
+	taken := 0
+	for i := 2; i < len(history); i++ {
+		if history[i].owner == owner && history[i].contested && history[i-2].owner == owner && now.Sub(history[i].time) < window {
+			taken++
+		}
+	}
+	return taken
+}
+
+// takenFrom counts how many times a route has recently gone straight from
+// one instance to another.
+func (f *routeFights) takenFrom(rtbID string, cidr string, from string, to string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	history := f.history[rtbID+" "+cidr]
+	now := f.clock.Now()
+	taken := 0
+	for i := 1; i < len(history); i++ {
+		if history[i-1].owner == from && history[i].owner == to && now.Sub(history[i].time) < fightHistory {
+			taken++
+		}
+	}
+	return taken
+}
+
+func (f *routeFights) backingOffTo(rtbID string, cidr string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.backingOff[rtbID+" "+cidr]
+}
+
+func (f *routeFights) backOff(rtbID string, cidr string, to string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.backingOff[rtbID+" "+cidr] = to
+}
+
+// winsFight decides which instance keeps a route they are fighting over.
+// Both instances come to the same decision: the one with the higher
+// priority wins, or if they have the same priority, the one with the higher
+// instance ID.
+func (r RouteTableManagerEC2) winsFight(contextLogger *log.Entry, rs ManageRoutesSpec, other string) bool {
+	mine, theirs := 0, 0
+	if rs.Priority != nil {
+		mine = *rs.Priority
+		priority, err := r.instancePriority(other, rs.Cidr)
+		if err != nil {
+			contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Error finding priority of other instance in route fight, assuming it is the same")
+			priority = mine
+		}
+		theirs = priority
+	}
+	if mine != theirs {
+		return mine > theirs
+	}
+	return rs.Instance > other
+}
+
+// backsOffFromFight decides if this instance should stop taking a route
+// from the healthy instance currently routing it, as they are fighting over
+// it and this instance has lost.
+func (r RouteTableManagerEC2) backsOffFromFight(contextLogger *log.Entry, rtbID string, route *ec2.Route, rs ManageRoutesSpec) bool {
+	if r.fights == nil {
+		return false
+	}
+	other := routeOwner(route)
+	if other == "" || other == rs.Instance {
+		return false
+	}
+	contextLogger = contextLogger.WithFields(log.Fields{"other_instance": other})
+	if to := r.fights.backingOffTo(rtbID, rs.Cidr); to != "" {
+		contextLogger.WithFields(log.Fields{"backing_off_to": to}).Debug("Backing off from route fight, only taking route if the current instance is unhealthy")
+		return true
+	}
+	taken := r.fights.takenFrom(rtbID, rs.Cidr, rs.Instance, other)
+	if taken < fightThreshold {
+		return false
+	}
+	contextLogger = contextLogger.WithFields(log.Fields{"times_taken": taken})
+	if r.winsFight(contextLogger, rs, other) {
+		contextLogger.Error("Route fight: another instance keeps taking this route, keeping it as this instance has the higher priority or instance ID")
+		return false
+	}
+	r.fights.backOff(rtbID, rs.Cidr, other)
+	contextLogger.Error("Route fight: another instance keeps taking this route, backing off as it has the higher priority or instance ID. Restart AWSnycast once the config is fixed to stop backing off")
+	return true
+}
@@ -4,11 +4,19 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bobtfish/AWSnycast/clock"
 	"github.com/bobtfish/AWSnycast/healthcheck"
+	"github.com/bobtfish/AWSnycast/hooks"
 	"github.com/bobtfish/AWSnycast/instancemetadata"
+	"github.com/bobtfish/AWSnycast/localaddress"
+	"github.com/bobtfish/AWSnycast/notify"
 	log "github.com/sirupsen/logrus"
 	"github.com/hashicorp/go-multierror"
 )
@@ -19,10 +27,19 @@ type ManageRoutesSpec struct {
 	InstanceIsSelf            bool                                `yaml:"-"`
 	HealthcheckName           string                              `yaml:"healthcheck"`
 	RemoteHealthcheckName     string                              `yaml:"remote_healthcheck"`
+	RemoteTargetGroup         string                              `yaml:"remote_target_group"`
 	healthcheck               healthcheck.CanBeHealthy            `yaml:"-"`
+	instanceHealthcheck       *healthcheck.Healthcheck            `yaml:"-"`
 	remotehealthchecktemplate *healthcheck.Healthcheck            `yaml:"-"`
 	remotehealthchecks        map[string]*healthcheck.Healthcheck `yaml:"-"`
+	remotelisteners           map[string]chan struct{}            `yaml:"-"`
 	IfUnhealthy               bool                                `yaml:"if_unhealthy"`
+	Priority                  *int                                `yaml:"priority"`
+	Preempt                   *bool                               `yaml:"preempt"`
+	Damping                   *DampingConfig                      `yaml:"damping"`
+	flapDamping               *damping                            `yaml:"-"`
+	owned                     *ownership                          `yaml:"-"`
+	ManageLocalAddress        *localaddress.Config                `yaml:"manage_local_address"`
 	ec2RouteTables            []*ec2.RouteTable                   `yaml:"-"`
 	Manager                   RouteTableManager                   `yaml:"-"`
 	NeverDelete               bool                                `yaml:"never_delete"`
@@ -31,6 +48,84 @@ type ManageRoutesSpec struct {
 	RunAfterReplaceRoute      []string                            `yaml:"run_after_replace_route"`
 	RunBeforeDeleteRoute      []string                            `yaml:"run_before_delete_route"`
 	RunAfterDeleteRoute       []string                            `yaml:"run_after_delete_route"`
+	RunBeforeAddRoute         []string                            `yaml:"run_before_add_route"`
+	RunAfterAddRoute          []string                            `yaml:"run_after_add_route"`
+	Hooks                     map[string][]hooks.Hook             `yaml:"hooks"`
+	HookTimeout               uint                                `yaml:"hook_timeout"`
+	AbortOnHookFailure        bool                                `yaml:"abort_on_hook_failure"`
+	FromInstanceTags          bool                                `yaml:"-"`
+	state                     *routeState                         `yaml:"-"`
+}
+
+// routeState is the part of a route which changes whilst its healthcheck
+// listeners are running. It is shared by every copy of the route's spec.
+// update is held whilst the route's route tables and remote healthchecks are
+// changed, and whilst a healthcheck result is acted on.
+type routeState struct {
+	lock      sync.Mutex
+	update    sync.Mutex
+	quit      chan struct{}
+	stopped   bool
+	released  bool
+	listeners sync.WaitGroup
+}
+
+func newRouteState() *routeState {
+	return &routeState{quit: make(chan struct{})}
+}
+
+// stop closes the quit channel, which ends the healthcheck listeners.
+func (s *routeState) stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.quit)
+	}
+}
+
+func (s *routeState) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.released = true
+}
+
+// A nil routeState has never been stopped or released.
+func (s *routeState) isStopped() bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stopped
+}
+
+func (s *routeState) isReleased() bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.released
+}
+
+// listen runs f with each result from c, until the route is stopped or done
+// is closed.
+func (s *routeState) listen(c <-chan bool, done <-chan struct{}, f func(bool)) {
+	s.listeners.Add(1)
+	go func() {
+		defer s.listeners.Done()
+		for {
+			select {
+			case res := <-c:
+				f(res)
+			case <-s.quit:
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
 }
 
 func (r *ManageRoutesSpec) Validate(meta instancemetadata.InstanceMetadata, manager RouteTableManager, name string, healthchecks map[string]*healthcheck.Healthcheck, remotehealthchecks map[string]*healthcheck.Healthcheck) error {
@@ -39,6 +134,13 @@ func (r *ManageRoutesSpec) Validate(meta instancemetadata.InstanceMetadata, mana
 	r.Manager = manager
 	r.ec2RouteTables = make([]*ec2.RouteTable, 0)
 	r.remotehealthchecks = make(map[string]*healthcheck.Healthcheck)
+	r.remotelisteners = make(map[string]chan struct{})
+	if r.owned == nil {
+		r.owned = newOwnership()
+	}
+	if r.state == nil {
+		r.state = newRouteState()
+	}
 	if r.Cidr == "" {
 		result = multierror.Append(result, errors.New(fmt.Sprintf("cidr is not defined in %s", name)))
 	} else {
@@ -55,6 +157,15 @@ func (r *ManageRoutesSpec) Validate(meta instancemetadata.InstanceMetadata, mana
 	if r.Instance == "SELF" {
 		r.InstanceIsSelf = true
 		r.Instance = meta.Instance
+		if r.Instance == "" {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s uses instance SELF, but the ID of this instance is not known", name, r.Cidr)))
+		}
+	} else {
+		// We're managing a route for another instance, so healthchecks
+		// should consider that instance's IP, not ours.
+		// It is looked up by Setup, so that the config can be checked
+		// without calling the EC2 API.
+		r.myIPAddress = ""
 	}
 	if r.HealthcheckName != "" {
 		if hc, ok := healthchecks[r.HealthcheckName]; ok {
@@ -70,23 +181,160 @@ func (r *ManageRoutesSpec) Validate(meta instancemetadata.InstanceMetadata, mana
 			result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s cannot find remote healthcheck '%s'", name, r.Cidr, r.RemoteHealthcheckName)))
 		}
 	}
+	if r.RemoteTargetGroup != "" {
+		if err := validateTargetGroupArn(r.RemoteTargetGroup); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s remote_target_group: %s", name, r.Cidr, err.Error())))
+		}
+	}
+	if r.Priority != nil && *r.Priority < 0 {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s priority cannot be negative", name, r.Cidr)))
+	}
+	if r.Preempt != nil && r.Priority == nil {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s has preempt set, but no priority", name, r.Cidr)))
+	}
+	if r.Damping != nil {
+		if err := r.Damping.Validate(); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s %s", name, r.Cidr, err.Error())))
+		} else if r.flapDamping == nil {
+			r.flapDamping = newDamping(*r.Damping)
+		}
+	}
+	if r.ManageLocalAddress != nil {
+		if !r.InstanceIsSelf {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s has manage_local_address set, but is not for instance SELF", name, r.Cidr)))
+		} else if err := r.ManageLocalAddress.Validate(r.Cidr); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s %s", name, r.Cidr, err.Error())))
+		}
+	}
+	events := make([]string, 0, len(r.Hooks))
+	for event := range r.Hooks {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	for _, event := range events {
+		if !isRouteEvent(event) {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s has hooks for unknown event '%s'", name, r.Cidr, event)))
+			continue
+		}
+		for _, h := range r.Hooks[event] {
+			if err := h.Validate(); err != nil {
+				result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s %s hook: %s", name, r.Cidr, event, err.Error())))
+			}
+		}
+	}
 	return result.ErrorOrNil()
 }
 
+// Setup looks up the IP address of the instance a route for another
+// instance is for. Without a healthcheck of its own, such a route is
+// healthchecked by running the remote healthcheck against it.
+func (r *ManageRoutesSpec) Setup() error {
+	if r.InstanceIsSelf || r.myIPAddress != "" {
+		return nil
+	}
+	f, ok := r.Manager.(InstanceIPFetcher)
+	if !ok {
+		return nil
+	}
+	ip, err := f.GetInstanceIP(r.Instance)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Route %s cannot find IP address of instance %s: %s", r.Cidr, r.Instance, err.Error()))
+	}
+	r.myIPAddress = ip
+	if r.healthcheck == nil && r.remotehealthchecktemplate != nil {
+		hc, err := r.remotehealthchecktemplate.NewWithDestinationInstance(r.myIPAddress, r.Instance)
+		if err != nil {
+			return err
+		}
+		r.instanceHealthcheck = hc
+		r.healthcheck = hc
+	}
+	return nil
+}
+
+// preempt is if this route should be taken over from healthy instances
+// with a lower priority, which it is unless preempt is set to false.
+func (r *ManageRoutesSpec) preempt() bool {
+	return r.Preempt == nil || *r.Preempt
+}
+
 func (r *ManageRoutesSpec) StartHealthcheckListener(noop bool) {
 	if r.healthcheck == nil {
 		return
 	}
-	go func() {
-		c := r.healthcheck.GetListener()
-		for {
-			r.handleHealthcheckResult(<-c, false, noop)
-		}
-	}()
+	c := r.healthcheck.GetListener()
+	if r.instanceHealthcheck != nil {
+		r.instanceHealthcheck.Run(false)
+	}
+	r.getState().listen(c, nil, func(res bool) {
+		r.handleHealthcheckResult(res, false, noop)
+	})
 	return
 }
 
+func (r *ManageRoutesSpec) getState() *routeState {
+	if r.state == nil {
+		r.state = newRouteState()
+	}
+	return r.state
+}
+
+// SetClock sets the clock used by the healthcheck for another instance,
+// if this route has one, and for flap damping.
+func (r *ManageRoutesSpec) SetClock(c clock.Clock) {
+	if r.instanceHealthcheck != nil {
+		r.instanceHealthcheck.SetClock(c)
+	}
+	if r.flapDamping != nil {
+		r.flapDamping.setClock(c)
+	}
+}
+
+// SetNotifier sets where the healthcheck for another instance, if this
+// route has one, sends notifications.
+func (r *ManageRoutesSpec) SetNotifier(n *notify.Notifier) {
+	if r.instanceHealthcheck != nil {
+		r.instanceHealthcheck.SetNotifier(n)
+	}
+}
+
+// Stop makes this route ignore any further healthcheck results, ends its
+// healthcheck listeners and stops its remote healthchecks. It is used when a
+// route is removed from the config whilst the daemon is running.
+func (r *ManageRoutesSpec) Stop() {
+	s := r.getState()
+	s.stop()
+	s.update.Lock()
+	defer s.update.Unlock()
+	if r.instanceHealthcheck != nil {
+		r.instanceHealthcheck.Stop()
+	}
+	for ip := range r.remotehealthchecks {
+		r.stopRemoteHealthcheck(ip)
+	}
+}
+
+// Release stops the route, and makes it delete the route wherever it still
+// points to this instance (unless never_delete is set), rather than managing
+// it. It is used when a route is removed from the config whilst the daemon is
+// running, so that it is not left pointing here.
+func (r *ManageRoutesSpec) Release() {
+	r.Stop()
+	r.state.release()
+}
+
+// Released is if the route has been released.
+func (r *ManageRoutesSpec) Released() bool {
+	return r.state.isReleased()
+}
+
 func (r *ManageRoutesSpec) handleHealthcheckResult(res bool, remote bool, noop bool) {
+	s := r.getState()
+	s.update.Lock()
+	defer s.update.Unlock()
+	if s.isStopped() {
+		return
+	}
 	resText := "FAILED"
 	if res {
 		resText = "PASSED"
@@ -115,48 +363,84 @@ func (r *ManageRoutesSpec) handleHealthcheckResult(res bool, remote bool, noop b
 
 func (r *ManageRoutesSpec) UpdateEc2RouteTables(rt []*ec2.RouteTable) {
 	log.Debug(fmt.Sprintf("manange routes: %+v", rt))
+	s := r.getState()
+	s.update.Lock()
+	defer s.update.Unlock()
 	r.ec2RouteTables = rt
+	r.owned.retain(rt)
 	r.UpdateRemoteHealthchecks()
 }
 
 var eniToIP map[string]string
 
+// eniToIPLock guards eniToIP, as the route tables in each region and account
+// are polled at the same time.
+var eniToIPLock sync.Mutex
+
 func init() {
 	eniToIP = make(map[string]string)
 }
 
+func eniIP(eni string) (string, bool) {
+	eniToIPLock.Lock()
+	defer eniToIPLock.Unlock()
+	ip, ok := eniToIP[eni]
+	return ip, ok
+}
+
+// uncachedENIs is the network interfaces routes point to whose IP addresses
+// are not yet known.
+func uncachedENIs(routes []*ec2.Route) []*string {
+	eniIdsToFetch := make([]*string, 0)
+	for _, route := range routes {
+		if _, ok := eniIP(*route.NetworkInterfaceId); !ok {
+			eniIdsToFetch = append(eniIdsToFetch, route.NetworkInterfaceId)
+		}
+	}
+	return eniIdsToFetch
+}
+
+// fetchENIIPs looks up the IP address of each network interface.
+func fetchENIIPs(conn MyEC2Conn, eniIds []*string) error {
+	out, err := conn.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{NetworkInterfaceIds: eniIds})
+	if err != nil {
+		return err
+	}
+	eniToIPLock.Lock()
+	defer eniToIPLock.Unlock()
+	for _, iface := range out.NetworkInterfaces {
+		eniToIP[*iface.NetworkInterfaceId] = *iface.PrivateIpAddress
+	}
+	return nil
+}
+
 func (r *ManageRoutesSpec) UpdateRemoteHealthchecks() {
 	if r.RemoteHealthcheckName == "" {
 		return
 	}
-	eniIdsToFetch := make([]*string, 0)
+	routes := make([]*ec2.Route, 0)
 	routeEnis := make([]string, 0)
+	eniInstances := make(map[string]string)
 	for _, rtb := range r.ec2RouteTables {
 		route := findRouteFromRouteTable(*rtb, r.Cidr)
 		if route != nil {
+			routes = append(routes, route)
 			routeEnis = append(routeEnis, *route.NetworkInterfaceId)
-			if _, ok := eniToIP[*route.NetworkInterfaceId]; !ok {
-				eniIdsToFetch = append(eniIdsToFetch, route.NetworkInterfaceId)
-			}
+			eniInstances[*route.NetworkInterfaceId] = aws.StringValue(route.InstanceId)
 		}
 	}
-	if len(eniIdsToFetch) > 0 {
-		out, err := r.Manager.(*RouteTableManagerEC2).conn.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{NetworkInterfaceIds: eniIdsToFetch})
-		if err != nil {
+	if eniIdsToFetch := uncachedENIs(routes); len(eniIdsToFetch) > 0 {
+		if err := fetchENIIPs(r.Manager.(*RouteTableManagerEC2).conn, eniIdsToFetch); err != nil {
 			log.Error("Error " + err.Error())
 			return
 		}
-		for _, iface := range out.NetworkInterfaces {
-			eniToIP[*iface.NetworkInterfaceId] = *iface.PrivateIpAddress
-		}
 	}
-	log.Debug(fmt.Sprintf("ENI %+v", eniToIP))
 	healthchecks := make(map[string]bool)
 	for ip, _ := range r.remotehealthchecks {
 		healthchecks[ip] = false
 	}
 	for _, eniId := range routeEnis {
-		ip := eniToIP[eniId]
+		ip, _ := eniIP(eniId)
 		contextLogger := log.WithFields(log.Fields{"ip": ip})
 		healthchecks[ip] = true
 		if ip == r.myIPAddress {
@@ -164,21 +448,20 @@ func (r *ManageRoutesSpec) UpdateRemoteHealthchecks() {
 			continue
 		}
 		if _, ok := r.remotehealthchecks[ip]; !ok {
-			hc, err := r.remotehealthchecktemplate.NewWithDestination(ip)
+			hc, err := r.remotehealthchecktemplate.NewWithDestinationInstance(ip, eniInstances[eniId])
 			if err != nil {
 				contextLogger.Error(err.Error())
 			} else {
 				r.remotehealthchecks[ip] = hc
+				done := make(chan struct{})
+				r.remotelisteners[ip] = done
+				c := hc.GetListener()
 				r.remotehealthchecks[ip].Run(true)
 				contextLogger.Debug(fmt.Sprintf("New healthcheck being run"))
-				go func() {
-					c := hc.GetListener()
-					for {
-						res := <-c
-						contextLogger.WithFields(log.Fields{"result": res}).Debug("Got result from remote healthchecl")
-						r.handleHealthcheckResult(res, true, false)
-					}
-				}()
+				r.getState().listen(c, done, func(res bool) {
+					contextLogger.WithFields(log.Fields{"result": res}).Debug("Got result from remote healthchecl")
+					r.handleHealthcheckResult(res, true, false)
+				})
 			}
 		}
 	}
@@ -187,7 +470,62 @@ func (r *ManageRoutesSpec) UpdateRemoteHealthchecks() {
 			continue
 		}
 		log.WithFields(log.Fields{"ip": ip}).Debug("Stopping healthcheck")
-		r.remotehealthchecks[ip].Stop()
-		delete(r.remotehealthchecks, ip)
+		r.stopRemoteHealthcheck(ip)
+	}
+}
+
+// stopRemoteHealthcheck stops the remote healthcheck of ip, and ends its
+// listener.
+func (r *ManageRoutesSpec) stopRemoteHealthcheck(ip string) {
+	r.remotehealthchecks[ip].Stop()
+	delete(r.remotehealthchecks, ip)
+	if done, ok := r.remotelisteners[ip]; ok {
+		close(done)
+		delete(r.remotelisteners, ip)
+	}
+}
+
+func isRouteEvent(event string) bool {
+	for _, e := range hooks.RouteEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// hooksFor returns the hooks to run for an event: the run_* command for it
+// (if there is one), followed by those in the hooks block.
+func (r *ManageRoutesSpec) hooksFor(eventType string) []hooks.Hook {
+	commands := map[string][]string{
+		hooks.BeforeAddRoute:     r.RunBeforeAddRoute,
+		hooks.AfterAddRoute:      r.RunAfterAddRoute,
+		hooks.BeforeReplaceRoute: r.RunBeforeReplaceRoute,
+		hooks.AfterReplaceRoute:  r.RunAfterReplaceRoute,
+		hooks.BeforeDeleteRoute:  r.RunBeforeDeleteRoute,
+		hooks.AfterDeleteRoute:   r.RunAfterDeleteRoute,
+	}
+	hs := make([]hooks.Hook, 0)
+	if len(commands[eventType]) > 0 {
+		hs = append(hs, hooks.Hook{Command: commands[eventType]})
+	}
+	return append(hs, r.Hooks[eventType]...)
+}
+
+// runHooks runs this route's hooks for an event in a route table. A failure
+// is only returned (so the route change can be abandoned) for "before" hooks
+// when abort_on_hook_failure is set, in which case no more hooks are run.
+func (r *ManageRoutesSpec) runHooks(eventType string, rtb string, previousTarget string) error {
+	abort := r.AbortOnHookFailure && strings.HasPrefix(eventType, "before_")
+	err := hooks.RunAll(r.hooksFor(eventType), hooks.Event{
+		Type:           eventType,
+		Cidr:           r.Cidr,
+		RouteTable:     rtb,
+		PreviousTarget: previousTarget,
+		Healthcheck:    r.HealthcheckName,
+	}, time.Duration(r.HookTimeout)*time.Second, abort)
+	if abort {
+		return err
 	}
+	return nil
 }
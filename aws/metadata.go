@@ -1,9 +1,7 @@
 package aws
 
 import (
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/bobtfish/AWSnycast/instancemetadata"
 )
 
 type MetadataFetcher interface {
@@ -12,9 +10,5 @@ type MetadataFetcher interface {
 }
 
 func NewMetadataFetcher(debug bool) MetadataFetcher {
-	sess := session.New()
-	if debug {
-		sess.Config.LogLevel = aws.LogLevel(aws.LogDebug)
-	}
-	return ec2metadata.New(sess)
+	return instancemetadata.New(debug)
 }
@@ -0,0 +1,196 @@
+package aws
+
+import (
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bobtfish/AWSnycast/localaddress"
+	log "github.com/sirupsen/logrus"
+)
+
+// ownership records which route tables a route is routed to this instance
+// in, as of when it was last managed. A nil ownership owns nothing.
+type ownership struct {
+	lock      sync.Mutex
+	rtbs      map[string]bool
+	addressed bool // If the route's local addresses have been added
+	settled   bool // If addressed is known to be true of the interface
+}
+
+func newOwnership() *ownership {
+	return &ownership{rtbs: make(map[string]bool)}
+}
+
+func (o *ownership) set(rtb string, owned bool) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.rtbs[rtb] = owned
+}
+
+// retain forgets the route tables which are not in tables.
+func (o *ownership) retain(tables []*ec2.RouteTable) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	found := make(map[string]bool)
+	for _, rtb := range tables {
+		found[*(rtb.RouteTableId)] = true
+	}
+	for rtb := range o.rtbs {
+		if !found[rtb] {
+			delete(o.rtbs, rtb)
+		}
+	}
+}
+
+func (o *ownership) any() bool {
+	if o == nil {
+		return false
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.anyLocked()
+}
+
+func (o *ownership) anyLocked() bool {
+	for _, owned := range o.rtbs {
+		if owned {
+			return true
+		}
+	}
+	return false
+}
+
+// seenLocked is if the ownership of the route in every one of tables is
+// known.
+func (o *ownership) seenLocked(tables []*ec2.RouteTable) bool {
+	for _, rtb := range tables {
+		if _, ok := o.rtbs[*(rtb.RouteTableId)]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// updateLocalAddress adds the local addresses when the route becomes owned,
+// and removes them when it stops being owned. If that fails, it is tried
+// again the next time. Until the addresses have been added or removed once
+// (e.g. when starting up, as they are left in place on exit), they are only
+// removed once the route is known not to be owned in any of tables, so that
+// addresses which are in use are not removed whilst finding that out.
+func (o *ownership) updateLocalAddress(c *localaddress.Config, tables []*ec2.RouteTable, contextLogger *log.Entry) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	owned := o.anyLocked()
+	if o.settled && owned == o.addressed {
+		return
+	}
+	if !o.settled && !owned && !o.seenLocked(tables) {
+		return
+	}
+	var err error
+	if owned {
+		err = c.Add()
+	} else {
+		err = c.Remove()
+	}
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Error("Error managing local address")
+		return
+	}
+	o.addressed = owned
+	o.settled = true
+}
+
+// removeLocalAddress removes the local addresses, if they were added.
+func (o *ownership) removeLocalAddress(c *localaddress.Config, contextLogger *log.Entry) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if !o.addressed {
+		return
+	}
+	if err := c.Remove(); err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Error("Error removing local address")
+		return
+	}
+	o.addressed = false
+}
+
+// withoutAddress is a copy of the ownership, but knowing nothing about the
+// local addresses.
+func (o *ownership) withoutAddress() *ownership {
+	c := newOwnership()
+	if o == nil {
+		return c
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for rtb, owned := range o.rtbs {
+		c.rtbs[rtb] = owned
+	}
+	return c
+}
+
+// setOwned records if the route is routed to this instance in a route
+// table, managing its local addresses if manage_local_address is set.
+func (r *ManageRoutesSpec) setOwned(rtb string, owned bool, noop bool, contextLogger *log.Entry) {
+	r.owned.set(rtb, owned)
+	if !noop && r.ManageLocalAddress != nil {
+		r.owned.updateLocalAddress(r.ManageLocalAddress, r.ec2RouteTables, contextLogger)
+	}
+}
+
+// CarryOver makes a route in a new config carry on from previous, the same
+// route in the config it is replacing, so that it knows which route tables it
+// is routed to this instance in, and which local addresses have been added.
+// If manage_local_address has changed, the addresses added for previous are
+// removed (and the new ones are added the next time the route is managed).
+// If damping is unchanged, its hold times, cooldowns and penalties carry on
+// too, so that reloading the config doesn't stop a flapping route being
+// suppressed.
+func (r *ManageRoutesSpec) CarryOver(previous *ManageRoutesSpec) {
+	if previous.flapDamping != nil && r.Damping != nil && *r.Damping == *previous.Damping {
+		r.flapDamping = previous.flapDamping
+	}
+	if previous.owned == nil {
+		return
+	}
+	if r.ManageLocalAddress.Equal(previous.ManageLocalAddress) {
+		r.owned = previous.owned
+		return
+	}
+	previous.RemoveLocalAddress()
+	r.owned = previous.owned.withoutAddress()
+}
+
+// RemoveLocalAddress removes the route's local addresses, if they were
+// added. It is used when the route is removed from the config.
+func (r *ManageRoutesSpec) RemoveLocalAddress() {
+	if r.ManageLocalAddress == nil {
+		return
+	}
+	r.owned.removeLocalAddress(r.ManageLocalAddress, log.WithFields(log.Fields{"cidr": r.Cidr}))
+}
+
+// Owned is if the route is routed to this instance in any of the route
+// tables it is managed in.
+func (r *ManageRoutesSpec) Owned() bool {
+	return r.owned.any()
+}
+
+// Healthy is if the route's healthcheck is healthy, or it has no
+// healthcheck.
+func (r *ManageRoutesSpec) Healthy() bool {
+	return r.healthcheck == nil || r.healthcheck.IsHealthy()
+}
@@ -0,0 +1,152 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+)
+
+// PriorityTagPrefix is prepended to the cidr of a route to make the key of
+// the instance tag advertising the priority of that instance for the route.
+const PriorityTagPrefix = "awsnycast:priority:"
+
+// PollStarter is implemented by RouteTableManagers which remember what they
+// look up until the next poll starts.
+type PollStarter interface {
+	StartPoll()
+}
+
+// instanceTags caches the tags of the instances which routes point to, so
+// that their priorities are only looked up once each poll, however many
+// routes they are for.
+type instanceTags struct {
+	lock sync.Mutex
+	tags map[string]map[string]string
+	errs map[string]error
+}
+
+func newInstanceTags() *instanceTags {
+	t := &instanceTags{}
+	t.reset()
+	return t
+}
+
+func (t *instanceTags) reset() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.tags = make(map[string]map[string]string)
+	t.errs = make(map[string]error)
+}
+
+// get returns the tags of an instance, looking them up with fetch if they
+// haven't been this poll. Errors are remembered too, so that an instance
+// whose tags can't be looked up isn't tried again for every route.
+func (t *instanceTags) get(instanceID string, fetch func(string) (map[string]string, error)) (map[string]string, error) {
+	if t == nil {
+		return fetch(instanceID)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if tags, ok := t.tags[instanceID]; ok {
+		return tags, nil
+	}
+	if err, ok := t.errs[instanceID]; ok {
+		return nil, err
+	}
+	tags, err := fetch(instanceID)
+	if err != nil {
+		t.errs[instanceID] = err
+	} else {
+		t.tags[instanceID] = tags
+	}
+	return tags, err
+}
+
+// StartPoll forgets the instance tags looked up in the previous poll, so
+// that changes to the priorities of instances are seen.
+func (r RouteTableManagerEC2) StartPoll() {
+	r.instanceTags.reset()
+}
+
+// advertisePriority tags the instance a route is for with its priority, so
+// that other instances managing the route can tell if they should preempt
+// it. Each instance is only tagged again when its priority changes.
+func (r RouteTableManagerEC2) advertisePriority(rs ManageRoutesSpec, noop bool) {
+	if rs.Priority == nil || noop {
+		return
+	}
+	key := PriorityTagPrefix + rs.Cidr
+	value := strconv.Itoa(*rs.Priority)
+	if r.advertised != nil {
+		if v, ok := r.advertised.Load(rs.Instance + " " + key); ok && v.(string) == value {
+			return
+		}
+	}
+	contextLogger := log.WithFields(log.Fields{
+		"instance_id": rs.Instance,
+		"cidr":        rs.Cidr,
+		"priority":    *rs.Priority,
+	})
+	_, err := r.conn.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{aws.String(rs.Instance)},
+		Tags:      []*ec2.Tag{{Key: aws.String(key), Value: aws.String(value)}},
+	})
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Error advertising route priority")
+		return
+	}
+	contextLogger.Info("Advertised route priority")
+	if r.advertised != nil {
+		r.advertised.Store(rs.Instance+" "+key, value)
+	}
+}
+
+// instancePriority returns the priority an instance advertises for a route,
+// which is 0 if it doesn't advertise one.
+func (r RouteTableManagerEC2) instancePriority(instanceID string, cidr string) (int, error) {
+	tags, err := r.instanceTags.get(instanceID, r.GetInstanceTags)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := tags[PriorityTagPrefix+cidr]
+	if !ok {
+		return 0, nil
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Instance %s has priority '%s' for %s, which is not a number", instanceID, value, cidr))
+	}
+	return priority, nil
+}
+
+// preempts decides if a route should be taken over from the healthy
+// instance it currently points to, as that instance has a lower priority.
+// If it should, the reason for doing so is returned.
+func (r RouteTableManagerEC2) preempts(contextLogger *log.Entry, route *ec2.Route, rs ManageRoutesSpec) (bool, string) {
+	if rs.Priority == nil || !rs.preempt() || route.InstanceId == nil {
+		return false, ""
+	}
+	priority, err := r.instancePriority(*(route.InstanceId), rs.Cidr)
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Error finding priority of current instance, not preempting it")
+		return false, ""
+	}
+	contextLogger = contextLogger.WithFields(log.Fields{
+		"priority":         *rs.Priority,
+		"current_priority": priority,
+	})
+	if priority >= *rs.Priority {
+		contextLogger.Debug("Current instance has the same or a higher priority, not preempting it")
+		return false, ""
+	}
+	contextLogger.Info("Current instance has a lower priority - replacing")
+	return true, fmt.Sprintf("current instance has a lower priority (%d < %d)", priority, *rs.Priority)
+}
@@ -2,12 +2,21 @@ package aws
 
 import (
 	"errors"
-	"os/exec"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/bobtfish/AWSnycast/clock"
+	"github.com/bobtfish/AWSnycast/hooks"
+	"github.com/bobtfish/AWSnycast/instancemetadata"
+	"github.com/bobtfish/AWSnycast/notify"
 	"github.com/bobtfish/AWSnycast/version"
 	log "github.com/sirupsen/logrus"
 )
@@ -15,13 +24,16 @@ import (
 var errNICNotFound = errors.New("nic with source dest check disabled was not found")
 
 type MyEC2Conn interface {
-	CreateRoute(*ec2.CreateRouteInput) (*ec2.CreateRouteOutput, error)
-	ReplaceRoute(*ec2.ReplaceRouteInput) (*ec2.ReplaceRouteOutput, error)
+	CreateRouteWithContext(aws.Context, *ec2.CreateRouteInput, ...request.Option) (*ec2.CreateRouteOutput, error)
+	ReplaceRouteWithContext(aws.Context, *ec2.ReplaceRouteInput, ...request.Option) (*ec2.ReplaceRouteOutput, error)
 	DescribeRouteTables(*ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error)
-	DeleteRoute(*ec2.DeleteRouteInput) (*ec2.DeleteRouteOutput, error)
+	DeleteRouteWithContext(aws.Context, *ec2.DeleteRouteInput, ...request.Option) (*ec2.DeleteRouteOutput, error)
 	DescribeNetworkInterfaces(*ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error)
 	DescribeInstanceAttribute(*ec2.DescribeInstanceAttributeInput) (*ec2.DescribeInstanceAttributeOutput, error)
 	DescribeInstanceStatus(*ec2.DescribeInstanceStatusInput) (*ec2.DescribeInstanceStatusOutput, error)
+	DescribeTags(*ec2.DescribeTagsInput) (*ec2.DescribeTagsOutput, error)
+	CreateTags(*ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error)
+	ModifyNetworkInterfaceAttribute(*ec2.ModifyNetworkInterfaceAttributeInput) (*ec2.ModifyNetworkInterfaceAttributeOutput, error)
 }
 
 type RouteTableManager interface {
@@ -30,23 +42,240 @@ type RouteTableManager interface {
 	InstanceIsRouter(string) bool
 }
 
+// InstanceTagFetcher is implemented by RouteTableManagers which can look up
+// the tags of an instance from the EC2 API.
+type InstanceTagFetcher interface {
+	GetInstanceTags(string) (map[string]string, error)
+}
+
+// InstanceIPFetcher is implemented by RouteTableManagers which can look up
+// the primary private IP address of an instance.
+type InstanceIPFetcher interface {
+	GetInstanceIP(string) (string, error)
+}
+
+// SourceDestCheckDisabler is implemented by RouteTableManagers which can
+// disable source/destination checking for an instance, so that it can be
+// a router.
+type SourceDestCheckDisabler interface {
+	DisableSourceDestCheck(string) (string, error)
+}
+
 type RouteTableManagerEC2 struct {
 	Region                 string
 	conn                   MyEC2Conn
+	elbv2                  MyELBV2Conn
 	srcdstcheckForInstance map[string]bool
+	notifier               *notify.Notifier
+	auditLog               *AuditLog
+	advertised             *sync.Map     // Priorities which instances have been tagged with
+	instanceTags           *instanceTags // Tags of the instances routes point to, this poll
+	safety                 *Safety
+	fights                 *routeFights
+	accounts               *accountManagers // Managers for other regions and accounts
+	transitGateway         *TransitGatewayManagerEC2
+	interrupted            *interruptedInstances
+	clock                  clock.Clock
+}
+
+// NotifierSetter is implemented by RouteTableManagers which can send
+// notifications when they change routes.
+type NotifierSetter interface {
+	SetNotifier(*notify.Notifier)
 }
 
 func NewRouteTableManagerEC2(region string, debug bool) *RouteTableManagerEC2 {
+	return NewRouteTableManagerEC2WithEndpoint(region, "", debug)
+}
+
+// NewRouteTableManagerEC2WithEndpoint talks to the EC2 API at endpoint, rather
+// than the default endpoint for the region, if endpoint is not empty.
+func NewRouteTableManagerEC2WithEndpoint(region string, endpoint string, debug bool) *RouteTableManagerEC2 {
+	r := newRouteTableManagerEC2(region, endpoint, newSession(region))
+	r.accounts = &accountManagers{
+		endpoint: endpoint,
+		rate:     DefaultEC2RateLimit,
+		burst:    DefaultEC2RateBurst,
+		managers: make(map[string]*RouteTableManagerEC2),
+	}
+	return r
+}
+
+func newRouteTableManagerEC2(region string, endpoint string, sess *session.Session) *RouteTableManagerEC2 {
 	r := RouteTableManagerEC2{
+		Region:                 region,
 		srcdstcheckForInstance: map[string]bool{},
+		advertised:             &sync.Map{},
+		instanceTags:           newInstanceTags(),
+		fights:                 newRouteFights(clock.Real),
+		interrupted:            newInterruptedInstances(),
+	}
+	cfg := request.WithRetryer(aws.NewConfig(), throttleRetryer{client.DefaultRetryer{NumMaxRetries: 3}})
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	conn := ec2.New(sess, cfg)
+	r.elbv2 = elbv2.New(sess)
+	throttled := newThrottledEC2Conn(conn, DefaultEC2RateLimit, DefaultEC2RateBurst, clock.Real)
+	r.conn = throttled
+	r.transitGateway = NewTransitGatewayManagerEC2WithConn(&throttledTransitGatewayConn{throttledEC2Conn: throttled, transitGateway: conn}, &r)
+	return &r
+}
+
+// SetRateLimit changes the rate (in calls per second) and burst size that
+// calls to the EC2 API are limited to. A rate of 0 turns off rate limiting.
+// This has no effect on managers made with NewRouteTableManagerEC2WithConn.
+// Each manager for another region or account has its own limit, which is
+// changed as well.
+func (r RouteTableManagerEC2) SetRateLimit(rate float64, burst int) {
+	r.setRateLimit(rate, burst)
+	r.accounts.setRateLimit(rate, burst)
+}
+
+func (r RouteTableManagerEC2) setRateLimit(rate float64, burst int) {
+	if t, ok := r.conn.(*throttledEC2Conn); ok {
+		t.limiter = NewRateLimiter(rate, burst, t.clock)
+	}
+}
+
+// EC2APICalls returns how many calls have been made to the EC2 API, and how
+// many of those were throttled, including by the managers for other regions
+// and accounts.
+func (r RouteTableManagerEC2) EC2APICalls() (int64, int64) {
+	var calls, throttled int64
+	if t, ok := r.conn.(*throttledEC2Conn); ok {
+		calls, throttled = t.stats()
+	}
+	r.accounts.each(func(m *RouteTableManagerEC2) {
+		c, t := m.EC2APICalls()
+		calls += c
+		throttled += t
+	})
+	return calls, throttled
+}
+
+// SetNotifier sets where notifications of route changes are sent.
+func (r *RouteTableManagerEC2) SetNotifier(n *notify.Notifier) {
+	r.notifier = n
+	r.accounts.each(func(m *RouteTableManagerEC2) {
+		m.notifier = n
+	})
+}
+
+// SetAuditLog sets where route changes are recorded.
+func (r *RouteTableManagerEC2) SetAuditLog(a *AuditLog) {
+	r.auditLog = a
+	r.accounts.each(func(m *RouteTableManagerEC2) {
+		m.auditLog = a
+	})
+}
+
+// ClockSetter is implemented by RouteTableManagers which can be given the
+// clock to tell the time with.
+type ClockSetter interface {
+	SetClock(clock.Clock)
+}
+
+// SetClock sets the clock used to decide when instances stop being treated
+// as interrupted, if scheduled events are soon, and how long ago routes were
+// fought over.
+func (r *RouteTableManagerEC2) SetClock(c clock.Clock) {
+	r.setClock(c)
+	r.accounts.each(func(m *RouteTableManagerEC2) {
+		m.setClock(c)
+	})
+}
+
+func (r *RouteTableManagerEC2) setClock(c clock.Clock) {
+	r.clock = c
+	r.fights.setClock(c)
+}
+
+func (r RouteTableManagerEC2) getClock() clock.Clock {
+	if r.clock == nil {
+		return clock.Real
+	}
+	return r.clock
+}
+
+// SetSafety sets the limits on which routes can be changed, and how many.
+func (r *RouteTableManagerEC2) SetSafety(s *Safety) {
+	r.safety = s
+	r.accounts.each(func(m *RouteTableManagerEC2) {
+		m.safety = s
+	})
+}
+
+// allowChange checks that a route change is within the safety limits.
+func (r RouteTableManagerEC2) allowChange(contextLogger *log.Entry) error {
+	if err := r.safety.checkChange(); err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Error("Not changing route, as it would exceed the safety limits")
+		return err
+	}
+	return nil
+}
+
+// changed counts a route change towards the safety limits, alarming if that
+// trips the circuit breaker. Fights over the route are counted from the
+// route's history of owners.
+func (r RouteTableManagerEC2) changed(noop bool, n notify.Notification) {
+	if noop {
+		return
 	}
+	fights := 0
+	if n.NewTarget != "" {
+		fights = r.fights.takenBack(n.RouteTable, n.Cidr, n.NewTarget, r.safety.fightWindow())
+	}
+	if why := r.safety.changed(n.RouteTable, n.Cidr, fights); why != "" {
+		log.WithFields(log.Fields{
+			"rtb":    n.RouteTable,
+			"cidr":   n.Cidr,
+			"reason": why,
+		}).Error("Circuit breaker tripped, no more routes will be changed until restarted")
+		r.notifier.Notify(notify.Notification{
+			Type:       notify.CircuitBreakerTripped,
+			Cidr:       n.Cidr,
+			RouteTable: n.RouteTable,
+			Reason:     why,
+		})
+	}
+}
+
+// notify sends a notification of a route change, unless in noop mode (when
+// no routes are really changed).
+func (r RouteTableManagerEC2) notify(noop bool, n notify.Notification) {
+	if !noop {
+		r.notifier.Notify(n)
+	}
+}
+
+func (r RouteTableManagerEC2) notifyFailed(noop bool, n notify.Notification, err error) {
+	n.Type = notify.RouteFailed
+	n.Reason = err.Error()
+	r.notify(noop, n)
+}
+
+// NewRouteTableManagerEC2WithConn makes EC2 API calls using conn, without rate
+// limiting or retrying throttled calls, for example
+// an in-memory simulation of EC2.
+func NewRouteTableManagerEC2WithConn(conn MyEC2Conn) *RouteTableManagerEC2 {
+	return &RouteTableManagerEC2{
+		conn:                   conn,
+		srcdstcheckForInstance: map[string]bool{},
+		advertised:             &sync.Map{},
+		instanceTags:           newInstanceTags(),
+		fights:                 newRouteFights(clock.Real),
+		interrupted:            newInterruptedInstances(),
+	}
+}
+
+func newSession(region string) *session.Session {
 	sess := session.New(&aws.Config{
 		Region:     aws.String(region),
 		MaxRetries: aws.Int(3),
 	})
 	sess.Handlers.Build.PushFrontNamed(addAWSnycastToUserAgent)
-	r.conn = ec2.New(sess)
-	return &r
+	return sess
 }
 
 // InstanceIsRouter when source destination check is disabled on any interface.
@@ -88,7 +317,65 @@ func (r RouteTableManagerEC2) routerInterface(instanceID string) (nicID string,
 	return "", errNICNotFound
 }
 
+// primaryInterface returns the interface of an instance at device index 0.
+func (r RouteTableManagerEC2) primaryInterface(instanceID string) (*ec2.NetworkInterface, error) {
+	out, err := r.conn.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("attachment.instance-id"), Values: aws.StringSlice([]string{instanceID})},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, nic := range out.NetworkInterfaces {
+		if nic.Attachment != nil && nic.Attachment.DeviceIndex != nil && *nic.Attachment.DeviceIndex == 0 {
+			return nic, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Cannot find primary network interface for instance %s", instanceID))
+}
+
+// GetInstanceIP returns the primary private IP address of an instance (the
+// address of the interface at device index 0).
+func (r RouteTableManagerEC2) GetInstanceIP(instanceID string) (string, error) {
+	nic, err := r.primaryInterface(instanceID)
+	if err != nil {
+		return "", err
+	}
+	return *nic.PrivateIpAddress, nil
+}
+
+// DisableSourceDestCheck disables source/destination checking on the
+// primary interface of an instance (which routes to the instance go to), and
+// then checks that the instance is a router. It returns the ID of the
+// interface.
+func (r RouteTableManagerEC2) DisableSourceDestCheck(instanceID string) (string, error) {
+	nic, err := r.primaryInterface(instanceID)
+	if err != nil {
+		return "", err
+	}
+	_, err = r.conn.ModifyNetworkInterfaceAttribute(&ec2.ModifyNetworkInterfaceAttributeInput{
+		NetworkInterfaceId: nic.NetworkInterfaceId,
+		SourceDestCheck:    &ec2.AttributeBooleanValue{Value: aws.Bool(false)},
+	})
+	if err != nil {
+		return "", err
+	}
+	nicID, err := r.routerInterface(instanceID)
+	if err == errNICNotFound {
+		return "", errors.New(fmt.Sprintf("Source/destination checking is still enabled for instance %s after disabling it on %s", instanceID, *nic.NetworkInterfaceId))
+	}
+	if err != nil {
+		return "", err
+	}
+	r.srcdstcheckForInstance[instanceID] = true
+	return nicID, nil
+}
+
 func (r RouteTableManagerEC2) ManageInstanceRoute(rtb ec2.RouteTable, rs ManageRoutesSpec, noop bool) error {
+	if !rs.Released() {
+		r.advertisePriority(rs, noop)
+	}
 	route := findRouteFromRouteTable(rtb, rs.Cidr)
 	contextLogger := log.WithFields(log.Fields{
 		"vpc":         *(rtb.VpcId),
@@ -97,7 +384,7 @@ func (r RouteTableManagerEC2) ManageInstanceRoute(rtb ec2.RouteTable, rs ManageR
 		"cidr":        rs.Cidr,
 		"my_instance": rs.Instance,
 	})
-	if rs.HealthcheckName != "" {
+	if rs.healthcheck != nil {
 		contextLogger = contextLogger.WithFields(log.Fields{
 			"healthcheck":         rs.HealthcheckName,
 			"healthcheck_healthy": rs.healthcheck.IsHealthy(),
@@ -109,40 +396,53 @@ func (r RouteTableManagerEC2) ManageInstanceRoute(rtb ec2.RouteTable, rs ManageR
 			"remote_healthcheck": rs.RemoteHealthcheckName,
 		})
 	}
+	contextLogger = contextLogger.WithFields(rs.flapDamping.fields(*(rtb.RouteTableId)))
+	if err := r.safety.checkRoute(rtb, rs.Cidr); err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Error("Not managing route")
+		return err
+	}
+	r.fights.observe(*(rtb.RouteTableId), rs.Cidr, routeOwner(route))
+	rs.setOwned(*(rtb.RouteTableId), routeOwner(route) == rs.Instance && aws.StringValue(route.State) == "active", noop, contextLogger)
+	if rs.Released() {
+		if routeOwner(route) != rs.Instance {
+			return nil
+		}
+		if rs.NeverDelete {
+			contextLogger.Info("Route removed from config, but set to never_delete - leaving it")
+			return nil
+		}
+		contextLogger.Info("Route removed from config: deleting route")
+		return r.deleteOwnRoute(rtb, rs, "removed from config", noop, contextLogger)
+	}
 	if route != nil {
 		if route.InstanceId != nil {
 			contextLogger = contextLogger.WithFields(log.Fields{
 				"instance_id": *(route.InstanceId),
 			})
 			if *(route.InstanceId) == rs.Instance {
-				if rs.HealthcheckName != "" && !rs.healthcheck.IsHealthy() && rs.healthcheck.CanPassYet() {
+				if rs.healthcheck != nil && !rs.healthcheck.IsHealthy() && rs.healthcheck.CanPassYet() {
 					if rs.NeverDelete {
 						contextLogger.Info("Healthcheck unhealthy, but set to never_delete - ignoring")
 						return nil
 					}
-					contextLogger.Info("Healthcheck unhealthy: deleting route")
-					if len(rs.RunBeforeDeleteRoute) > 0 {
-						cmd := rs.RunBeforeDeleteRoute[0]
-						if err := exec.Command(cmd, rs.RunBeforeDeleteRoute[1:]...).Run(); err != nil {
-							contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("RunBeforeDeleteRoute failed")
-						}
-					}
-					if err := r.DeleteInstanceRoute(rtb.RouteTableId, route, rs.Cidr, rs.Instance, noop); err != nil {
-						return err
-					}
-					if len(rs.RunAfterDeleteRoute) > 0 {
-						cmd := rs.RunAfterDeleteRoute[0]
-						if err := exec.Command(cmd, rs.RunAfterDeleteRoute[1:]...).Run(); err != nil {
-							contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("RunAfterDeleteRoute failed")
-						}
+					if why := rs.flapDamping.canRelease(*(rtb.RouteTableId), contextLogger); why != "" {
+						contextLogger.WithFields(log.Fields{"damping": why}).Info("Healthcheck unhealthy, but not deleting route, as it is being held down")
+						return nil
 					}
-					return nil
+					contextLogger.Info("Healthcheck unhealthy: deleting route")
+					return r.deleteOwnRoute(rtb, rs, "healthcheck unhealthy", noop, contextLogger)
 				}
 				contextLogger.Debug("Currently routed by this instance, doing nothing")
 				return nil
 			}
 			contextLogger.Debug("Not routed by my instance - evaluate for replacement")
 		}
+		if r.backsOffFromFight(contextLogger, *(rtb.RouteTableId), route, rs) {
+			rs.IfUnhealthy = true
+			if rs.Priority != nil {
+				rs.Preempt = aws.Bool(false)
+			}
+		}
 
 		if err := r.ReplaceInstanceRoute(rtb.RouteTableId, route, rs, noop); err != nil {
 			return err
@@ -151,7 +451,7 @@ func (r RouteTableManagerEC2) ManageInstanceRoute(rtb ec2.RouteTable, rs ManageR
 	}
 
 	// These is no pre-existing route
-	if rs.HealthcheckName != "" && !rs.healthcheck.IsHealthy() {
+	if rs.healthcheck != nil && !rs.healthcheck.IsHealthy() {
 		if rs.healthcheck.CanPassYet() {
 			contextLogger.Info("Healthcheck unhealthy: not creating route")
 		} else {
@@ -160,12 +460,81 @@ func (r RouteTableManagerEC2) ManageInstanceRoute(rtb ec2.RouteTable, rs ManageR
 		return nil
 	}
 
+	if why := rs.flapDamping.canAcquire(*(rtb.RouteTableId), contextLogger); why != "" {
+		contextLogger.WithFields(log.Fields{"damping": why}).Info("Not creating route, as it is being damped")
+		return nil
+	}
+
+	n := notify.Notification{
+		Cidr:        rs.Cidr,
+		RouteTable:  *(rtb.RouteTableId),
+		NewTarget:   rs.Instance,
+		Reason:      "no route",
+		Healthcheck: rs.HealthcheckName,
+	}
+	if err := r.allowChange(contextLogger); err != nil {
+		return err
+	}
+	if err := rs.runHooks(hooks.BeforeAddRoute, *(rtb.RouteTableId), ""); err != nil {
+		contextLogger.Warn("Not creating route, as run_before_add_route failed")
+		r.notifyFailed(noop, n, err)
+		return err
+	}
+
 	opts := getCreateRouteInput(rtb, rs.Cidr, rs.Instance, noop)
 
 	contextLogger.Info("Creating route to my instance")
-	if _, err := r.conn.CreateRoute(&opts); err != nil {
+	var requestID string
+	_, err := r.conn.CreateRouteWithContext(aws.BackgroundContext(), &opts, saveRequestID(&requestID))
+	r.audit("CreateRoute", noop, n, rs, requestID, err)
+	if err != nil {
+		r.notifyFailed(noop, n, err)
+		return err
+	}
+	if !noop {
+		rs.flapDamping.acquired(*(rtb.RouteTableId), contextLogger)
+		r.fights.observe(*(rtb.RouteTableId), rs.Cidr, rs.Instance)
+		rs.setOwned(*(rtb.RouteTableId), true, noop, contextLogger)
+	}
+	n.Type = notify.RouteCreated
+	r.notify(noop, n)
+	r.changed(noop, n)
+	rs.runHooks(hooks.AfterAddRoute, *(rtb.RouteTableId), "")
+	return nil
+}
+
+// deleteOwnRoute deletes a route which points to this instance, running the
+// delete hooks around it.
+func (r RouteTableManagerEC2) deleteOwnRoute(rtb ec2.RouteTable, rs ManageRoutesSpec, reason string, noop bool, contextLogger *log.Entry) error {
+	n := notify.Notification{
+		Cidr:           rs.Cidr,
+		RouteTable:     *(rtb.RouteTableId),
+		PreviousTarget: rs.Instance,
+		Reason:         reason,
+		Healthcheck:    rs.HealthcheckName,
+	}
+	if err := r.allowChange(contextLogger); err != nil {
+		return err
+	}
+	if err := rs.runHooks(hooks.BeforeDeleteRoute, *(rtb.RouteTableId), rs.Instance); err != nil {
+		contextLogger.Warn("Not deleting route, as run_before_delete_route failed")
+		r.notifyFailed(noop, n, err)
+		return err
+	}
+	requestID, err := r.deleteInstanceRoute(rtb.RouteTableId, rs.Cidr, noop)
+	r.audit("DeleteRoute", noop, n, rs, requestID, err)
+	if err != nil {
+		r.notifyFailed(noop, n, err)
 		return err
 	}
+	if !noop {
+		rs.flapDamping.released(*(rtb.RouteTableId), contextLogger)
+		rs.setOwned(*(rtb.RouteTableId), false, noop, contextLogger)
+	}
+	n.Type = notify.RouteDeleted
+	r.notify(noop, n)
+	r.changed(noop, n)
+	rs.runHooks(hooks.AfterDeleteRoute, *(rtb.RouteTableId), rs.Instance)
 	return nil
 }
 
@@ -179,12 +548,20 @@ func findRouteFromRouteTable(rtb ec2.RouteTable, cidr string) *ec2.Route {
 }
 
 func (r RouteTableManagerEC2) DeleteInstanceRoute(routeTableId *string, route *ec2.Route, cidr string, instance string, noop bool) error {
+	_, err := r.deleteInstanceRoute(routeTableId, cidr, noop)
+	return err
+}
+
+// deleteInstanceRoute deletes a route, also returning the request ID of the
+// EC2 API call.
+func (r RouteTableManagerEC2) deleteInstanceRoute(routeTableId *string, cidr string, noop bool) (string, error) {
 	params := &ec2.DeleteRouteInput{
 		DestinationCidrBlock: aws.String(cidr),
 		RouteTableId:         routeTableId,
 		DryRun:               aws.Bool(noop),
 	}
-	_, err := r.conn.DeleteRoute(params)
+	var requestID string
+	_, err := r.conn.DeleteRouteWithContext(aws.BackgroundContext(), params, saveRequestID(&requestID))
 	contextLogger := log.WithFields(log.Fields{
 		"cidr": cidr,
 		"rtb":  *routeTableId,
@@ -195,10 +572,10 @@ func (r RouteTableManagerEC2) DeleteInstanceRoute(routeTableId *string, route *e
 		contextLogger.WithFields(log.Fields{
 			"err": err.Error(),
 		}).Warn("Error deleting route")
-		return err
+		return requestID, err
 	}
 	contextLogger.Debug("Successfully deleted route")
-	return nil
+	return requestID, nil
 }
 
 func (r RouteTableManagerEC2) checkRemoteHealthCheck(contextLogger *log.Entry, route *ec2.Route, rs ManageRoutesSpec) bool {
@@ -207,7 +584,7 @@ func (r RouteTableManagerEC2) checkRemoteHealthCheck(contextLogger *log.Entry, r
 		"current_eni":        *(route.NetworkInterfaceId),
 	})
 	contextLogger.Info("Has remote healthcheck ")
-	if ip, ok := eniToIP[*route.NetworkInterfaceId]; ok {
+	if ip, ok := eniIP(*route.NetworkInterfaceId); ok {
 		contextLogger = contextLogger.WithFields(log.Fields{"current_ip": ip})
 		if hc, ok := rs.remotehealthchecks[ip]; ok {
 			contextLogger = contextLogger.WithFields(log.Fields{
@@ -237,6 +614,160 @@ func (r RouteTableManagerEC2) checkRemoteHealthCheck(contextLogger *log.Entry, r
 	return true
 }
 
+// currentInstanceHealthy returns true if the instance an active route points
+// to is healthy, and so should not be replaced by if_unhealthy routes.
+// Instances which are about to be interrupted, or which are unhealthy in the
+// route's target group, are not healthy.
+func (r RouteTableManagerEC2) currentInstanceHealthy(contextLogger *log.Entry, route *ec2.Route, rs ManageRoutesSpec) bool {
+	if route.InstanceId != nil && r.InstanceInterrupted(*(route.InstanceId)) {
+		contextLogger.Info("Current instance is going to be interrupted - replacing")
+		return false
+	}
+	if rs.RemoteTargetGroup != "" && r.targetUnhealthy(contextLogger, route, rs) {
+		return false
+	}
+	if rs.RemoteHealthcheckName != "" {
+		if !r.checkRemoteHealthCheck(contextLogger, route, rs) {
+			return true
+		}
+	}
+	if route.InstanceId == nil {
+		contextLogger.Debug("Current route target is not an instance, not checking its status")
+		return true
+	}
+	o, err := r.conn.DescribeInstanceStatus(&ec2.DescribeInstanceStatusInput{
+		IncludeAllInstances: aws.Bool(false),
+		InstanceIds:         []*string{aws.String(*(route.InstanceId))},
+	})
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Error("Error trying to DescribeInstanceStatus, not replacing route")
+		return true
+	}
+	if len(o.InstanceStatuses) == 1 {
+		is := o.InstanceStatuses[0]
+		instanceHealthOK := true
+		if *(is.InstanceStatus.Status) == "impaired" {
+			instanceHealthOK = false
+		}
+		systemHealthOK := true
+		if *(is.SystemStatus.Status) == "impaired" {
+			systemHealthOK = false
+		}
+		contextLogger = contextLogger.WithFields(log.Fields{"instanceHealthOK": instanceHealthOK, "systemHealthOK": systemHealthOK})
+		if event := pendingScheduledEvent(is.Events, r.getClock().Now()); event != nil {
+			contextLogger.WithFields(log.Fields{
+				"event":      aws.StringValue(event.Code),
+				"not_before": aws.TimeValue(event.NotBefore),
+			}).Info("Current instance has a scheduled event soon - replacing")
+			return false
+		}
+		if instanceHealthOK && systemHealthOK {
+			contextLogger.Info("Not replacing route, as current route is active and instance is healthy")
+			return true
+		}
+	} else {
+		contextLogger.Error("Did not get 1 instance for DescribeInstanceStatus - assuming instance has been terminated")
+	}
+	return false
+}
+
+// pendingScheduledEvent returns the first scheduled event which has not
+// completed or been canceled, and starts within the scheduled event lead
+// time of now.
+func pendingScheduledEvent(events []*ec2.InstanceStatusEvent, now time.Time) *ec2.InstanceStatusEvent {
+	for _, event := range events {
+		description := aws.StringValue(event.Description)
+		if strings.HasPrefix(description, "[Completed]") || strings.HasPrefix(description, "[Canceled]") {
+			continue
+		}
+		if event.NotBefore != nil && event.NotBefore.Sub(now) <= instancemetadata.DefaultScheduledEventLead {
+			return event
+		}
+	}
+	return nil
+}
+
+// Instances are treated as interrupted for this long after being marked, as
+// stopped or hibernated spot instances can come back with the same ID.
+const interruptedInstanceExpiry = time.Hour
+
+// InterruptionMarker is implemented by RouteTableManagers which can be told
+// that instances are about to be interrupted.
+type InterruptionMarker interface {
+	MarkInstanceInterrupted(string)
+}
+
+// interruptedInstances are the instances which have been reported to be
+// about to be interrupted (for example by a spot interruption warning
+// event), and when this was heard. A nil interruptedInstances has none.
+type interruptedInstances struct {
+	lock   sync.Mutex
+	marked map[string]time.Time
+}
+
+func newInterruptedInstances() *interruptedInstances {
+	return &interruptedInstances{marked: make(map[string]time.Time)}
+}
+
+func (i *interruptedInstances) mark(instanceID string, now time.Time) {
+	if i == nil {
+		return
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.marked[instanceID] = now
+}
+
+func (i *interruptedInstances) interrupted(instanceID string, now time.Time) bool {
+	if i == nil {
+		return false
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	marked, ok := i.marked[instanceID]
+	if ok && now.Sub(marked) > interruptedInstanceExpiry {
+		delete(i.marked, instanceID)
+		return false
+	}
+	return ok
+}
+
+// MarkInstanceInterrupted records that an instance is about to be
+// interrupted, so routes through it are replaced as if it were unhealthy.
+func (r RouteTableManagerEC2) MarkInstanceInterrupted(instanceID string) {
+	log.WithFields(log.Fields{"instance_id": instanceID}).Info("Marking instance as going to be interrupted")
+	r.interrupted.mark(instanceID, r.getClock().Now())
+}
+
+func (r RouteTableManagerEC2) InstanceInterrupted(instanceID string) bool {
+	return r.interrupted.interrupted(instanceID, r.getClock().Now())
+}
+
+// targetUnhealthy returns true if the instance a route points to is
+// unhealthy in the route's target group. If its health can't be found, it
+// is not considered unhealthy, and the other checks decide. Routes which
+// don't point to an instance (e.g. to a NAT gateway's interface) aren't
+// looked up.
+func (r RouteTableManagerEC2) targetUnhealthy(contextLogger *log.Entry, route *ec2.Route, rs ManageRoutesSpec) bool {
+	contextLogger = contextLogger.WithFields(log.Fields{"remote_target_group": rs.RemoteTargetGroup})
+	if route.InstanceId == nil {
+		contextLogger.Debug("Current route target is not an instance, not checking target group")
+		return false
+	}
+	state, reason, err := targetHealth(r.elbv2, rs.RemoteTargetGroup, *(route.InstanceId))
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Error("Error getting target health")
+		return false
+	}
+	contextLogger = contextLogger.WithFields(log.Fields{"target_health": state, "target_health_reason": reason})
+	if unhealthyTargetStates[state] {
+		contextLogger.Info("Current instance is unhealthy in target group - replacing")
+		return true
+	}
+	contextLogger.Debug("Current instance is not unhealthy in target group")
+	return false
+}
+
 func (r RouteTableManagerEC2) ReplaceInstanceRoute(routeTableId *string, route *ec2.Route, rs ManageRoutesSpec, noop bool) error {
 	cidr := rs.Cidr
 	instance := rs.Instance
@@ -250,52 +781,43 @@ func (r RouteTableManagerEC2) ReplaceInstanceRoute(routeTableId *string, route *
 	if route.InstanceId != nil {
 		contextLogger = contextLogger.WithFields(log.Fields{"current_instance_id": *(route.InstanceId)})
 	}
-	if ifUnhealthy {
+	reason := "not routed by this instance"
+	if ifUnhealthy || rs.Priority != nil {
 		if *(route.State) == "active" {
-			if rs.RemoteHealthcheckName != "" {
-				if !r.checkRemoteHealthCheck(contextLogger, route, rs) {
-					return nil
-				}
-			}
-			o, err := r.conn.DescribeInstanceStatus(&ec2.DescribeInstanceStatusInput{
-				IncludeAllInstances: aws.Bool(false),
-				InstanceIds:         []*string{aws.String(*(route.InstanceId))},
-			})
-			if err != nil {
-				contextLogger.WithFields(log.Fields{"err": err.Error()}).Error("Error trying to DescribeInstanceStatus, not replacing route")
+			if preempting, why := r.preempts(contextLogger, route, rs); preempting {
+				reason = why
+			} else if r.currentInstanceHealthy(contextLogger, route, rs) {
 				return nil
-			}
-			if len(o.InstanceStatuses) == 1 {
-				is := o.InstanceStatuses[0]
-				instanceHealthOK := true
-				if *(is.InstanceStatus.Status) == "impaired" {
-					instanceHealthOK = false
-				}
-				systemHealthOK := true
-				if *(is.SystemStatus.Status) == "impaired" {
-					systemHealthOK = false
-				}
-				contextLogger = contextLogger.WithFields(log.Fields{"instanceHealthOK": instanceHealthOK, "systemHealthOK": systemHealthOK})
-				if instanceHealthOK && systemHealthOK {
-					contextLogger.Info("Not replacing route, as current route is active and instance is healthy")
-					return nil
-				}
 			} else {
-				contextLogger.Error("Did not get 1 instance for DescribeInstanceStatus - assuming instance has been terminated")
+				reason = "current instance unhealthy"
 			}
 		} else {
 			contextLogger.Info("Current route is not active - replacing")
+			reason = "current route is " + *(route.State)
 		}
 	}
-	if rs.HealthcheckName != "" && !rs.healthcheck.IsHealthy() && rs.healthcheck.CanPassYet() {
+	if rs.healthcheck != nil && !rs.healthcheck.IsHealthy() && rs.healthcheck.CanPassYet() {
 		contextLogger.Info("Not replacing route, as local healthcheck is failing")
 		return nil
 	}
-	if len(rs.RunBeforeReplaceRoute) > 0 {
-		cmd := rs.RunBeforeReplaceRoute[0]
-		if err := exec.Command(cmd, rs.RunBeforeReplaceRoute[1:]...).Run(); err != nil {
-			contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("RunBeforeReplaceRoute failed")
-		}
+	if why := rs.flapDamping.canAcquire(*routeTableId, contextLogger); why != "" {
+		contextLogger.WithFields(log.Fields{"damping": why}).Info("Not replacing route, as it is being damped")
+		return nil
+	}
+	previousTarget := aws.StringValue(route.InstanceId)
+	if previousTarget == "" {
+		previousTarget = aws.StringValue(route.NetworkInterfaceId)
+	}
+	n := notify.Notification{
+		Cidr:           cidr,
+		RouteTable:     *routeTableId,
+		PreviousTarget: previousTarget,
+		NewTarget:      instance,
+		Reason:         reason,
+		Healthcheck:    rs.HealthcheckName,
+	}
+	if err := r.allowChange(contextLogger); err != nil {
+		return err
 	}
 
 	nicID, err := r.routerInterface(instance)
@@ -304,27 +826,41 @@ func (r RouteTableManagerEC2) ReplaceInstanceRoute(routeTableId *string, route *
 			contextLogger.WithFields(log.Fields{
 				"err": err.Error(),
 			}).Warn("Error replacing route")
+			r.notifyFailed(noop, n, err)
 			return err
 		}
 	}
-	if _, err = r.conn.ReplaceRoute(&ec2.ReplaceRouteInput{
+	if err := rs.runHooks(hooks.BeforeReplaceRoute, *routeTableId, previousTarget); err != nil {
+		contextLogger.Warn("Not replacing route, as run_before_replace_route failed")
+		r.notifyFailed(noop, n, err)
+		return err
+	}
+	params := &ec2.ReplaceRouteInput{
 		DestinationCidrBlock: aws.String(cidr),
 		RouteTableId:         routeTableId,
 		NetworkInterfaceId:   aws.String(nicID),
 		DryRun:               aws.Bool(noop),
-	}); err != nil {
+	}
+	var requestID string
+	_, err = r.conn.ReplaceRouteWithContext(aws.BackgroundContext(), params, saveRequestID(&requestID))
+	r.audit("ReplaceRoute", noop, n, rs, requestID, err)
+	if err != nil {
 		contextLogger.WithFields(log.Fields{
 			"err": err.Error(),
 		}).Warn("Error replacing route")
+		r.notifyFailed(noop, n, err)
 		return err
 	}
 	contextLogger.Info("Replaced route")
-	if len(rs.RunAfterReplaceRoute) > 0 {
-		cmd := rs.RunAfterReplaceRoute[0]
-		if err := exec.Command(cmd, rs.RunAfterReplaceRoute[1:]...).Run(); err != nil {
-			contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("RunAfterReplaceRoute failed")
-		}
+	if !noop {
+		rs.flapDamping.acquired(*routeTableId, contextLogger)
+		r.fights.took(*routeTableId, cidr, instance, aws.StringValue(route.State) == "active")
+		rs.setOwned(*routeTableId, true, noop, contextLogger)
 	}
+	n.Type = notify.RouteReplaced
+	r.notify(noop, n)
+	r.changed(noop, n)
+	rs.runHooks(hooks.AfterReplaceRoute, *routeTableId, previousTarget)
 	return nil
 }
 
@@ -339,6 +875,33 @@ func (r RouteTableManagerEC2) GetRouteTables() ([]*ec2.RouteTable, error) {
 	return resp.RouteTables, nil
 }
 
+func (r RouteTableManagerEC2) GetInstanceTags(instanceID string) (map[string]string, error) {
+	tags := make(map[string]string)
+	input := &ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("resource-id"), Values: aws.StringSlice([]string{instanceID})},
+			{Name: aws.String("resource-type"), Values: aws.StringSlice([]string{"instance"})},
+		},
+	}
+	for {
+		out, err := r.conn.DescribeTags(input)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":         err.Error(),
+				"instance_id": instanceID,
+			}).Warn("Error on DescribeTags")
+			return tags, err
+		}
+		for _, tag := range out.Tags {
+			tags[*tag.Key] = *tag.Value
+		}
+		if out.NextToken == nil || *out.NextToken == "" {
+			return tags, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
 func getCreateRouteInput(rtb ec2.RouteTable, cidr string, instance string, noop bool) ec2.CreateRouteInput {
 	return ec2.CreateRouteInput{
 		RouteTableId:         rtb.RouteTableId,
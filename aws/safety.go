@@ -0,0 +1,250 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bobtfish/AWSnycast/clock"
+	"github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultFightWindow is how long (in seconds) taking a route back from
+// another instance counts towards tripping the circuit breaker.
+const DefaultFightWindow = 3600
+
+// SafetyConfig limits how much damage a bad config can do, by limiting how
+// many routes can be changed, and which.
+type SafetyConfig struct {
+	MaxChangesPerPoll  int      `yaml:"max_changes_per_poll"` // 0 for no limit
+	MaxChangesPerHour  int      `yaml:"max_changes_per_hour"` // 0 for no limit
+	AllowedCidrs       []string `yaml:"allowed_cidrs"`        // Managed routes must be inside one of these, if set
+	AllowedRouteTables []string `yaml:"allowed_route_tables"` // IDs of the only route tables which can be changed, if set
+	MaxFights          int      `yaml:"max_fights"`           // 0 for no circuit breaker
+	FightWindow        uint     `yaml:"fight_window"`         // Seconds
+}
+
+func (c *SafetyConfig) Validate() error {
+	var result *multierror.Error
+	if c.MaxChangesPerPoll < 0 {
+		result = multierror.Append(result, errors.New("safety max_changes_per_poll cannot be negative"))
+	}
+	if c.MaxChangesPerHour < 0 {
+		result = multierror.Append(result, errors.New("safety max_changes_per_hour cannot be negative"))
+	}
+	if c.MaxFights < 0 {
+		result = multierror.Append(result, errors.New("safety max_fights cannot be negative"))
+	}
+	if c.FightWindow == 0 {
+		c.FightWindow = DefaultFightWindow
+	}
+	for _, cidr := range c.AllowedCidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("safety allowed_cidrs '%s' does not parse: %s", cidr, err.Error())))
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// Safety enforces a SafetyConfig, counting route changes. The counts are
+// kept when the config changes, so that a bad config can't reset them. A nil
+// Safety allows any change.
+type Safety struct {
+	config     SafetyConfig
+	allowed    []*net.IPNet
+	clock      clock.Clock
+	lock       sync.Mutex
+	pollCount  int
+	hourly     []time.Time // When each change in the last hour was made
+	tripped    bool
+	trippedFor string
+}
+
+// SafetySetter is implemented by RouteTableManagers which can limit route
+// changes with a Safety.
+type SafetySetter interface {
+	SetSafety(*Safety)
+}
+
+func NewSafety(c clock.Clock) *Safety {
+	return &Safety{clock: c}
+}
+
+// SetConfig changes the limits enforced. The config must be valid.
+func (s *Safety) SetConfig(c SafetyConfig) {
+	if s == nil {
+		return
+	}
+	allowed := make([]*net.IPNet, 0, len(c.AllowedCidrs))
+	for _, cidr := range c.AllowedCidrs {
+		if _, n, err := net.ParseCIDR(cidr); err == nil {
+			allowed = append(allowed, n)
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.config = c
+	s.allowed = allowed
+}
+
+// StartPoll resets the count of changes made in this poll.
+func (s *Safety) StartPoll() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pollCount = 0
+}
+
+// Tripped returns if the circuit breaker has been tripped, and so no more
+// changes will be made.
+func (s *Safety) Tripped() bool {
+	if s == nil {
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.tripped
+}
+
+// cidrWithin is if the network cidr is inside (or the same as) n.
+func cidrWithin(cidr *net.IPNet, n *net.IPNet) bool {
+	cidrOnes, cidrBits := cidr.Mask.Size()
+	ones, bits := n.Mask.Size()
+	return cidrBits == bits && cidrOnes >= ones && n.Contains(cidr.IP)
+}
+
+// checkRoute returns why a route in a route table cannot be managed, if it
+// can't be. Routes inside the route table's local routes (i.e. the VPC's
+// own addresses) are never managed.
+func (s *Safety) checkRoute(rtb ec2.RouteTable, cidr string) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	for _, route := range rtb.Routes {
+		if aws.StringValue(route.GatewayId) != "local" || route.DestinationCidrBlock == nil {
+			continue
+		}
+		if _, local, err := net.ParseCIDR(*(route.DestinationCidrBlock)); err == nil && cidrWithin(n, local) {
+			return errors.New(fmt.Sprintf("Refusing to manage %s, as it is inside the local route %s", cidr, *(route.DestinationCidrBlock)))
+		}
+	}
+	return s.checkAllowed(aws.StringValue(rtb.RouteTableId), cidr, n)
+}
+
+// checkTransitGatewayRoute returns why a route in a transit gateway route
+// table cannot be managed, if it can't be.
+func (s *Safety) checkTransitGatewayRoute(rtbID string, cidr string) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	return s.checkAllowed(rtbID, cidr, n)
+}
+
+// checkAllowed returns why a route cannot be managed in a route table, if it
+// is not in the allowed route tables or cidrs.
+func (s *Safety) checkAllowed(rtbID string, cidr string, n *net.IPNet) error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.config.AllowedRouteTables) > 0 {
+		allowed := false
+		for _, id := range s.config.AllowedRouteTables {
+			if id == rtbID {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return errors.New(fmt.Sprintf("Refusing to manage routes in %s, as it is not in safety allowed_route_tables", rtbID))
+		}
+	}
+	if len(s.allowed) > 0 {
+		for _, a := range s.allowed {
+			if cidrWithin(n, a) {
+				return nil
+			}
+		}
+		return errors.New(fmt.Sprintf("Refusing to manage %s, as it is not in safety allowed_cidrs", cidr))
+	}
+	return nil
+}
+
+// prune drops the changes which are too old to count. It must be called
+// with the lock held.
+func (s *Safety) prune(now time.Time) {
+	i := 0
+	for i < len(s.hourly) && now.Sub(s.hourly[i]) >= time.Hour {
+		i++
+	}
+	s.hourly = s.hourly[i:]
+}
+
+// fightWindow is how long taking a route back from another instance counts
+// towards tripping the circuit breaker.
+func (s *Safety) fightWindow() time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Duration(s.config.FightWindow) * time.Second
+}
+
+// checkChange returns why a route cannot be changed now, if it can't be.
+func (s *Safety) checkChange() error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.tripped {
+		return errors.New(fmt.Sprintf("Circuit breaker tripped (%s), not changing any routes", s.trippedFor))
+	}
+	s.prune(s.clock.Now())
+	if s.config.MaxChangesPerPoll > 0 && s.pollCount >= s.config.MaxChangesPerPoll {
+		return errors.New(fmt.Sprintf("Already changed max_changes_per_poll (%d) routes this poll", s.config.MaxChangesPerPoll))
+	}
+	if s.config.MaxChangesPerHour > 0 && len(s.hourly) >= s.config.MaxChangesPerHour {
+		return errors.New(fmt.Sprintf("Already changed max_changes_per_hour (%d) routes in the last hour", s.config.MaxChangesPerHour))
+	}
+	return nil
+}
+
+// changed counts a route change. fights is how many times in the last
+// fight_window this instance has taken the route back from another instance
+// which had taken it from this instance, including this change. If there
+// have been too many, the circuit breaker is tripped and the reason it was
+// is returned.
+func (s *Safety) changed(rtbID string, cidr string, fights int) string {
+	if s == nil {
+		return ""
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pollCount++
+	s.hourly = append(s.hourly, s.clock.Now())
+	if fights == 0 {
+		return ""
+	}
+	log.WithFields(log.Fields{
+		"rtb":    rtbID,
+		"cidr":   cidr,
+		"fights": fights,
+	}).Warn("Took back a route another instance took from this instance")
+	if s.config.MaxFights > 0 && fights > s.config.MaxFights && !s.tripped {
+		s.tripped = true
+		s.trippedFor = fmt.Sprintf("fought over %s in %s %d times", cidr, rtbID, fights)
+		return s.trippedFor
+	}
+	return ""
+}
@@ -0,0 +1,41 @@
+package aws
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+type MySSMConn interface {
+	GetParameter(*ssm.GetParameterInput) (*ssm.GetParameterOutput, error)
+}
+
+// ParameterFetcher fetches a config document and its version from a
+// central store.
+type ParameterFetcher interface {
+	FetchParameter() (string, int64, error)
+}
+
+type SSMParameter struct {
+	Name string
+	conn MySSMConn
+}
+
+func NewSSMParameter(name string, region string) *SSMParameter {
+	return &SSMParameter{
+		Name: name,
+		conn: ssm.New(newSession(region)),
+	}
+}
+
+// FetchParameter returns the (decrypted) value of the parameter and its
+// version, which increases every time the parameter is changed.
+func (p *SSMParameter) FetchParameter() (string, int64, error) {
+	out, err := p.conn.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(p.Name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return *out.Parameter.Value, *out.Parameter.Version, nil
+}
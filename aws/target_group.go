@@ -0,0 +1,61 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+)
+
+type MyELBV2Conn interface {
+	DescribeTargetHealth(*elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error)
+}
+
+// Target health states in which an instance should not be routed to. Other
+// states (initial, unavailable) don't tell us either way, and nor does
+// unused, as an instance which is healthy is unused when the target group
+// isn't used by a load balancer, or its AZ isn't enabled.
+var unhealthyTargetStates = map[string]bool{
+	elbv2.TargetHealthStateEnumUnhealthy: true,
+	elbv2.TargetHealthStateEnumDraining:  true,
+}
+
+func validateTargetGroupArn(arn string) error {
+	if !strings.HasPrefix(arn, "arn:") || !strings.Contains(arn, ":targetgroup/") {
+		return errors.New(fmt.Sprintf("'%s' is not a target group ARN", arn))
+	}
+	return nil
+}
+
+// targetHealth returns the health state of an instance in a target group,
+// and the reason for it (if any). If the instance is registered more than
+// once (on different ports), it is only healthy if every registration is.
+func targetHealth(conn MyELBV2Conn, targetGroupArn string, instanceID string) (string, string, error) {
+	if conn == nil {
+		return "", "", errors.New("No ELBv2 client to check target health with")
+	}
+	out, err := conn.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: aws.String(targetGroupArn),
+		Targets:        []*elbv2.TargetDescription{{Id: aws.String(instanceID)}},
+	})
+	if err != nil {
+		return "", "", err
+	}
+	if len(out.TargetHealthDescriptions) == 0 {
+		return "", "", errors.New(fmt.Sprintf("No target health returned for %s", instanceID))
+	}
+	state, reason := "", ""
+	for _, desc := range out.TargetHealthDescriptions {
+		if desc.TargetHealth == nil {
+			continue
+		}
+		state = aws.StringValue(desc.TargetHealth.State)
+		reason = aws.StringValue(desc.TargetHealth.Reason)
+		if unhealthyTargetStates[state] {
+			break
+		}
+	}
+	return state, reason, nil
+}
@@ -0,0 +1,289 @@
+package aws
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bobtfish/AWSnycast/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultEC2RateLimit = 5.0 // Requests per second
+	DefaultEC2RateBurst = 10
+	// Calls which are throttled are retried this many times, backing off
+	// exponentially (with jitter) from throttleBaseBackoff up to
+	// throttleMaxBackoff between attempts.
+	throttleMaxRetries  = 5
+	throttleBaseBackoff = time.Second
+	throttleMaxBackoff  = 30 * time.Second
+)
+
+// RateLimiter is a token bucket, allowing bursts of up to burst calls, and
+// rate calls per second on average. A rate of 0 means no limit.
+type RateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	clock  clock.Clock
+	lock   sync.Mutex
+}
+
+func NewRateLimiter(rate float64, burst int, c clock.Clock) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   c.Now(),
+		clock:  c,
+	}
+}
+
+// Wait blocks until a call can be made. Callers are let through in the order
+// they call Wait.
+func (l *RateLimiter) Wait() {
+	if l.rate <= 0 {
+		return
+	}
+	l.lock.Lock()
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// Take our token even if there isn't one yet, so that later callers
+	// queue up behind us.
+	l.tokens--
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.lock.Unlock()
+	if wait > 0 {
+		clock.Sleep(l.clock, wait)
+	}
+}
+
+// throttleRetryer retries requests as the SDK normally would, except for
+// those which are throttled, which are left for throttledEC2Conn to retry, so
+// that they are rate limited and backed off from with jitter.
+type throttleRetryer struct {
+	client.DefaultRetryer
+}
+
+func (r throttleRetryer) ShouldRetry(req *request.Request) bool {
+	if req.IsErrorThrottle() {
+		return false
+	}
+	return r.DefaultRetryer.ShouldRetry(req)
+}
+
+// EC2APIStats is implemented by RouteTableManagers which count the EC2 API
+// calls they make, and how many of them have been throttled.
+type EC2APIStats interface {
+	EC2APICalls() (calls int64, throttled int64)
+}
+
+// throttledEC2Conn rate limits all the calls made through it, and retries
+// calls which are throttled by EC2 with jittered exponential backoff, so
+// that a fleet of instances being throttled at once don't all retry in
+// lockstep.
+type throttledEC2Conn struct {
+	conn      MyEC2Conn
+	limiter   *RateLimiter
+	clock     clock.Clock
+	calls     int64
+	throttled int64
+}
+
+func newThrottledEC2Conn(conn MyEC2Conn, rate float64, burst int, c clock.Clock) *throttledEC2Conn {
+	return &throttledEC2Conn{
+		conn:    conn,
+		limiter: NewRateLimiter(rate, burst, c),
+		clock:   c,
+	}
+}
+
+var jitter = rand.Int63n
+
+// throttleBackoff returns how long to wait before retry number attempt (from
+// 0), which is a random time between half and all of the exponential
+// backoff.
+func throttleBackoff(attempt int) time.Duration {
+	backoff := throttleBaseBackoff << uint(attempt)
+	if backoff > throttleMaxBackoff || backoff <= 0 {
+		backoff = throttleMaxBackoff
+	}
+	return backoff/2 + time.Duration(jitter(int64(backoff/2)+1))
+}
+
+func (c *throttledEC2Conn) do(action string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		c.limiter.Wait()
+		atomic.AddInt64(&c.calls, 1)
+		err := f()
+		if err == nil || !request.IsErrorThrottle(err) {
+			return err
+		}
+		throttled := atomic.AddInt64(&c.throttled, 1)
+		contextLogger := log.WithFields(log.Fields{
+			"action":          action,
+			"attempt":         attempt + 1,
+			"throttled_total": throttled,
+		})
+		if attempt >= throttleMaxRetries {
+			contextLogger.Warn("EC2 API call throttled, giving up")
+			return err
+		}
+		backoff := throttleBackoff(attempt)
+		contextLogger.WithFields(log.Fields{"backoff": backoff}).Warn("EC2 API call throttled, backing off")
+		clock.Sleep(c.clock, backoff)
+	}
+}
+
+func (c *throttledEC2Conn) stats() (int64, int64) {
+	return atomic.LoadInt64(&c.calls), atomic.LoadInt64(&c.throttled)
+}
+
+func (c *throttledEC2Conn) CreateRouteWithContext(ctx aws.Context, i *ec2.CreateRouteInput, opts ...request.Option) (o *ec2.CreateRouteOutput, err error) {
+	err = c.do("CreateRoute", func() (err error) {
+		o, err = c.conn.CreateRouteWithContext(ctx, i, opts...)
+		return
+	})
+	return
+}
+
+func (c *throttledEC2Conn) ReplaceRouteWithContext(ctx aws.Context, i *ec2.ReplaceRouteInput, opts ...request.Option) (o *ec2.ReplaceRouteOutput, err error) {
+	err = c.do("ReplaceRoute", func() (err error) {
+		o, err = c.conn.ReplaceRouteWithContext(ctx, i, opts...)
+		return
+	})
+	return
+}
+
+func (c *throttledEC2Conn) DescribeRouteTables(i *ec2.DescribeRouteTablesInput) (o *ec2.DescribeRouteTablesOutput, err error) {
+	err = c.do("DescribeRouteTables", func() (err error) {
+		o, err = c.conn.DescribeRouteTables(i)
+		return
+	})
+	return
+}
+
+func (c *throttledEC2Conn) DeleteRouteWithContext(ctx aws.Context, i *ec2.DeleteRouteInput, opts ...request.Option) (o *ec2.DeleteRouteOutput, err error) {
+	err = c.do("DeleteRoute", func() (err error) {
+		o, err = c.conn.DeleteRouteWithContext(ctx, i, opts...)
+		return
+	})
+	return
+}
+
+func (c *throttledEC2Conn) DescribeNetworkInterfaces(i *ec2.DescribeNetworkInterfacesInput) (o *ec2.DescribeNetworkInterfacesOutput, err error) {
+	err = c.do("DescribeNetworkInterfaces", func() (err error) {
+		o, err = c.conn.DescribeNetworkInterfaces(i)
+		return
+	})
+	return
+}
+
+func (c *throttledEC2Conn) DescribeInstanceAttribute(i *ec2.DescribeInstanceAttributeInput) (o *ec2.DescribeInstanceAttributeOutput, err error) {
+	err = c.do("DescribeInstanceAttribute", func() (err error) {
+		o, err = c.conn.DescribeInstanceAttribute(i)
+		return
+	})
+	return
+}
+
+func (c *throttledEC2Conn) DescribeInstanceStatus(i *ec2.DescribeInstanceStatusInput) (o *ec2.DescribeInstanceStatusOutput, err error) {
+	err = c.do("DescribeInstanceStatus", func() (err error) {
+		o, err = c.conn.DescribeInstanceStatus(i)
+		return
+	})
+	return
+}
+
+func (c *throttledEC2Conn) ModifyNetworkInterfaceAttribute(i *ec2.ModifyNetworkInterfaceAttributeInput) (o *ec2.ModifyNetworkInterfaceAttributeOutput, err error) {
+	err = c.do("ModifyNetworkInterfaceAttribute", func() (err error) {
+		o, err = c.conn.ModifyNetworkInterfaceAttribute(i)
+		return
+	})
+	return
+}
+
+func (c *throttledEC2Conn) DescribeTags(i *ec2.DescribeTagsInput) (o *ec2.DescribeTagsOutput, err error) {
+	err = c.do("DescribeTags", func() (err error) {
+		o, err = c.conn.DescribeTags(i)
+		return
+	})
+	return
+}
+
+func (c *throttledEC2Conn) CreateTags(i *ec2.CreateTagsInput) (o *ec2.CreateTagsOutput, err error) {
+	err = c.do("CreateTags", func() (err error) {
+		o, err = c.conn.CreateTags(i)
+		return
+	})
+	return
+}
+
+// throttledTransitGatewayConn makes transit gateway calls to the EC2 API
+// with the same rate limit as a throttledEC2Conn.
+type throttledTransitGatewayConn struct {
+	*throttledEC2Conn
+	transitGateway MyTransitGatewayConn
+}
+
+func (c *throttledTransitGatewayConn) DescribeTransitGatewayRouteTables(i *ec2.DescribeTransitGatewayRouteTablesInput) (o *ec2.DescribeTransitGatewayRouteTablesOutput, err error) {
+	err = c.do("DescribeTransitGatewayRouteTables", func() (err error) {
+		o, err = c.transitGateway.DescribeTransitGatewayRouteTables(i)
+		return
+	})
+	return
+}
+
+func (c *throttledTransitGatewayConn) SearchTransitGatewayRoutes(i *ec2.SearchTransitGatewayRoutesInput) (o *ec2.SearchTransitGatewayRoutesOutput, err error) {
+	err = c.do("SearchTransitGatewayRoutes", func() (err error) {
+		o, err = c.transitGateway.SearchTransitGatewayRoutes(i)
+		return
+	})
+	return
+}
+
+func (c *throttledTransitGatewayConn) CreateTransitGatewayRouteWithContext(ctx aws.Context, i *ec2.CreateTransitGatewayRouteInput, opts ...request.Option) (o *ec2.CreateTransitGatewayRouteOutput, err error) {
+	err = c.do("CreateTransitGatewayRoute", func() (err error) {
+		o, err = c.transitGateway.CreateTransitGatewayRouteWithContext(ctx, i, opts...)
+		return
+	})
+	return
+}
+
+func (c *throttledTransitGatewayConn) ReplaceTransitGatewayRouteWithContext(ctx aws.Context, i *ec2.ReplaceTransitGatewayRouteInput, opts ...request.Option) (o *ec2.ReplaceTransitGatewayRouteOutput, err error) {
+	err = c.do("ReplaceTransitGatewayRoute", func() (err error) {
+		o, err = c.transitGateway.ReplaceTransitGatewayRouteWithContext(ctx, i, opts...)
+		return
+	})
+	return
+}
+
+func (c *throttledTransitGatewayConn) DeleteTransitGatewayRouteWithContext(ctx aws.Context, i *ec2.DeleteTransitGatewayRouteInput, opts ...request.Option) (o *ec2.DeleteTransitGatewayRouteOutput, err error) {
+	err = c.do("DeleteTransitGatewayRoute", func() (err error) {
+		o, err = c.transitGateway.DeleteTransitGatewayRouteWithContext(ctx, i, opts...)
+		return
+	})
+	return
+}
+
+func (c *throttledTransitGatewayConn) DescribeTransitGatewayAttachments(i *ec2.DescribeTransitGatewayAttachmentsInput) (o *ec2.DescribeTransitGatewayAttachmentsOutput, err error) {
+	err = c.do("DescribeTransitGatewayAttachments", func() (err error) {
+		o, err = c.transitGateway.DescribeTransitGatewayAttachments(i)
+		return
+	})
+	return
+}
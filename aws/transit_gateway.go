@@ -0,0 +1,622 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bobtfish/AWSnycast/healthcheck"
+	"github.com/bobtfish/AWSnycast/notify"
+	"github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+)
+
+type MyTransitGatewayConn interface {
+	DescribeTransitGatewayRouteTables(*ec2.DescribeTransitGatewayRouteTablesInput) (*ec2.DescribeTransitGatewayRouteTablesOutput, error)
+	SearchTransitGatewayRoutes(*ec2.SearchTransitGatewayRoutesInput) (*ec2.SearchTransitGatewayRoutesOutput, error)
+	CreateTransitGatewayRouteWithContext(aws.Context, *ec2.CreateTransitGatewayRouteInput, ...request.Option) (*ec2.CreateTransitGatewayRouteOutput, error)
+	ReplaceTransitGatewayRouteWithContext(aws.Context, *ec2.ReplaceTransitGatewayRouteInput, ...request.Option) (*ec2.ReplaceTransitGatewayRouteOutput, error)
+	DeleteTransitGatewayRouteWithContext(aws.Context, *ec2.DeleteTransitGatewayRouteInput, ...request.Option) (*ec2.DeleteTransitGatewayRouteOutput, error)
+	DescribeTransitGatewayAttachments(*ec2.DescribeTransitGatewayAttachmentsInput) (*ec2.DescribeTransitGatewayAttachmentsOutput, error)
+}
+
+// TransitGatewayManager manages routes in transit gateway route tables,
+// pointing them at transit gateway attachments (e.g. the attachment for
+// this instance's VPC).
+type TransitGatewayManager interface {
+	GetTransitGatewayRouteTables() ([]*ec2.TransitGatewayRouteTable, error)
+	ManageTransitGatewayRoute(ec2.TransitGatewayRouteTable, ManageTransitGatewayRoutesSpec, bool) error
+}
+
+// TransitGatewayManagerProvider is implemented by RouteTableManagers which
+// can also manage transit gateway route tables.
+type TransitGatewayManagerProvider interface {
+	TransitGatewayManager() TransitGatewayManager
+}
+
+// ManageTransitGatewayRoutesSpec is a route to manage in transit gateway
+// route tables. The route is created or replaced to point at the attachment
+// whilst the healthcheck is healthy, and deleted when it is unhealthy, in
+// the same way as routes in VPC route tables are for instances.
+type ManageTransitGatewayRoutesSpec struct {
+	Cidr                      string                              `yaml:"cidr"`
+	Attachment                string                              `yaml:"attachment"`
+	HealthcheckName           string                              `yaml:"healthcheck"`
+	RemoteHealthcheckName     string                              `yaml:"remote_healthcheck"`
+	RemoteTargetGroup         string                              `yaml:"remote_target_group"`
+	IfUnhealthy               bool                                `yaml:"if_unhealthy"`
+	NeverDelete               bool                                `yaml:"never_delete"`
+	healthcheck               healthcheck.CanBeHealthy            `yaml:"-"`
+	remotehealthchecktemplate *healthcheck.Healthcheck            `yaml:"-"`
+	remotehealthchecks        map[string]*healthcheck.Healthcheck `yaml:"-"`
+	remotelisteners           map[string]chan struct{}            `yaml:"-"`
+	ec2RouteTables            []*ec2.TransitGatewayRouteTable     `yaml:"-"`
+	Manager                   TransitGatewayManager               `yaml:"-"`
+	noop                      bool                                `yaml:"-"`
+	state                     *routeState                         `yaml:"-"`
+}
+
+func (r *ManageTransitGatewayRoutesSpec) Validate(name string, healthchecks map[string]*healthcheck.Healthcheck, remotehealthchecks map[string]*healthcheck.Healthcheck) error {
+	var result *multierror.Error
+	r.ec2RouteTables = make([]*ec2.TransitGatewayRouteTable, 0)
+	r.remotehealthchecks = make(map[string]*healthcheck.Healthcheck)
+	r.remotelisteners = make(map[string]chan struct{})
+	if r.state == nil {
+		r.state = newRouteState()
+	}
+	if r.Cidr == "" {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("cidr is not defined in %s", name)))
+	} else {
+		if !strings.Contains(r.Cidr, "/") {
+			r.Cidr = fmt.Sprintf("%s/32", r.Cidr)
+		}
+		if _, _, err := net.ParseCIDR(r.Cidr); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Could not parse %s in %s", err.Error(), name)))
+		}
+	}
+	if r.Attachment == "" {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("Transit gateway route tables %s, route %s has no attachment", name, r.Cidr)))
+	} else if !strings.HasPrefix(r.Attachment, "tgw-attach-") {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("Transit gateway route tables %s, route %s attachment '%s' is not a transit gateway attachment ID", name, r.Cidr, r.Attachment)))
+	}
+	if r.HealthcheckName != "" {
+		if hc, ok := healthchecks[r.HealthcheckName]; ok {
+			r.healthcheck = hc
+		} else {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Transit gateway route tables %s, route %s cannot find healthcheck '%s'", name, r.Cidr, r.HealthcheckName)))
+		}
+	}
+	if r.RemoteHealthcheckName != "" {
+		if hc, ok := remotehealthchecks[r.RemoteHealthcheckName]; ok {
+			r.remotehealthchecktemplate = hc
+		} else {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Transit gateway route tables %s, route %s cannot find remote healthcheck '%s'", name, r.Cidr, r.RemoteHealthcheckName)))
+		}
+	}
+	if r.RemoteTargetGroup != "" {
+		if err := validateTargetGroupArn(r.RemoteTargetGroup); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Transit gateway route tables %s, route %s remote_target_group: %s", name, r.Cidr, err.Error())))
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+func (r *ManageTransitGatewayRoutesSpec) getState() *routeState {
+	if r.state == nil {
+		r.state = newRouteState()
+	}
+	return r.state
+}
+
+// StartHealthcheckListener manages the route in each of its transit gateway
+// route tables whenever its healthcheck changes state, rather than waiting
+// for the next poll.
+func (r *ManageTransitGatewayRoutesSpec) StartHealthcheckListener(noop bool) {
+	s := r.getState()
+	s.update.Lock()
+	r.noop = noop
+	s.update.Unlock()
+	if r.healthcheck == nil {
+		return
+	}
+	c := r.healthcheck.GetListener()
+	s.listen(c, nil, func(res bool) {
+		r.handleHealthcheckResult(res, false)
+	})
+}
+
+// Stop makes this route ignore any further healthcheck results, ends its
+// healthcheck listeners and stops its remote healthchecks. It is used when
+// the config is reloaded whilst the daemon is running.
+func (r *ManageTransitGatewayRoutesSpec) Stop() {
+	s := r.getState()
+	s.stop()
+	s.update.Lock()
+	defer s.update.Unlock()
+	for ip := range r.remotehealthchecks {
+		r.stopRemoteHealthcheck(ip)
+	}
+}
+
+func (r *ManageTransitGatewayRoutesSpec) handleHealthcheckResult(res bool, remote bool) {
+	s := r.getState()
+	s.update.Lock()
+	defer s.update.Unlock()
+	if s.isStopped() || r.Manager == nil {
+		return
+	}
+	resText := "FAILED"
+	if res {
+		resText = "PASSED"
+	}
+	typeText := "local"
+	if remote {
+		typeText = "remote"
+	}
+	contextLogger := log.WithFields(log.Fields{
+		"healtcheck_status": resText,
+		"healthcheck_name":  r.HealthcheckName,
+		"healthcheck_type":  typeText,
+		"route_cidr":        r.Cidr,
+	})
+	contextLogger.Info("Healthcheck status change, reevaluating current transit gateway routes")
+	for _, rtb := range r.ec2RouteTables {
+		innerLogger := contextLogger.WithFields(log.Fields{
+			"tgw_rtb": aws.StringValue(rtb.TransitGatewayRouteTableId),
+		})
+		if err := r.Manager.ManageTransitGatewayRoute(*rtb, *r, r.noop); err != nil {
+			innerLogger.WithFields(log.Fields{"err": err.Error()}).Warn("error")
+		}
+	}
+}
+
+// UpdateEc2RouteTables sets the transit gateway route tables the route is
+// managed in, and the manager which manages it when its healthchecks change
+// state.
+func (r *ManageTransitGatewayRoutesSpec) UpdateEc2RouteTables(rt []*ec2.TransitGatewayRouteTable, manager TransitGatewayManager) {
+	s := r.getState()
+	s.update.Lock()
+	defer s.update.Unlock()
+	r.ec2RouteTables = rt
+	r.Manager = manager
+	r.updateRemoteHealthchecks()
+}
+
+// updateRemoteHealthchecks runs the remote healthcheck against each instance
+// the route currently ends up at through another attachment, and stops it
+// for instances the route no longer ends up at.
+func (r *ManageTransitGatewayRoutesSpec) updateRemoteHealthchecks() {
+	if r.remotehealthchecktemplate == nil {
+		return
+	}
+	t, ok := r.Manager.(*TransitGatewayManagerEC2)
+	if !ok {
+		return
+	}
+	routes := make([]*ec2.Route, 0)
+	for _, rtb := range r.ec2RouteTables {
+		route, err := t.findTransitGatewayRoute(aws.StringValue(rtb.TransitGatewayRouteTableId), r.Cidr)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err.Error()}).Warn("Error on SearchTransitGatewayRoutes")
+			return
+		}
+		attachment := transitGatewayRouteAttachment(route)
+		if attachment == "" || attachment == r.Attachment {
+			continue
+		}
+		instanceRoute, err := t.attachmentRoute(attachment, r.Cidr)
+		if err != nil {
+			log.WithFields(log.Fields{"attachment": attachment, "err": err.Error()}).Warn("Error finding the instance behind attachment")
+			return
+		}
+		if instanceRoute != nil {
+			routes = append(routes, instanceRoute)
+		}
+	}
+	if eniIdsToFetch := uncachedENIs(routes); len(eniIdsToFetch) > 0 {
+		if err := fetchENIIPs(t.routes.conn, eniIdsToFetch); err != nil {
+			log.Error("Error " + err.Error())
+			return
+		}
+	}
+	healthchecks := make(map[string]bool)
+	for ip := range r.remotehealthchecks {
+		healthchecks[ip] = false
+	}
+	for _, route := range routes {
+		ip, _ := eniIP(*route.NetworkInterfaceId)
+		contextLogger := log.WithFields(log.Fields{"ip": ip})
+		healthchecks[ip] = true
+		if _, ok := r.remotehealthchecks[ip]; ok {
+			continue
+		}
+		hc, err := r.remotehealthchecktemplate.NewWithDestinationInstance(ip, *route.InstanceId)
+		if err != nil {
+			contextLogger.Error(err.Error())
+			continue
+		}
+		r.remotehealthchecks[ip] = hc
+		done := make(chan struct{})
+		r.remotelisteners[ip] = done
+		c := hc.GetListener()
+		hc.Run(true)
+		contextLogger.Debug("New healthcheck being run")
+		r.getState().listen(c, done, func(res bool) {
+			r.handleHealthcheckResult(res, true)
+		})
+	}
+	for ip, v := range healthchecks {
+		if v {
+			continue
+		}
+		log.WithFields(log.Fields{"ip": ip}).Debug("Stopping healthcheck")
+		r.stopRemoteHealthcheck(ip)
+	}
+}
+
+// stopRemoteHealthcheck stops the remote healthcheck of ip, and ends its
+// listener.
+func (r *ManageTransitGatewayRoutesSpec) stopRemoteHealthcheck(ip string) {
+	r.remotehealthchecks[ip].Stop()
+	delete(r.remotehealthchecks, ip)
+	if done, ok := r.remotelisteners[ip]; ok {
+		close(done)
+		delete(r.remotelisteners, ip)
+	}
+}
+
+// instanceRoutesSpec is the part of the route which is used to check the
+// instance behind the attachment the route currently points to, in the same
+// way as the instance a VPC route points to is checked.
+func (r ManageTransitGatewayRoutesSpec) instanceRoutesSpec() ManageRoutesSpec {
+	return ManageRoutesSpec{
+		Cidr:                  r.Cidr,
+		RemoteHealthcheckName: r.RemoteHealthcheckName,
+		RemoteTargetGroup:     r.RemoteTargetGroup,
+		remotehealthchecks:    r.remotehealthchecks,
+	}
+}
+
+// TransitGatewayManagerEC2 manages transit gateway routes through the EC2
+// API. It shares the notifier, audit log and safety limits of the
+// RouteTableManagerEC2 which made it.
+type TransitGatewayManagerEC2 struct {
+	conn   MyTransitGatewayConn
+	routes *RouteTableManagerEC2
+	// attachmentVpcs is the VPC of each attachment which has been looked up.
+	attachmentVpcs map[string]string
+	lock           sync.Mutex
+}
+
+func NewTransitGatewayManagerEC2WithConn(conn MyTransitGatewayConn, routes *RouteTableManagerEC2) *TransitGatewayManagerEC2 {
+	return &TransitGatewayManagerEC2{
+		conn:           conn,
+		routes:         routes,
+		attachmentVpcs: make(map[string]string),
+	}
+}
+
+// TransitGatewayManager returns the manager for transit gateway route tables
+// in the same region and account, which makes EC2 API calls with the same
+// rate limit, if there is one.
+func (r *RouteTableManagerEC2) TransitGatewayManager() TransitGatewayManager {
+	if r.transitGateway == nil {
+		return nil
+	}
+	return r.transitGateway
+}
+
+func (t *TransitGatewayManagerEC2) GetTransitGatewayRouteTables() ([]*ec2.TransitGatewayRouteTable, error) {
+	tables := make([]*ec2.TransitGatewayRouteTable, 0)
+	input := &ec2.DescribeTransitGatewayRouteTablesInput{}
+	for {
+		out, err := t.conn.DescribeTransitGatewayRouteTables(input)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err.Error(),
+			}).Warn("Error on DescribeTransitGatewayRouteTables")
+			return []*ec2.TransitGatewayRouteTable{}, err
+		}
+		tables = append(tables, out.TransitGatewayRouteTables...)
+		if aws.StringValue(out.NextToken) == "" {
+			return tables, nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// findTransitGatewayRoute finds the static route for exactly cidr in a
+// transit gateway route table, if there is one. Propagated routes are
+// ignored, as a static route overrides them.
+func (t *TransitGatewayManagerEC2) findTransitGatewayRoute(rtbID string, cidr string) (*ec2.TransitGatewayRoute, error) {
+	out, err := t.conn.SearchTransitGatewayRoutes(&ec2.SearchTransitGatewayRoutesInput{
+		TransitGatewayRouteTableId: aws.String(rtbID),
+		Filters: []*ec2.Filter{
+			{Name: aws.String("route-search.exact-match"), Values: aws.StringSlice([]string{cidr})},
+			{Name: aws.String("type"), Values: aws.StringSlice([]string{"static"})},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range out.Routes {
+		if aws.StringValue(route.DestinationCidrBlock) != cidr {
+			continue
+		}
+		if state := aws.StringValue(route.State); state == "deleting" || state == "deleted" {
+			continue
+		}
+		return route, nil
+	}
+	return nil, nil
+}
+
+// transitGatewayRouteAttachment is the attachment a route points to, or an
+// empty string for a blackhole route.
+func transitGatewayRouteAttachment(route *ec2.TransitGatewayRoute) string {
+	if route == nil {
+		return ""
+	}
+	for _, a := range route.TransitGatewayAttachments {
+		if a.TransitGatewayAttachmentId != nil {
+			return *(a.TransitGatewayAttachmentId)
+		}
+	}
+	return ""
+}
+
+// attachmentVpc is the VPC an attachment is for, or an empty string if it is
+// not a VPC attachment. An attachment's VPC cannot change, so each attachment
+// is only looked up once.
+func (t *TransitGatewayManagerEC2) attachmentVpc(attachment string) (string, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if vpc, ok := t.attachmentVpcs[attachment]; ok {
+		return vpc, nil
+	}
+	out, err := t.conn.DescribeTransitGatewayAttachments(&ec2.DescribeTransitGatewayAttachmentsInput{
+		TransitGatewayAttachmentIds: aws.StringSlice([]string{attachment}),
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, a := range out.TransitGatewayAttachments {
+		if aws.StringValue(a.TransitGatewayAttachmentId) != attachment {
+			continue
+		}
+		vpc := ""
+		if aws.StringValue(a.ResourceType) == "vpc" {
+			vpc = aws.StringValue(a.ResourceId)
+		}
+		t.attachmentVpcs[attachment] = vpc
+		return vpc, nil
+	}
+	return "", nil
+}
+
+// attachmentRoute finds the route for cidr to an instance in the route tables
+// of the VPC an attachment is for, which is where traffic sent to the
+// attachment ends up. nil is returned if the attachment is not for a VPC, or
+// its VPC does not route cidr to an instance.
+func (t *TransitGatewayManagerEC2) attachmentRoute(attachment string, cidr string) (*ec2.Route, error) {
+	vpc, err := t.attachmentVpc(attachment)
+	if err != nil || vpc == "" {
+		return nil, err
+	}
+	out, err := t.routes.conn.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("vpc-id"), Values: aws.StringSlice([]string{vpc})},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, rtb := range out.RouteTables {
+		if aws.StringValue(rtb.VpcId) != vpc {
+			continue
+		}
+		route := findRouteFromRouteTable(*rtb, cidr)
+		if route != nil && route.InstanceId != nil && route.NetworkInterfaceId != nil {
+			return route, nil
+		}
+	}
+	return nil, nil
+}
+
+// currentAttachmentHealthy returns true if the instance behind the attachment
+// an active route points to is healthy, and so should not be replaced by
+// if_unhealthy routes. An attachment stays active after that instance dies,
+// so it is checked in the same way as the instance an active VPC route points
+// to. If there is no such instance, the attachment is healthy whilst it is
+// active.
+func (t *TransitGatewayManagerEC2) currentAttachmentHealthy(contextLogger *log.Entry, attachment string, rs ManageTransitGatewayRoutesSpec) bool {
+	route, err := t.attachmentRoute(attachment, rs.Cidr)
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Error("Error finding the instance behind current attachment, not replacing route")
+		return true
+	}
+	if route == nil {
+		contextLogger.Debug("Not replacing route, as current attachment is active")
+		return true
+	}
+	contextLogger = contextLogger.WithFields(log.Fields{"instance_id": *(route.InstanceId)})
+	if aws.StringValue(route.State) != "active" {
+		contextLogger.Info("Route to the instance behind current attachment is not active - replacing")
+		return false
+	}
+	return t.routes.currentInstanceHealthy(contextLogger, route, rs.instanceRoutesSpec())
+}
+
+func (t *TransitGatewayManagerEC2) audit(action string, noop bool, n notify.Notification, rs ManageTransitGatewayRoutesSpec, requestID string, err error) {
+	t.routes.audit(action, noop, n, ManageRoutesSpec{HealthcheckName: rs.HealthcheckName, healthcheck: rs.healthcheck}, requestID, err)
+}
+
+func (t *TransitGatewayManagerEC2) ManageTransitGatewayRoute(rtb ec2.TransitGatewayRouteTable, rs ManageTransitGatewayRoutesSpec, noop bool) error {
+	rtbID := aws.StringValue(rtb.TransitGatewayRouteTableId)
+	contextLogger := log.WithFields(log.Fields{
+		"tgw":           aws.StringValue(rtb.TransitGatewayId),
+		"tgw_rtb":       rtbID,
+		"noop":          noop,
+		"cidr":          rs.Cidr,
+		"my_attachment": rs.Attachment,
+	})
+	healthy, ready := true, true
+	if rs.healthcheck != nil {
+		healthy, ready = rs.healthcheck.IsHealthy(), rs.healthcheck.CanPassYet()
+		contextLogger = contextLogger.WithFields(log.Fields{
+			"healthcheck":         rs.HealthcheckName,
+			"healthcheck_healthy": healthy,
+			"healthcheck_ready":   ready,
+		})
+	}
+	if err := t.routes.safety.checkTransitGatewayRoute(rtbID, rs.Cidr); err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Error("Not managing route")
+		return err
+	}
+	route, err := t.findTransitGatewayRoute(rtbID, rs.Cidr)
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Error on SearchTransitGatewayRoutes")
+		return err
+	}
+	t.routes.fights.observe(rtbID, rs.Cidr, transitGatewayRouteAttachment(route))
+
+	if route == nil {
+		if !healthy {
+			if ready {
+				contextLogger.Info("Healthcheck unhealthy: not creating route")
+			} else {
+				contextLogger.Debug("Healthcheck cannot be healthy yet: not creating route")
+			}
+			return nil
+		}
+		n := notify.Notification{
+			Cidr:        rs.Cidr,
+			RouteTable:  rtbID,
+			NewTarget:   rs.Attachment,
+			Reason:      "no route",
+			Healthcheck: rs.HealthcheckName,
+		}
+		if err := t.routes.allowChange(contextLogger); err != nil {
+			return err
+		}
+		params := &ec2.CreateTransitGatewayRouteInput{
+			TransitGatewayRouteTableId: rtb.TransitGatewayRouteTableId,
+			DestinationCidrBlock:       aws.String(rs.Cidr),
+			TransitGatewayAttachmentId: aws.String(rs.Attachment),
+			DryRun:                     aws.Bool(noop),
+		}
+		contextLogger.Info("Creating route to my attachment")
+		var requestID string
+		_, err := t.conn.CreateTransitGatewayRouteWithContext(aws.BackgroundContext(), params, saveRequestID(&requestID))
+		t.audit("CreateTransitGatewayRoute", noop, n, rs, requestID, err)
+		if err != nil {
+			contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Error creating route")
+			t.routes.notifyFailed(noop, n, err)
+			return err
+		}
+		if !noop {
+			t.routes.fights.took(rtbID, rs.Cidr, rs.Attachment, false)
+		}
+		n.Type = notify.RouteCreated
+		t.routes.notify(noop, n)
+		t.routes.changed(noop, n)
+		return nil
+	}
+
+	attachment := transitGatewayRouteAttachment(route)
+	contextLogger = contextLogger.WithFields(log.Fields{
+		"attachment":  attachment,
+		"route_state": aws.StringValue(route.State),
+	})
+	if attachment == rs.Attachment {
+		if healthy || !ready {
+			contextLogger.Debug("Currently routed to my attachment, doing nothing")
+			return nil
+		}
+		if rs.NeverDelete {
+			contextLogger.Info("Healthcheck unhealthy, but set to never_delete - ignoring")
+			return nil
+		}
+		contextLogger.Info("Healthcheck unhealthy: deleting route")
+		n := notify.Notification{
+			Cidr:           rs.Cidr,
+			RouteTable:     rtbID,
+			PreviousTarget: rs.Attachment,
+			Reason:         "healthcheck unhealthy",
+			Healthcheck:    rs.HealthcheckName,
+		}
+		if err := t.routes.allowChange(contextLogger); err != nil {
+			return err
+		}
+		params := &ec2.DeleteTransitGatewayRouteInput{
+			TransitGatewayRouteTableId: rtb.TransitGatewayRouteTableId,
+			DestinationCidrBlock:       aws.String(rs.Cidr),
+			DryRun:                     aws.Bool(noop),
+		}
+		var requestID string
+		_, err := t.conn.DeleteTransitGatewayRouteWithContext(aws.BackgroundContext(), params, saveRequestID(&requestID))
+		t.audit("DeleteTransitGatewayRoute", noop, n, rs, requestID, err)
+		if err != nil {
+			contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Error deleting route")
+			t.routes.notifyFailed(noop, n, err)
+			return err
+		}
+		n.Type = notify.RouteDeleted
+		t.routes.notify(noop, n)
+		t.routes.changed(noop, n)
+		return nil
+	}
+
+	if !healthy {
+		contextLogger.Debug("Healthcheck unhealthy: not taking route")
+		return nil
+	}
+	active := aws.StringValue(route.State) == "active"
+	reason := "if_unhealthy not set"
+	if !active {
+		reason = "current attachment not active"
+	} else if rs.IfUnhealthy {
+		if t.currentAttachmentHealthy(contextLogger, attachment, rs) {
+			return nil
+		}
+		reason = "current attachment's instance unhealthy"
+	}
+	n := notify.Notification{
+		Cidr:           rs.Cidr,
+		RouteTable:     rtbID,
+		PreviousTarget: attachment,
+		NewTarget:      rs.Attachment,
+		Reason:         reason,
+		Healthcheck:    rs.HealthcheckName,
+	}
+	if err := t.routes.allowChange(contextLogger); err != nil {
+		return err
+	}
+	params := &ec2.ReplaceTransitGatewayRouteInput{
+		TransitGatewayRouteTableId: rtb.TransitGatewayRouteTableId,
+		DestinationCidrBlock:       aws.String(rs.Cidr),
+		TransitGatewayAttachmentId: aws.String(rs.Attachment),
+		DryRun:                     aws.Bool(noop),
+	}
+	contextLogger.WithFields(log.Fields{"reason": reason}).Info("Replacing route to my attachment")
+	var requestID string
+	_, err = t.conn.ReplaceTransitGatewayRouteWithContext(aws.BackgroundContext(), params, saveRequestID(&requestID))
+	t.audit("ReplaceTransitGatewayRoute", noop, n, rs, requestID, err)
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Error replacing route")
+		t.routes.notifyFailed(noop, n, err)
+		return err
+	}
+	if !noop {
+		t.routes.fights.took(rtbID, rs.Cidr, rs.Attachment, active)
+	}
+	n.Type = notify.RouteReplaced
+	t.routes.notify(noop, n)
+	t.routes.changed(noop, n)
+	return nil
+}
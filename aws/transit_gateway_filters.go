@@ -0,0 +1,101 @@
+package aws
+
+import (
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+type TransitGatewayRouteTableFilter interface {
+	Keep(*ec2.TransitGatewayRouteTable) bool
+}
+
+func FilterTransitGatewayRouteTables(f TransitGatewayRouteTableFilter, tables []*ec2.TransitGatewayRouteTable) []*ec2.TransitGatewayRouteTable {
+	out := make([]*ec2.TransitGatewayRouteTable, 0, len(tables))
+	for _, rtb := range tables {
+		if f.Keep(rtb) {
+			out = append(out, rtb)
+		}
+	}
+	return out
+}
+
+type TransitGatewayRouteTableFilterNot struct {
+	Filter TransitGatewayRouteTableFilter
+}
+
+func (fs TransitGatewayRouteTableFilterNot) Keep(rt *ec2.TransitGatewayRouteTable) bool {
+	return !fs.Filter.Keep(rt)
+}
+
+type TransitGatewayRouteTableFilterAnd struct {
+	Filters []TransitGatewayRouteTableFilter
+}
+
+func (fs TransitGatewayRouteTableFilterAnd) Keep(rt *ec2.TransitGatewayRouteTable) bool {
+	for _, f := range fs.Filters {
+		if !f.Keep(rt) {
+			return false
+		}
+	}
+	return true
+}
+
+type TransitGatewayRouteTableFilterOr struct {
+	Filters []TransitGatewayRouteTableFilter
+}
+
+func (fs TransitGatewayRouteTableFilterOr) Keep(rt *ec2.TransitGatewayRouteTable) bool {
+	for _, f := range fs.Filters {
+		if f.Keep(rt) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitGatewayRouteTableFilterTransitGateway keeps the route tables of one
+// transit gateway.
+type TransitGatewayRouteTableFilterTransitGateway struct {
+	TransitGatewayId string
+}
+
+func (fs TransitGatewayRouteTableFilterTransitGateway) Keep(rt *ec2.TransitGatewayRouteTable) bool {
+	return rt.TransitGatewayId != nil && *(rt.TransitGatewayId) == fs.TransitGatewayId
+}
+
+// TransitGatewayRouteTableFilterDefault keeps the route tables which new
+// attachments are associated with by default.
+type TransitGatewayRouteTableFilterDefault struct{}
+
+func (fs TransitGatewayRouteTableFilterDefault) Keep(rt *ec2.TransitGatewayRouteTable) bool {
+	return rt.DefaultAssociationRouteTable != nil && *(rt.DefaultAssociationRouteTable)
+}
+
+type TransitGatewayRouteTableFilterTagMatch struct {
+	Key   string
+	Value string
+}
+
+func (fs TransitGatewayRouteTableFilterTagMatch) Keep(rt *ec2.TransitGatewayRouteTable) bool {
+	for _, t := range rt.Tags {
+		if *(t.Key) == fs.Key && *(t.Value) == fs.Value {
+			return true
+		}
+	}
+	return false
+}
+
+type TransitGatewayRouteTableFilterTagRegexMatch struct {
+	Key    string
+	Regexp *regexp.Regexp
+}
+
+func (fs TransitGatewayRouteTableFilterTagRegexMatch) Keep(rt *ec2.TransitGatewayRouteTable) bool {
+	for _, t := range rt.Tags {
+		if *(t.Key) == fs.Key && fs.Regexp.MatchString(*(t.Value)) {
+			return true
+		}
+	}
+	return false
+}
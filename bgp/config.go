@@ -0,0 +1,86 @@
+package bgp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	DefaultPort     = 179
+	DefaultHoldTime = 90 // Seconds
+)
+
+// Config is how to announce routes over BGP, and who to announce them to.
+type Config struct {
+	LocalAS   uint32     `yaml:"local_as"`
+	RouterID  string     `yaml:"router_id"` // Defaults to the instance's IP address
+	Listen    string     `yaml:"listen"`    // host:port to accept connections from neighbors on, if set
+	HoldTime  uint16     `yaml:"hold_time"` // Seconds
+	NextHop   string     `yaml:"next_hop"`  // Defaults to the local address of each session
+	Neighbors []Neighbor `yaml:"neighbors"`
+}
+
+// Neighbor is a BGP peer, e.g. a VPN or Direct Connect appliance.
+type Neighbor struct {
+	Address  string `yaml:"address"`
+	Port     int    `yaml:"port"`
+	RemoteAS uint32 `yaml:"remote_as"`
+	Passive  bool   `yaml:"passive"` // Only accept connections from this neighbor, never connect to it
+}
+
+func isIPv4(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() != nil
+}
+
+// Validate checks the config, filling in the defaults. routerID is the
+// router ID to use if none is configured.
+func (c *Config) Validate(routerID string) error {
+	var result *multierror.Error
+	if c.LocalAS == 0 {
+		result = multierror.Append(result, errors.New("bgp local_as must be set"))
+	}
+	if c.RouterID == "" {
+		c.RouterID = routerID
+	}
+	if !isIPv4(c.RouterID) {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("bgp router_id '%s' is not an IPv4 address", c.RouterID)))
+	}
+	if c.HoldTime == 0 {
+		c.HoldTime = DefaultHoldTime
+	}
+	if c.HoldTime < 3 {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("bgp hold_time (%d) must be at least 3", c.HoldTime)))
+	}
+	if c.NextHop != "" && !isIPv4(c.NextHop) {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("bgp next_hop '%s' is not an IPv4 address", c.NextHop)))
+	}
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("bgp listen '%s' is not a host:port", c.Listen)))
+		}
+	}
+	if len(c.Neighbors) == 0 {
+		result = multierror.Append(result, errors.New("bgp needs at least one neighbor"))
+	}
+	for i := range c.Neighbors {
+		n := &c.Neighbors[i]
+		if net.ParseIP(n.Address) == nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("bgp neighbor %d address '%s' is not an IP address", i+1, n.Address)))
+			continue
+		}
+		if n.Port == 0 {
+			n.Port = DefaultPort
+		}
+		if n.RemoteAS == 0 {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("bgp neighbor %s remote_as must be set", n.Address)))
+		}
+		if n.Passive && c.Listen == "" {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("bgp neighbor %s is passive, but listen is not set", n.Address)))
+		}
+	}
+	return result.ErrorOrNil()
+}
@@ -0,0 +1,46 @@
+package bgp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidateDefaults(t *testing.T) {
+	c := Config{LocalAS: 65001, Neighbors: []Neighbor{{Address: "10.0.0.2", RemoteAS: 65002}}}
+	if assert.Nil(t, c.Validate("10.0.0.1")) {
+		assert.Equal(t, c.RouterID, "10.0.0.1")
+		assert.Equal(t, c.HoldTime, uint16(DefaultHoldTime))
+		assert.Equal(t, c.Neighbors[0].Port, DefaultPort)
+	}
+}
+
+func TestConfigValidateErrors(t *testing.T) {
+	c := Config{
+		HoldTime: 2,
+		NextHop:  "fe80::1",
+		Neighbors: []Neighbor{
+			{Address: "nonsense", RemoteAS: 65002},
+			{Address: "10.0.0.2", Passive: true},
+		},
+	}
+	err := c.Validate("")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "bgp local_as must be set")
+		assert.Contains(t, err.Error(), "bgp router_id '' is not an IPv4 address")
+		assert.Contains(t, err.Error(), "bgp hold_time (2) must be at least 3")
+		assert.Contains(t, err.Error(), "bgp next_hop 'fe80::1' is not an IPv4 address")
+		assert.Contains(t, err.Error(), "bgp neighbor 1 address 'nonsense' is not an IP address")
+		assert.Contains(t, err.Error(), "bgp neighbor 10.0.0.2 remote_as must be set")
+		assert.Contains(t, err.Error(), "bgp neighbor 10.0.0.2 is passive, but listen is not set")
+	}
+}
+
+func TestConfigValidateNoNeighbors(t *testing.T) {
+	c := Config{LocalAS: 65001, Listen: "nonsense"}
+	err := c.Validate("10.0.0.1")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "bgp listen 'nonsense' is not a host:port")
+		assert.Contains(t, err.Error(), "bgp needs at least one neighbor")
+	}
+}
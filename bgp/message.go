@@ -0,0 +1,322 @@
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// The parts of BGP-4 (RFC 4271) needed to announce IPv4 unicast routes, with
+// 4-octet AS numbers (RFC 6793).
+const (
+	headerLen     = 19
+	maxMessageLen = 4096
+
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+
+	attrOrigin    = 1
+	attrASPath    = 2
+	attrNextHop   = 3
+	attrLocalPref = 5
+
+	flagOptional       = 0x80
+	flagTransitive     = 0x40
+	flagExtendedLength = 0x10
+
+	originIGP        = 0
+	asSequence       = 2
+	asTrans          = 23456 // Sent in place of AS numbers which don't fit in 2 octets
+	defaultLocalPref = 100
+
+	paramCapabilities = 2
+	capMultiprotocol  = 1
+	capFourOctetAS    = 65
+
+	errMessageHeader    = 1
+	errOpenMessage      = 2
+	errUpdateMessage    = 3
+	errHoldTimerExpired = 4
+	errCease            = 6
+
+	errUnsupportedVersion   = 1
+	errBadPeerAS            = 2
+	errBadBGPIdentifier     = 3
+	errUnacceptableHoldTime = 6
+	errMalformedAttributes  = 1
+	errBadMessageLength     = 2
+	errConnectionNotSynced  = 1
+	ceaseAdminShutdown      = 2
+	ceaseCollision          = 7
+)
+
+var marker = bytes.Repeat([]byte{0xff}, 16)
+
+// notification is a BGP NOTIFICATION message, which is also used as the
+// error when a message from a neighbor is bad.
+type notification struct {
+	Code    uint8
+	Subcode uint8
+	Data    []byte
+}
+
+func (n notification) Error() string {
+	return fmt.Sprintf("BGP notification code %d subcode %d", n.Code, n.Subcode)
+}
+
+func (n notification) marshal() []byte {
+	return append([]byte{n.Code, n.Subcode}, n.Data...)
+}
+
+func parseNotification(b []byte) notification {
+	if len(b) < 2 {
+		return notification{}
+	}
+	return notification{Code: b[0], Subcode: b[1], Data: b[2:]}
+}
+
+func writeMessage(w io.Writer, msgType uint8, body []byte) error {
+	if headerLen+len(body) > maxMessageLen {
+		return errors.New(fmt.Sprintf("BGP message of %d bytes is too long", headerLen+len(body)))
+	}
+	msg := make([]byte, 0, headerLen+len(body))
+	msg = append(msg, marker...)
+	msg = append(msg, byte((headerLen+len(body))>>8), byte(headerLen+len(body)), msgType)
+	_, err := w.Write(append(msg, body...))
+	return err
+}
+
+// readMessage reads a message, returning its type and body.
+func readMessage(r io.Reader) (uint8, []byte, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if !bytes.Equal(header[:16], marker) {
+		return 0, nil, notification{Code: errMessageHeader, Subcode: errConnectionNotSynced}
+	}
+	length := int(binary.BigEndian.Uint16(header[16:18]))
+	if length < headerLen || length > maxMessageLen {
+		return 0, nil, notification{Code: errMessageHeader, Subcode: errBadMessageLength, Data: header[16:18]}
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[18], body, nil
+}
+
+type open struct {
+	AS          uint32
+	HoldTime    uint16
+	RouterID    net.IP
+	FourOctetAS bool // If the 4-octet AS number capability was sent
+}
+
+func (o open) marshal() []byte {
+	as := o.AS
+	if as > 0xffff {
+		as = asTrans
+	}
+	b := []byte{4, byte(as >> 8), byte(as), byte(o.HoldTime >> 8), byte(o.HoldTime)}
+	b = append(b, o.RouterID.To4()...)
+	capabilities := []byte{
+		capMultiprotocol, 4, 0, 1, 0, 1, // IPv4 unicast
+		capFourOctetAS, 4, byte(o.AS >> 24), byte(o.AS >> 16), byte(o.AS >> 8), byte(o.AS),
+	}
+	b = append(b, byte(len(capabilities)+2), paramCapabilities, byte(len(capabilities)))
+	return append(b, capabilities...)
+}
+
+func parseOpen(b []byte) (open, error) {
+	bad := notification{Code: errOpenMessage}
+	if len(b) < 10 || len(b) != 10+int(b[9]) {
+		return open{}, notification{Code: errMessageHeader, Subcode: errBadMessageLength}
+	}
+	if b[0] != 4 {
+		bad.Subcode = errUnsupportedVersion
+		bad.Data = []byte{0, 4}
+		return open{}, bad
+	}
+	o := open{
+		AS:       uint32(binary.BigEndian.Uint16(b[1:3])),
+		HoldTime: binary.BigEndian.Uint16(b[3:5]),
+		RouterID: net.IP(append([]byte{}, b[5:9]...)),
+	}
+	params := b[10:]
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			return open{}, notification{Code: errOpenMessage}
+		}
+		if paramType == paramCapabilities {
+			capabilities := params[2 : 2+paramLen]
+			for len(capabilities) >= 2 {
+				code, capLen := capabilities[0], int(capabilities[1])
+				if len(capabilities) < 2+capLen {
+					return open{}, notification{Code: errOpenMessage}
+				}
+				if code == capFourOctetAS && capLen == 4 {
+					o.FourOctetAS = true
+					o.AS = binary.BigEndian.Uint32(capabilities[2:6])
+				}
+				capabilities = capabilities[2+capLen:]
+			}
+		}
+		params = params[2+paramLen:]
+	}
+	return o, nil
+}
+
+type update struct {
+	Withdrawn []*net.IPNet
+	NLRI      []*net.IPNet
+	NextHop   net.IP
+	ASPath    []uint32
+	LocalPref bool // Send LOCAL_PREF, as is needed for internal neighbors
+}
+
+func appendPrefix(b []byte, n *net.IPNet) []byte {
+	ones, _ := n.Mask.Size()
+	return append(append(b, byte(ones)), n.IP.To4()[:(ones+7)/8]...)
+}
+
+func parsePrefixes(b []byte) ([]*net.IPNet, error) {
+	prefixes := make([]*net.IPNet, 0)
+	for len(b) > 0 {
+		ones := int(b[0])
+		size := (ones + 7) / 8
+		if ones > 32 || len(b) < 1+size {
+			return nil, notification{Code: errUpdateMessage, Subcode: errMalformedAttributes}
+		}
+		ip := make(net.IP, 4)
+		copy(ip, b[1:1+size])
+		prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)})
+		b = b[1+size:]
+	}
+	return prefixes, nil
+}
+
+func appendAttribute(b []byte, flags uint8, attrType uint8, value []byte) []byte {
+	if len(value) > 0xff {
+		return append(append(b, flags|flagExtendedLength, attrType, byte(len(value)>>8), byte(len(value))), value...)
+	}
+	return append(append(b, flags, attrType, byte(len(value))), value...)
+}
+
+func (u update) marshal(fourOctetAS bool) []byte {
+	withdrawn := make([]byte, 0)
+	for _, n := range u.Withdrawn {
+		withdrawn = appendPrefix(withdrawn, n)
+	}
+	attrs := make([]byte, 0)
+	nlri := make([]byte, 0)
+	if len(u.NLRI) > 0 {
+		attrs = appendAttribute(attrs, flagTransitive, attrOrigin, []byte{originIGP})
+		path := make([]byte, 0)
+		if len(u.ASPath) > 0 {
+			path = append(path, asSequence, byte(len(u.ASPath)))
+			for _, as := range u.ASPath {
+				if fourOctetAS {
+					path = append(path, byte(as>>24), byte(as>>16), byte(as>>8), byte(as))
+				} else {
+					if as > 0xffff {
+						as = asTrans
+					}
+					path = append(path, byte(as>>8), byte(as))
+				}
+			}
+		}
+		attrs = appendAttribute(attrs, flagTransitive, attrASPath, path)
+		attrs = appendAttribute(attrs, flagTransitive, attrNextHop, u.NextHop.To4())
+		if u.LocalPref {
+			attrs = appendAttribute(attrs, flagTransitive, attrLocalPref, []byte{0, 0, 0, defaultLocalPref})
+		}
+		for _, n := range u.NLRI {
+			nlri = appendPrefix(nlri, n)
+		}
+	}
+	b := []byte{byte(len(withdrawn) >> 8), byte(len(withdrawn))}
+	b = append(b, withdrawn...)
+	b = append(b, byte(len(attrs)>>8), byte(len(attrs)))
+	b = append(b, attrs...)
+	return append(b, nlri...)
+}
+
+func parseUpdate(b []byte, fourOctetAS bool) (update, error) {
+	malformed := notification{Code: errUpdateMessage, Subcode: errMalformedAttributes}
+	var u update
+	if len(b) < 4 {
+		return u, malformed
+	}
+	withdrawnLen := int(binary.BigEndian.Uint16(b[0:2]))
+	if len(b) < 4+withdrawnLen {
+		return u, malformed
+	}
+	var err error
+	if u.Withdrawn, err = parsePrefixes(b[2 : 2+withdrawnLen]); err != nil {
+		return u, err
+	}
+	b = b[2+withdrawnLen:]
+	attrsLen := int(binary.BigEndian.Uint16(b[0:2]))
+	if len(b) < 2+attrsLen {
+		return u, malformed
+	}
+	attrs := b[2 : 2+attrsLen]
+	for len(attrs) > 0 {
+		if len(attrs) < 3 {
+			return u, malformed
+		}
+		flags, attrType := attrs[0], attrs[1]
+		valueLen, start := int(attrs[2]), 3
+		if flags&flagExtendedLength != 0 {
+			if len(attrs) < 4 {
+				return u, malformed
+			}
+			valueLen, start = int(binary.BigEndian.Uint16(attrs[2:4])), 4
+		}
+		if len(attrs) < start+valueLen {
+			return u, malformed
+		}
+		value := attrs[start : start+valueLen]
+		switch attrType {
+		case attrNextHop:
+			if len(value) != 4 {
+				return u, malformed
+			}
+			u.NextHop = net.IP(append([]byte{}, value...))
+		case attrASPath:
+			asLen := 2
+			if fourOctetAS {
+				asLen = 4
+			}
+			for len(value) >= 2 {
+				count := int(value[1])
+				if len(value) < 2+count*asLen {
+					return u, malformed
+				}
+				for i := 0; i < count; i++ {
+					as := value[2+i*asLen : 2+(i+1)*asLen]
+					if fourOctetAS {
+						u.ASPath = append(u.ASPath, binary.BigEndian.Uint32(as))
+					} else {
+						u.ASPath = append(u.ASPath, uint32(binary.BigEndian.Uint16(as)))
+					}
+				}
+				value = value[2+count*asLen:]
+			}
+		case attrLocalPref:
+			u.LocalPref = true
+		}
+		attrs = attrs[start+valueLen:]
+	}
+	if u.NLRI, err = parsePrefixes(b[2+attrsLen:]); err != nil {
+		return u, err
+	}
+	return u, nil
+}
@@ -0,0 +1,119 @@
+package bgp
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, msgKeepalive, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, buf.Len(), headerLen)
+	msgType, body, err := readMessage(&buf)
+	if assert.Nil(t, err) {
+		assert.Equal(t, msgType, uint8(msgKeepalive))
+		assert.Equal(t, len(body), 0)
+	}
+}
+
+func TestMessageBadMarker(t *testing.T) {
+	b := make([]byte, headerLen)
+	b[16], b[17], b[18] = 0, headerLen, msgKeepalive
+	_, _, err := readMessage(bytes.NewReader(b))
+	assert.Equal(t, err, notification{Code: errMessageHeader, Subcode: errConnectionNotSynced})
+}
+
+func TestMessageBadLength(t *testing.T) {
+	b := append(append([]byte{}, marker...), 0xff, 0xff, msgUpdate)
+	_, _, err := readMessage(bytes.NewReader(b))
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.(notification).Subcode, uint8(errBadMessageLength))
+	}
+}
+
+func TestOpenRoundTrip(t *testing.T) {
+	o, err := parseOpen(open{AS: 65001, HoldTime: 90, RouterID: net.ParseIP("10.0.0.1")}.marshal())
+	if assert.Nil(t, err) {
+		assert.Equal(t, o.AS, uint32(65001))
+		assert.Equal(t, o.HoldTime, uint16(90))
+		assert.Equal(t, o.RouterID.String(), "10.0.0.1")
+		assert.Equal(t, o.FourOctetAS, true)
+	}
+}
+
+func TestOpenFourOctetAS(t *testing.T) {
+	b := open{AS: 4200000000, HoldTime: 90, RouterID: net.ParseIP("10.0.0.1")}.marshal()
+	assert.Equal(t, int(b[1])<<8|int(b[2]), asTrans)
+	o, err := parseOpen(b)
+	if assert.Nil(t, err) {
+		assert.Equal(t, o.AS, uint32(4200000000))
+	}
+}
+
+func TestOpenBadVersion(t *testing.T) {
+	b := open{AS: 65001, HoldTime: 90, RouterID: net.ParseIP("10.0.0.1")}.marshal()
+	b[0] = 3
+	_, err := parseOpen(b)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.(notification).Subcode, uint8(errUnsupportedVersion))
+	}
+}
+
+func TestUpdateRoundTrip(t *testing.T) {
+	for _, fourOctetAS := range []bool{true, false} {
+		u := update{
+			Withdrawn: []*net.IPNet{mustCIDR("10.1.0.0/16")},
+			NLRI:      []*net.IPNet{mustCIDR("0.0.0.0/0"), mustCIDR("192.168.1.1/32"), mustCIDR("172.16.0.0/12")},
+			NextHop:   net.ParseIP("10.0.0.1"),
+			ASPath:    []uint32{65001},
+		}
+		parsed, err := parseUpdate(u.marshal(fourOctetAS), fourOctetAS)
+		if assert.Nil(t, err) {
+			assert.Equal(t, prefixStrings(parsed.Withdrawn), []string{"10.1.0.0/16"})
+			assert.Equal(t, prefixStrings(parsed.NLRI), []string{"0.0.0.0/0", "172.16.0.0/12", "192.168.1.1/32"})
+			assert.Equal(t, parsed.NextHop.String(), "10.0.0.1")
+			assert.Equal(t, parsed.ASPath, []uint32{65001})
+			assert.Equal(t, parsed.LocalPref, false)
+		}
+	}
+}
+
+func TestUpdateWithdrawOnly(t *testing.T) {
+	u := update{Withdrawn: []*net.IPNet{mustCIDR("10.1.0.0/16")}}
+	b := u.marshal(true)
+	assert.Equal(t, b, []byte{0, 3, 16, 10, 1, 0, 0})
+	parsed, err := parseUpdate(b, true)
+	if assert.Nil(t, err) {
+		assert.Equal(t, len(parsed.NLRI), 0)
+		assert.Nil(t, parsed.NextHop)
+	}
+}
+
+func TestUpdateInternal(t *testing.T) {
+	u := update{NLRI: []*net.IPNet{mustCIDR("10.1.0.0/16")}, NextHop: net.ParseIP("10.0.0.1"), LocalPref: true}
+	parsed, err := parseUpdate(u.marshal(true), true)
+	if assert.Nil(t, err) {
+		assert.Equal(t, len(parsed.ASPath), 0)
+		assert.Equal(t, parsed.LocalPref, true)
+	}
+}
+
+func TestUpdateMalformed(t *testing.T) {
+	u := update{NLRI: []*net.IPNet{mustCIDR("10.1.0.0/16")}, NextHop: net.ParseIP("10.0.0.1")}
+	b := u.marshal(true)
+	_, err := parseUpdate(b[:len(b)-1], true)
+	assert.Equal(t, err, notification{Code: errUpdateMessage, Subcode: errMalformedAttributes})
+}
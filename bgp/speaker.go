@@ -0,0 +1,597 @@
+package bgp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// How long to wait between attempts to connect to a neighbor
+	connectRetry = 5 * time.Second
+	// How long to wait for a neighbor to open a session
+	openTimeout  = 4 * time.Minute
+	writeTimeout = 10 * time.Second
+)
+
+// The most prefixes sent in one UPDATE, keeping it well under the maximum
+// message length.
+const maxPrefixesPerUpdate = 500
+
+// Speaker is a minimal BGP speaker, which announces routes to its
+// neighbors, and records the routes they announce to it. It only speaks IPv4
+// unicast, and does not pass on routes it learns.
+type Speaker struct {
+	config   Config
+	lock     sync.Mutex
+	routes   map[string]*net.IPNet        // What is announced, by cidr
+	sessions map[string]*session          // Established sessions, by neighbor address
+	received map[string]map[string]net.IP // Next hops announced by each neighbor, by cidr
+	conns    map[net.Conn]bool            // Every open connection, so they can be closed
+	listener net.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+type session struct {
+	neighbor    Neighbor
+	conn        net.Conn
+	outgoing    bool       // If this speaker opened the connection
+	lock        sync.Mutex // Held whilst writing
+	fourOctetAS bool
+	routerID    net.IP // The neighbor's
+	nextHop     net.IP
+	logger      *log.Entry
+	// Signalled when the routes announced change, so that the session's
+	// writer sends UPDATEs without holding up the speaker
+	updates chan struct{}
+	sent    map[string]*net.IPNet // What the writer has announced, by cidr
+}
+
+func newSession(n Neighbor, conn net.Conn, outgoing bool) *session {
+	return &session{
+		neighbor: n,
+		conn:     conn,
+		outgoing: outgoing,
+		logger: log.WithFields(log.Fields{
+			"neighbor":  n.Address,
+			"remote_as": n.RemoteAS,
+		}),
+		updates: make(chan struct{}, 1),
+		sent:    make(map[string]*net.IPNet),
+	}
+}
+
+// NewSpeaker makes a speaker with a valid config. Nothing is announced
+// until it is started and routes are set.
+func NewSpeaker(c Config) *Speaker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Speaker{
+		config:   c,
+		routes:   make(map[string]*net.IPNet),
+		sessions: make(map[string]*session),
+		received: make(map[string]map[string]net.IP),
+		conns:    make(map[net.Conn]bool),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Config returns the config the speaker was made with.
+func (s *Speaker) Config() Config {
+	return s.config
+}
+
+// Start listens for connections from neighbors, if configured to, and starts
+// connecting to every neighbor which isn't passive.
+func (s *Speaker) Start() error {
+	if s.config.Listen != "" {
+		l, err := net.Listen("tcp", s.config.Listen)
+		if err != nil {
+			return err
+		}
+		s.listener = l
+		s.wg.Add(1)
+		go s.accept()
+	}
+	for _, n := range s.config.Neighbors {
+		if !n.Passive {
+			s.wg.Add(1)
+			go s.connect(n)
+		}
+	}
+	return nil
+}
+
+// Addr returns the address the speaker is listening on, if it is.
+func (s *Speaker) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Stop closes every session, telling the neighbors that it is being shut
+// down so that they withdraw the routes straight away.
+func (s *Speaker) Stop() {
+	s.cancel()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.lock.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.lock.Unlock()
+	for _, sess := range sessions {
+		sess.notify(notification{Code: errCease, Subcode: ceaseAdminShutdown})
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	s.wg.Wait()
+}
+
+// SetRoutes changes the routes announced to every neighbor to cidrs,
+// withdrawing any which were announced before and are not in cidrs.
+func (s *Speaker) SetRoutes(cidrs []string) error {
+	routes := make(map[string]*net.IPNet)
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		if n.IP.To4() == nil {
+			continue
+		}
+		routes[n.String()] = n
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	announced := make([]*net.IPNet, 0)
+	withdrawn := make([]*net.IPNet, 0)
+	for cidr, n := range routes {
+		if _, ok := s.routes[cidr]; !ok {
+			announced = append(announced, n)
+		}
+	}
+	for cidr, n := range s.routes {
+		if _, ok := routes[cidr]; !ok {
+			withdrawn = append(withdrawn, n)
+		}
+	}
+	if len(announced) == 0 && len(withdrawn) == 0 {
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"announced": prefixStrings(announced),
+		"withdrawn": prefixStrings(withdrawn),
+	}).Info("Changing routes announced over BGP")
+	s.routes = routes
+	for _, sess := range s.sessions {
+		sess.queueUpdate()
+	}
+	return nil
+}
+
+// Routes returns the cidrs being announced.
+func (s *Speaker) Routes() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cidrs := make([]string, 0, len(s.routes))
+	for cidr := range s.routes {
+		cidrs = append(cidrs, cidr)
+	}
+	sort.Strings(cidrs)
+	return cidrs
+}
+
+// Established returns the addresses of the neighbors with established
+// sessions.
+func (s *Speaker) Established() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	addresses := make([]string, 0, len(s.sessions))
+	for address := range s.sessions {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// Received returns the routes announced by neighbors, as the next hop for
+// each cidr.
+func (s *Speaker) Received() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	routes := make(map[string]string)
+	for _, received := range s.received {
+		for cidr, nextHop := range received {
+			routes[cidr] = nextHop.String()
+		}
+	}
+	return routes
+}
+
+func prefixStrings(prefixes []*net.IPNet) []string {
+	s := make([]string, 0, len(prefixes))
+	for _, n := range prefixes {
+		s = append(s, n.String())
+	}
+	sort.Strings(s)
+	return s
+}
+
+func (s *Speaker) neighborFor(ip net.IP) (Neighbor, bool) {
+	for _, n := range s.config.Neighbors {
+		if net.ParseIP(n.Address).Equal(ip) {
+			return n, true
+		}
+	}
+	return Neighbor{}, false
+}
+
+func (s *Speaker) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.ctx.Done():
+				return
+			default:
+			}
+			log.WithFields(log.Fields{"err": err.Error()}).Warn("Error accepting BGP connection")
+			continue
+		}
+		n, ok := s.neighborFor(conn.RemoteAddr().(*net.TCPAddr).IP)
+		if !ok {
+			log.WithFields(log.Fields{"remote": conn.RemoteAddr().String()}).Warn("Refusing BGP connection from unknown neighbor")
+			conn.Close()
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.run(n, conn, false)
+		}()
+	}
+}
+
+// connect keeps a session to a neighbor open, reconnecting whenever it is
+// closed, until the speaker is stopped.
+func (s *Speaker) connect(n Neighbor) {
+	defer s.wg.Done()
+	address := net.JoinHostPort(n.Address, strconv.Itoa(n.Port))
+	dialer := net.Dialer{Timeout: connectRetry}
+	for {
+		s.lock.Lock()
+		_, established := s.sessions[n.Address]
+		s.lock.Unlock()
+		if !established {
+			conn, err := dialer.DialContext(s.ctx, "tcp", address)
+			if err == nil {
+				s.run(n, conn, true)
+			} else if s.ctx.Err() == nil {
+				log.WithFields(log.Fields{"neighbor": n.Address, "err": err.Error()}).Debug("Error connecting to BGP neighbor")
+			}
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(connectRetry):
+		}
+	}
+}
+
+func (s *Speaker) track(conn net.Conn, open bool) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if open {
+		if s.ctx.Err() != nil {
+			return false
+		}
+		s.conns[conn] = true
+	} else {
+		delete(s.conns, conn)
+	}
+	return true
+}
+
+// run opens a session on a connection to a neighbor, and then handles the
+// messages it sends until the session is closed.
+func (s *Speaker) run(n Neighbor, conn net.Conn, outgoing bool) {
+	defer conn.Close()
+	if !s.track(conn, true) {
+		return
+	}
+	defer s.track(conn, false)
+	sess := newSession(n, conn, outgoing)
+	sess.nextHop = net.ParseIP(s.config.NextHop)
+	if sess.nextHop == nil {
+		sess.nextHop = conn.LocalAddr().(*net.TCPAddr).IP
+	}
+	holdTime, err := s.open(sess)
+	if err != nil {
+		sess.logger.WithFields(log.Fields{"err": err.Error()}).Warn("Error opening BGP session")
+		if notify, ok := err.(notification); ok {
+			sess.notify(notify)
+		}
+		return
+	}
+	if !s.established(sess) {
+		return
+	}
+	defer s.closed(sess)
+	sess.logger.WithFields(log.Fields{"hold_time": holdTime}).Info("BGP session established")
+
+	// A hold time of 0 means that neither side sends keepalives, or expects
+	// to receive them.
+	conn.SetReadDeadline(time.Time{})
+	done := make(chan struct{})
+	defer close(done)
+	go s.sendUpdates(sess, done)
+	if holdTime > 0 {
+		go sess.keepalive(holdTime/3, done)
+	}
+	for {
+		if holdTime > 0 {
+			conn.SetReadDeadline(time.Now().Add(holdTime))
+		}
+		msgType, body, err := readMessage(conn)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				err = notification{Code: errHoldTimerExpired}
+			}
+			if notify, ok := err.(notification); ok {
+				sess.notify(notify)
+			}
+			if s.ctx.Err() == nil {
+				sess.logger.WithFields(log.Fields{"err": err.Error()}).Warn("BGP session closed")
+			}
+			return
+		}
+		switch msgType {
+		case msgUpdate:
+			u, err := parseUpdate(body, sess.fourOctetAS)
+			if err != nil {
+				sess.logger.WithFields(log.Fields{"err": err.Error()}).Warn("Bad BGP update, closing session")
+				sess.notify(err.(notification))
+				return
+			}
+			s.updateReceived(sess, u)
+		case msgNotification:
+			sess.logger.WithFields(log.Fields{"err": parseNotification(body).Error()}).Warn("BGP neighbor closed session")
+			return
+		}
+	}
+}
+
+// open exchanges OPEN and KEEPALIVE messages with a neighbor, returning the
+// negotiated hold time.
+func (s *Speaker) open(sess *session) (time.Duration, error) {
+	err := sess.write(msgOpen, open{
+		AS:       s.config.LocalAS,
+		HoldTime: s.config.HoldTime,
+		RouterID: net.ParseIP(s.config.RouterID),
+	}.marshal())
+	if err != nil {
+		return 0, err
+	}
+	sess.conn.SetReadDeadline(time.Now().Add(openTimeout))
+	msgType, body, err := readMessage(sess.conn)
+	if err != nil {
+		return 0, err
+	}
+	if msgType != msgOpen {
+		return 0, notification{Code: errOpenMessage}
+	}
+	o, err := parseOpen(body)
+	if err != nil {
+		return 0, err
+	}
+	if o.AS != sess.neighbor.RemoteAS {
+		return 0, notification{Code: errOpenMessage, Subcode: errBadPeerAS}
+	}
+	if o.RouterID.Equal(net.ParseIP(s.config.RouterID)) {
+		return 0, notification{Code: errOpenMessage, Subcode: errBadBGPIdentifier}
+	}
+	if o.HoldTime == 1 || o.HoldTime == 2 {
+		return 0, notification{Code: errOpenMessage, Subcode: errUnacceptableHoldTime}
+	}
+	sess.fourOctetAS = o.FourOctetAS
+	sess.routerID = o.RouterID
+	holdTime := s.config.HoldTime
+	if o.HoldTime < holdTime {
+		holdTime = o.HoldTime
+	}
+	if err := sess.write(msgKeepalive, nil); err != nil {
+		return 0, err
+	}
+	msgType, body, err = readMessage(sess.conn)
+	if err != nil {
+		return 0, err
+	}
+	if msgType == msgNotification {
+		return 0, parseNotification(body)
+	}
+	if msgType != msgKeepalive {
+		return 0, notification{Code: errOpenMessage}
+	}
+	return time.Duration(holdTime) * time.Second, nil
+}
+
+// established records a session as established, and queues announcing all
+// of the routes to it. If there is already a session with the neighbor
+// (because both sides connected at once), the collision is resolved as in
+// RFC 4271 section 6.8: the session on the connection opened by the speaker
+// with the higher router ID is kept, and the other is closed.
+func (s *Speaker) established(sess *session) bool {
+	s.lock.Lock()
+	existing, ok := s.sessions[sess.neighbor.Address]
+	if ok && (existing.outgoing == sess.outgoing || sess.outgoing != s.keepsOutgoing(sess.routerID)) {
+		s.lock.Unlock()
+		sess.notify(notification{Code: errCease, Subcode: ceaseCollision})
+		return false
+	}
+	s.sessions[sess.neighbor.Address] = sess
+	s.lock.Unlock()
+	if ok {
+		existing.logger.Info("Closing BGP session, as the neighbor connected at the same time")
+		existing.notify(notification{Code: errCease, Subcode: ceaseCollision})
+		existing.conn.Close()
+	}
+	sess.queueUpdate()
+	return true
+}
+
+// announcing returns the routes being announced, by cidr.
+func (s *Speaker) announcing() map[string]*net.IPNet {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	routes := make(map[string]*net.IPNet, len(s.routes))
+	for cidr, n := range s.routes {
+		routes[cidr] = n
+	}
+	return routes
+}
+
+// sendUpdates is a session's writer. Each time the routes change, it sends
+// UPDATEs for the difference between them and what it last sent, until done
+// is closed. A neighbor which is slow to read only holds up its own session.
+// If sending fails, the session is closed.
+func (s *Speaker) sendUpdates(sess *session, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-sess.updates:
+		}
+		routes := s.announcing()
+		announced := make([]*net.IPNet, 0)
+		withdrawn := make([]*net.IPNet, 0)
+		for cidr, n := range routes {
+			if _, ok := sess.sent[cidr]; !ok {
+				announced = append(announced, n)
+			}
+		}
+		for cidr, n := range sess.sent {
+			if _, ok := routes[cidr]; !ok {
+				withdrawn = append(withdrawn, n)
+			}
+		}
+		if err := sess.sendRoutes(s.config, announced, withdrawn); err != nil {
+			sess.logger.WithFields(log.Fields{"err": err.Error()}).Warn("Error sending BGP update")
+			sess.conn.Close()
+			return
+		}
+		sess.sent = routes
+	}
+}
+
+// keepsOutgoing is if, when both this speaker and a neighbor with routerID
+// connect to each other at once, the connection this speaker opened is
+// kept.
+func (s *Speaker) keepsOutgoing(routerID net.IP) bool {
+	return bytes.Compare(net.ParseIP(s.config.RouterID).To4(), routerID.To4()) > 0
+}
+
+func (s *Speaker) closed(sess *session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sessions[sess.neighbor.Address] == sess {
+		delete(s.sessions, sess.neighbor.Address)
+		delete(s.received, sess.neighbor.Address)
+	}
+}
+
+func (s *Speaker) updateReceived(sess *session, u update) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	address := sess.neighbor.Address
+	if s.sessions[address] != sess {
+		return
+	}
+	received, ok := s.received[address]
+	if !ok {
+		received = make(map[string]net.IP)
+		s.received[address] = received
+	}
+	for _, n := range u.Withdrawn {
+		delete(received, n.String())
+	}
+	for _, n := range u.NLRI {
+		received[n.String()] = u.NextHop
+	}
+}
+
+// queueUpdate tells the session's writer that the routes have changed. It
+// never blocks, as a change which is already queued covers this one too.
+func (sess *session) queueUpdate() {
+	select {
+	case sess.updates <- struct{}{}:
+	default:
+	}
+}
+
+func (sess *session) write(msgType uint8, body []byte) error {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	sess.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeMessage(sess.conn, msgType, body)
+}
+
+func (sess *session) notify(n notification) {
+	sess.write(msgNotification, n.marshal())
+}
+
+func (sess *session) keepalive(every time.Duration, done chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := sess.write(msgKeepalive, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// sendRoutes sends UPDATEs announcing and withdrawing routes.
+func (sess *session) sendRoutes(c Config, announced []*net.IPNet, withdrawn []*net.IPNet) error {
+	internal := sess.neighbor.RemoteAS == c.LocalAS
+	for len(announced) > 0 || len(withdrawn) > 0 {
+		u := update{NextHop: sess.nextHop, LocalPref: internal}
+		if !internal {
+			u.ASPath = []uint32{c.LocalAS}
+		}
+		u.Withdrawn, withdrawn = split(withdrawn)
+		u.NLRI, announced = split(announced)
+		if err := sess.write(msgUpdate, u.marshal(sess.fourOctetAS)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func split(prefixes []*net.IPNet) ([]*net.IPNet, []*net.IPNet) {
+	if len(prefixes) > maxPrefixesPerUpdate {
+		return prefixes[:maxPrefixesPerUpdate], prefixes[maxPrefixesPerUpdate:]
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,289 @@
+package bgp
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	connectRetry = 100 * time.Millisecond
+}
+
+// startPair starts two speakers on loopback; a listens and b connects to it.
+func startPair(t *testing.T, aAS uint32, bAS uint32, bRemoteAS uint32) (*Speaker, *Speaker) {
+	ac := Config{
+		LocalAS:   aAS,
+		RouterID:  "10.0.0.1",
+		Listen:    "127.0.0.1:0",
+		Neighbors: []Neighbor{{Address: "127.0.0.1", RemoteAS: bAS, Passive: true}},
+	}
+	if err := ac.Validate(""); err != nil {
+		t.Fatal(err)
+	}
+	a := NewSpeaker(ac)
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	bc := Config{
+		LocalAS:   bAS,
+		RouterID:  "10.0.0.2",
+		NextHop:   "10.0.0.2",
+		Neighbors: []Neighbor{{Address: "127.0.0.1", Port: a.Addr().(*net.TCPAddr).Port, RemoteAS: bRemoteAS}},
+	}
+	if err := bc.Validate(""); err != nil {
+		t.Fatal(err)
+	}
+	b := NewSpeaker(bc)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func established(s *Speaker) func() bool {
+	return func() bool {
+		return len(s.Established()) == 1
+	}
+}
+
+func TestSpeakerAnnounceAndWithdraw(t *testing.T) {
+	a, b := startPair(t, 65001, 65002, 65001)
+	defer b.Stop()
+	assert.Nil(t, b.SetRoutes([]string{"0.0.0.0/0", "192.168.1.0/24"}))
+	assert.Eventually(t, established(a), 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, established(b), 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return len(a.Received()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, a.Received(), map[string]string{"0.0.0.0/0": "10.0.0.2", "192.168.1.0/24": "10.0.0.2"})
+
+	// a didn't set a next hop, so announces the address it is connected on
+	assert.Nil(t, a.SetRoutes([]string{"10.1.0.0/16"}))
+	assert.Eventually(t, func() bool { return len(b.Received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, b.Received(), map[string]string{"10.1.0.0/16": "127.0.0.1"})
+
+	assert.Nil(t, b.SetRoutes([]string{"192.168.1.0/24"}))
+	assert.Eventually(t, func() bool { return len(a.Received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, a.Received(), map[string]string{"192.168.1.0/24": "10.0.0.2"})
+	assert.Equal(t, b.Routes(), []string{"192.168.1.0/24"})
+
+	a.Stop()
+	assert.Eventually(t, func() bool { return len(b.Established()) == 0 && len(b.Received()) == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSpeakerInternal(t *testing.T) {
+	a, b := startPair(t, 65001, 65001, 65001)
+	defer a.Stop()
+	defer b.Stop()
+	assert.Nil(t, b.SetRoutes([]string{"192.168.1.0/24"}))
+	assert.Eventually(t, func() bool { return len(a.Received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSpeakerBadPeerAS(t *testing.T) {
+	a, b := startPair(t, 65001, 65002, 65003)
+	defer a.Stop()
+	defer b.Stop()
+	assert.Nil(t, b.SetRoutes([]string{"192.168.1.0/24"}))
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, len(a.Established()), 0)
+	assert.Equal(t, len(b.Established()), 0)
+	assert.Equal(t, len(a.Received()), 0)
+}
+
+func TestSpeakerRefusesUnknownNeighbor(t *testing.T) {
+	c := Config{
+		LocalAS:   65001,
+		RouterID:  "10.0.0.1",
+		Listen:    "127.0.0.1:0",
+		Neighbors: []Neighbor{{Address: "10.0.0.2", RemoteAS: 65002, Passive: true}},
+	}
+	if err := c.Validate(""); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSpeaker(c)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(s.Addr().(*net.TCPAddr).Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = readMessage(conn)
+	assert.NotNil(t, err)
+}
+
+func TestSetRoutesBadCidr(t *testing.T) {
+	s := NewSpeaker(Config{})
+	assert.NotNil(t, s.SetRoutes([]string{"nonsense"}))
+}
+
+// freePort returns a port on loopback which nothing is listening on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestSpeakerBothActive(t *testing.T) {
+	aPort, bPort := freePort(t), freePort(t)
+	ac := Config{
+		LocalAS:   65001,
+		RouterID:  "10.0.0.2",
+		Listen:    net.JoinHostPort("127.0.0.1", strconv.Itoa(aPort)),
+		Neighbors: []Neighbor{{Address: "127.0.0.1", Port: bPort, RemoteAS: 65002}},
+	}
+	bc := Config{
+		LocalAS:   65002,
+		RouterID:  "10.0.0.1",
+		Listen:    net.JoinHostPort("127.0.0.1", strconv.Itoa(bPort)),
+		Neighbors: []Neighbor{{Address: "127.0.0.1", Port: aPort, RemoteAS: 65001}},
+	}
+	assert.Nil(t, ac.Validate(""))
+	assert.Nil(t, bc.Validate(""))
+	a, b := NewSpeaker(ac), NewSpeaker(bc)
+	assert.Nil(t, a.Start())
+	defer a.Stop()
+	assert.Nil(t, b.Start())
+	defer b.Stop()
+	assert.Nil(t, b.SetRoutes([]string{"192.168.1.0/24"}))
+	assert.Eventually(t, established(a), 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, established(b), 5*time.Second, 10*time.Millisecond)
+
+	// Once settled, the same session is kept on both sides
+	time.Sleep(3 * connectRetry)
+	a.lock.Lock()
+	aSess := a.sessions["127.0.0.1"]
+	a.lock.Unlock()
+	b.lock.Lock()
+	bSess := b.sessions["127.0.0.1"]
+	b.lock.Unlock()
+	if assert.NotNil(t, aSess) && assert.NotNil(t, bSess) {
+		assert.NotEqual(t, aSess.outgoing, bSess.outgoing, "Both speakers should be using the same connection")
+	}
+	time.Sleep(10 * connectRetry)
+	a.lock.Lock()
+	assert.True(t, a.sessions["127.0.0.1"] == aSess, "Session on a was replaced")
+	a.lock.Unlock()
+	b.lock.Lock()
+	assert.True(t, b.sessions["127.0.0.1"] == bSess, "Session on b was replaced")
+	b.lock.Unlock()
+	assert.Equal(t, a.Received(), map[string]string{"192.168.1.0/24": "127.0.0.1"})
+}
+
+// pipeSession is a session on one end of a pipe, the other end of which is
+// read and discarded.
+func pipeSession(address string, outgoing bool, routerID string) *session {
+	local, remote := net.Pipe()
+	go io.Copy(ioutil.Discard, remote)
+	sess := newSession(Neighbor{Address: address}, local, outgoing)
+	sess.routerID = net.ParseIP(routerID)
+	return sess
+}
+
+func TestSpeakerCollision(t *testing.T) {
+	// With the higher router ID, the connection this speaker opened is kept
+	s := NewSpeaker(Config{RouterID: "10.0.0.2"})
+	incoming := pipeSession("10.1.1.1", false, "10.0.0.1")
+	assert.Equal(t, s.established(incoming), true)
+	outgoing := pipeSession("10.1.1.1", true, "10.0.0.1")
+	assert.Equal(t, s.established(outgoing), true)
+	assert.True(t, s.sessions["10.1.1.1"] == outgoing)
+	s.closed(incoming)
+	assert.Equal(t, s.Established(), []string{"10.1.1.1"})
+	assert.Equal(t, s.established(pipeSession("10.1.1.1", false, "10.0.0.1")), false)
+	assert.True(t, s.sessions["10.1.1.1"] == outgoing)
+
+	// With the lower router ID, the connection the neighbor opened is kept
+	s = NewSpeaker(Config{RouterID: "10.0.0.1"})
+	outgoing = pipeSession("10.1.1.2", true, "10.0.0.2")
+	assert.Equal(t, s.established(outgoing), true)
+	incoming = pipeSession("10.1.1.2", false, "10.0.0.2")
+	assert.Equal(t, s.established(incoming), true)
+	assert.True(t, s.sessions["10.1.1.2"] == incoming)
+	assert.Equal(t, s.established(pipeSession("10.1.1.2", true, "10.0.0.2")), false)
+}
+
+func TestSpeakerStalledNeighbor(t *testing.T) {
+	s := NewSpeaker(Config{LocalAS: 65001, RouterID: "10.0.0.1"})
+	// Nothing reads from the other end of the stalled session's pipe, so
+	// writes to it block
+	local, remote := net.Pipe()
+	defer remote.Close()
+	stalled := newSession(Neighbor{Address: "10.1.1.1", RemoteAS: 65002}, local, true)
+	other := pipeSession("10.1.1.2", true, "10.0.0.2")
+	done := make(chan struct{})
+	defer close(done)
+	for _, sess := range []*session{stalled, other} {
+		sess.nextHop = net.ParseIP("10.0.0.1")
+		assert.Equal(t, s.established(sess), true)
+		go s.sendUpdates(sess, done)
+	}
+
+	set := make(chan error, 1)
+	go func() { set <- s.SetRoutes([]string{"192.168.1.0/24"}) }()
+	select {
+	case err := <-set:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("SetRoutes was held up by a stalled neighbor")
+	}
+	assert.Equal(t, s.Routes(), []string{"192.168.1.0/24"})
+	assert.Equal(t, s.Established(), []string{"10.1.1.1", "10.1.1.2"})
+
+	// Once the neighbor reads again, it is sent the routes
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msgType, body, err := readMessage(remote)
+	if assert.Nil(t, err) && assert.Equal(t, msgType, uint8(msgUpdate)) {
+		u, err := parseUpdate(body, false)
+		assert.Nil(t, err)
+		assert.Equal(t, prefixStrings(u.NLRI), []string{"192.168.1.0/24"})
+	}
+}
+
+func TestSpeakerZeroHoldTime(t *testing.T) {
+	c := Config{
+		LocalAS:   65001,
+		RouterID:  "10.0.0.1",
+		HoldTime:  3,
+		Listen:    "127.0.0.1:0",
+		Neighbors: []Neighbor{{Address: "127.0.0.1", RemoteAS: 65002, Passive: true}},
+	}
+	assert.Nil(t, c.Validate(""))
+	s := NewSpeaker(c)
+	assert.Nil(t, s.Start())
+	defer s.Stop()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Nil(t, writeMessage(conn, msgOpen, open{AS: 65002, HoldTime: 0, RouterID: net.ParseIP("10.0.0.2")}.marshal()))
+	assert.Nil(t, writeMessage(conn, msgKeepalive, nil))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	msgType, _, err := readMessage(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, msgType, uint8(msgOpen))
+	msgType, _, err = readMessage(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, msgType, uint8(msgKeepalive))
+	assert.Eventually(t, established(s), 5*time.Second, 10*time.Millisecond)
+
+	// With a hold time of 0, no keepalives are sent, and the session is
+	// not closed for want of them after our hold time
+	conn.SetReadDeadline(time.Now().Add(4 * time.Second))
+	_, _, err = readMessage(conn)
+	if netErr, ok := err.(net.Error); assert.True(t, ok, "Expected a timeout, not %v", err) {
+		assert.True(t, netErr.Timeout())
+	}
+	assert.Equal(t, s.Established(), []string{"127.0.0.1"})
+}
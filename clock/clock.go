@@ -0,0 +1,56 @@
+// Package clock lets code which waits for time to pass be driven by a fake
+// clock in tests.
+package clock
+
+import "time"
+
+type Clock interface {
+	Now() time.Time
+	AfterFunc(time.Duration, func()) Timer
+	NewTicker(time.Duration) Ticker
+}
+
+type Timer interface {
+	Stop() bool
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the Clock backed by the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTicker) Stop() {
+	t.t.Stop()
+}
+
+// Sleep blocks until d has passed on c.
+func Sleep(c Clock, d time.Duration) {
+	done := make(chan bool)
+	c.AfterFunc(d, func() { close(done) })
+	<-done
+}
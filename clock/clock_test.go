@@ -0,0 +1,67 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var start = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestRealClock(t *testing.T) {
+	fired := make(chan bool, 1)
+	Real.AfterFunc(time.Millisecond, func() { fired <- true })
+	assert.True(t, <-fired)
+	ticker := Real.NewTicker(time.Millisecond)
+	<-ticker.C()
+	ticker.Stop()
+	assert.False(t, Real.Now().IsZero())
+}
+
+func TestFakeAfterFunc(t *testing.T) {
+	c := NewFake(start)
+	fired := make(chan time.Time, 1)
+	c.AfterFunc(2*time.Second, func() { fired <- c.Now() })
+	c.Advance(time.Second)
+	assert.Equal(t, c.Timers(), 1)
+	c.Advance(time.Second)
+	assert.Equal(t, <-fired, start.Add(2*time.Second))
+	assert.Equal(t, c.Timers(), 0)
+}
+
+func TestFakeAfterFuncStop(t *testing.T) {
+	c := NewFake(start)
+	timer := c.AfterFunc(time.Second, func() { panic("Stopped timer fired") })
+	assert.True(t, timer.Stop())
+	assert.False(t, timer.Stop())
+	c.Advance(2 * time.Second)
+	assert.Equal(t, c.Now(), start.Add(2*time.Second))
+}
+
+func TestFakeTicker(t *testing.T) {
+	c := NewFake(start)
+	ticker := c.NewTicker(time.Second)
+	c.Advance(time.Second)
+	assert.Equal(t, <-ticker.C(), start.Add(time.Second))
+	c.Advance(3 * time.Second) // Ticks are dropped if not received
+	assert.Equal(t, <-ticker.C(), start.Add(2*time.Second))
+	select {
+	case <-ticker.C():
+		t.Fail()
+	default:
+	}
+	ticker.Stop()
+	assert.Equal(t, c.Timers(), 0)
+}
+
+func TestFakeFiresInOrder(t *testing.T) {
+	c := NewFake(start)
+	order := make(chan int, 2)
+	c.AfterFunc(2*time.Second, func() { order <- 2 })
+	c.AfterFunc(time.Second, func() { order <- 1 })
+	c.Advance(time.Second)
+	assert.Equal(t, <-order, 1)
+	c.Advance(time.Second)
+	assert.Equal(t, <-order, 2)
+}
@@ -0,0 +1,125 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock which only moves when Advance is called. Timers and
+// tickers which become due fire in order, as they would in real time.
+type Fake struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *Fake
+	at     time.Time
+	period time.Duration // Only set for tickers
+	f      func()
+	c      chan time.Time
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *Fake) add(t *fakeTimer) *fakeTimer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.timers = append(f.timers, t)
+	return t
+}
+
+// remove must be called with the lock held.
+func (f *Fake) remove(t *fakeTimer) bool {
+	for i, v := range f.timers {
+		if v == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	return f.add(&fakeTimer{clock: f, at: f.Now().Add(d), f: fn})
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.add(&fakeTimer{clock: f, at: f.Now().Add(d), period: d, c: make(chan time.Time, 1)})}
+}
+
+// Timers returns the number of timers and tickers which have not yet fired
+// or been stopped.
+func (f *Fake) Timers() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.timers)
+}
+
+// next returns the first timer due at or before until, or nil.
+func (f *Fake) next(until time.Time) *fakeTimer {
+	var first *fakeTimer
+	for _, t := range f.timers {
+		if !t.at.After(until) && (first == nil || t.at.Before(first.at)) {
+			first = t
+		}
+	}
+	return first
+}
+
+// Advance moves the clock forward by d, firing any timers and tickers which
+// become due on the way. AfterFunc functions are run in their own goroutine
+// (as with time.AfterFunc), so may not have completed when Advance returns.
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	until := f.now.Add(d)
+	for {
+		t := f.next(until)
+		if t == nil {
+			break
+		}
+		f.now = t.at
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+			select { // Like time.Ticker, drop ticks for slow receivers
+			case t.c <- f.now:
+			default:
+			}
+		} else {
+			f.remove(t)
+			go t.f()
+		}
+	}
+	f.now = until
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	return t.clock.remove(t)
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
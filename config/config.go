@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/bobtfish/AWSnycast/aws"
+	"github.com/bobtfish/AWSnycast/bgp"
+	"github.com/bobtfish/AWSnycast/clock"
 	"github.com/bobtfish/AWSnycast/healthcheck"
 	"github.com/bobtfish/AWSnycast/instancemetadata"
+	"github.com/bobtfish/AWSnycast/notify"
 	"github.com/hashicorp/go-multierror"
-	"gopkg.in/yaml.v2"
 	"io/ioutil"
 )
 
@@ -16,18 +18,56 @@ type Config struct {
 	Healthchecks               map[string]*healthcheck.Healthcheck `yaml:"healthchecks"`
 	RemoteHealthcheckTemplates map[string]*healthcheck.Healthcheck `yaml:"remote_healthchecks"`
 	RouteTables                map[string]*RouteTable              `yaml:"routetables"`
+	TransitGatewayRouteTables  map[string]*TransitGatewayTable     `yaml:"transit_gateway_routetables"`
+	ConfD                      string                              `yaml:"conf_d"`
+	InstanceTags               *InstanceTagsConfig                 `yaml:"instance_tags"`
+	Notifications              *notify.Config                      `yaml:"notifications"`
+	Safety                     *aws.SafetyConfig                   `yaml:"safety"`
+	BGP                        *bgp.Config                         `yaml:"bgp"`
+	DisableSrcDstCheck         bool                                `yaml:"ensure_source_dest_check_disabled"`
+	appliedInstanceTags        string
+	instanceTagsApplied        bool
 }
 
 func New(filename string, im instancemetadata.InstanceMetadata, manager aws.RouteTableManager) (*Config, error) {
-	c := new(Config)
 	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return new(Config), err
+	}
+	return Parse(filename, data, im, manager)
+}
+
+// Parse builds and validates a config from a YAML or JSON document. The
+// filename is used to detect JSON, in error messages, and to find a relative
+// conf_d directory.
+func Parse(filename string, data []byte, im instancemetadata.InstanceMetadata, manager aws.RouteTableManager) (*Config, error) {
+	c := new(Config)
+	err := parse(filename, data, im, c)
 	if err != nil {
 		return c, err
 	}
-	err = yaml.Unmarshal(data, &c)
-	if err == nil {
-		err = c.Validate(im, manager)
+	if c.ConfD != "" {
+		if err := c.loadConfD(filename, im); err != nil {
+			return c, err
+		}
 	}
+	err = c.Validate(im, manager)
+	return c, err
+}
+
+// ParseParameter builds and validates a config from the value of an SSM
+// parameter. conf_d cannot be used, as there is no directory for it to be
+// relative to, and a config in SSM should not depend on local files.
+func ParseParameter(name string, data []byte, im instancemetadata.InstanceMetadata, manager aws.RouteTableManager) (*Config, error) {
+	filename := "ssm:" + name
+	c := new(Config)
+	if err := parse(filename, data, im, c); err != nil {
+		return c, err
+	}
+	if c.ConfD != "" {
+		return c, errors.New(fmt.Sprintf("conf_d cannot be set in config from SSM parameter %s", name))
+	}
+	err := c.Validate(im, manager)
 	return c, err
 }
 
@@ -36,6 +76,26 @@ func (c *Config) Validate(im instancemetadata.InstanceMetadata, manager aws.Rout
 		c.PollTime = 300 // Default to every 5m
 	}
 	var result *multierror.Error
+	if c.InstanceTags != nil {
+		if err := c.InstanceTags.Validate(); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	if c.Notifications != nil {
+		if err := c.Notifications.Validate(); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	if c.Safety != nil {
+		if err := c.Safety.Validate(); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	if c.BGP != nil {
+		if err := c.BGP.Validate(im.IPAddress); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
 	if c.RouteTables == nil {
 		result = multierror.Append(result, errors.New("No route_tables key in config"))
 	} else {
@@ -43,12 +103,18 @@ func (c *Config) Validate(im instancemetadata.InstanceMetadata, manager aws.Rout
 			result = multierror.Append(result, errors.New("No route_tables defined in config"))
 		} else {
 			for k, v := range c.RouteTables {
+				v.routesFromInstanceTags = c.InstanceTags != nil
 				if err := v.Validate(im, manager, k, c.Healthchecks, c.RemoteHealthcheckTemplates); err != nil {
 					result = multierror.Append(result, err)
 				}
 			}
 		}
 	}
+	for k, v := range c.TransitGatewayRouteTables {
+		if err := v.Validate(k, c.Healthchecks, c.RemoteHealthcheckTemplates); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
 	if c.Healthchecks != nil {
 		for k, v := range c.Healthchecks {
 			if v == nil {
@@ -72,3 +138,73 @@ func (c *Config) Validate(im instancemetadata.InstanceMetadata, manager aws.Rout
 	}
 	return result.ErrorOrNil()
 }
+
+// CarryOver makes each route in the config carry on from the same route (in
+// the route table with the same name, with the same cidr and instance) in
+// previous, the config it is replacing. The local addresses of the routes in
+// previous which are not in the config are removed. Released routes are kept,
+// so that they are still deleted, unless the config has the same cidr in the
+// same route table.
+func (c *Config) CarryOver(previous *Config) {
+	for name, previousTable := range previous.RouteTables {
+		rt, ok := c.RouteTables[name]
+		if !ok {
+			rt = &RouteTable{}
+		}
+		routes := rt.ManageRoutes
+		carried := make(map[*aws.ManageRoutesSpec]bool)
+		for _, prev := range previousTable.ManageRoutes {
+			found := false
+			for _, mr := range routes {
+				if !carried[mr] && mr.Cidr == prev.Cidr && (prev.Released() || mr.Instance == prev.Instance) {
+					if !prev.Released() {
+						mr.CarryOver(prev)
+						carried[mr] = true
+					}
+					found = true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+			if prev.Released() && ok {
+				rt.ManageRoutes = append(rt.ManageRoutes, prev)
+				continue
+			}
+			prev.RemoveLocalAddress()
+		}
+	}
+}
+
+// SetClock sets the clock used to schedule all of the healthchecks in the
+// config.
+func (c *Config) SetClock(cl clock.Clock) {
+	for _, hc := range c.Healthchecks {
+		hc.SetClock(cl)
+	}
+	for _, hc := range c.RemoteHealthcheckTemplates {
+		hc.SetClock(cl)
+	}
+	for _, rt := range c.RouteTables {
+		for _, mr := range rt.ManageRoutes {
+			mr.SetClock(cl)
+		}
+	}
+}
+
+// SetNotifier sets where all of the healthchecks in the config send
+// notifications.
+func (c *Config) SetNotifier(n *notify.Notifier) {
+	for _, hc := range c.Healthchecks {
+		hc.SetNotifier(n)
+	}
+	for _, hc := range c.RemoteHealthcheckTemplates {
+		hc.SetNotifier(n)
+	}
+	for _, rt := range c.RouteTables {
+		for _, mr := range rt.ManageRoutes {
+			mr.SetNotifier(n)
+		}
+	}
+}
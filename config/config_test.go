@@ -3,13 +3,16 @@ package config
 import (
 	"errors"
 	"fmt"
+	"os"
 	"testing"
 
 	a "github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/bobtfish/AWSnycast/aws"
+	"github.com/bobtfish/AWSnycast/bgp"
 	"github.com/bobtfish/AWSnycast/healthcheck"
 	"github.com/bobtfish/AWSnycast/instancemetadata"
+	"github.com/bobtfish/AWSnycast/notify"
 	"github.com/bobtfish/AWSnycast/testhelpers"
 	"github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/assert"
@@ -111,6 +114,150 @@ func TestLoadConfigHealthchecks(t *testing.T) {
 	assert.Equal(t, b.Find.Type, "and")
 }
 
+func TestLoadConfigJSON(t *testing.T) {
+	c, err := New("../tests/awsnycast.json", tim, rtm)
+	if assert.Nil(t, err) {
+		assert.Equal(t, c.PollTime, uint(60))
+		assert.Equal(t, c.Healthchecks["public"].Destination, "8.8.8.8")
+		assert.Equal(t, c.RouteTables["a"].Find.Config["value"], "private a")
+		assert.Equal(t, c.RouteTables["a"].ManageRoutes[0].NeverDelete, true)
+	}
+}
+
+func TestUnmarshalJSONSniffed(t *testing.T) {
+	c := new(Config)
+	err := unmarshal("awsnycast.conf", []byte(`  {"poll_time": 10}`), c)
+	assert.Nil(t, err)
+	assert.Equal(t, c.PollTime, uint(10))
+}
+
+func TestUnmarshalJSONInvalid(t *testing.T) {
+	c := new(Config)
+	err := unmarshal("awsnycast.json", []byte(`{"poll_time": `), c)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Error parsing JSON in awsnycast.json: unexpected end of JSON input")
+	}
+}
+
+func TestLoadConfigInterpolation(t *testing.T) {
+	assert.Nil(t, os.Setenv("AWSNYCAST_TEST_DESTINATION", "8.8.4.4"))
+	defer os.Unsetenv("AWSNYCAST_TEST_DESTINATION")
+	im := instancemetadata.InstanceMetadata{
+		Instance:         "i-1234",
+		AvailabilityZone: "us-west-1a",
+	}
+	c, err := New("../tests/interpolate.yaml", im, rtm)
+	if assert.Nil(t, err) {
+		assert.Equal(t, c.Healthchecks["public"].Destination, "8.8.4.4")
+		assert.Equal(t, c.RouteTables["a"].Find.Config["value"], "us-west-1a")
+	}
+}
+
+func TestLoadConfigInterpolationMissingEnv(t *testing.T) {
+	os.Unsetenv("AWSNYCAST_TEST_DESTINATION")
+	_, err := New("../tests/interpolate.yaml", tim, rtm)
+	testhelpers.CheckOneMultiError(t, err, "Environment variable 'AWSNYCAST_TEST_DESTINATION' used in config is not set")
+}
+
+func TestInterpolate(t *testing.T) {
+	out, err := interpolate("${metadata:instance-id} $${NOT_INTERPOLATED}", tim)
+	assert.Nil(t, err)
+	assert.Equal(t, out, "i-1234 ${NOT_INTERPOLATED}")
+}
+
+func TestInterpolateUnknownMetadata(t *testing.T) {
+	_, err := interpolate("${metadata:favourite-colour}", tim)
+	testhelpers.CheckOneMultiError(t, err, "Unknown instance metadata key 'favourite-colour' in config")
+}
+
+func TestTypedScalar(t *testing.T) {
+	assert.Equal(t, typedScalar("5"), 5)
+	assert.Equal(t, typedScalar("true"), true)
+	assert.Equal(t, typedScalar("1.5"), 1.5)
+	assert.Equal(t, typedScalar("010"), "010")
+	assert.Equal(t, typedScalar("8.8.8.8"), "8.8.8.8")
+	assert.Equal(t, typedScalar("a: b"), "a: b")
+}
+
+func TestParseInterpolationIgnoresComments(t *testing.T) {
+	os.Unsetenv("AWSNYCAST_TEST_UNSET")
+	c := new(Config)
+	err := parse("awsnycast.yaml", []byte("# Use ${AWSNYCAST_TEST_UNSET} to...\npoll_time: 10 # or ${AWSNYCAST_TEST_UNSET}\n"), tim, c)
+	assert.Nil(t, err)
+	assert.Equal(t, c.PollTime, uint(10))
+}
+
+func TestParseInterpolationKeepsStructure(t *testing.T) {
+	assert.Nil(t, os.Setenv("AWSNYCAST_TEST_DESTINATION", "8.8.4.4 # not a comment\npoll_time: 1"))
+	defer os.Unsetenv("AWSNYCAST_TEST_DESTINATION")
+	assert.Nil(t, os.Setenv("AWSNYCAST_TEST_EVERY", "5"))
+	defer os.Unsetenv("AWSNYCAST_TEST_EVERY")
+	c := new(Config)
+	err := parse("awsnycast.yaml", []byte("poll_time: 10\nhealthchecks:\n  public:\n    type: ping\n    destination: ${AWSNYCAST_TEST_DESTINATION}\n    every: ${AWSNYCAST_TEST_EVERY}\n"), tim, c)
+	if assert.Nil(t, err) {
+		assert.Equal(t, c.PollTime, uint(10))
+		assert.Equal(t, c.Healthchecks["public"].Destination, "8.8.4.4 # not a comment\npoll_time: 1")
+		assert.Equal(t, c.Healthchecks["public"].Every, uint(5))
+	}
+}
+
+func TestParseInterpolationJSON(t *testing.T) {
+	c := new(Config)
+	err := parse("awsnycast.json", []byte(`{"poll_time": 10, "conf_d": "${metadata:instance-id}: x"}`), tim, c)
+	if assert.Nil(t, err) {
+		assert.Equal(t, c.PollTime, uint(10))
+		assert.Equal(t, c.ConfD, "i-1234: x")
+	}
+}
+
+func TestLoadConfigConfD(t *testing.T) {
+	c, err := New("../tests/confd/awsnycast.yaml", tim, rtm)
+	if assert.Nil(t, err) {
+		assert.Equal(t, len(c.Healthchecks), 2)
+		assert.Equal(t, c.Healthchecks["localservice"].Destination, "127.0.0.1")
+		assert.Equal(t, c.RemoteHealthcheckTemplates["service"].Type, "ping")
+		if assert.Equal(t, len(c.RouteTables), 2) {
+			assert.Equal(t, c.RouteTables["b"].Name, "b")
+			assert.Equal(t, c.RouteTables["b"].ManageRoutes[0].RemoteHealthcheckName, "service")
+		}
+	}
+}
+
+func TestLoadConfigConfDConflict(t *testing.T) {
+	_, err := New("../tests/confd_conflict/awsnycast.yaml", tim, rtm)
+	if assert.NotNil(t, err) {
+		merr, ok := err.(*multierror.Error)
+		if assert.Equal(t, ok, true) && assert.Equal(t, len(merr.Errors), 2) {
+			assert.Equal(t, merr.Errors[0].Error(), "Healthcheck 'public' in ../tests/confd_conflict/conf.d/dup.yaml is already defined")
+			assert.Equal(t, merr.Errors[1].Error(), "Route table 'a' in ../tests/confd_conflict/conf.d/dup.yaml is already defined")
+		}
+	}
+}
+
+func TestConfigMergeFragmentPollTime(t *testing.T) {
+	c := new(Config)
+	err := c.merge("foo.yaml", &Config{PollTime: 10})
+	testhelpers.CheckOneMultiError(t, err, "poll_time cannot be set in conf.d fragment foo.yaml")
+}
+
+func TestConfigMergeFragmentEnsureSourceDestCheckDisabled(t *testing.T) {
+	c := new(Config)
+	err := c.merge("foo.yaml", &Config{DisableSrcDstCheck: true})
+	testhelpers.CheckOneMultiError(t, err, "ensure_source_dest_check_disabled cannot be set in conf.d fragment foo.yaml")
+}
+
+func TestConfigMergeFragmentInstanceTags(t *testing.T) {
+	c := new(Config)
+	err := c.merge("foo.yaml", &Config{InstanceTags: &InstanceTagsConfig{}})
+	testhelpers.CheckOneMultiError(t, err, "instance_tags cannot be set in conf.d fragment foo.yaml")
+}
+
+func TestConfigMergeFragmentNotifications(t *testing.T) {
+	c := new(Config)
+	err := c.merge("foo.yaml", &Config{Notifications: &notify.Config{}})
+	testhelpers.CheckOneMultiError(t, err, "notifications cannot be set in conf.d fragment foo.yaml")
+}
+
 func TestConfigDefault(t *testing.T) {
 	r := make(map[string]*RouteTable)
 	r["a"] = &RouteTable{
@@ -139,6 +286,40 @@ func TestConfigValidateEmptyRouteTables(t *testing.T) {
 	testhelpers.CheckOneMultiError(t, err, "No route_tables defined in config")
 }
 
+func TestConfigValidateBadNotifications(t *testing.T) {
+	c := Config{
+		RouteTables:   make(map[string]*RouteTable),
+		Notifications: &notify.Config{Slack: &notify.SlackConfig{URL: "hooks.slack.com"}},
+	}
+	err := c.Validate(tim, rtm)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "notifications slack url 'hooks.slack.com' is not http or https")
+	}
+}
+
+func TestConfigValidateBadSafety(t *testing.T) {
+	c := Config{
+		RouteTables: make(map[string]*RouteTable),
+		Safety:      &aws.SafetyConfig{MaxFights: -1},
+	}
+	err := c.Validate(tim, rtm)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "safety max_fights cannot be negative")
+	}
+}
+
+func TestConfigValidateBGP(t *testing.T) {
+	c := Config{
+		RouteTables: make(map[string]*RouteTable),
+		BGP:         &bgp.Config{LocalAS: 65001, Neighbors: []bgp.Neighbor{{Address: "10.0.0.2"}}},
+	}
+	err := c.Validate(instancemetadata.InstanceMetadata{Instance: "i-1234", IPAddress: "10.0.0.1"}, rtm)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "bgp neighbor 10.0.0.2 remote_as must be set")
+	}
+	assert.Equal(t, c.BGP.RouterID, "10.0.0.1")
+}
+
 func TestConfigValidateBadRouteTables(t *testing.T) {
 	r := make(map[string]*RouteTable)
 	conf := make(map[string]interface{})
@@ -327,6 +508,81 @@ func TestRouteTableValidate(t *testing.T) {
 	assert.Nil(t, r.Validate(tim, rtm, "foo", emptyHealthchecks, emptyHealthchecks))
 }
 
+// accountsRouteTableManager makes a manager for each region and role it is
+// asked for.
+type accountsRouteTableManager struct {
+	FakeRouteTableManager
+	Managers map[string]*FakeRouteTableManager
+}
+
+func (r *accountsRouteTableManager) ManagerFor(region string, roleArn string, externalID string) (aws.RouteTableManager, error) {
+	key := region + " " + roleArn + " " + externalID
+	if _, ok := r.Managers[key]; !ok {
+		r.Managers[key] = &FakeRouteTableManager{}
+	}
+	return r.Managers[key], nil
+}
+
+func regionRouteTable() *RouteTable {
+	return &RouteTable{
+		Find: RouteTableFindSpec{
+			Type:   "by_tag",
+			Config: map[string]interface{}{"key": "foo", "value": "foo"},
+		},
+		ManageRoutes:  []*aws.ManageRoutesSpec{&aws.ManageRoutesSpec{Cidr: "127.0.0.1", Instance: "i-5678"}},
+		Region:        "eu-west-1",
+		AssumeRoleArn: "arn:aws:iam::123456789012:role/AWSnycast",
+		ExternalID:    "secret",
+	}
+}
+
+func TestRouteTableValidateRegion(t *testing.T) {
+	m := &accountsRouteTableManager{Managers: make(map[string]*FakeRouteTableManager)}
+	r := regionRouteTable()
+	assert.Nil(t, r.Validate(tim, m, "foo", emptyHealthchecks, emptyHealthchecks))
+	assert.Equal(t, r.Manager(), m.Managers["eu-west-1 arn:aws:iam::123456789012:role/AWSnycast secret"])
+	r = regionRouteTable()
+	r.Region = ""
+	r.AssumeRoleArn = ""
+	r.ExternalID = ""
+	assert.Nil(t, r.Validate(tim, m, "foo", emptyHealthchecks, emptyHealthchecks))
+	assert.Equal(t, r.Manager(), m)
+}
+
+func TestRouteTableValidateRegionSelf(t *testing.T) {
+	m := &accountsRouteTableManager{Managers: make(map[string]*FakeRouteTableManager)}
+	r := regionRouteTable()
+	r.ManageRoutes[0].Instance = "SELF"
+	err := r.Validate(tim, m, "foo", emptyHealthchecks, emptyHealthchecks)
+	testhelpers.CheckOneMultiError(t, err, "Route tables foo, route 127.0.0.1/32 uses instance SELF, but the route table is in another region or account")
+	// The instance's own region, in its own account
+	im := tim
+	im.Region = "eu-west-1"
+	r = regionRouteTable()
+	r.ManageRoutes[0].Instance = "SELF"
+	r.AssumeRoleArn = ""
+	r.ExternalID = ""
+	assert.Nil(t, r.Validate(im, m, "foo", emptyHealthchecks, emptyHealthchecks))
+}
+
+func TestRouteTableValidateRegionNotSupported(t *testing.T) {
+	r := regionRouteTable()
+	err := r.Validate(tim, rtm, "foo", emptyHealthchecks, emptyHealthchecks)
+	testhelpers.CheckOneMultiError(t, err, "Route table 'foo' sets region or assume_role_arn, which cannot be used with this route table manager")
+}
+
+func TestRouteTableValidateBadAssumeRole(t *testing.T) {
+	m := &accountsRouteTableManager{Managers: make(map[string]*FakeRouteTableManager)}
+	r := regionRouteTable()
+	r.AssumeRoleArn = "AWSnycast"
+	err := r.Validate(tim, m, "foo", emptyHealthchecks, emptyHealthchecks)
+	testhelpers.CheckOneMultiError(t, err, "Route table 'foo' assume_role_arn 'AWSnycast' is not an ARN")
+	r = regionRouteTable()
+	r.AssumeRoleArn = ""
+	err = r.Validate(tim, m, "foo", emptyHealthchecks, emptyHealthchecks)
+	testhelpers.CheckOneMultiError(t, err, "Route table 'foo' has external_id set, but no assume_role_arn")
+}
+
 func TestByTagRouteTableFindMissingKey(t *testing.T) {
 	c := make(map[string]interface{})
 	c["value"] = "foo"
@@ -517,6 +773,62 @@ func TestRunEc2Updates(t *testing.T) {
 	}
 }
 
+// failingCidrRouteTableManager fails to manage one CIDR, and records the
+// others it was asked to manage.
+type failingCidrRouteTableManager struct {
+	FakeRouteTableManager
+	FailCidr string
+	Managed  []string
+}
+
+func (r *failingCidrRouteTableManager) ManageInstanceRoute(rtb ec2.RouteTable, rs aws.ManageRoutesSpec, noop bool) error {
+	if rs.Cidr == r.FailCidr {
+		return errors.New("Failed " + rs.Cidr)
+	}
+	r.Managed = append(r.Managed, *(rtb.RouteTableId)+" "+rs.Cidr)
+	return nil
+}
+
+func TestRunEc2UpdatesContinuesAfterError(t *testing.T) {
+	rt := &RouteTable{
+		ManageRoutes: []*aws.ManageRoutesSpec{
+			&aws.ManageRoutesSpec{Cidr: "127.0.0.1"},
+			&aws.ManageRoutesSpec{Cidr: "127.0.0.2"},
+		},
+	}
+	rt.Validate(tim, rtm, "foo", emptyHealthchecks, emptyHealthchecks)
+	rt.ec2RouteTables = []*ec2.RouteTable{
+		&ec2.RouteTable{RouteTableId: a.String("rtb-1")},
+		&ec2.RouteTable{RouteTableId: a.String("rtb-2")},
+	}
+	frtm := &failingCidrRouteTableManager{FailCidr: "127.0.0.1/32"}
+	err := rt.RunEc2Updates(frtm, true)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Failed 127.0.0.1/32")
+	}
+	assert.Equal(t, frtm.Managed, []string{"rtb-1 127.0.0.2/32", "rtb-2 127.0.0.2/32"})
+}
+
+func TestRouteTableAffectedBy(t *testing.T) {
+	rt := &RouteTable{
+		ManageRoutes: []*aws.ManageRoutesSpec{&aws.ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-managed"}},
+		ec2RouteTables: []*ec2.RouteTable{
+			&ec2.RouteTable{
+				RouteTableId: a.String("rtb-1"),
+				Routes: []*ec2.Route{
+					&ec2.Route{DestinationCidrBlock: a.String("10.0.0.0/16"), GatewayId: a.String("local")},
+					&ec2.Route{DestinationCidrBlock: a.String("0.0.0.0/0"), InstanceId: a.String("i-target")},
+				},
+			},
+		},
+	}
+	assert.Equal(t, rt.AffectedBy(aws.RouteEvent{RouteTableIds: []string{"rtb-1"}}), true)
+	assert.Equal(t, rt.AffectedBy(aws.RouteEvent{RouteTableIds: []string{"rtb-2"}}), false)
+	assert.Equal(t, rt.AffectedBy(aws.RouteEvent{InstanceIds: []string{"i-target"}}), true)
+	assert.Equal(t, rt.AffectedBy(aws.RouteEvent{InstanceIds: []string{"i-managed"}}), true)
+	assert.Equal(t, rt.AffectedBy(aws.RouteEvent{InstanceIds: []string{"i-other"}}), false)
+}
+
 func TestRouteTableFindSpecAndNoFilters(t *testing.T) {
 	c := make(map[string]interface{})
 	_, err := RouteTableFindSpec{Config: c, Type: "and"}.GetFilter()
@@ -638,3 +950,202 @@ func TestGetFiltersListForSpecInnerFails(t *testing.T) {
 		}
 	}
 }
+
+func TestInstanceTagsConfigValidate(t *testing.T) {
+	tc := &InstanceTagsConfig{}
+	assert.Nil(t, tc.Validate())
+	assert.Equal(t, tc.Source, "metadata")
+	assert.Equal(t, tc.Prefix, "awsnycast")
+	tc.Source = "carrier-pigeon"
+	if err := tc.Validate(); assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "instance_tags source 'carrier-pigeon' is not one of metadata or api")
+	}
+}
+
+func TestLoadConfigInstanceTagsNoManageRoutes(t *testing.T) {
+	c, err := New("../tests/instance_tags.yaml", tim, rtm)
+	if assert.Nil(t, err) {
+		assert.Equal(t, len(c.RouteTables["a"].ManageRoutes), 0)
+		assert.Equal(t, len(c.RouteTables["b"].ManageRoutes), 1)
+	}
+}
+
+func TestApplyInstanceTagsOtherRegion(t *testing.T) {
+	c, err := New("../tests/instance_tags.yaml", tim, rtm)
+	assert.Nil(t, err)
+	c.RouteTables["peered"] = regionRouteTable()
+	added, err := c.ApplyInstanceTags(map[string]string{"awsnycast:route:default": "cidr=0.0.0.0/0"}, tim, rtm)
+	assert.Nil(t, err)
+	assert.Equal(t, len(added), 2)
+	assert.Equal(t, len(c.RouteTables["peered"].ManageRoutes), 1)
+	_, err = c.ApplyInstanceTags(map[string]string{"awsnycast:route:default": "cidr=0.0.0.0/0,routetable=peered"}, tim, rtm)
+	testhelpers.CheckOneMultiError(t, err, "Instance tag awsnycast:route:default refers to route table 'peered', which is in another region or account")
+}
+
+func TestApplyInstanceTags(t *testing.T) {
+	c, err := New("../tests/instance_tags.yaml", tim, rtm)
+	assert.Nil(t, err)
+	tags := map[string]string{
+		"Name":                      "nat-a",
+		"awsnycast:route:default":   "cidr=0.0.0.0/0,healthcheck=public, if_unhealthy,never_delete",
+		"awsnycast:route:service":   "cidr=10.0.0.1,routetable=a",
+		"awsnycast:something_else":  "ignored",
+		"otherprefix:route:service": "cidr=10.0.0.2/32",
+	}
+	added, err := c.ApplyInstanceTags(tags, tim, rtm)
+	if assert.Nil(t, err) {
+		assert.Equal(t, len(added), 3)
+	}
+	a := c.RouteTables["a"].ManageRoutes
+	if assert.Equal(t, len(a), 2) {
+		assert.Equal(t, a[0].Cidr, "0.0.0.0/0")
+		assert.Equal(t, a[0].Instance, "i-1234")
+		assert.Equal(t, a[0].HealthcheckName, "public")
+		assert.Equal(t, a[0].IfUnhealthy, true)
+		assert.Equal(t, a[0].NeverDelete, true)
+		assert.Equal(t, a[0].FromInstanceTags, true)
+		assert.Equal(t, a[1].Cidr, "10.0.0.1/32")
+		assert.Equal(t, a[1].IfUnhealthy, false)
+	}
+	b := c.RouteTables["b"].ManageRoutes
+	if assert.Equal(t, len(b), 2) {
+		assert.Equal(t, b[0].Cidr, "192.168.1.1/32")
+		assert.Equal(t, b[0].FromInstanceTags, false)
+		assert.Equal(t, b[1].Cidr, "0.0.0.0/0")
+	}
+
+	added, err = c.ApplyInstanceTags(tags, tim, rtm)
+	assert.Nil(t, err)
+	assert.Nil(t, added, "Unchanged tags should not change routes")
+
+	delete(tags, "awsnycast:route:default")
+	added, err = c.ApplyInstanceTags(tags, tim, rtm)
+	assert.Nil(t, err)
+	assert.Equal(t, len(added), 1)
+	// The removed routes never pointed to this instance, so are dropped
+	// rather than kept to be deleted
+	a = c.RouteTables["a"].ManageRoutes
+	if assert.Equal(t, len(a), 1) {
+		assert.Equal(t, a[0].Cidr, "10.0.0.1/32")
+		assert.Equal(t, a[0].Released(), false)
+	}
+	assert.Equal(t, len(c.RouteTables["b"].ManageRoutes), 1)
+}
+
+func TestApplyInstanceTagsReaddedDropsReleased(t *testing.T) {
+	c, err := New("../tests/instance_tags.yaml", tim, rtm)
+	assert.Nil(t, err)
+	tags := map[string]string{"awsnycast:route:service": "cidr=10.0.0.1,routetable=a"}
+	_, err = c.ApplyInstanceTags(tags, tim, rtm)
+	assert.Nil(t, err)
+	tags["awsnycast:route:service"] = "cidr=10.0.0.1,routetable=a,if_unhealthy"
+	_, err = c.ApplyInstanceTags(tags, tim, rtm)
+	assert.Nil(t, err)
+	a := c.RouteTables["a"].ManageRoutes
+	if assert.Equal(t, len(a), 1) {
+		assert.Equal(t, a[0].Released(), false)
+		assert.Equal(t, a[0].IfUnhealthy, true)
+	}
+}
+
+func TestApplyInstanceTagsInvalidKeepsRoutes(t *testing.T) {
+	c, err := New("../tests/instance_tags.yaml", tim, rtm)
+	assert.Nil(t, err)
+	_, err = c.ApplyInstanceTags(map[string]string{"awsnycast:route:service": "cidr=10.0.0.1,routetable=a"}, tim, rtm)
+	assert.Nil(t, err)
+	_, err = c.ApplyInstanceTags(map[string]string{"awsnycast:route:service": "cidr=10.0.0.1,routetable=c,flap"}, tim, rtm)
+	if assert.NotNil(t, err) {
+		merr := err.(*multierror.Error)
+		assert.Equal(t, merr.Errors[0].Error(), "Unknown option 'flap' in instance tag awsnycast:route:service")
+	}
+	_, err = c.ApplyInstanceTags(map[string]string{"awsnycast:route:service": "routetable=a"}, tim, rtm)
+	testhelpers.CheckOneMultiError(t, err, "No cidr option in instance tag awsnycast:route:service")
+	_, err = c.ApplyInstanceTags(map[string]string{"awsnycast:route:service": "cidr=10.0.0.1,routetable=c"}, tim, rtm)
+	testhelpers.CheckOneMultiError(t, err, "Instance tag awsnycast:route:service refers to unknown route table 'c'")
+	_, err = c.ApplyInstanceTags(map[string]string{"awsnycast:route:service": "cidr=10.0.0.1,routetable=a,healthcheck=missing"}, tim, rtm)
+	testhelpers.CheckOneMultiError(t, err, "Route tables a, route 10.0.0.1/32 cannot find healthcheck 'missing'")
+	if assert.Equal(t, len(c.RouteTables["a"].ManageRoutes), 1) {
+		assert.Equal(t, c.RouteTables["a"].ManageRoutes[0].Cidr, "10.0.0.1/32")
+	}
+}
+
+func TestApplyInstanceTagsNotEnabled(t *testing.T) {
+	c, err := New("../tests/awsnycast.yaml", tim, rtm)
+	assert.Nil(t, err)
+	added, err := c.ApplyInstanceTags(map[string]string{"awsnycast:route:service": "cidr=10.0.0.1"}, tim, rtm)
+	assert.Nil(t, err)
+	assert.Nil(t, added)
+}
+
+func TestParse(t *testing.T) {
+	c, err := Parse("ssm:/awsnycast/config", []byte(`{"routetables": {"a": {"find": {"type": "main", "config": {}}, "manage_routes": [{"cidr": "10.0.0.1"}]}}}`), tim, rtm)
+	if assert.Nil(t, err) {
+		assert.Equal(t, c.RouteTables["a"].ManageRoutes[0].Cidr, "10.0.0.1/32")
+	}
+}
+
+func TestParseParameter(t *testing.T) {
+	c, err := ParseParameter("/awsnycast/config", []byte(`{"routetables": {"a": {"find": {"type": "main", "config": {}}, "manage_routes": [{"cidr": "10.0.0.1"}]}}}`), tim, rtm)
+	if assert.Nil(t, err) {
+		assert.Equal(t, c.RouteTables["a"].ManageRoutes[0].Cidr, "10.0.0.1/32")
+	}
+}
+
+func TestParseParameterConfD(t *testing.T) {
+	_, err := ParseParameter("/awsnycast/config", []byte(`{"conf_d": "conf.d", "routetables": {"a": {"find": {"type": "main", "config": {}}, "manage_routes": [{"cidr": "10.0.0.1"}]}}}`), tim, rtm)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "conf_d cannot be set in config from SSM parameter /awsnycast/config")
+	}
+}
+
+func TestLoadConfigTransitGateway(t *testing.T) {
+	c, err := New("../tests/transit_gateway.yaml", tim, rtm)
+	if !assert.Nil(t, err) {
+		return
+	}
+	hub := c.TransitGatewayRouteTables["hub"]
+	if assert.NotNil(t, hub) {
+		assert.Equal(t, hub.Name, "hub")
+		assert.Equal(t, hub.ManageRoutes[0].Cidr, "10.1.0.1/32")
+	}
+	tables := []*ec2.TransitGatewayRouteTable{
+		&ec2.TransitGatewayRouteTable{
+			TransitGatewayId:           a.String("tgw-0123456789abcdef0"),
+			TransitGatewayRouteTableId: a.String("tgw-rtb-1"),
+			Tags:                       []*ec2.Tag{&ec2.Tag{Key: a.String("Name"), Value: a.String("anycast")}},
+		},
+		&ec2.TransitGatewayRouteTable{
+			TransitGatewayId:           a.String("tgw-0fedcba9876543210"),
+			TransitGatewayRouteTableId: a.String("tgw-rtb-2"),
+			Tags:                       []*ec2.Tag{&ec2.Tag{Key: a.String("Name"), Value: a.String("anycast")}},
+		},
+	}
+	assert.Nil(t, hub.UpdateEc2RouteTables(tables, nil))
+	if assert.Equal(t, len(hub.ec2RouteTables), 1) {
+		assert.Equal(t, *(hub.ec2RouteTables[0].TransitGatewayRouteTableId), "tgw-rtb-1")
+	}
+	err = hub.UpdateEc2RouteTables(tables[1:], nil)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "No transit gateway route table in AWS matched filter spec in transit gateway route table 'hub'")
+	}
+}
+
+func TestTransitGatewayTableValidate(t *testing.T) {
+	r := &TransitGatewayTable{
+		Find: TransitGatewayRouteTableFindSpec{Type: "transit_gateway"},
+	}
+	err := r.Validate("hub", emptyHealthchecks, emptyHealthchecks)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "No manage_routes key in transit gateway route table 'hub'")
+		assert.Contains(t, err.Error(), "Transit gateway route find spec hub: No transit_gateway_id in config for transit_gateway transit gateway route table finder")
+	}
+	r = &TransitGatewayTable{
+		Find:         TransitGatewayRouteTableFindSpec{Type: "default", Not: true},
+		ManageRoutes: []*aws.ManageTransitGatewayRoutesSpec{&aws.ManageTransitGatewayRoutesSpec{Cidr: "10.1.0.1", Attachment: "tgw-attach-1"}},
+	}
+	assert.Nil(t, r.Validate("hub", emptyHealthchecks, emptyHealthchecks))
+	def := &ec2.TransitGatewayRouteTable{TransitGatewayRouteTableId: a.String("tgw-rtb-1"), DefaultAssociationRouteTable: a.Bool(true)}
+	other := &ec2.TransitGatewayRouteTable{TransitGatewayRouteTableId: a.String("tgw-rtb-2"), DefaultAssociationRouteTable: a.Bool(false)}
+	assert.Nil(t, r.UpdateEc2RouteTables([]*ec2.TransitGatewayRouteTable{def, other}, nil))
+	assert.Equal(t, r.ec2RouteTables, []*ec2.TransitGatewayRouteTable{other})
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bobtfish/AWSnycast/aws"
+	"github.com/bobtfish/AWSnycast/instancemetadata"
+	"github.com/hashicorp/go-multierror"
+)
+
+// InstanceTagsConfig enables managing routes configured by tags on this
+// instance, in addition to those in the config file. A tag like:
+//
+//	awsnycast:route:default = cidr=0.0.0.0/0,healthcheck=public,if_unhealthy
+//
+// adds a route for 0.0.0.0/0 to every route table in the config (or just the
+// ones named with routetable=name options). The cidr is in the value, as tag
+// keys containing / are not available from the instance metadata service.
+type InstanceTagsConfig struct {
+	Source string `yaml:"source"`
+	Prefix string `yaml:"prefix"`
+}
+
+func (t *InstanceTagsConfig) Validate() error {
+	if t.Source == "" {
+		t.Source = "metadata"
+	}
+	if t.Prefix == "" {
+		t.Prefix = "awsnycast"
+	}
+	if t.Source != "metadata" && t.Source != "api" {
+		return errors.New(fmt.Sprintf("instance_tags source '%s' is not one of metadata or api", t.Source))
+	}
+	return nil
+}
+
+type instanceTagRoute struct {
+	Cidr                  string
+	RouteTables           []string
+	HealthcheckName       string
+	RemoteHealthcheckName string
+	IfUnhealthy           bool
+	NeverDelete           bool
+}
+
+func (t instanceTagRoute) manageRoutesSpec() *aws.ManageRoutesSpec {
+	return &aws.ManageRoutesSpec{
+		Cidr:                  t.Cidr,
+		Instance:              "SELF",
+		HealthcheckName:       t.HealthcheckName,
+		RemoteHealthcheckName: t.RemoteHealthcheckName,
+		IfUnhealthy:           t.IfUnhealthy,
+		NeverDelete:           t.NeverDelete,
+		FromInstanceTags:      true,
+	}
+}
+
+func parseInstanceTagRoute(key string, value string) (instanceTagRoute, error) {
+	route := instanceTagRoute{}
+	var result *multierror.Error
+	for _, option := range strings.Split(value, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		name, arg := option, ""
+		if i := strings.Index(option, "="); i != -1 {
+			name, arg = option[:i], option[i+1:]
+		}
+		switch name {
+		case "cidr":
+			route.Cidr = arg
+		case "healthcheck":
+			route.HealthcheckName = arg
+		case "remote_healthcheck":
+			route.RemoteHealthcheckName = arg
+		case "routetable":
+			route.RouteTables = append(route.RouteTables, arg)
+		case "if_unhealthy":
+			route.IfUnhealthy = true
+		case "never_delete":
+			route.NeverDelete = true
+		default:
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Unknown option '%s' in instance tag %s", name, key)))
+		}
+	}
+	if route.Cidr == "" {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("No cidr option in instance tag %s", key)))
+	}
+	return route, result.ErrorOrNil()
+}
+
+// routeTags returns the tags which configure routes, and a canonical string
+// representation of them used to detect changes.
+func (t *InstanceTagsConfig) routeTags(tags map[string]string) ([]string, string) {
+	keys := make([]string, 0)
+	for k := range tags {
+		if strings.HasPrefix(k, t.Prefix+":route:") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var canonical []string
+	for _, k := range keys {
+		canonical = append(canonical, k+"="+tags[k])
+	}
+	return keys, strings.Join(canonical, "\n")
+}
+
+// ApplyInstanceTags replaces any routes previously configured from instance
+// tags with those described by tags. If the tags have not changed since they
+// were last applied nothing is done. If any of the tags are invalid, an error
+// is returned and the existing routes are left in place. The newly added
+// routes are returned so that the caller can start their healthcheck
+// listeners.
+//
+// Routes whose tags have been removed are released, so that they are deleted
+// wherever they still point to this instance, and then dropped once they no
+// longer do.
+func (c *Config) ApplyInstanceTags(tags map[string]string, im instancemetadata.InstanceMetadata, manager aws.RouteTableManager) ([]*aws.ManageRoutesSpec, error) {
+	if c.InstanceTags == nil {
+		return nil, nil
+	}
+	c.dropReleasedRoutes(nil)
+	keys, canonical := c.InstanceTags.routeTags(tags)
+	if c.instanceTagsApplied && canonical == c.appliedInstanceTags {
+		return nil, nil
+	}
+	var result *multierror.Error
+	added := make([]*aws.ManageRoutesSpec, 0)
+	byTable := make(map[string][]*aws.ManageRoutesSpec)
+	for _, key := range keys {
+		route, err := parseInstanceTagRoute(key, tags[key])
+		if err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		tables := route.RouteTables
+		if len(tables) == 0 {
+			for name, rt := range c.RouteTables {
+				if !rt.elsewhere(im) {
+					tables = append(tables, name)
+				}
+			}
+			sort.Strings(tables)
+		}
+		for _, name := range tables {
+			rt, ok := c.RouteTables[name]
+			if !ok {
+				result = multierror.Append(result, errors.New(fmt.Sprintf("Instance tag %s refers to unknown route table '%s'", key, name)))
+				continue
+			}
+			if rt.elsewhere(im) {
+				result = multierror.Append(result, errors.New(fmt.Sprintf("Instance tag %s refers to route table '%s', which is in another region or account", key, name)))
+				continue
+			}
+			tableManager := manager
+			if rt.Manager() != nil {
+				tableManager = rt.Manager()
+			}
+			spec := route.manageRoutesSpec()
+			if err := spec.Validate(im, tableManager, name, c.Healthchecks, c.RemoteHealthcheckTemplates); err != nil {
+				result = multierror.Append(result, err)
+				continue
+			}
+			byTable[name] = append(byTable[name], spec)
+			added = append(added, spec)
+		}
+	}
+	if err := result.ErrorOrNil(); err != nil {
+		return nil, err
+	}
+	for _, rt := range c.RouteTables {
+		for _, mr := range rt.ManageRoutes {
+			if mr.FromInstanceTags && !mr.Released() {
+				mr.Release()
+			}
+		}
+	}
+	c.dropReleasedRoutes(byTable)
+	for name, rt := range c.RouteTables {
+		rt.ManageRoutes = append(rt.ManageRoutes, byTable[name]...)
+	}
+	c.appliedInstanceTags = canonical
+	c.instanceTagsApplied = true
+	return added, nil
+}
+
+// dropReleasedRoutes drops the released routes which no longer point to this
+// instance, or which are set to never_delete, so will never be deleted. Any
+// released routes for a cidr which is being added again to the same route
+// table are also dropped, so that they do not delete the new route.
+func (c *Config) dropReleasedRoutes(adding map[string][]*aws.ManageRoutesSpec) {
+	for name, rt := range c.RouteTables {
+		cidrs := make(map[string]bool)
+		for _, mr := range adding[name] {
+			cidrs[mr.Cidr] = true
+		}
+		routes := make([]*aws.ManageRoutesSpec, 0, len(rt.ManageRoutes))
+		for _, mr := range rt.ManageRoutes {
+			if mr.Released() && (!mr.Owned() || mr.NeverDelete || cidrs[mr.Cidr]) {
+				continue
+			}
+			routes = append(routes, mr)
+		}
+		rt.ManageRoutes = routes
+	}
+}
@@ -0,0 +1,279 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bobtfish/AWSnycast/healthcheck"
+	"github.com/bobtfish/AWSnycast/instancemetadata"
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v2"
+)
+
+var interpolationRegexp = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// interpolate replaces ${ENV_VAR} with the value of the environment variable
+// and ${metadata:key} with the matching field from the instance metadata.
+// $${ can be used to get a literal ${ into the config.
+func interpolate(s string, im instancemetadata.InstanceMetadata) (string, error) {
+	var result *multierror.Error
+	out := interpolationRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		name := match[2 : len(match)-1]
+		if strings.HasPrefix(name, "metadata:") {
+			key := strings.TrimPrefix(name, "metadata:")
+			if v, ok := im.Lookup(key); ok {
+				return v
+			}
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Unknown instance metadata key '%s' in config", key)))
+			return match
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			return v
+		}
+		result = multierror.Append(result, errors.New(fmt.Sprintf("Environment variable '%s' used in config is not set", name)))
+		return match
+	})
+	return out, result.ErrorOrNil()
+}
+
+// typedScalar returns a value which has been interpolated as the number or
+// boolean it would have been if it had been written in the config, so that
+// it can be used for settings which are numbers or booleans. Anything else
+// stays a string.
+func typedScalar(s string) interface{} {
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	switch v.(type) {
+	case int, float64, bool:
+		if out, err := yaml.Marshal(v); err == nil && strings.TrimSpace(string(out)) == s {
+			return v
+		}
+	}
+	return s
+}
+
+// interpolateValues interpolates every string value in a parsed config
+// document. Keys, and the structure of the document, are left alone, so
+// whatever a value is replaced with, it is only ever that value.
+func interpolateValues(v interface{}, im instancemetadata.InstanceMetadata) (interface{}, error) {
+	var result *multierror.Error
+	switch v := v.(type) {
+	case string:
+		out, err := interpolate(v, im)
+		if err != nil || out == v {
+			return v, err
+		}
+		return typedScalar(out), nil
+	case map[interface{}]interface{}:
+		for k, e := range v {
+			out, err := interpolateValues(e, im)
+			if err != nil {
+				result = multierror.Append(result, err)
+			}
+			v[k] = out
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			out, err := interpolateValues(e, im)
+			if err != nil {
+				result = multierror.Append(result, err)
+			}
+			v[k] = out
+		}
+	case []interface{}:
+		for i, e := range v {
+			out, err := interpolateValues(e, im)
+			if err != nil {
+				result = multierror.Append(result, err)
+			}
+			v[i] = out
+		}
+	}
+	return v, result.ErrorOrNil()
+}
+
+func isJSON(filename string, data []byte) bool {
+	if strings.HasSuffix(filename, ".json") {
+		return true
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// unmarshal parses a YAML or JSON config document into c. JSON is decoded
+// generically and then repacked as YAML so that only one set of struct tags
+// needs to be maintained.
+func unmarshal(filename string, data []byte, c *Config) error {
+	if isJSON(filename, data) {
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return errors.New(fmt.Sprintf("Error parsing JSON in %s: %s", filename, err.Error()))
+		}
+		repacked, err := yaml.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		data = repacked
+	}
+	return yaml.Unmarshal(data, c)
+}
+
+// parse parses a YAML or JSON config document into c, interpolating its
+// values. Documents without anything to interpolate are unmarshalled
+// directly, so that errors refer to the lines in them.
+func parse(filename string, data []byte, im instancemetadata.InstanceMetadata, c *Config) error {
+	if !interpolationRegexp.Match(data) {
+		return unmarshal(filename, data, c)
+	}
+	var doc interface{}
+	if isJSON(filename, data) {
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return errors.New(fmt.Sprintf("Error parsing JSON in %s: %s", filename, err.Error()))
+		}
+	} else if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	doc, err := interpolateValues(doc, im)
+	if err != nil {
+		return err
+	}
+	repacked, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(repacked, c)
+}
+
+func loadFile(filename string, im instancemetadata.InstanceMetadata, c *Config) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return parse(filename, data, im, c)
+}
+
+func isFragment(name string) bool {
+	for _, ext := range []string{".yaml", ".yml", ".json"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadConfD reads every fragment in the conf.d directory (in lexical order)
+// and merges it into c.
+func (c *Config) loadConfD(filename string, im instancemetadata.InstanceMetadata) error {
+	dir := c.ConfD
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(filename), dir)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() && isFragment(f.Name()) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	var result *multierror.Error
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		fragment := new(Config)
+		if err := loadFile(path, im, fragment); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		if err := c.merge(path, fragment); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+func mergeHealthchecks(into map[string]*healthcheck.Healthcheck, from map[string]*healthcheck.Healthcheck, what string, path string) (map[string]*healthcheck.Healthcheck, error) {
+	var result *multierror.Error
+	if into == nil && len(from) > 0 {
+		into = make(map[string]*healthcheck.Healthcheck)
+	}
+	for k, v := range from {
+		if _, ok := into[k]; ok {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("%s '%s' in %s is already defined", what, k, path)))
+			continue
+		}
+		into[k] = v
+	}
+	return into, result.ErrorOrNil()
+}
+
+// merge adds the healthchecks, remote healthchecks and route tables from a
+// conf.d fragment, refusing to redefine anything which already exists.
+func (c *Config) merge(path string, fragment *Config) error {
+	var result *multierror.Error
+	if fragment.PollTime != 0 {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("poll_time cannot be set in conf.d fragment %s", path)))
+	}
+	if fragment.ConfD != "" {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("conf_d cannot be set in conf.d fragment %s", path)))
+	}
+	if fragment.Safety != nil {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("safety cannot be set in conf.d fragment %s", path)))
+	}
+	if fragment.BGP != nil {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("bgp cannot be set in conf.d fragment %s", path)))
+	}
+	if fragment.InstanceTags != nil {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("instance_tags cannot be set in conf.d fragment %s", path)))
+	}
+	if fragment.Notifications != nil {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("notifications cannot be set in conf.d fragment %s", path)))
+	}
+	if fragment.DisableSrcDstCheck {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("ensure_source_dest_check_disabled cannot be set in conf.d fragment %s", path)))
+	}
+	var err error
+	c.Healthchecks, err = mergeHealthchecks(c.Healthchecks, fragment.Healthchecks, "Healthcheck", path)
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+	c.RemoteHealthcheckTemplates, err = mergeHealthchecks(c.RemoteHealthcheckTemplates, fragment.RemoteHealthcheckTemplates, "Remote healthcheck", path)
+	if err != nil {
+		result = multierror.Append(result, err)
+	}
+	if c.RouteTables == nil && len(fragment.RouteTables) > 0 {
+		c.RouteTables = make(map[string]*RouteTable)
+	}
+	for k, v := range fragment.RouteTables {
+		if _, ok := c.RouteTables[k]; ok {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route table '%s' in %s is already defined", k, path)))
+			continue
+		}
+		c.RouteTables[k] = v
+	}
+	if c.TransitGatewayRouteTables == nil && len(fragment.TransitGatewayRouteTables) > 0 {
+		c.TransitGatewayRouteTables = make(map[string]*TransitGatewayTable)
+	}
+	for k, v := range fragment.TransitGatewayRouteTables {
+		if _, ok := c.TransitGatewayRouteTables[k]; ok {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Transit gateway route table '%s' in %s is already defined", k, path)))
+			continue
+		}
+		c.TransitGatewayRouteTables[k] = v
+	}
+	return result.ErrorOrNil()
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/bobtfish/AWSnycast/aws"
 	"github.com/bobtfish/AWSnycast/healthcheck"
@@ -15,7 +16,14 @@ type RouteTable struct {
 	Name           string                  `yaml:"-"`
 	Find           RouteTableFindSpec      `yaml:"find"`
 	ManageRoutes   []*aws.ManageRoutesSpec `yaml:"manage_routes"`
+	Region         string                  `yaml:"region"`          // Defaults to the instance's region
+	AssumeRoleArn  string                  `yaml:"assume_role_arn"` // For route tables in another account
+	ExternalID     string                  `yaml:"external_id"`
 	ec2RouteTables []*ec2.RouteTable
+	manager        aws.RouteTableManager
+	// Set when routes may be added later from instance tags, so an empty
+	// manage_routes is not an error.
+	routesFromInstanceTags bool
 }
 
 func (r *RouteTable) UpdateEc2RouteTables(rt []*ec2.RouteTable) error {
@@ -36,20 +44,100 @@ func (r *RouteTable) UpdateEc2RouteTables(rt []*ec2.RouteTable) error {
 	return nil
 }
 
+// Manager returns the manager for the route table's region and account, as
+// chosen when it was validated.
+func (r *RouteTable) Manager() aws.RouteTableManager {
+	return r.manager
+}
+
+// elsewhere is if the route table is in another region or account from the
+// instance, so its routes cannot point to this instance.
+func (r *RouteTable) elsewhere(meta instancemetadata.InstanceMetadata) bool {
+	return r.AssumeRoleArn != "" || (r.Region != "" && r.Region != meta.Region)
+}
+
+// managerFor chooses the manager for the route table's region and account,
+// which is manager unless the route table is in another region or account.
+func (r *RouteTable) managerFor(manager aws.RouteTableManager) (aws.RouteTableManager, error) {
+	if r.ExternalID != "" && r.AssumeRoleArn == "" {
+		return nil, errors.New(fmt.Sprintf("Route table '%s' has external_id set, but no assume_role_arn", r.Name))
+	}
+	if r.AssumeRoleArn != "" && !strings.HasPrefix(r.AssumeRoleArn, "arn:") {
+		return nil, errors.New(fmt.Sprintf("Route table '%s' assume_role_arn '%s' is not an ARN", r.Name, r.AssumeRoleArn))
+	}
+	if r.Region == "" && r.AssumeRoleArn == "" {
+		return manager, nil
+	}
+	if p, ok := manager.(aws.ManagerProvider); ok {
+		return p.ManagerFor(r.Region, r.AssumeRoleArn, r.ExternalID)
+	}
+	return nil, errors.New(fmt.Sprintf("Route table '%s' sets region or assume_role_arn, which cannot be used with this route table manager", r.Name))
+}
+
+// AffectedBy returns true if an event concerns one of the route tables found
+// at the last update, an instance which one of their routes points to, or an
+// instance which routes are managed for.
+func (r *RouteTable) AffectedBy(event aws.RouteEvent) bool {
+	for _, rtb := range r.ec2RouteTables {
+		for _, id := range event.RouteTableIds {
+			if *(rtb.RouteTableId) == id {
+				return true
+			}
+		}
+		for _, route := range rtb.Routes {
+			for _, id := range event.InstanceIds {
+				if route.InstanceId != nil && *(route.InstanceId) == id {
+					return true
+				}
+			}
+		}
+	}
+	for _, manageRoute := range r.ManageRoutes {
+		for _, id := range event.InstanceIds {
+			if manageRoute.Instance == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RunEc2Updates manages every route in every matching route table. A route
+// which fails does not stop the others being managed; the first error is
+// returned once all routes have been tried.
 func (r *RouteTable) RunEc2Updates(manager aws.RouteTableManager, noop bool) error {
+	var firstErr error
+	managed, failed := 0, 0
 	for _, rtb := range r.ec2RouteTables {
 		contextLogger := log.WithFields(log.Fields{
 			"rtb": *(rtb.RouteTableId),
 		})
 		contextLogger.Debug("Finder found route table")
 		for _, manageRoute := range r.ManageRoutes {
-			contextLogger.WithFields(log.Fields{"cidr": manageRoute.Cidr}).Debug("Trying to manage route")
+			routeLogger := contextLogger.WithFields(log.Fields{"cidr": manageRoute.Cidr})
+			routeLogger.Debug("Trying to manage route")
 			if err := manager.ManageInstanceRoute(*rtb, *manageRoute, noop); err != nil {
-				return err
+				routeLogger.WithFields(log.Fields{"err": err.Error()}).Error("Error managing route")
+				failed++
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
 			}
+			managed++
 		}
 	}
-	return nil
+	contextLogger := log.WithFields(log.Fields{
+		"route_tables":   len(r.ec2RouteTables),
+		"routes_managed": managed,
+		"routes_failed":  failed,
+	})
+	if failed > 0 {
+		contextLogger.Warn("Some routes could not be managed")
+	} else {
+		contextLogger.Debug("Managed routes")
+	}
+	return firstErr
 }
 
 func (r *RouteTable) Validate(meta instancemetadata.InstanceMetadata, manager aws.RouteTableManager, name string, healthchecks map[string]*healthcheck.Healthcheck, remotehealthchecks map[string]*healthcheck.Healthcheck) error {
@@ -58,7 +146,7 @@ func (r *RouteTable) Validate(meta instancemetadata.InstanceMetadata, manager aw
 		r.ManageRoutes = make([]*aws.ManageRoutesSpec, 0)
 	}
 	var result *multierror.Error
-	if len(r.ManageRoutes) == 0 {
+	if len(r.ManageRoutes) == 0 && !r.routesFromInstanceTags {
 		result = multierror.Append(result, errors.New(fmt.Sprintf("No manage_routes key in route table '%s'", r.Name)))
 	}
 	if err := r.Find.Validate(name); err != nil {
@@ -67,9 +155,18 @@ func (r *RouteTable) Validate(meta instancemetadata.InstanceMetadata, manager aw
 	if r.ec2RouteTables == nil {
 		r.ec2RouteTables = make([]*ec2.RouteTable, 0)
 	}
+	m, err := r.managerFor(manager)
+	if err != nil {
+		return multierror.Append(result, err)
+	}
+	r.manager = m
 	for _, v := range r.ManageRoutes {
-		if err := v.Validate(meta, manager, name, healthchecks, remotehealthchecks); err != nil {
+		if err := v.Validate(meta, m, name, healthchecks, remotehealthchecks); err != nil {
 			result = multierror.Append(result, err)
+			continue
+		}
+		if v.InstanceIsSelf && r.elsewhere(meta) {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Route tables %s, route %s uses instance SELF, but the route table is in another region or account", name, v.Cidr)))
 		}
 	}
 
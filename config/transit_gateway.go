@@ -0,0 +1,212 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bobtfish/AWSnycast/aws"
+	"github.com/bobtfish/AWSnycast/healthcheck"
+	"github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// TransitGatewayRouteTableFindSpec finds transit gateway route tables, in
+// the same way as a RouteTableFindSpec finds VPC route tables.
+type TransitGatewayRouteTableFindSpec struct {
+	NoResultsOk bool                   `yaml:"no_results_ok"`
+	Type        string                 `yaml:"type"`
+	Not         bool                   `yaml:"not"`
+	Config      map[string]interface{} `yaml:"config"`
+}
+
+var transitGatewayFindTypes map[string]func(TransitGatewayRouteTableFindSpec) (aws.TransitGatewayRouteTableFilter, error)
+
+func init() {
+	transitGatewayFindTypes = make(map[string]func(TransitGatewayRouteTableFindSpec) (aws.TransitGatewayRouteTableFilter, error))
+	transitGatewayFindTypes["by_tag"] = func(spec TransitGatewayRouteTableFindSpec) (aws.TransitGatewayRouteTableFilter, error) {
+		var result *multierror.Error
+		key, ok := spec.Config["key"].(string)
+		if !ok {
+			result = multierror.Append(result, errors.New("No key in config for by_tag transit gateway route table finder"))
+		}
+		value, ok := spec.Config["value"].(string)
+		if !ok {
+			result = multierror.Append(result, errors.New("No value in config for by_tag transit gateway route table finder"))
+		}
+		if err := result.ErrorOrNil(); err != nil {
+			return nil, err
+		}
+		return aws.TransitGatewayRouteTableFilterTagMatch{Key: key, Value: value}, nil
+	}
+	transitGatewayFindTypes["by_tag_regexp"] = func(spec TransitGatewayRouteTableFindSpec) (aws.TransitGatewayRouteTableFilter, error) {
+		var result *multierror.Error
+		key, ok := spec.Config["key"].(string)
+		if !ok {
+			result = multierror.Append(result, errors.New("No key in config for by_tag_regexp transit gateway route table finder"))
+		}
+		var re *regexp.Regexp
+		if v, ok := spec.Config["regexp"].(string); !ok {
+			result = multierror.Append(result, errors.New("No regexp in config for by_tag_regexp transit gateway route table finder"))
+		} else {
+			var err error
+			re, err = regexp.Compile(v)
+			if err != nil {
+				result = multierror.Append(result, fmt.Errorf("Invalid regexp in config for by_tag_regexp transit gateway route table finder: %s", err))
+			}
+		}
+		if err := result.ErrorOrNil(); err != nil {
+			return nil, err
+		}
+		return aws.TransitGatewayRouteTableFilterTagRegexMatch{Key: key, Regexp: re}, nil
+	}
+	transitGatewayFindTypes["and"] = func(spec TransitGatewayRouteTableFindSpec) (aws.TransitGatewayRouteTableFilter, error) {
+		filters, err := getTransitGatewayFiltersListForSpec(spec)
+		if err != nil {
+			return nil, appendMultiError(err, "for and transit gateway route table finder")
+		}
+		return aws.TransitGatewayRouteTableFilterAnd{Filters: filters}, nil
+	}
+	transitGatewayFindTypes["or"] = func(spec TransitGatewayRouteTableFindSpec) (aws.TransitGatewayRouteTableFilter, error) {
+		filters, err := getTransitGatewayFiltersListForSpec(spec)
+		if err != nil {
+			return nil, appendMultiError(err, "for or transit gateway route table finder")
+		}
+		return aws.TransitGatewayRouteTableFilterOr{Filters: filters}, nil
+	}
+	transitGatewayFindTypes["transit_gateway"] = func(spec TransitGatewayRouteTableFindSpec) (aws.TransitGatewayRouteTableFilter, error) {
+		id, ok := spec.Config["transit_gateway_id"].(string)
+		if !ok {
+			return nil, errors.New("No transit_gateway_id in config for transit_gateway transit gateway route table finder")
+		}
+		return aws.TransitGatewayRouteTableFilterTransitGateway{TransitGatewayId: id}, nil
+	}
+	transitGatewayFindTypes["default"] = func(spec TransitGatewayRouteTableFindSpec) (aws.TransitGatewayRouteTableFilter, error) {
+		return aws.TransitGatewayRouteTableFilterDefault{}, nil
+	}
+}
+
+func getTransitGatewayFiltersListForSpec(spec TransitGatewayRouteTableFindSpec) ([]aws.TransitGatewayRouteTableFilter, *multierror.Error) {
+	var result *multierror.Error
+	v, ok := spec.Config["filters"]
+	if !ok {
+		return nil, multierror.Append(errors.New("No filters in config"))
+	}
+	var filters []aws.TransitGatewayRouteTableFilter
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, multierror.Append(result, errors.New(fmt.Sprintf("unexpected type %T for 'filters' key", v)))
+	}
+	for _, filter := range list {
+		filterRepacked, err := yaml.Marshal(filter)
+		if err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		var spec TransitGatewayRouteTableFindSpec
+		if err := yaml.Unmarshal(filterRepacked, &spec); err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		filter, err := spec.GetFilter()
+		if err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		filters = append(filters, filter)
+	}
+	return filters, result
+}
+
+func (spec TransitGatewayRouteTableFindSpec) GetFilter() (aws.TransitGatewayRouteTableFilter, error) {
+	genFilter, found := transitGatewayFindTypes[spec.Type]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("Transit gateway route table finder type '%s' not found in the registry", spec.Type))
+	}
+	filter, err := genFilter(spec)
+	if err != nil {
+		return filter, err
+	}
+	if spec.Not {
+		return aws.TransitGatewayRouteTableFilterNot{Filter: filter}, nil
+	}
+	return filter, nil
+}
+
+func (r *TransitGatewayRouteTableFindSpec) Validate(name string) error {
+	var result *multierror.Error
+	if r.Config == nil {
+		r.Config = make(map[string]interface{})
+	}
+	if r.Type == "" {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("Transit gateway route find spec %s needs a type key", name)))
+	} else if _, err := r.GetFilter(); err != nil {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("Transit gateway route find spec %s: %s", name, err.Error())))
+	}
+	return result.ErrorOrNil()
+}
+
+// TransitGatewayTable is a set of routes to manage in the transit
+// gateway route tables which are found.
+type TransitGatewayTable struct {
+	Name           string                                `yaml:"-"`
+	Find           TransitGatewayRouteTableFindSpec      `yaml:"find"`
+	ManageRoutes   []*aws.ManageTransitGatewayRoutesSpec `yaml:"manage_routes"`
+	ec2RouteTables []*ec2.TransitGatewayRouteTable
+}
+
+func (r *TransitGatewayTable) Validate(name string, healthchecks map[string]*healthcheck.Healthcheck, remotehealthchecks map[string]*healthcheck.Healthcheck) error {
+	r.Name = name
+	var result *multierror.Error
+	if len(r.ManageRoutes) == 0 {
+		result = multierror.Append(result, errors.New(fmt.Sprintf("No manage_routes key in transit gateway route table '%s'", name)))
+	}
+	if err := r.Find.Validate(name); err != nil {
+		result = multierror.Append(result, err)
+	}
+	for _, v := range r.ManageRoutes {
+		if err := v.Validate(name, healthchecks, remotehealthchecks); err != nil {
+			result = multierror.Append(result, err)
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// UpdateEc2RouteTables finds the transit gateway route tables to manage
+// routes in, which are managed by manager when their healthchecks change
+// state.
+func (r *TransitGatewayTable) UpdateEc2RouteTables(rt []*ec2.TransitGatewayRouteTable, manager aws.TransitGatewayManager) error {
+	filter, err := r.Find.GetFilter()
+	if err != nil {
+		return err
+	}
+	r.ec2RouteTables = aws.FilterTransitGatewayRouteTables(filter, rt)
+	for _, manageRoute := range r.ManageRoutes {
+		manageRoute.UpdateEc2RouteTables(r.ec2RouteTables, manager)
+	}
+	if len(r.ec2RouteTables) == 0 && !r.Find.NoResultsOk {
+		return errors.New(fmt.Sprintf("No transit gateway route table in AWS matched filter spec in transit gateway route table '%s'", r.Name))
+	}
+	return nil
+}
+
+// RunEc2Updates manages every route in every matching transit gateway route
+// table. A route which fails does not stop the others being managed; the
+// first error is returned once all routes have been tried.
+func (r *TransitGatewayTable) RunEc2Updates(manager aws.TransitGatewayManager, noop bool) error {
+	var firstErr error
+	for _, rtb := range r.ec2RouteTables {
+		contextLogger := log.WithFields(log.Fields{"tgw_rtb": *(rtb.TransitGatewayRouteTableId)})
+		for _, manageRoute := range r.ManageRoutes {
+			if err := manager.ManageTransitGatewayRoute(*rtb, *manageRoute, noop); err != nil {
+				contextLogger.WithFields(log.Fields{"cidr": manageRoute.Cidr, "err": err.Error()}).Error("Error managing transit gateway route")
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	return firstErr
+}
@@ -1,52 +1,139 @@
 package daemon
 
 import (
+	"errors"
+	"reflect"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/bobtfish/AWSnycast/aws"
+	"github.com/bobtfish/AWSnycast/bgp"
+	"github.com/bobtfish/AWSnycast/clock"
 	"github.com/bobtfish/AWSnycast/config"
 	"github.com/bobtfish/AWSnycast/instancemetadata"
+	"github.com/bobtfish/AWSnycast/notify"
 	log "github.com/sirupsen/logrus"
 )
 
+// How long to wait before trying again if receiving events fails
+const eventErrorBackoff = 10 * time.Second
+
+// How often to check which routes should be announced over BGP
+const bgpUpdateEvery = time.Second
+
 type Daemon struct {
 	oneShot           bool
 	noop              bool
 	ConfigFile        string
+	SSMParameter      string
+	ParameterFetcher  aws.ParameterFetcher
+	configVersion     int64
 	Debug             bool
 	Config            *config.Config
 	MetadataFetcher   instancemetadata.MetadataFetcher
+	MetadataEndpoint  string
+	MetadataTimeout   time.Duration
+	MetadataWait      time.Duration
+	StaticMetadata    *instancemetadata.InstanceMetadata // Used instead of the metadata service if set
+	EC2Endpoint       string
+	EC2RateLimit      float64 // EC2 API calls per second, 0 for no limit
+	EC2RateBurst      int     // If 0, the default rate limit is used
+	SQSQueueURL       string
+	EventSource       aws.EventSource // Made from SQSQueueURL if not set
+	eventChan         chan []aws.RouteEvent
+	eventQuitChan     chan bool
+	InterruptEvery    time.Duration // How often to check for interruption notices, 0 to not check
+	interruptWatcher  *instancemetadata.InterruptionWatcher
+	interruptChan     chan instancemetadata.InterruptionNotice
+	interrupted       bool
+	notifier          *notify.Notifier
+	safety            *aws.Safety
+	speaker           *bgp.Speaker
+	AuditLogFile      string // Where to record route changes, if set
+	AuditLogMaxSize   int64  // Bytes, 0 to never rotate the audit log
+	AuditLogBackups   int
 	RouteTableManager aws.RouteTableManager
+	TGWManager        aws.TransitGatewayManager // Made from RouteTableManager if not set
 	quitChan          chan bool
 	loopQuitChan      chan bool
 	FetchWait         time.Duration
+	Clock             clock.Clock // Defaults to clock.Real
+	listenersRunning  bool
 	instancemetadata.InstanceMetadata
 }
 
 func (d *Daemon) setupMetadataFetcher() {
 	if d.MetadataFetcher == nil {
-		d.MetadataFetcher = instancemetadata.New(d.Debug)
+		d.MetadataFetcher = instancemetadata.NewClient(d.MetadataEndpoint, d.MetadataTimeout, d.Debug)
 	}
 }
 
-func (d *Daemon) Setup() error {
+func (d *Daemon) getClock() clock.Clock {
+	if d.Clock == nil {
+		return clock.Real
+	}
+	return d.Clock
+}
+
+func (d *Daemon) fetchMetadata() (instancemetadata.InstanceMetadata, error) {
+	if d.StaticMetadata != nil {
+		return d.StaticMetadata.CompleteStatic()
+	}
 	d.setupMetadataFetcher()
-	im, err := instancemetadata.FetchMetadata(d.MetadataFetcher)
+	return instancemetadata.FetchMetadataWithRetry(d.MetadataFetcher, d.MetadataWait)
+}
+
+func (d *Daemon) Setup() error {
+	im, err := d.fetchMetadata()
 	if err != nil {
 		return err
 	}
 	d.InstanceMetadata = im
 
 	if d.RouteTableManager == nil {
-		d.RouteTableManager = aws.NewRouteTableManagerEC2(d.Region, d.Debug)
+		manager := aws.NewRouteTableManagerEC2WithEndpoint(d.Region, d.EC2Endpoint, d.Debug)
+		if d.EC2RateBurst > 0 {
+			manager.SetRateLimit(d.EC2RateLimit, d.EC2RateBurst)
+		}
+		d.RouteTableManager = manager
+	}
+	if p, ok := d.RouteTableManager.(aws.TransitGatewayManagerProvider); ok && d.TGWManager == nil {
+		d.TGWManager = p.TransitGatewayManager()
+	}
+	if c, ok := d.RouteTableManager.(aws.ClockSetter); ok {
+		c.SetClock(d.getClock())
+	}
+	if s, ok := d.RouteTableManager.(aws.SafetySetter); ok {
+		d.safety = aws.NewSafety(d.getClock())
+		s.SetSafety(d.safety)
+	}
+	if s, ok := d.RouteTableManager.(aws.AuditLogSetter); ok && d.AuditLogFile != "" {
+		a, err := aws.NewAuditLog(d.AuditLogFile, d.AuditLogMaxSize, d.AuditLogBackups, d.getClock())
+		if err != nil {
+			return err
+		}
+		a.Instance = d.Instance
+		s.SetAuditLog(a)
+	}
+	if d.EventSource == nil && d.SQSQueueURL != "" {
+		d.EventSource = aws.NewSQSEventSource(d.SQSQueueURL, d.Region)
 	}
 
-	config, err := config.New(d.ConfigFile, d.InstanceMetadata, d.RouteTableManager)
+	config, err := d.loadConfig()
 	if err != nil {
 		return err
 	}
 	d.Config = config
+	d.Config.SetClock(d.getClock())
+	d.setupNotifier(d.Config)
+	d.setupSafety(d.Config)
+	if err := d.setupBGP(d.Config); err != nil {
+		return err
+	}
+
+	if err := d.updateFromInstanceTags(); err != nil {
+		return err
+	}
 
 	if d.FetchWait == 0 {
 		d.FetchWait = time.Second * time.Duration(config.PollTime)
@@ -55,6 +142,186 @@ func (d *Daemon) Setup() error {
 	return setupHealthchecks(d.Config)
 }
 
+// setupNotifier sends notifications to the sinks in the notifications
+// section of a config, replacing the notifier for any previous config.
+func (d *Daemon) setupNotifier(c *config.Config) {
+	d.notifier.Stop()
+	d.notifier = nil
+	if sinks := c.Notifications.Sinks(d.getClock()); len(sinks) > 0 {
+		d.notifier = notify.NewNotifier(sinks, d.Instance, d.getClock())
+	}
+	c.SetNotifier(d.notifier)
+	if s, ok := d.RouteTableManager.(aws.NotifierSetter); ok {
+		s.SetNotifier(d.notifier)
+	}
+}
+
+// setupSafety enforces the safety limits in a config. The counts of routes
+// changed are kept from any previous config.
+func (d *Daemon) setupSafety(c *config.Config) {
+	if c.Safety != nil {
+		d.safety.SetConfig(*c.Safety)
+	} else {
+		d.safety.SetConfig(aws.SafetyConfig{})
+	}
+}
+
+// setupBGP starts a BGP speaker for the bgp section of a config. The speaker
+// for any previous config is kept if its config is unchanged, otherwise it
+// is stopped. If the new speaker cannot be started, the previous one is
+// started again, so that routes are still announced whilst the current
+// config is kept.
+func (d *Daemon) setupBGP(c *config.Config) error {
+	previous := d.speaker
+	if previous != nil {
+		if c.BGP != nil && reflect.DeepEqual(previous.Config(), *c.BGP) {
+			return nil
+		}
+		// The new speaker may listen on the same address, so this one
+		// has to be stopped first.
+		previous.Stop()
+		d.speaker = nil
+	}
+	if c.BGP == nil {
+		return nil
+	}
+	speaker := bgp.NewSpeaker(*c.BGP)
+	if err := speaker.Start(); err != nil {
+		if previous != nil {
+			d.restartBGP(previous.Config())
+		}
+		return err
+	}
+	d.speaker = speaker
+	return nil
+}
+
+// restartBGP starts a speaker again after it was stopped, announcing the
+// routes it was announcing.
+func (d *Daemon) restartBGP(c bgp.Config) {
+	speaker := bgp.NewSpeaker(c)
+	if err := speaker.Start(); err != nil {
+		log.WithFields(log.Fields{"err": err.Error()}).Error("Error restarting BGP speaker, routes are no longer announced")
+		return
+	}
+	d.speaker = speaker
+	d.updateBGP()
+}
+
+func (d *Daemon) stopBGP() {
+	if d.speaker != nil {
+		d.speaker.Stop()
+	}
+}
+
+// updateBGP announces the routes which are routed to this instance and
+// healthy, and withdraws all others.
+func (d *Daemon) updateBGP() {
+	if d.speaker == nil {
+		return
+	}
+	cidrs := make([]string, 0)
+	for _, configRouteTables := range d.Config.RouteTables {
+		for _, mr := range configRouteTables.ManageRoutes {
+			if mr.InstanceIsSelf && !mr.Released() && mr.Owned() && mr.Healthy() {
+				cidrs = append(cidrs, mr.Cidr)
+			}
+		}
+	}
+	if err := d.speaker.SetRoutes(cidrs); err != nil {
+		log.WithFields(log.Fields{"err": err.Error()}).Warn("Error setting routes announced over BGP")
+	}
+}
+
+func (d *Daemon) loadConfig() (*config.Config, error) {
+	if d.SSMParameter == "" && d.ParameterFetcher == nil {
+		return config.New(d.ConfigFile, d.InstanceMetadata, d.RouteTableManager)
+	}
+	if d.ParameterFetcher == nil {
+		d.ParameterFetcher = aws.NewSSMParameter(d.SSMParameter, d.Region)
+	}
+	value, version, err := d.ParameterFetcher.FetchParameter()
+	if err != nil {
+		return nil, err
+	}
+	c, err := config.ParseParameter(d.SSMParameter, []byte(value), d.InstanceMetadata, d.RouteTableManager)
+	if err != nil {
+		return nil, err
+	}
+	d.configVersion = version
+	log.WithFields(log.Fields{"parameter": d.SSMParameter, "version": version}).Info("Loaded config from SSM parameter")
+	return c, nil
+}
+
+// checkConfigParameter loads the config from the SSM parameter if it has a
+// new version, and switches to it if it is valid. If the new config is not
+// valid, the current config is kept.
+func (d *Daemon) checkConfigParameter() error {
+	if d.ParameterFetcher == nil {
+		return nil
+	}
+	value, version, err := d.ParameterFetcher.FetchParameter()
+	if err != nil {
+		return err
+	}
+	if version == d.configVersion {
+		return nil
+	}
+	contextLogger := log.WithFields(log.Fields{
+		"parameter":       d.SSMParameter,
+		"version":         version,
+		"current_version": d.configVersion,
+	})
+	contextLogger.Info("SSM parameter has changed, reloading config")
+	c, err := config.ParseParameter(d.SSMParameter, []byte(value), d.InstanceMetadata, d.RouteTableManager)
+	if err != nil {
+		return err
+	}
+	if err := setupHealthchecks(c); err != nil {
+		return err
+	}
+	if err := d.setupBGP(c); err != nil {
+		return err
+	}
+	c.SetClock(d.getClock())
+	d.setupNotifier(c)
+	d.setupSafety(c)
+	d.replaceConfig(c)
+	d.configVersion = version
+	contextLogger.Info("Switched to new config")
+	return nil
+}
+
+func (d *Daemon) replaceConfig(c *config.Config) {
+	running := d.listenersRunning
+	if running {
+		d.stopHealthChecks()
+	}
+	for _, configRouteTables := range d.Config.RouteTables {
+		for _, mr := range configRouteTables.ManageRoutes {
+			mr.Stop()
+		}
+	}
+	for _, t := range d.Config.TransitGatewayRouteTables {
+		for _, mr := range t.ManageRoutes {
+			mr.Stop()
+		}
+	}
+	if d.FetchWait == time.Second*time.Duration(d.Config.PollTime) {
+		d.FetchWait = time.Second * time.Duration(c.PollTime)
+	}
+	previous := d.Config
+	d.Config = c
+	d.listenersRunning = false
+	if err := d.updateFromInstanceTags(); err != nil {
+		log.WithFields(log.Fields{"err": err.Error()}).Warn("Error updating routes from instance tags")
+	}
+	c.CarryOver(previous)
+	if running {
+		d.runHealthChecks()
+	}
+}
+
 func setupHealthchecks(c *config.Config) error {
 	for _, v := range c.Healthchecks {
 		err := v.Setup()
@@ -62,6 +329,13 @@ func setupHealthchecks(c *config.Config) error {
 			return err
 		}
 	}
+	for _, rt := range c.RouteTables {
+		for _, mr := range rt.ManageRoutes {
+			if err := mr.Setup(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -75,33 +349,323 @@ func (d *Daemon) runHealthChecks() {
 			mr.StartHealthcheckListener(d.noop)
 		}
 	}
+	for _, t := range d.Config.TransitGatewayRouteTables {
+		for _, mr := range t.ManageRoutes {
+			mr.StartHealthcheckListener(d.noop)
+		}
+	}
+	d.listenersRunning = true
 	log.Debug("Started all healthchecks")
+	if d.interrupted {
+		d.forceHealthchecksUnhealthy()
+	}
+}
+
+func (d *Daemon) forceHealthchecksUnhealthy() {
+	for _, v := range d.Config.Healthchecks {
+		v.ForceUnhealthy()
+	}
+}
+
+// RunInterruptionWatcher watches the metadata service for notice that this
+// instance is going to be interrupted, so that routes can be handed over to
+// other instances before it goes away.
+func (d *Daemon) RunInterruptionWatcher() {
+	if d.InterruptEvery == 0 || d.StaticMetadata != nil || d.MetadataFetcher == nil {
+		return
+	}
+	d.interruptChan = make(chan instancemetadata.InterruptionNotice, 1)
+	d.interruptWatcher = instancemetadata.NewInterruptionWatcher(d.MetadataFetcher, d.getClock())
+	d.interruptWatcher.Every = d.InterruptEvery
+	d.interruptWatcher.Start(func(notice instancemetadata.InterruptionNotice) {
+		d.interruptChan <- notice
+	})
+}
+
+func (d *Daemon) stopInterruptionWatcher() {
+	if d.interruptWatcher != nil {
+		d.interruptWatcher.Stop()
+	}
+}
+
+// handleInterruption makes all local healthchecks unhealthy, and updates the
+// route tables straight away, so that routes through this instance are
+// deleted (unless never_delete is set) and taken over by other instances.
+func (d *Daemon) handleInterruption(notice instancemetadata.InterruptionNotice) {
+	log.WithFields(log.Fields{
+		"source": notice.Source,
+		"action": notice.Action,
+		"at":     notice.Time,
+	}).Warn("Instance is going to be interrupted, marking all healthchecks unhealthy")
+	d.interrupted = true
+	if d.Instance != "" {
+		d.markInterrupted(d.Instance)
+	}
+	d.forceHealthchecksUnhealthy()
+	if err := d.RunRouteTables(); err != nil {
+		log.WithFields(log.Fields{"err": err.Error()}).Warn("Error releasing routes after interruption notice")
+	}
+}
+
+// markInterrupted tells the route table manager that an instance is about
+// to be interrupted, so that routes through it are replaced.
+func (d *Daemon) markInterrupted(instanceID string) {
+	if m, ok := d.RouteTableManager.(aws.InterruptionMarker); ok {
+		m.MarkInstanceInterrupted(instanceID)
+	}
+}
+
+func (d *Daemon) fetchInstanceTags() (map[string]string, error) {
+	if d.Config.InstanceTags.Source == "api" {
+		tf, ok := d.RouteTableManager.(aws.InstanceTagFetcher)
+		if !ok {
+			return nil, errors.New("Route table manager cannot fetch instance tags from the EC2 API")
+		}
+		return tf.GetInstanceTags(d.Instance)
+	}
+	return instancemetadata.FetchInstanceTags(d.MetadataFetcher)
+}
+
+func (d *Daemon) updateFromInstanceTags() error {
+	if d.Config.InstanceTags == nil {
+		return nil
+	}
+	tags, err := d.fetchInstanceTags()
+	if err != nil {
+		return err
+	}
+	added, err := d.Config.ApplyInstanceTags(tags, d.InstanceMetadata, d.RouteTableManager)
+	if err != nil {
+		return err
+	}
+	if added == nil {
+		return nil
+	}
+	log.WithFields(log.Fields{"routes": len(added)}).Info("Routes updated from instance tags")
+	if d.listenersRunning {
+		for _, mr := range added {
+			mr.StartHealthcheckListener(d.noop)
+		}
+	}
+	return nil
 }
 
 func (d *Daemon) stopHealthChecks() {
 	for _, v := range d.Config.Healthchecks {
 		v.Stop()
 	}
+	d.listenersRunning = false
+}
+
+// managerFor returns the manager for a route table in the config, which is
+// different from the daemon's manager if it is in another region or account.
+func (d *Daemon) managerFor(configRouteTable *config.RouteTable) aws.RouteTableManager {
+	if m := configRouteTable.Manager(); m != nil {
+		return m
+	}
+	return d.RouteTableManager
 }
 
 func (d *Daemon) RunOneRouteTable(rt []*ec2.RouteTable, name string, configRouteTable *config.RouteTable) error {
 	if err := configRouteTable.UpdateEc2RouteTables(rt); err != nil {
 		return err
 	}
-	return configRouteTable.RunEc2Updates(d.RouteTableManager, d.noop)
+	return configRouteTable.RunEc2Updates(d.managerFor(configRouteTable), d.noop)
 }
 
 func (d *Daemon) RunRouteTables() error {
-	rt, err := d.RouteTableManager.GetRouteTables()
+	return d.runRouteTables(nil)
+}
+
+// runRouteTables updates the route tables in the config named in only, or
+// all of them if only is nil. The route tables in each region and account
+// are polled at the same time, so that one which is slow or failing (e.g.
+// because its role cannot be assumed) does not hold up the others.
+func (d *Daemon) runRouteTables(only map[string]bool) error {
+	byManager := make(map[aws.RouteTableManager][]string)
+	for name, configRouteTables := range d.Config.RouteTables {
+		if only != nil && !only[name] {
+			continue
+		}
+		manager := d.managerFor(configRouteTables)
+		byManager[manager] = append(byManager[manager], name)
+	}
+	// Without any route tables to update, the instance's own region is
+	// still polled, so that failing to fetch its route tables is noticed
+	if len(byManager) == 0 && only == nil {
+		byManager[d.RouteTableManager] = nil
+	}
+	results := make(chan pollResult, len(byManager))
+	for manager, names := range byManager {
+		go func(manager aws.RouteTableManager, names []string) {
+			results <- d.pollManager(manager, names)
+		}(manager, names)
+	}
+	// One route table failing should not stop the others being updated
+	var firstErr error
+	updated, failed := 0, 0
+	for range byManager {
+		res := <-results
+		updated += res.updated
+		failed += res.failed
+		if firstErr == nil {
+			firstErr = res.err
+		}
+	}
+	if only == nil {
+		tgwUpdated, tgwFailed, err := d.runTransitGatewayTables()
+		updated += tgwUpdated
+		failed += tgwFailed
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	contextLogger := log.WithFields(log.Fields{
+		"route_tables": updated,
+		"failed":       failed,
+	})
+	if stats, ok := d.RouteTableManager.(aws.EC2APIStats); ok {
+		calls, throttled := stats.EC2APICalls()
+		contextLogger = contextLogger.WithFields(log.Fields{"api_calls": calls, "api_throttled": throttled})
+	}
+	contextLogger.Debug("Finished updating route tables")
+	d.updateBGP()
+	return firstErr
+}
+
+// pollResult is how many route tables were updated by pollManager, how
+// many of them failed, and the first error.
+type pollResult struct {
+	updated int
+	failed  int
+	err     error
+}
+
+// pollManager fetches the route tables in the region and account of
+// manager, and updates the route tables in the config named in names.
+func (d *Daemon) pollManager(manager aws.RouteTableManager, names []string) pollResult {
+	res := pollResult{}
+	if p, ok := manager.(aws.PollStarter); ok {
+		p.StartPoll()
+	}
+	rt, fetchErr := manager.GetRouteTables()
+	if len(names) == 0 {
+		res.err = fetchErr
+		return res
+	}
+	for _, name := range names {
+		res.updated++
+		err := fetchErr
+		if err == nil {
+			err = d.RunOneRouteTable(rt, name, d.Config.RouteTables[name])
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"name": name, "err": err.Error()}).Error("Error updating route table")
+			res.failed++
+			if res.err == nil {
+				res.err = err
+			}
+		}
+	}
+	return res
+}
+
+// runTransitGatewayTables updates all of the transit gateway route tables in
+// the config, returning how many there are, how many failed, and the first
+// error.
+func (d *Daemon) runTransitGatewayTables() (int, int, error) {
+	tables := d.Config.TransitGatewayRouteTables
+	if len(tables) == 0 {
+		return 0, 0, nil
+	}
+	if d.TGWManager == nil {
+		return len(tables), len(tables), errors.New("Transit gateway route tables are configured, but cannot be managed")
+	}
+	rt, err := d.TGWManager.GetTransitGatewayRouteTables()
 	if err != nil {
-		return err
+		return len(tables), len(tables), err
 	}
-	for name, configRouteTables := range d.Config.RouteTables {
-		if err := d.RunOneRouteTable(rt, name, configRouteTables); err != nil {
-			return err
+	var firstErr error
+	failed := 0
+	for name, t := range tables {
+		err := t.UpdateEc2RouteTables(rt, d.TGWManager)
+		if err == nil {
+			err = t.RunEc2Updates(d.TGWManager, d.noop)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"name": name, "err": err.Error()}).Error("Error updating transit gateway route table")
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
-	return nil
+	return len(tables), failed, firstErr
+}
+
+// RunEventSource receives events from the EventSource, and passes them to
+// the sleep loop so that the route tables they affect are updated straight
+// away rather than at the next poll.
+func (d *Daemon) RunEventSource() {
+	if d.EventSource == nil {
+		return
+	}
+	d.eventChan = make(chan []aws.RouteEvent, 1)
+	d.eventQuitChan = make(chan bool, 1)
+	go func() {
+		for {
+			select {
+			case <-d.eventQuitChan:
+				return
+			default:
+			}
+			events, err := d.EventSource.ReceiveEvents()
+			if err != nil {
+				log.WithFields(log.Fields{"err": err.Error()}).Warn("Error receiving events")
+				clock.Sleep(d.getClock(), eventErrorBackoff)
+				continue
+			}
+			if len(events) > 0 {
+				select {
+				case d.eventChan <- events:
+				case <-d.eventQuitChan:
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (d *Daemon) runRouteTablesForEvents(events []aws.RouteEvent) {
+	affected := make(map[string]bool)
+	names := make([]string, 0)
+	for _, event := range events {
+		if event.DetailType == aws.SpotInterruptionWarning {
+			for _, id := range event.InstanceIds {
+				d.markInterrupted(id)
+			}
+		}
+		for name, rt := range d.Config.RouteTables {
+			if !affected[name] && rt.AffectedBy(event) {
+				affected[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if len(affected) == 0 {
+		log.WithFields(log.Fields{"events": len(events)}).Debug("Events do not affect any route tables")
+		return
+	}
+	log.WithFields(log.Fields{"route_tables": names}).Info("Updating route tables after event")
+	if err := d.runRouteTables(affected); err != nil {
+		log.WithFields(log.Fields{"err": err.Error()}).Warn("Error in route table event run")
+	}
+}
+
+func (d *Daemon) stopEventSource() {
+	if d.eventQuitChan != nil {
+		d.eventQuitChan <- true
+	}
 }
 
 func (d *Daemon) Run(oneShot bool, noop bool) int {
@@ -112,12 +676,29 @@ func (d *Daemon) Run(oneShot bool, noop bool) int {
 		return 1
 	}
 
-	if !d.RouteTableManager.InstanceIsRouter(d.Instance) {
-		log.WithFields(log.Fields{"instance_id": d.Instance}).Error("I am not a router (do not have src/destination checking disabled)")
-		return 1
+	if d.Instance != "" && !d.RouteTableManager.InstanceIsRouter(d.Instance) {
+		if !d.Config.DisableSrcDstCheck {
+			log.WithFields(log.Fields{"instance_id": d.Instance}).Error("I am not a router (do not have src/destination checking disabled)")
+			return 1
+		}
+		if err := d.disableSourceDestCheck(); err != nil {
+			log.WithFields(log.Fields{"instance_id": d.Instance, "err": err.Error()}).Error("I am not a router, and could not disable src/destination checking")
+			return 1
+		}
+	}
+	for _, configRouteTables := range d.Config.RouteTables {
+		for _, mr := range configRouteTables.ManageRoutes {
+			if !mr.InstanceIsSelf && !d.managerFor(configRouteTables).InstanceIsRouter(mr.Instance) {
+				log.WithFields(log.Fields{"instance_id": mr.Instance, "cidr": mr.Cidr}).Error("Instance for route is not a router (does not have src/destination checking disabled)")
+				return 1
+			}
+		}
 	}
 
-	d.quitChan = make(chan bool, 1)
+	if d.quitChan == nil {
+		d.quitChan = make(chan bool, 1)
+	}
+	defer d.stopBGP()
 	d.runHealthChecks()
 	defer d.stopHealthChecks()
 	err := d.RunRouteTables()
@@ -129,6 +710,10 @@ func (d *Daemon) Run(oneShot bool, noop bool) int {
 	if oneShot {
 		d.quitChan <- true
 	} else {
+		d.RunInterruptionWatcher()
+		defer d.stopInterruptionWatcher()
+		d.RunEventSource()
+		defer d.stopEventSource()
 		d.RunSleepLoop()
 	}
 	<-d.quitChan
@@ -136,11 +721,34 @@ func (d *Daemon) Run(oneShot bool, noop bool) int {
 	return 0
 }
 
+// disableSourceDestCheck makes this instance a router, as
+// ensure_source_dest_check_disabled is set. In noop mode, nothing is changed.
+func (d *Daemon) disableSourceDestCheck() error {
+	contextLogger := log.WithFields(log.Fields{"instance_id": d.Instance})
+	if d.noop {
+		contextLogger.Warn("Not a router, would disable src/destination checking (noop)")
+		return nil
+	}
+	s, ok := d.RouteTableManager.(aws.SourceDestCheckDisabler)
+	if !ok {
+		return errors.New("Route table manager cannot disable src/destination checking")
+	}
+	nicID, err := s.DisableSourceDestCheck(d.Instance)
+	if err != nil {
+		return err
+	}
+	contextLogger.WithFields(log.Fields{"eni": nicID}).Info("Disabled src/destination checking")
+	return nil
+}
+
 func (d *Daemon) RunSleepLoop() {
 	go func() {
 
-		ticker := time.NewTicker(d.FetchWait)
-		fetch := ticker.C
+		fetchWait := d.FetchWait
+		ticker := d.getClock().NewTicker(fetchWait)
+		fetch := ticker.C()
+		bgpTicker := d.getClock().NewTicker(bgpUpdateEvery)
+		defer bgpTicker.Stop()
 
 		for {
 			select {
@@ -148,10 +756,31 @@ func (d *Daemon) RunSleepLoop() {
 				ticker.Stop()
 				return
 			case <-fetch:
+				if err := d.checkConfigParameter(); err != nil {
+					log.WithFields(log.Fields{"err": err.Error()}).Error("Error loading new config from SSM parameter, keeping current config")
+				}
+				if d.FetchWait != fetchWait {
+					ticker.Stop()
+					fetchWait = d.FetchWait
+					ticker = d.getClock().NewTicker(fetchWait)
+					fetch = ticker.C()
+				}
+				if err := d.updateFromInstanceTags(); err != nil {
+					log.WithFields(log.Fields{"err": err.Error()}).Warn("Error updating routes from instance tags, keeping current routes")
+				}
+				// Changes made by runs for events count towards the
+				// limit of the poll they are made in
+				d.safety.StartPoll()
 				err := d.RunRouteTables()
 				if err != nil {
 					log.WithFields(log.Fields{"err": err.Error()}).Warn("Error in route table poll run")
 				}
+			case events := <-d.eventChan:
+				d.runRouteTablesForEvents(events)
+			case notice := <-d.interruptChan:
+				d.handleInterruption(notice)
+			case <-bgpTicker.C():
+				d.updateBGP()
 			}
 		}
 	}()
@@ -9,8 +9,13 @@ import (
 	"github.com/bobtfish/AWSnycast/config"
 	"github.com/bobtfish/AWSnycast/healthcheck"
 	"github.com/bobtfish/AWSnycast/instancemetadata"
+	"github.com/bobtfish/AWSnycast/testhelpers"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
 	"os"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -102,6 +107,180 @@ func TestRunRouteTablesFailGetRouteTables(t *testing.T) {
 	}
 }
 
+func TestRunRouteTablesContinuesAfterError(t *testing.T) {
+	d := getD(true)
+	rtf := d.RouteTableManager.(*FakeRouteTableManager)
+	rtf.Tables = []*ec2.RouteTable{
+		&ec2.RouteTable{
+			RouteTableId: a.String("rtb-9696cffe"),
+			Tags:         []*ec2.Tag{&ec2.Tag{Key: a.String("Name"), Value: a.String("private a")}},
+		},
+	}
+	findByName := func(name string) config.RouteTableFindSpec {
+		return config.RouteTableFindSpec{
+			Type:   "by_tag",
+			Config: map[string]interface{}{"key": "Name", "value": name},
+		}
+	}
+	d.Config.RouteTables = map[string]*config.RouteTable{
+		"missing": &config.RouteTable{
+			Name:         "missing",
+			Find:         findByName("does not exist"),
+			ManageRoutes: []*aws.ManageRoutesSpec{&aws.ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-12345"}},
+		},
+		"private": &config.RouteTable{
+			Name:         "private",
+			Find:         findByName("private a"),
+			ManageRoutes: []*aws.ManageRoutesSpec{&aws.ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-12345"}},
+		},
+	}
+	err := d.RunRouteTables()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "No route table in AWS matched filter spec in route table 'missing'")
+	}
+	assert.Equal(t, *(rtf.RouteTable.RouteTableId), "rtb-9696cffe")
+}
+
+type FakeTransitGatewayManager struct {
+	Tables []*ec2.TransitGatewayRouteTable
+	Error  error
+	Routes []string
+}
+
+func (f *FakeTransitGatewayManager) GetTransitGatewayRouteTables() ([]*ec2.TransitGatewayRouteTable, error) {
+	return f.Tables, f.Error
+}
+
+func (f *FakeTransitGatewayManager) ManageTransitGatewayRoute(rtb ec2.TransitGatewayRouteTable, rs aws.ManageTransitGatewayRoutesSpec, noop bool) error {
+	f.Routes = append(f.Routes, *(rtb.TransitGatewayRouteTableId)+" "+rs.Cidr)
+	return nil
+}
+
+func TestRunRouteTablesTransitGateway(t *testing.T) {
+	d := getD(true)
+	tgw := &FakeTransitGatewayManager{Tables: []*ec2.TransitGatewayRouteTable{&ec2.TransitGatewayRouteTable{
+		TransitGatewayId:           a.String("tgw-0123456789abcdef0"),
+		TransitGatewayRouteTableId: a.String("tgw-rtb-0123456789abcdef0"),
+	}}}
+	d.Config.TransitGatewayRouteTables = map[string]*config.TransitGatewayTable{
+		"hub": &config.TransitGatewayTable{
+			Find: config.TransitGatewayRouteTableFindSpec{
+				Type:   "transit_gateway",
+				Config: map[string]interface{}{"transit_gateway_id": "tgw-0123456789abcdef0"},
+			},
+			ManageRoutes: []*aws.ManageTransitGatewayRoutesSpec{&aws.ManageTransitGatewayRoutesSpec{Cidr: "10.1.0.1/32", Attachment: "tgw-attach-1"}},
+		},
+	}
+	err := d.RunRouteTables()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Transit gateway route tables are configured, but cannot be managed")
+	}
+	d.TGWManager = tgw
+	assert.Nil(t, d.RunRouteTables())
+	assert.Equal(t, tgw.Routes, []string{"tgw-rtb-0123456789abcdef0 10.1.0.1/32"})
+
+	// Transit gateway route tables are only updated by polls, not events
+	assert.Nil(t, d.runRouteTables(map[string]bool{"hub": true}))
+	assert.Equal(t, len(tgw.Routes), 1)
+}
+
+// accountsRouteTableManager has a manager for route tables in another region.
+type accountsRouteTableManager struct {
+	*FakeRouteTableManager
+	Other *FakeRouteTableManager
+}
+
+func (m *accountsRouteTableManager) ManagerFor(region string, roleArn string, externalID string) (aws.RouteTableManager, error) {
+	return m.Other, nil
+}
+
+func TestRunRouteTablesOtherRegion(t *testing.T) {
+	d := getD(true)
+	private := &ec2.RouteTable{
+		RouteTableId: a.String("rtb-9696cffe"),
+		Tags:         []*ec2.Tag{&ec2.Tag{Key: a.String("Name"), Value: a.String("private")}},
+	}
+	other := NewFakeRouteTableManager()
+	other.Tables = []*ec2.RouteTable{&ec2.RouteTable{
+		RouteTableId: a.String("rtb-12345678"),
+		Tags:         []*ec2.Tag{&ec2.Tag{Key: a.String("Name"), Value: a.String("private")}},
+	}}
+	rtf := d.RouteTableManager.(*FakeRouteTableManager)
+	rtf.Tables = []*ec2.RouteTable{private}
+	manager := &accountsRouteTableManager{FakeRouteTableManager: rtf, Other: other}
+	d.RouteTableManager = manager
+	find := config.RouteTableFindSpec{
+		Type:   "by_tag",
+		Config: map[string]interface{}{"key": "Name", "value": "private"},
+	}
+	d.Config.RouteTables = map[string]*config.RouteTable{
+		"here": &config.RouteTable{
+			Find:         find,
+			ManageRoutes: []*aws.ManageRoutesSpec{&aws.ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-12345"}},
+		},
+		"there": &config.RouteTable{
+			Find:          find,
+			ManageRoutes:  []*aws.ManageRoutesSpec{&aws.ManageRoutesSpec{Cidr: "0.0.0.0/0", Instance: "i-12345"}},
+			Region:        "eu-west-1",
+			AssumeRoleArn: "arn:aws:iam::123456789012:role/AWSnycast",
+		},
+	}
+	for name, rt := range d.Config.RouteTables {
+		assert.Nil(t, rt.Validate(d.InstanceMetadata, manager, name, nil, nil))
+	}
+	assert.Nil(t, d.RunRouteTables())
+	assert.Equal(t, *(rtf.RouteTable.RouteTableId), "rtb-9696cffe")
+	assert.Equal(t, *(other.RouteTable.RouteTableId), "rtb-12345678")
+
+	// Failing to fetch the route tables in one region does not stop the others
+	// being updated
+	rtf.RouteTable = ec2.RouteTable{}
+	other.Error = errors.New("Cannot assume role")
+	err := d.RunRouteTables()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Cannot assume role")
+	}
+	assert.Equal(t, *(rtf.RouteTable.RouteTableId), "rtb-9696cffe")
+
+	// Nor does failing in the instance's own region
+	other.RouteTable = ec2.RouteTable{}
+	other.Error = nil
+	rtf.Error = errors.New("Whoops, AWS blew up")
+	err = d.RunRouteTables()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Whoops, AWS blew up")
+	}
+	assert.Equal(t, *(other.RouteTable.RouteTableId), "rtb-12345678")
+}
+
+func TestSetupSQSQueueURL(t *testing.T) {
+	d := getD(true)
+	d.SQSQueueURL = "https://sqs.us-west-1.amazonaws.com/123456789012/awsnycast"
+	assert.Nil(t, d.Setup())
+	if assert.NotNil(t, d.EventSource) {
+		assert.Equal(t, d.EventSource.(*aws.SQSEventSource).QueueURL, d.SQSQueueURL)
+	}
+}
+
+func TestHandleInterruption(t *testing.T) {
+	d := getD(true)
+	assert.Nil(t, d.Setup())
+	d.handleInterruption(instancemetadata.InterruptionNotice{Source: "spot", Action: "terminate"})
+	assert.Equal(t, d.interrupted, true)
+	for name, hc := range d.Config.Healthchecks {
+		assert.Equal(t, hc.IsHealthy(), false, name)
+		assert.Equal(t, hc.CanPassYet(), true, name)
+	}
+}
+
+func TestRunInterruptionWatcherStaticMetadata(t *testing.T) {
+	d := getD(true)
+	d.InterruptEvery = time.Second
+	d.StaticMetadata = &instancemetadata.InstanceMetadata{Region: "us-west-1"}
+	d.RunInterruptionWatcher()
+	assert.Nil(t, d.interruptWatcher)
+}
+
 func TestSetupNoMetadataService(t *testing.T) {
 	assert := assert.New(t)
 	fakeM := FakeMetadataFetcher{
@@ -353,6 +532,53 @@ func TestRunOneRouteTableUpsertRouteFail(t *testing.T) {
 	}
 }
 
+func TestSetupBGP(t *testing.T) {
+	d := getD(true)
+	d.ConfigFile = "../tests/bgp.yaml"
+	assert.Nil(t, d.Setup())
+	defer d.stopBGP()
+	if assert.NotNil(t, d.speaker) {
+		assert.NotNil(t, d.speaker.Addr())
+		assert.Equal(t, d.speaker.Config().RouterID, "127.0.0.1")
+	}
+	speaker := d.speaker
+
+	// Nothing is routed to this instance yet, so nothing is announced
+	d.updateBGP()
+	assert.Equal(t, d.speaker.Routes(), []string{})
+
+	assert.Nil(t, d.setupBGP(d.Config))
+	assert.True(t, d.speaker == speaker, "Speaker should be kept if the config is unchanged")
+
+	assert.Nil(t, d.setupBGP(&config.Config{}))
+	assert.Nil(t, d.speaker)
+	d.updateBGP()
+}
+
+func TestCheckConfigParameterBGPFails(t *testing.T) {
+	d := getD(true)
+	pf := &FakeParameterFetcher{Value: readTestConfig(t, "../tests/bgp.yaml"), Version: 1}
+	d.ParameterFetcher = pf
+	assert.Nil(t, d.Setup())
+	defer d.stopBGP()
+	old := d.Config
+
+	// The new speaker can't listen, as something else is
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pf.Value = strings.Replace(pf.Value, "listen: 127.0.0.1:0", "listen: "+l.Addr().String(), 1)
+	pf.Version = 2
+	assert.NotNil(t, d.checkConfigParameter())
+	assert.True(t, d.Config == old, "Config should be kept")
+	if assert.NotNil(t, d.speaker, "The previous speaker should be running") {
+		assert.NotNil(t, d.speaker.Addr())
+		assert.Equal(t, d.speaker.Config(), *old.BGP)
+	}
+}
+
 func TestRunSleepLoop(t *testing.T) {
 	d := getD(true)
 	assert.Nil(t, d.Setup())
@@ -395,6 +621,7 @@ func TestRunOneReal(t *testing.T) {
 		},
 	}
 	d.RouteTableManager.(*FakeRouteTableManager).Tables = awsRt
+	d.quitChan = make(chan bool, 1)
 	hasFinishedRunLoop := make(chan bool, 1)
 	go func() {
 		assert.Equal(t, d.Run(false, true), 0, "Run was not successful")
@@ -405,3 +632,213 @@ func TestRunOneReal(t *testing.T) {
 	finished := <-hasFinishedRunLoop
 	assert.Equal(t, finished, true)
 }
+
+func TestSetupInstanceTags(t *testing.T) {
+	d := getD(true)
+	d.ConfigFile = "../tests/instance_tags.yaml"
+	meta := d.MetadataFetcher.(FakeMetadataFetcher).Meta
+	meta["tags/instance"] = "awsnycast:route:default"
+	meta["tags/instance/awsnycast:route:default"] = "cidr=0.0.0.0/0,routetable=a,healthcheck=public"
+	assert.Nil(t, d.Setup())
+	if assert.Equal(t, len(d.Config.RouteTables["a"].ManageRoutes), 1) {
+		assert.Equal(t, d.Config.RouteTables["a"].ManageRoutes[0].Cidr, "0.0.0.0/0")
+	}
+	meta["tags/instance/awsnycast:route:default"] = "cidr=0.0.0.0/0,routetable=b"
+	d.runHealthChecks()
+	defer d.stopHealthChecks()
+	assert.Nil(t, d.updateFromInstanceTags())
+	assert.Equal(t, len(d.Config.RouteTables["a"].ManageRoutes), 0)
+	assert.Equal(t, len(d.Config.RouteTables["b"].ManageRoutes), 2)
+}
+
+func TestSetupInstanceTagsFail(t *testing.T) {
+	d := getD(true)
+	d.ConfigFile = "../tests/instance_tags.yaml"
+	err := d.Setup()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Error getting instance tags: Key tags/instance unknown")
+	}
+}
+
+func TestFetchInstanceTagsAPINotSupported(t *testing.T) {
+	d := getD(true)
+	d.Config.InstanceTags = &config.InstanceTagsConfig{Source: "api"}
+	_, err := d.fetchInstanceTags()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Route table manager cannot fetch instance tags from the EC2 API")
+	}
+}
+
+type FakeParameterFetcher struct {
+	Value   string
+	Version int64
+	Error   error
+}
+
+func (f *FakeParameterFetcher) FetchParameter() (string, int64, error) {
+	return f.Value, f.Version, f.Error
+}
+
+func readTestConfig(t *testing.T, filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func TestSetupSSMParameter(t *testing.T) {
+	d := getD(true)
+	d.SSMParameter = "/awsnycast/config"
+	d.ParameterFetcher = &FakeParameterFetcher{Value: readTestConfig(t, "../tests/awsnycast.yaml"), Version: 1}
+	assert.Nil(t, d.Setup())
+	assert.Equal(t, d.configVersion, int64(1))
+	_, ok := d.Config.Healthchecks["localservice"]
+	assert.Equal(t, ok, true)
+}
+
+func TestSetupSSMParameterFail(t *testing.T) {
+	d := getD(true)
+	d.ParameterFetcher = &FakeParameterFetcher{Error: errors.New("ParameterNotFound")}
+	err := d.Setup()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "ParameterNotFound")
+	}
+}
+
+func TestCheckConfigParameter(t *testing.T) {
+	d := getD(true)
+	pf := &FakeParameterFetcher{Value: readTestConfig(t, "../tests/awsnycast.yaml"), Version: 1}
+	d.ParameterFetcher = pf
+	assert.Nil(t, d.Setup())
+	d.runHealthChecks()
+	defer d.stopHealthChecks()
+	old := d.Config
+
+	assert.Nil(t, d.checkConfigParameter())
+	assert.Equal(t, d.Config, old, "Same version should not reload")
+
+	pf.Value = readTestConfig(t, "../tests/invalid.yaml")
+	pf.Version = 2
+	assert.NotNil(t, d.checkConfigParameter())
+	assert.Equal(t, d.Config, old, "Invalid config should be ignored")
+	assert.Equal(t, d.configVersion, int64(1))
+
+	pf.Value = readTestConfig(t, "../tests/awsnycast.json")
+	pf.Version = 3
+	assert.Nil(t, d.checkConfigParameter())
+	assert.NotEqual(t, d.Config, old)
+	assert.Equal(t, d.configVersion, int64(3))
+	assert.Equal(t, d.Config.PollTime, uint(60))
+	assert.Equal(t, old.Healthchecks["public"].IsRunning(), false)
+	assert.Equal(t, d.Config.Healthchecks["public"].IsRunning(), true)
+}
+
+// healthcheckListeners counts the goroutines listening for healthcheck
+// results for routes which were started by the calling goroutine, so that
+// those left running by other tests are not counted.
+func healthcheckListeners() int {
+	buf := make([]byte, 1<<16)
+	n := runtime.Stack(buf, false)
+	self := strings.Fields(string(buf[:n]))[1]
+	for {
+		n = runtime.Stack(buf, true)
+		if n < len(buf) {
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	count := 0
+	for _, g := range strings.Split(string(buf[:n]), "\n\n") {
+		if strings.Contains(g, "(*routeState).listen in goroutine "+self+"\n") {
+			count++
+		}
+	}
+	return count
+}
+
+// waitForHealthcheckListeners waits for there to be n healthcheck listeners
+// started by the calling goroutine, and returns how many there are.
+func waitForHealthcheckListeners(n int) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count := healthcheckListeners()
+		if count == n || time.Now().After(deadline) {
+			return count
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReloadEndsHealthcheckListeners(t *testing.T) {
+	d := getD(true)
+	pf := &FakeParameterFetcher{Value: readTestConfig(t, "../tests/awsnycast.yaml"), Version: 1}
+	d.ParameterFetcher = pf
+	assert.Nil(t, d.Setup())
+	d.runHealthChecks()
+	assert.Equal(t, healthcheckListeners(), 4)
+
+	pf.Value = readTestConfig(t, "../tests/awsnycast.json")
+	pf.Version = 2
+	assert.Nil(t, d.checkConfigParameter())
+	assert.Equal(t, waitForHealthcheckListeners(1), 1, "Listeners for the old config should have exited")
+
+	d.stopHealthChecks()
+	for _, rt := range d.Config.RouteTables {
+		for _, mr := range rt.ManageRoutes {
+			mr.Stop()
+		}
+	}
+	assert.Equal(t, waitForHealthcheckListeners(0), 0)
+}
+
+func TestSetupIMDSv2(t *testing.T) {
+	imds := testhelpers.NewFakeIMDS(getFakeMetadataFetcher(true).(FakeMetadataFetcher).Meta)
+	defer imds.Close()
+	imds.FailRequests = 1
+	d := getD(true)
+	d.MetadataFetcher = nil
+	d.MetadataEndpoint = imds.URL()
+	d.MetadataWait = 10 * time.Second
+	assert.Nil(t, d.Setup())
+	assert.Equal(t, d.Instance, "i-1234")
+	assert.Equal(t, d.Region, "us-west-1")
+	assert.Equal(t, imds.TokenRequests, 1)
+}
+
+func TestSetupStaticMetadata(t *testing.T) {
+	d := getD(false)
+	d.StaticMetadata = &instancemetadata.InstanceMetadata{
+		Instance:         "i-1234",
+		AvailabilityZone: "us-west-1a",
+	}
+	assert.Nil(t, d.Setup())
+	assert.Equal(t, d.Instance, "i-1234")
+	assert.Equal(t, d.Region, "us-west-1")
+}
+
+func TestSetupStaticMetadataNoRegion(t *testing.T) {
+	d := getD(true)
+	d.StaticMetadata = &instancemetadata.InstanceMetadata{Instance: "i-1234"}
+	err := d.Setup()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "A region or availability zone must be given when not using the metadata service")
+	}
+}
+
+func TestSetupStaticMetadataNoInstanceSELF(t *testing.T) {
+	d := getD(true)
+	d.StaticMetadata = &instancemetadata.InstanceMetadata{Region: "us-west-1"}
+	err := d.Setup()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "uses instance SELF, but the ID of this instance is not known")
+	}
+}
+
+func TestRunNotRouterCannotDisableSourceDestCheck(t *testing.T) {
+	d := getD(true)
+	d.ConfigFile = "../tests/simulator/ensure_router.yaml"
+	assert.Nil(t, d.Setup())
+	err := d.disableSourceDestCheck()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Route table manager cannot disable src/destination checking")
+	}
+}
@@ -0,0 +1,326 @@
+package daemon
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	a "github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/bobtfish/AWSnycast/aws"
+	"github.com/bobtfish/AWSnycast/clock"
+	"github.com/bobtfish/AWSnycast/healthcheck"
+	"github.com/bobtfish/AWSnycast/instancemetadata"
+	"github.com/bobtfish/AWSnycast/testhelpers"
+	"github.com/stretchr/testify/assert"
+)
+
+// A scenario runs several daemons against one simulated route table, using
+// a fake clock which moves forward a second at a time. Healthchecks in the
+// scenario configs have type 'scenario', and pass unless their destination
+// has been failed. Steps are scheduled at times from the start of the
+// scenario, for example:
+//
+//	s.at(5*time.Second, s.fail("10.0.1.10"))
+//	s.at(15*time.Second, s.expectRoute("192.168.1.1/32", "i-backup"))
+type scenario struct {
+	t       *testing.T
+	clock   *clock.Fake
+	ec2     *testhelpers.FakeEC2
+	lock    sync.Mutex
+	failing map[string]bool
+	checks  int
+	daemons map[string]*Daemon
+	events  map[string]*scenarioEventSource
+	steps   map[time.Duration][]scenarioStep
+	now     time.Duration
+	done    chan bool
+}
+
+type scenarioStep struct {
+	desc string
+	f    func()
+}
+
+type scenarioHealthcheck struct {
+	s           *scenario
+	destination string
+}
+
+func (h scenarioHealthcheck) Healthcheck() bool {
+	h.s.lock.Lock()
+	defer h.s.lock.Unlock()
+	h.s.checks++
+	return !h.s.failing[h.destination]
+}
+
+// scenarioEventSource is the event queue for one daemon, which receives
+// events about all instances in the scenario.
+type scenarioEventSource struct {
+	c    chan []aws.RouteEvent
+	done chan bool
+}
+
+func (e *scenarioEventSource) ReceiveEvents() ([]aws.RouteEvent, error) {
+	select {
+	case events := <-e.c:
+		return events, nil
+	case <-e.done:
+		return nil, nil
+	}
+}
+
+func newScenario(t *testing.T) *scenario {
+	s := &scenario{
+		t:       t,
+		clock:   clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)),
+		ec2:     testhelpers.NewFakeEC2(),
+		failing: make(map[string]bool),
+		daemons: make(map[string]*Daemon),
+		events:  make(map[string]*scenarioEventSource),
+		steps:   make(map[time.Duration][]scenarioStep),
+		done:    make(chan bool),
+	}
+	healthcheck.RegisterHealthcheck("scenario", func(h healthcheck.Healthcheck) (healthcheck.HealthChecker, error) {
+		return scenarioHealthcheck{s: s, destination: h.Destination}, nil
+	})
+	s.ec2.AddRouteTable(&ec2.RouteTable{
+		RouteTableId: a.String("rtb-private"),
+		VpcId:        a.String("vpc-1"),
+		Routes: []*ec2.Route{
+			{DestinationCidrBlock: a.String("10.0.0.0/16"), GatewayId: a.String("local"), State: a.String("active")},
+		},
+		Tags: []*ec2.Tag{{Key: a.String("Name"), Value: a.String("private")}},
+	})
+	return s
+}
+
+// daemon adds an instance to the simulation, with a daemon which will run
+// on it with the given config once started.
+func (s *scenario) daemon(instanceId string, ip string, configFile string) {
+	s.ec2.AddInstance(&testhelpers.FakeInstance{
+		InstanceId:       instanceId,
+		PrivateIpAddress: ip,
+		SubnetId:         "subnet-" + instanceId,
+		VpcId:            "vpc-1",
+		AvailabilityZone: "us-west-1a",
+	})
+	s.daemons[instanceId] = &Daemon{
+		ConfigFile: configFile,
+		StaticMetadata: &instancemetadata.InstanceMetadata{
+			Instance:         instanceId,
+			AvailabilityZone: "us-west-1a",
+			Subnet:           "subnet-" + instanceId,
+			IPAddress:        ip,
+		},
+		RouteTableManager: aws.NewRouteTableManagerEC2WithConn(s.ec2),
+		Clock:             s.clock,
+	}
+}
+
+// subscribe gives a daemon an event source, which is sent an event when any
+// instance is stopped.
+func (s *scenario) subscribe(instanceId string) {
+	e := &scenarioEventSource{c: make(chan []aws.RouteEvent, 10), done: s.done}
+	s.events[instanceId] = e
+	s.daemons[instanceId].EventSource = e
+}
+
+func (s *scenario) at(t time.Duration, steps ...scenarioStep) {
+	s.steps[t] = append(s.steps[t], steps...)
+}
+
+// start does what Daemon.Run does, without blocking.
+func (s *scenario) start(instanceId string) scenarioStep {
+	return scenarioStep{"start " + instanceId, func() {
+		d := s.daemons[instanceId]
+		if !assert.Nil(s.t, d.Setup()) {
+			return
+		}
+		d.runHealthChecks()
+		assert.Nil(s.t, d.RunRouteTables())
+		// Unbuffered, so that stopDaemon only carries on once the loop
+		// has finished what it was doing
+		d.loopQuitChan = make(chan bool)
+		// Daemons have no metadata service to watch, notices are sent by
+		// interrupt instead
+		d.interruptChan = make(chan instancemetadata.InterruptionNotice, 1)
+		d.RunEventSource()
+		d.RunSleepLoop()
+	}}
+}
+
+func (s *scenario) stopDaemon(d *Daemon) {
+	if d.loopQuitChan != nil {
+		d.loopQuitChan <- true
+		d.loopQuitChan = nil
+		d.stopHealthChecks()
+		d.stopEventSource()
+	}
+}
+
+// stopInstance stops both the daemon and the simulated instance, so that
+// routes to it become blackholes and healthchecks against it fail.
+func (s *scenario) stopInstance(instanceId string) scenarioStep {
+	return scenarioStep{"stop " + instanceId, func() {
+		d := s.daemons[instanceId]
+		s.stopDaemon(d)
+		s.ec2.SetInstanceState(instanceId, "stopped")
+		s.setFailing(d.StaticMetadata.IPAddress, true)
+		for _, e := range s.events {
+			e.c <- []aws.RouteEvent{{DetailType: "EC2 Instance State-change Notification", InstanceIds: []string{instanceId}}}
+		}
+	}}
+}
+
+// interrupt tells the daemon on an instance that the instance is going to
+// be interrupted, as its interruption watcher would.
+func (s *scenario) interrupt(instanceId string) scenarioStep {
+	return scenarioStep{"interruption notice on " + instanceId, func() {
+		s.daemons[instanceId].interruptChan <- instancemetadata.InterruptionNotice{Source: "spot", Action: "terminate", Time: s.clock.Now().Add(2 * time.Minute)}
+	}}
+}
+
+// spotWarning sends a spot interruption warning for an instance to all
+// subscribed daemons.
+func (s *scenario) spotWarning(instanceId string) scenarioStep {
+	return scenarioStep{"spot interruption warning for " + instanceId, func() {
+		for _, e := range s.events {
+			e.c <- []aws.RouteEvent{{DetailType: aws.SpotInterruptionWarning, InstanceIds: []string{instanceId}}}
+		}
+	}}
+}
+
+func (s *scenario) setFailing(ip string, failing bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failing[ip] = failing
+}
+
+// fail makes all healthchecks against ip fail, until it is recovered.
+func (s *scenario) fail(ip string) scenarioStep {
+	return scenarioStep{"healthchecks fail for " + ip, func() { s.setFailing(ip, true) }}
+}
+
+func (s *scenario) recover(ip string) scenarioStep {
+	return scenarioStep{"healthchecks pass for " + ip, func() { s.setFailing(ip, false) }}
+}
+
+// expectRoute checks which instance a route points to, an empty instance
+// meaning that there should be no route.
+func (s *scenario) expectRoute(cidr string, instanceId string) scenarioStep {
+	return scenarioStep{fmt.Sprintf("expect %s routed to '%s'", cidr, instanceId), func() {
+		target, _ := s.ec2.RouteTarget("rtb-private", cidr)
+		assert.Equal(s.t, target, instanceId, fmt.Sprintf("Route for %s at t=%s", cidr, s.now))
+	}}
+}
+
+// settle waits for the daemons to stop doing anything, by waiting for the
+// number of EC2 calls, healthchecks, pending timers and undelivered events
+// to stop changing.
+func (s *scenario) settle() {
+	last := ""
+	for quiet := 0; quiet < 3; {
+		time.Sleep(2 * time.Millisecond)
+		s.lock.Lock()
+		state := fmt.Sprintf("%d/%d/%d", s.ec2.Calls(), s.checks, s.clock.Timers())
+		s.lock.Unlock()
+		for _, e := range s.events {
+			state += fmt.Sprintf("/%d", len(e.c))
+		}
+		if state == last {
+			quiet++
+		} else {
+			quiet = 0
+			last = state
+		}
+	}
+}
+
+// run runs the scenario until the given time, and then stops all daemons.
+func (s *scenario) run(until time.Duration) {
+	defer s.ec2.Close()
+	ids := make([]string, 0)
+	for id := range s.daemons {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for s.now = 0; s.now <= until; s.now += time.Second {
+		if s.now > 0 {
+			s.clock.Advance(time.Second)
+		}
+		s.settle()
+		for _, step := range s.steps[s.now] {
+			s.t.Logf("t=%s: %s", s.now, step.desc)
+			step.f()
+			s.settle()
+		}
+	}
+	for _, id := range ids {
+		s.stopDaemon(s.daemons[id])
+	}
+	close(s.done)
+}
+
+func TestScenarioFailoverOnHealthcheck(t *testing.T) {
+	s := newScenario(t)
+	s.daemon("i-primary", "10.0.1.10", "../tests/scenario/primary.yaml")
+	s.daemon("i-backup", "10.0.2.10", "../tests/scenario/backup.yaml")
+	s.at(0, s.start("i-primary"), s.expectRoute("192.168.1.1/32", ""))
+	s.at(1*time.Second, s.expectRoute("192.168.1.1/32", "i-primary"))
+	s.at(3*time.Second, s.start("i-backup"))
+	s.at(5*time.Second, s.expectRoute("192.168.1.1/32", "i-primary"), s.fail("10.0.1.10"))
+	s.at(15*time.Second, s.expectRoute("192.168.1.1/32", "i-backup"))
+	s.at(20*time.Second, s.recover("10.0.1.10"))
+	s.at(25*time.Second, s.expectRoute("192.168.1.1/32", "i-primary"))
+	s.run(25 * time.Second)
+}
+
+func TestScenarioBackupPolls(t *testing.T) {
+	s := newScenario(t)
+	s.daemon("i-primary", "10.0.1.10", "../tests/scenario/primary.yaml")
+	s.daemon("i-backup", "10.0.2.10", "../tests/scenario/backup_poll.yaml")
+	s.at(0, s.start("i-primary"))
+	s.at(3*time.Second, s.start("i-backup"))
+	s.at(5*time.Second, s.expectRoute("192.168.1.1/32", "i-primary"), s.stopInstance("i-primary"))
+	// The backup has no healthchecks, so only notices the blackhole when it
+	// next polls, 10s after it started
+	s.at(12*time.Second, s.expectRoute("192.168.1.1/32", "i-primary"))
+	s.at(13*time.Second, s.expectRoute("192.168.1.1/32", "i-backup"))
+	s.run(13 * time.Second)
+}
+
+func TestScenarioBackupEvents(t *testing.T) {
+	s := newScenario(t)
+	s.daemon("i-primary", "10.0.1.10", "../tests/scenario/primary.yaml")
+	s.daemon("i-backup", "10.0.2.10", "../tests/scenario/backup_poll.yaml")
+	s.subscribe("i-backup")
+	s.at(0, s.start("i-primary"))
+	s.at(3*time.Second, s.start("i-backup"))
+	// Unlike TestScenarioBackupPolls, the backup takes over as soon as it
+	// hears that the primary has stopped, not at its next poll
+	s.at(5*time.Second, s.expectRoute("192.168.1.1/32", "i-primary"), s.stopInstance("i-primary"), s.expectRoute("192.168.1.1/32", "i-backup"))
+	s.run(6 * time.Second)
+}
+
+func TestScenarioSpotInterruptionWarning(t *testing.T) {
+	s := newScenario(t)
+	s.daemon("i-primary", "10.0.1.10", "../tests/scenario/primary.yaml")
+	s.daemon("i-backup", "10.0.2.10", "../tests/scenario/backup.yaml")
+	s.subscribe("i-backup")
+	s.at(0, s.start("i-primary"))
+	s.at(3*time.Second, s.start("i-backup"))
+	// The primary gives up the route as soon as it gets the notice, and the
+	// backup takes over as soon as it hears about it, rather than waiting for
+	// its remote healthcheck to fail
+	s.at(5*time.Second,
+		s.expectRoute("192.168.1.1/32", "i-primary"),
+		s.interrupt("i-primary"),
+		s.spotWarning("i-primary"),
+		s.expectRoute("192.168.1.1/32", "i-backup"),
+	)
+	s.at(10*time.Second, s.expectRoute("192.168.1.1/32", "i-backup"))
+	s.run(10 * time.Second)
+}
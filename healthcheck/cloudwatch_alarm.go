@@ -0,0 +1,113 @@
+package healthcheck
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	utils "github.com/bobtfish/AWSnycast/utils"
+	"github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	RegisterHealthcheck("cloudwatch_alarm", CloudWatchAlarmConstructor)
+}
+
+type MyCloudWatchConn interface {
+	DescribeAlarms(*cloudwatch.DescribeAlarmsInput) (*cloudwatch.DescribeAlarmsOutput, error)
+}
+
+// Clients are shared by all healthchecks in the same region
+var (
+	cloudWatchConns    = make(map[string]MyCloudWatchConn)
+	cloudWatchConnLock sync.Mutex
+	newCloudWatchConn  = func(region string) MyCloudWatchConn {
+		return cloudwatch.New(session.New(&aws.Config{Region: aws.String(region)}))
+	}
+)
+
+func getCloudWatchConn(region string) MyCloudWatchConn {
+	cloudWatchConnLock.Lock()
+	defer cloudWatchConnLock.Unlock()
+	if conn, ok := cloudWatchConns[region]; ok {
+		return conn
+	}
+	conn := newCloudWatchConn(region)
+	cloudWatchConns[region] = conn
+	return conn
+}
+
+// CloudWatchAlarmHealthCheck is healthy unless a CloudWatch alarm is in the
+// ALARM state. If the alarm can't be found, it is unhealthy.
+type CloudWatchAlarmHealthCheck struct {
+	Destination string
+	AlarmName   string
+	conn        MyCloudWatchConn
+}
+
+func (h CloudWatchAlarmHealthCheck) Healthcheck() bool {
+	contextLogger := log.WithFields(log.Fields{
+		"destination": h.Destination,
+		"alarm":       h.AlarmName,
+	})
+	out, err := h.conn.DescribeAlarms(&cloudwatch.DescribeAlarmsInput{
+		AlarmNames: []*string{aws.String(h.AlarmName)},
+		AlarmTypes: []*string{aws.String(cloudwatch.AlarmTypeMetricAlarm), aws.String(cloudwatch.AlarmTypeCompositeAlarm)},
+	})
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Info("Error describing alarm")
+		return false
+	}
+	state := ""
+	for _, alarm := range out.MetricAlarms {
+		state = aws.StringValue(alarm.StateValue)
+	}
+	for _, alarm := range out.CompositeAlarms {
+		state = aws.StringValue(alarm.StateValue)
+	}
+	if state == "" {
+		contextLogger.Info("Alarm not found")
+		return false
+	}
+	contextLogger = contextLogger.WithFields(log.Fields{"state": state})
+	if state == cloudwatch.StateValueAlarm {
+		contextLogger.Debug("Alarm is in ALARM state")
+		return false
+	}
+	contextLogger.Debug("Alarm OK")
+	return true
+}
+
+// CloudWatchAlarmConstructor makes a healthcheck from the alarm_name and
+// region config keys. The alarm name can include %DESTINATION% and
+// %INSTANCE_ID%, which are replaced with the address and instance ID that
+// the healthcheck is for, so that remote healthchecks can check a different
+// alarm for each instance.
+func CloudWatchAlarmConstructor(h Healthcheck) (HealthChecker, error) {
+	var result *multierror.Error
+	hc := CloudWatchAlarmHealthCheck{
+		Destination: h.Destination,
+	}
+	if val, ok := h.Config["alarm_name"]; ok {
+		hc.AlarmName = strings.Replace(utils.GetAsString(val), "%DESTINATION%", h.Destination, -1)
+		if strings.Contains(hc.AlarmName, "%INSTANCE_ID%") {
+			if h.instance == "" {
+				result = multierror.Append(result, errors.New(fmt.Sprintf("alarm_name '%s' uses %%INSTANCE_ID%%, but the instance ID of %s is not known", hc.AlarmName, h.Destination)))
+			}
+			hc.AlarmName = strings.Replace(hc.AlarmName, "%INSTANCE_ID%", h.instance, -1)
+		}
+	} else {
+		result = multierror.Append(result, errors.New("'alarm_name' not defined in cloudwatch_alarm healthcheck config to "+h.Destination))
+	}
+	if val, ok := h.Config["region"]; ok {
+		hc.conn = getCloudWatchConn(utils.GetAsString(val))
+	} else {
+		result = multierror.Append(result, errors.New("'region' not defined in cloudwatch_alarm healthcheck config to "+h.Destination))
+	}
+	return hc, result.ErrorOrNil()
+}
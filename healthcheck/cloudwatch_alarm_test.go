@@ -0,0 +1,140 @@
+package healthcheck
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/bobtfish/AWSnycast/testhelpers"
+	"github.com/stretchr/testify/assert"
+)
+
+type FakeCloudWatchConn struct {
+	States          map[string]string
+	DescribeError   error
+	DescribedAlarms []string
+}
+
+func (f *FakeCloudWatchConn) DescribeAlarms(i *cloudwatch.DescribeAlarmsInput) (*cloudwatch.DescribeAlarmsOutput, error) {
+	out := &cloudwatch.DescribeAlarmsOutput{MetricAlarms: make([]*cloudwatch.MetricAlarm, 0)}
+	for _, name := range i.AlarmNames {
+		f.DescribedAlarms = append(f.DescribedAlarms, *name)
+	}
+	if f.DescribeError != nil {
+		return nil, f.DescribeError
+	}
+	for _, name := range i.AlarmNames {
+		if state, ok := f.States[*name]; ok {
+			out.MetricAlarms = append(out.MetricAlarms, &cloudwatch.MetricAlarm{
+				AlarmName:  name,
+				StateValue: aws.String(state),
+			})
+		}
+	}
+	return out, nil
+}
+
+func withFakeCloudWatchConn(f *FakeCloudWatchConn, test func()) {
+	cloudWatchConnLock.Lock()
+	cloudWatchConns = make(map[string]MyCloudWatchConn)
+	orig := newCloudWatchConn
+	newCloudWatchConn = func(region string) MyCloudWatchConn { return f }
+	cloudWatchConnLock.Unlock()
+	defer func() {
+		cloudWatchConnLock.Lock()
+		cloudWatchConns = make(map[string]MyCloudWatchConn)
+		newCloudWatchConn = orig
+		cloudWatchConnLock.Unlock()
+	}()
+	test()
+}
+
+func cloudWatchAlarmHealthcheck(alarm string) *Healthcheck {
+	c := make(map[string]interface{})
+	c["alarm_name"] = alarm
+	c["region"] = "us-west-1"
+	return &Healthcheck{
+		Type:   "cloudwatch_alarm",
+		Config: c,
+	}
+}
+
+func TestHealthcheckCloudWatchAlarmStates(t *testing.T) {
+	f := &FakeCloudWatchConn{States: map[string]string{
+		"ok":           cloudwatch.StateValueOk,
+		"alarm":        cloudwatch.StateValueAlarm,
+		"insufficient": cloudwatch.StateValueInsufficientData,
+	}}
+	withFakeCloudWatchConn(f, func() {
+		for alarm, expected := range map[string]bool{
+			"ok":           true,
+			"alarm":        false,
+			"insufficient": true,
+			"missing":      false,
+		} {
+			h := cloudWatchAlarmHealthcheck(alarm)
+			h.Destination = "127.0.0.1"
+			if assert.Nil(t, h.Validate("foo", false)) && assert.Nil(t, h.Setup()) {
+				assert.Equal(t, h.healthchecker.Healthcheck(), expected, alarm)
+			}
+		}
+	})
+}
+
+func TestHealthcheckCloudWatchAlarmError(t *testing.T) {
+	f := &FakeCloudWatchConn{
+		States:        map[string]string{"ok": cloudwatch.StateValueOk},
+		DescribeError: errors.New("Throttling"),
+	}
+	withFakeCloudWatchConn(f, func() {
+		h := cloudWatchAlarmHealthcheck("ok")
+		h.Destination = "127.0.0.1"
+		h.Validate("foo", false)
+		if assert.Nil(t, h.Setup()) {
+			assert.Equal(t, h.healthchecker.Healthcheck(), false)
+		}
+	})
+}
+
+func TestHealthcheckCloudWatchAlarmRemoteTemplate(t *testing.T) {
+	f := &FakeCloudWatchConn{States: map[string]string{
+		"i-1234-10.0.0.5-down": cloudwatch.StateValueAlarm,
+	}}
+	withFakeCloudWatchConn(f, func() {
+		tmpl := cloudWatchAlarmHealthcheck("%INSTANCE_ID%-%DESTINATION%-down")
+		if assert.Nil(t, tmpl.Validate("foo", true)) {
+			h, err := tmpl.NewWithDestinationInstance("10.0.0.5", "i-1234")
+			if assert.Nil(t, err) {
+				assert.Equal(t, h.instance, "i-1234")
+				assert.Equal(t, h.healthchecker.Healthcheck(), false)
+				assert.Equal(t, f.DescribedAlarms, []string{"i-1234-10.0.0.5-down"})
+			}
+		}
+	})
+}
+
+func TestHealthcheckCloudWatchAlarmUnknownInstance(t *testing.T) {
+	withFakeCloudWatchConn(&FakeCloudWatchConn{}, func() {
+		tmpl := cloudWatchAlarmHealthcheck("%INSTANCE_ID%-down")
+		if assert.Nil(t, tmpl.Validate("foo", true)) {
+			_, err := tmpl.NewWithDestination("10.0.0.5")
+			if assert.NotNil(t, err) {
+				testhelpers.CheckOneMultiError(t, err, "alarm_name '%INSTANCE_ID%-down' uses %INSTANCE_ID%, but the instance ID of 10.0.0.5 is not known")
+			}
+		}
+	})
+}
+
+func TestHealthcheckCloudWatchAlarmNoConfig(t *testing.T) {
+	h := Healthcheck{
+		Type:        "cloudwatch_alarm",
+		Destination: "127.0.0.1",
+	}
+	h.Validate("foo", false)
+	err := h.Setup()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "'alarm_name' not defined in cloudwatch_alarm healthcheck config to 127.0.0.1")
+		assert.Contains(t, err.Error(), "'region' not defined in cloudwatch_alarm healthcheck config to 127.0.0.1")
+	}
+}
@@ -3,10 +3,13 @@ package healthcheck
 import (
 	"errors"
 	"fmt"
+	"github.com/bobtfish/AWSnycast/clock"
+	"github.com/bobtfish/AWSnycast/hooks"
+	"github.com/bobtfish/AWSnycast/notify"
 	log "github.com/sirupsen/logrus"
 	"github.com/hashicorp/go-multierror"
 	"net"
-	"os/exec"
+	"sync"
 	"time"
 )
 
@@ -29,7 +32,12 @@ type CanBeHealthy interface {
 	CanPassYet() bool
 }
 
+// Healthcheck runs a HealthChecker every so often, and works out whether
+// what it checks is healthy from the results. lock guards the state which
+// changes as it runs, as it is read by routes whilst it is running. It is
+// made by Validate.
 type Healthcheck struct {
+	lock           *sync.Mutex            `yaml:"-"`
 	canPassYet     bool                   `yaml:"-"`
 	runCount       uint64                 `yaml:"-"`
 	Type           string                 `yaml:"type"`
@@ -42,16 +50,31 @@ type Healthcheck struct {
 	Config         map[string]interface{} `yaml:"config"`
 	RunOnHealthy   []string               `yaml:"run_on_healthy"`
 	RunOnUnhealthy []string               `yaml:"run_on_unhealthy"`
+	HookTimeout    uint                   `yaml:"hook_timeout"`
 	healthchecker  HealthChecker          `yaml:"-"`
 	isRunning      bool                   `yaml:"-"`
 	quitChan       chan<- bool            `yaml:"-"`
 	hasQuitChan    <-chan bool            `yaml:"-"`
 	listeners      []chan<- bool          `yaml:"-"`
+	clock          clock.Clock            `yaml:"-"`
+	forceChan      chan<- chan bool       `yaml:"-"`
+	forced         bool                   `yaml:"-"`
+	instance       string                 `yaml:"-"` // The instance ID of the destination, if known
+	name           string                 `yaml:"-"`
+	notifier       *notify.Notifier       `yaml:"-"`
 }
 
 func (h *Healthcheck) NewWithDestination(destination string) (*Healthcheck, error) {
+	return h.NewWithDestinationInstance(destination, "")
+}
+
+// NewWithDestinationInstance makes a healthcheck against destination, which
+// is an address of the given instance. Healthchecks which need the instance
+// ID (rather than its address) can only be made this way.
+func (h *Healthcheck) NewWithDestinationInstance(destination string, instance string) (*Healthcheck, error) {
 	n := &Healthcheck{
 		Destination:    destination,
+		instance:       instance,
 		Type:           h.Type,
 		Rise:           h.Rise,
 		Fall:           h.Fall,
@@ -59,6 +82,10 @@ func (h *Healthcheck) NewWithDestination(destination string) (*Healthcheck, erro
 		Config:         h.Config,
 		RunOnHealthy:   h.RunOnHealthy,
 		RunOnUnhealthy: h.RunOnUnhealthy,
+		HookTimeout:    h.HookTimeout,
+		name:           h.name,
+		notifier:       h.notifier,
+		clock:          h.clock,
 	}
 	err := n.Validate(destination, false)
 	if err == nil {
@@ -66,6 +93,7 @@ func (h *Healthcheck) NewWithDestination(destination string) (*Healthcheck, erro
 	}
 	log.WithFields(log.Fields{
 		"destination": n.Destination,
+		"instance_id": n.instance,
 		"type":        n.Type,
 		"err":         err,
 	}).Info("Made new remote healthcheck")
@@ -74,37 +102,45 @@ func (h *Healthcheck) NewWithDestination(destination string) (*Healthcheck, erro
 
 func (h *Healthcheck) GetListener() <-chan bool {
 	c := make(chan bool, 5)
+	h.lock.Lock()
+	defer h.lock.Unlock()
 	h.listeners = append(h.listeners, c)
 	return c
 }
 
 func (h *Healthcheck) stateChange() {
-	contextLogger := log.WithFields(log.Fields{
-		"destination": h.Destination,
-		"type":        h.Type,
-	})
+	h.lock.Lock()
+	// Becoming healthy when first started is not worth telling anyone about
+	started := !h.canPassYet
 	h.canPassYet = true
-	if h.isHealthy {
-		if len(h.RunOnHealthy) > 0 {
-			cmd := h.RunOnHealthy[0]
-			if err := exec.Command(cmd, h.RunOnHealthy[1:]...).Run(); err != nil {
-				contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("healthcheck RunOnHealthy failed")
-			}
+	healthy := h.isHealthy
+	forced := h.forced
+	listeners := h.listeners
+	h.lock.Unlock()
+	timeout := time.Duration(h.HookTimeout) * time.Second
+	n := notify.Notification{Healthcheck: h.name, Destination: h.Destination}
+	if healthy {
+		if !started {
+			n.Type = notify.HealthcheckHealthy
+			h.notifier.Notify(n)
 		}
+		hooks.Run(h.RunOnHealthy, hooks.Event{Type: hooks.Healthy, Healthcheck: h.name}, timeout)
 	} else {
-		if len(h.RunOnUnhealthy) > 0 {
-			cmd := h.RunOnUnhealthy[0]
-			if err := exec.Command(cmd, h.RunOnUnhealthy[1:]...).Run(); err != nil {
-				contextLogger.WithFields(log.Fields{"err": err.Error()}).Debug("healthcheck RunOnUnhealthy failed")
-			}
+		n.Type = notify.HealthcheckUnhealthy
+		if forced {
+			n.Reason = "forced unhealthy"
 		}
+		h.notifier.Notify(n)
+		hooks.Run(h.RunOnUnhealthy, hooks.Event{Type: hooks.Unhealthy, Healthcheck: h.name}, timeout)
 	}
-	for _, l := range h.listeners {
-		l <- h.isHealthy
+	for _, l := range listeners {
+		l <- healthy
 	}
 }
 
 func (h *Healthcheck) CanPassYet() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
 	return h.canPassYet
 }
 
@@ -115,7 +151,9 @@ func (h Healthcheck) GetHealthChecker() (HealthChecker, error) {
 	return nil, errors.New(fmt.Sprintf("Healthcheck type '%s' not found in the healthcheck registry", h.Type))
 }
 
-func (h Healthcheck) IsHealthy() bool {
+func (h *Healthcheck) IsHealthy() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
 	return h.isHealthy
 }
 
@@ -123,8 +161,26 @@ func (h *Healthcheck) PerformHealthcheck() {
 	if h.healthchecker == nil {
 		panic("Setup() never called for healthcheck before Run")
 	}
+	h.lock.Lock()
+	forced := h.forced
+	h.lock.Unlock()
+	result := false
+	if !forced {
+		result = h.healthchecker.Healthcheck()
+	}
+	h.lock.Lock()
+	changed := h.record(result)
+	h.lock.Unlock()
+	if changed {
+		h.stateChange()
+	}
+}
+
+// record adds the result of running the healthcheck to its history, and
+// returns if listeners should be told about its state. It is called with
+// the lock held.
+func (h *Healthcheck) record(result bool) bool {
 	h.runCount = h.runCount + 1
-	result := h.healthchecker.Healthcheck()
 	maxIdx := uint(len(h.History) - 1)
 	h.History = append(h.History[:0], h.History[1:]...)
 	h.History = append(h.History, result)
@@ -136,24 +192,55 @@ func (h *Healthcheck) PerformHealthcheck() {
 		downTo := maxIdx - h.Fall + 1
 		for i := maxIdx; i >= downTo; i-- {
 			if h.History[i] {
-				return
+				return false
 			}
 		}
 		contextLogger.Info("Healthcheck is unhealthy")
 		h.isHealthy = false
-		h.stateChange()
-	} else { // Currently unhealthy
-		downTo := maxIdx - h.Rise + 1
-		for i := maxIdx; i >= downTo; i-- {
-			if !h.History[i] { // Still unhealthy
-				if h.runCount == uint64(h.Rise) { // We just started running, and *could* have come healthy, but didn't,
-					h.stateChange() // so lets inform anyone listening, in case they want to take action
-				}
-				return
-			}
+		return true
+	}
+	// Currently unhealthy
+	downTo := maxIdx - h.Rise + 1
+	for i := maxIdx; i >= downTo; i-- {
+		if !h.History[i] { // Still unhealthy
+			// We just started running, and *could* have come healthy, but didn't,
+			// so lets inform anyone listening, in case they want to take action
+			return h.runCount == uint64(h.Rise)
 		}
-		h.isHealthy = true
-		contextLogger.Info("Healthcheck is healthy")
+	}
+	h.isHealthy = true
+	contextLogger.Info("Healthcheck is healthy")
+	return true
+}
+
+// ForceUnhealthy makes the healthcheck unhealthy from now on, whatever the
+// results of running it, for example because this instance is about to be
+// terminated. It returns once the healthcheck is unhealthy.
+func (h *Healthcheck) ForceUnhealthy() {
+	if h.isRunning {
+		done := make(chan bool)
+		h.forceChan <- done
+		<-done
+		return
+	}
+	h.forceUnhealthy()
+}
+
+func (h *Healthcheck) forceUnhealthy() {
+	h.lock.Lock()
+	if h.forced {
+		h.lock.Unlock()
+		return
+	}
+	h.forced = true
+	changed := h.isHealthy || !h.canPassYet
+	h.isHealthy = false
+	h.lock.Unlock()
+	log.WithFields(log.Fields{
+		"destination": h.Destination,
+		"type":        h.Type,
+	}).Info("Healthcheck forced unhealthy")
+	if changed {
 		h.stateChange()
 	}
 }
@@ -162,6 +249,10 @@ func (h *Healthcheck) Validate(name string, remote bool) error {
 	if h == nil {
 		panic("Cannot validate nill healthcheck")
 	}
+	h.name = name
+	if h.lock == nil {
+		h.lock = &sync.Mutex{}
+	}
 	if h.Config == nil {
 		h.Config = make(map[string]interface{})
 	}
@@ -214,11 +305,29 @@ func (h *Healthcheck) Setup() error {
 	return nil
 }
 
-func sleepAndSend(t uint, send chan<- bool) {
-	go func() {
-		time.Sleep(time.Duration(t) * time.Second)
+// SetClock sets the clock used to schedule healthchecks. Remote healthchecks
+// made from this one (by NewWithDestination) use the same clock.
+func (h *Healthcheck) SetClock(c clock.Clock) {
+	h.clock = c
+}
+
+// SetNotifier sets where notifications of this healthcheck changing state
+// are sent. Remote healthchecks made from this one send them there too.
+func (h *Healthcheck) SetNotifier(n *notify.Notifier) {
+	h.notifier = n
+}
+
+func (h *Healthcheck) getClock() clock.Clock {
+	if h.clock == nil {
+		return clock.Real
+	}
+	return h.clock
+}
+
+func sleepAndSend(c clock.Clock, t uint, send chan<- bool) clock.Timer {
+	return c.AfterFunc(time.Duration(t)*time.Second, func() {
 		send <- true
-	}()
+	})
 }
 
 func (h *Healthcheck) Run(debug bool) {
@@ -228,18 +337,27 @@ func (h *Healthcheck) Run(debug bool) {
 	hasquit := make(chan bool)
 	quit := make(chan bool)
 	run := make(chan bool)
+	force := make(chan chan bool)
+	c := h.getClock()
 	go func() { // Simple and dumb runner. Runs healthcheck and then sleeps the 'Every' time.
+		var next clock.Timer
 	Loop: // Healthchecks are expected to complete much faster than the Every time!
 		for {
 			select {
 			case <-quit:
 				log.Debug("Healthcheck is exiting")
+				if next != nil {
+					next.Stop()
+				}
 				break Loop
 			case <-run:
 				log.Debug("Healthcheck is running")
 				h.PerformHealthcheck()
 				log.Debug("Healthcheck has run")
-				sleepAndSend(h.Every, run) // Queue the next run up
+				next = sleepAndSend(c, h.Every, run) // Queue the next run up
+			case done := <-force:
+				h.forceUnhealthy()
+				close(done)
 			}
 		}
 		hasquit <- true
@@ -247,11 +365,12 @@ func (h *Healthcheck) Run(debug bool) {
 	}()
 	h.hasQuitChan = hasquit
 	h.quitChan = quit
+	h.forceChan = force
 	h.isRunning = true
 	run <- true // Fire straight away once set running
 }
 
-func (h Healthcheck) IsRunning() bool {
+func (h *Healthcheck) IsRunning() bool {
 	return h.isRunning
 }
 
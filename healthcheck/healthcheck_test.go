@@ -3,12 +3,15 @@ package healthcheck
 import (
 	"errors"
 	"fmt"
+	"github.com/bobtfish/AWSnycast/clock"
+	"github.com/bobtfish/AWSnycast/notify"
 	"github.com/bobtfish/AWSnycast/testhelpers"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"log"
 	"os"
 	"testing"
+	"time"
 )
 
 type MyFakeHealthCheck struct {
@@ -423,3 +426,131 @@ func TestHealthcheckRunOnUnhealthy(t *testing.T) {
 	}
 	pingCmd = "ping"
 }
+
+func TestHealthcheckRunOnUnhealthyEnv(t *testing.T) {
+	pingCmd = "false"
+	dir, err := ioutil.TempDir("", "awsnycast")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // clean up
+	envFile := dir + "/env"
+	h := Healthcheck{
+		Type:           "ping",
+		Destination:    "127.0.0.1",
+		RunOnUnhealthy: []string{"/bin/sh", "-c", "echo $AWSNYCAST_EVENT $AWSNYCAST_HEALTHCHECK > " + envFile},
+	}
+	assert.Nil(t, h.Validate("foo", false))
+	assert.Nil(t, h.Setup())
+	c := h.GetListener()
+	h.PerformHealthcheck()
+	h.PerformHealthcheck()
+	assert.Equal(t, <-c, false)
+	env, err := ioutil.ReadFile(envFile)
+	if assert.Nil(t, err) {
+		assert.Equal(t, string(env), "unhealthy foo\n")
+	}
+	pingCmd = "ping"
+}
+
+type channelSink chan notify.Notification
+
+func (s channelSink) Name() string {
+	return "channel"
+}
+
+func (s channelSink) Send(n notify.Notification) error {
+	s <- n
+	return nil
+}
+
+func TestHealthcheckNotifiesUnhealthy(t *testing.T) {
+	pingCmd = "false"
+	sink := make(channelSink, 1)
+	n := notify.NewNotifier([]notify.Sink{sink}, "i-1234", clock.Real)
+	defer n.Stop()
+	h := Healthcheck{
+		Type:        "ping",
+		Destination: "127.0.0.1",
+	}
+	assert.Nil(t, h.Validate("foo", false))
+	assert.Nil(t, h.Setup())
+	h.SetNotifier(n)
+	h.PerformHealthcheck()
+	h.PerformHealthcheck()
+	select {
+	case got := <-sink:
+		assert.Equal(t, got.Type, notify.HealthcheckUnhealthy)
+		assert.Equal(t, got.Healthcheck, "foo")
+		assert.Equal(t, got.Destination, "127.0.0.1")
+	case <-time.After(5 * time.Second):
+		t.Fatal("No notification sent")
+	}
+	pingCmd = "ping"
+}
+
+func TestHealthcheckRunFakeClock(t *testing.T) {
+	RegisterHealthcheck("test_ok", MyFakeHealthConstructorOk)
+	c := clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := Healthcheck{Type: "test_ok", Destination: "127.0.0.1", Rise: 2, Every: 5}
+	h.Validate("foo", false)
+	h.Setup()
+	h.SetClock(c)
+	l := h.GetListener()
+	h.Run(false)
+	for c.Timers() != 1 { // Wait for the first check to finish, and schedule the next
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, h.IsHealthy(), false)
+	c.Advance(4 * time.Second)
+	assert.Equal(t, c.Timers(), 1)
+	c.Advance(time.Second)
+	assert.Equal(t, <-l, true)
+	assert.Equal(t, h.IsHealthy(), true)
+	h.Stop()
+	assert.Equal(t, c.Timers(), 0)
+}
+
+func TestHealthcheckNewWithDestinationKeepsClock(t *testing.T) {
+	RegisterHealthcheck("test_ok", MyFakeHealthConstructorOk)
+	c := clock.NewFake(time.Now())
+	h := Healthcheck{Type: "test_ok"}
+	h.SetClock(c)
+	n, err := h.NewWithDestination("127.0.0.1")
+	assert.Nil(t, err)
+	assert.Equal(t, n.getClock(), c)
+}
+
+func TestHealthcheckForceUnhealthy(t *testing.T) {
+	RegisterHealthcheck("test_ok", MyFakeHealthConstructorOk)
+	h := Healthcheck{Type: "test_ok", Destination: "127.0.0.1", Rise: 2}
+	h.Validate("foo", false)
+	h.Setup()
+	l := h.GetListener()
+	h.PerformHealthcheck()
+	h.PerformHealthcheck()
+	assert.Equal(t, <-l, true)
+	h.ForceUnhealthy()
+	assert.Equal(t, <-l, false)
+	assert.Equal(t, h.IsHealthy(), false)
+	for i := 0; i < 5; i++ {
+		h.PerformHealthcheck()
+	}
+	assert.Equal(t, h.IsHealthy(), false)
+}
+
+func TestHealthcheckForceUnhealthyRunning(t *testing.T) {
+	RegisterHealthcheck("test_ok", MyFakeHealthConstructorOk)
+	c := clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := Healthcheck{Type: "test_ok", Destination: "127.0.0.1", Rise: 2, Every: 1}
+	h.Validate("foo", false)
+	h.Setup()
+	h.SetClock(c)
+	l := h.GetListener()
+	h.Run(false)
+	// Not yet able to pass, but listeners are told it is unhealthy
+	h.ForceUnhealthy()
+	assert.Equal(t, <-l, false)
+	assert.Equal(t, h.CanPassYet(), true)
+	h.Stop()
+}
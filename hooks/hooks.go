@@ -0,0 +1,204 @@
+// Package hooks runs the user's scripts when routes change or healthchecks
+// change state.
+package hooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTimeout is how long a hook may run before it is killed.
+const DefaultTimeout = 30 * time.Second
+
+// The types of event which hooks are run for, passed to them as
+// AWSNYCAST_EVENT.
+const (
+	BeforeAddRoute     = "before_add_route"
+	AfterAddRoute      = "after_add_route"
+	BeforeReplaceRoute = "before_replace_route"
+	AfterReplaceRoute  = "after_replace_route"
+	BeforeDeleteRoute  = "before_delete_route"
+	AfterDeleteRoute   = "after_delete_route"
+	Healthy            = "healthy"
+	Unhealthy          = "unhealthy"
+)
+
+// Event describes what a hook is being run for. Fields which don't apply
+// to the event are empty.
+type Event struct {
+	Type           string `json:"event"`
+	Cidr           string `json:"cidr,omitempty"`
+	RouteTable     string `json:"rtb,omitempty"`
+	PreviousTarget string `json:"previous_target,omitempty"` // The instance (or ENI) the route pointed to
+	Healthcheck    string `json:"healthcheck,omitempty"`
+}
+
+// Env returns the environment variables describing the event.
+func (e Event) Env() []string {
+	return []string{
+		"AWSNYCAST_EVENT=" + e.Type,
+		"AWSNYCAST_CIDR=" + e.Cidr,
+		"AWSNYCAST_RTB=" + e.RouteTable,
+		"AWSNYCAST_PREVIOUS_TARGET=" + e.PreviousTarget,
+		"AWSNYCAST_HEALTHCHECK=" + e.Healthcheck,
+	}
+}
+
+// RouteEvents are the events which routes can have hooks for.
+var RouteEvents = []string{
+	BeforeAddRoute,
+	AfterAddRoute,
+	BeforeReplaceRoute,
+	AfterReplaceRoute,
+	BeforeDeleteRoute,
+	AfterDeleteRoute,
+}
+
+// Hook is either a command to run, or a URL to POST the event to as JSON.
+type Hook struct {
+	Command []string `yaml:"command"`
+	URL     string   `yaml:"url"`
+	Timeout uint     `yaml:"timeout"` // Seconds, overriding the timeout the hook is run with
+}
+
+func (h Hook) Validate() error {
+	if len(h.Command) == 0 && h.URL == "" {
+		return errors.New("Hook has neither a command nor a url")
+	}
+	if len(h.Command) > 0 && h.URL != "" {
+		return errors.New("Hook cannot have both a command and a url")
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Hook url '%s' does not parse: %s", h.URL, err.Error()))
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errors.New(fmt.Sprintf("Hook url '%s' is not http or https", h.URL))
+		}
+	}
+	return nil
+}
+
+func (h Hook) Run(event Event, timeout time.Duration) error {
+	if h.Timeout != 0 {
+		timeout = time.Duration(h.Timeout) * time.Second
+	}
+	if h.URL != "" {
+		return Post(h.URL, event, timeout)
+	}
+	return Run(h.Command, event, timeout)
+}
+
+// RunAll runs each of the hooks in turn, returning the first error. If
+// stopOnError is set, no more hooks are run after one fails.
+func RunAll(hs []Hook, event Event, timeout time.Duration, stopOnError bool) error {
+	var first error
+	for _, h := range hs {
+		if err := h.Run(event, timeout); err != nil {
+			if stopOnError {
+				return err
+			}
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Post sends an event as JSON to a webhook URL. Any response other than a
+// 2xx status is treated as a failure.
+func Post(webhook string, event Event, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	contextLogger := eventLogger(event).WithFields(log.Fields{"url": webhook})
+	body, err := json.Marshal(event)
+	if err == nil {
+		client := &http.Client{Timeout: timeout}
+		var resp *http.Response
+		resp, err = client.Post(webhook, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = errors.New(fmt.Sprintf("Got status %s", resp.Status))
+			}
+		}
+	}
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Hook failed")
+		return errors.New(fmt.Sprintf("Hook %s for %s failed: %s", webhook, event.Type, err.Error()))
+	}
+	contextLogger.Debug("Hook succeeded")
+	return nil
+}
+
+func eventLogger(event Event) *log.Entry {
+	contextLogger := log.WithFields(log.Fields{"event": event.Type})
+	if event.Cidr != "" {
+		contextLogger = contextLogger.WithFields(log.Fields{"cidr": event.Cidr})
+	}
+	if event.RouteTable != "" {
+		contextLogger = contextLogger.WithFields(log.Fields{"rtb": event.RouteTable})
+	}
+	if event.Healthcheck != "" {
+		contextLogger = contextLogger.WithFields(log.Fields{"healthcheck": event.Healthcheck})
+	}
+	return contextLogger
+}
+
+// Run runs a hook command (the command followed by its arguments) for an
+// event, killing it if it takes longer than timeout (or DefaultTimeout if
+// timeout is 0). Anything the hook outputs is logged. An error is returned
+// if the hook fails or times out.
+func Run(command []string, event Event, timeout time.Duration) error {
+	if len(command) == 0 {
+		return nil
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	contextLogger := eventLogger(event).WithFields(log.Fields{"hook": command[0]})
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = append(os.Environ(), event.Env()...)
+	startGroup(cmd)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Start()
+	if err == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		timer := time.NewTimer(timeout)
+		select {
+		case err = <-done:
+			timer.Stop()
+			if out := strings.TrimSpace(output.String()); out != "" {
+				contextLogger.WithFields(log.Fields{"output": out}).Info("Hook output")
+			}
+		case <-timer.C:
+			// Kill anything the hook started too, but don't wait for the
+			// output, as something which escaped the process group may
+			// still be holding it open.
+			killGroup(cmd)
+			err = errors.New(fmt.Sprintf("Timed out after %s", timeout))
+		}
+	}
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Hook failed")
+		return errors.New(fmt.Sprintf("Hook %s for %s failed: %s", command[0], event.Type, err.Error()))
+	}
+	contextLogger.Debug("Hook succeeded")
+	return nil
+}
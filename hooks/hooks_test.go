@@ -0,0 +1,147 @@
+package hooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunNoCommand(t *testing.T) {
+	assert.Nil(t, Run([]string{}, Event{Type: Healthy}, 0))
+}
+
+func TestRunEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "env")
+	err = Run([]string{"/bin/sh", "-c", "env > " + out}, Event{
+		Type:           BeforeReplaceRoute,
+		Cidr:           "0.0.0.0/0",
+		RouteTable:     "rtb-1234",
+		PreviousTarget: "i-1234",
+		Healthcheck:    "public",
+	}, 0)
+	if assert.Nil(t, err) {
+		env, err := ioutil.ReadFile(out)
+		if assert.Nil(t, err) {
+			lines := strings.Split(string(env), "\n")
+			assert.Contains(t, lines, "AWSNYCAST_EVENT=before_replace_route")
+			assert.Contains(t, lines, "AWSNYCAST_CIDR=0.0.0.0/0")
+			assert.Contains(t, lines, "AWSNYCAST_RTB=rtb-1234")
+			assert.Contains(t, lines, "AWSNYCAST_PREVIOUS_TARGET=i-1234")
+			assert.Contains(t, lines, "AWSNYCAST_HEALTHCHECK=public")
+			assert.Contains(t, lines, "PATH="+os.Getenv("PATH"))
+		}
+	}
+}
+
+func TestRunFails(t *testing.T) {
+	err := Run([]string{"/bin/sh", "-c", "echo oops; exit 3"}, Event{Type: Unhealthy}, 0)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Hook /bin/sh for unhealthy failed: exit status 3")
+	}
+}
+
+func TestRunNotFound(t *testing.T) {
+	assert.NotNil(t, Run([]string{"/does/not/exist"}, Event{Type: Healthy}, 0))
+}
+
+func TestRunTimeout(t *testing.T) {
+	start := time.Now()
+	err := Run([]string{"/bin/sh", "-c", "sleep 10"}, Event{Type: AfterDeleteRoute}, 100*time.Millisecond)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Hook /bin/sh for after_delete_route failed: Timed out after 100ms")
+	}
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestRunTimeoutKillsChildren(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "ran")
+	err = Run([]string{"/bin/sh", "-c", "(sleep 0.5; touch " + file + ") & wait"}, Event{Type: AfterDeleteRoute}, 100*time.Millisecond)
+	assert.NotNil(t, err)
+	time.Sleep(time.Second)
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err), "The hook's child should have been killed")
+}
+
+func TestHookValidate(t *testing.T) {
+	assert.Nil(t, Hook{Command: []string{"/bin/true"}}.Validate())
+	assert.Nil(t, Hook{URL: "https://example.com/hook"}.Validate())
+	for hook, expected := range map[*Hook]string{
+		&Hook{}: "Hook has neither a command nor a url",
+		&Hook{Command: []string{"/bin/true"}, URL: "http://example.com/"}: "Hook cannot have both a command and a url",
+		&Hook{URL: "ftp://example.com/"}:                                  "Hook url 'ftp://example.com/' is not http or https",
+	} {
+		err := hook.Validate()
+		if assert.NotNil(t, err) {
+			assert.Equal(t, err.Error(), expected)
+		}
+	}
+	err := Hook{URL: "http://[::1"}.Validate()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Hook url 'http://[::1' does not parse: ")
+	}
+}
+
+func TestPost(t *testing.T) {
+	var got Event
+	var contentType string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer ts.Close()
+	event := Event{Type: AfterAddRoute, Cidr: "0.0.0.0/0", RouteTable: "rtb-1234"}
+	assert.Nil(t, Hook{URL: ts.URL}.Run(event, 0))
+	assert.Equal(t, got, event)
+	assert.Equal(t, contentType, "application/json")
+}
+
+func TestPostFails(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	err := Post(ts.URL, Event{Type: AfterAddRoute}, 0)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Hook "+ts.URL+" for after_add_route failed: Got status 500 Internal Server Error")
+	}
+}
+
+func TestRunAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "ran")
+	hs := []Hook{
+		{Command: []string{"/bin/false"}},
+		{Command: []string{"/bin/sh", "-c", "touch " + out}},
+	}
+	err = RunAll(hs, Event{Type: BeforeAddRoute}, 0, true)
+	assert.NotNil(t, err)
+	_, err = os.Stat(out)
+	assert.True(t, os.IsNotExist(err))
+
+	err = RunAll(hs, Event{Type: BeforeAddRoute}, 0, false)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Hook /bin/false for before_add_route failed: exit status 1")
+	}
+	_, err = os.Stat(out)
+	assert.Nil(t, err)
+}
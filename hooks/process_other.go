@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package hooks
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startGroup makes the command start in a process group of its own, so that
+// anything it starts can be killed along with it.
+func startGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killGroup kills the command's process group.
+func killGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,12 @@
+package hooks
+
+import (
+	"os/exec"
+)
+
+func startGroup(cmd *exec.Cmd) {}
+
+// killGroup only kills the command itself, as there are no process groups.
+func killGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
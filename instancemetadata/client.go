@@ -0,0 +1,140 @@
+package instancemetadata
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultEndpoint = "http://169.254.169.254"
+	DefaultTimeout  = time.Second
+	DefaultTokenTTL = 6 * time.Hour
+	// Tokens are refreshed this long before they expire, so that a request
+	// is never made with a token which expires in flight.
+	tokenRefreshMargin = time.Minute
+)
+
+// Client fetches instance metadata using IMDSv2 session tokens. Tokens are
+// fetched when first needed, and refreshed before they expire (or if the
+// metadata service rejects them).
+type Client struct {
+	Endpoint    string
+	Timeout     time.Duration
+	TokenTTL    time.Duration
+	Debug       bool
+	httpClient  *http.Client
+	lock        sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func NewClient(endpoint string, timeout time.Duration, debug bool) *Client {
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return &Client{
+		Endpoint:   endpoint,
+		Timeout:    timeout,
+		TokenTTL:   DefaultTokenTTL,
+		Debug:      debug,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *Client) getToken() (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.token != "" && time.Now().Add(tokenRefreshMargin).Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+	requested := time.Now()
+	req, err := http.NewRequest("PUT", c.Endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", strconv.Itoa(int(c.TokenTTL.Seconds())))
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("Error getting metadata token: status %d", resp.StatusCode))
+	}
+	c.token = string(body)
+	c.tokenExpiry = requested.Add(c.TokenTTL)
+	if c.Debug {
+		log.WithFields(log.Fields{"expires": c.tokenExpiry}).Debug("Got new metadata token")
+	}
+	return c.token, nil
+}
+
+func (c *Client) invalidateToken() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.token = ""
+}
+
+func (c *Client) get(path string, token string) (int, string, error) {
+	req, err := http.NewRequest("GET", c.Endpoint+"/latest/meta-data/"+path, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
+
+// GetMetadata fetches a path below /latest/meta-data/
+func (c *Client) GetMetadata(path string) (string, error) {
+	token, err := c.getToken()
+	if err != nil {
+		return "", err
+	}
+	status, body, err := c.get(path, token)
+	if err != nil {
+		return "", err
+	}
+	if status == http.StatusUnauthorized {
+		// Our token has been revoked or expired early, get a new one and try again
+		c.invalidateToken()
+		if token, err = c.getToken(); err != nil {
+			return "", err
+		}
+		if status, body, err = c.get(path, token); err != nil {
+			return "", err
+		}
+	}
+	if c.Debug {
+		log.WithFields(log.Fields{"path": path, "status": status}).Debug("Fetched metadata")
+	}
+	if status != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("Error getting metadata %s: status %d", path, status))
+	}
+	return body, nil
+}
+
+// Available returns true if the metadata service can be reached.
+func (c *Client) Available() bool {
+	_, err := c.GetMetadata("instance-id")
+	return err == nil
+}
@@ -0,0 +1,134 @@
+package instancemetadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bobtfish/AWSnycast/testhelpers"
+	"github.com/stretchr/testify/assert"
+)
+
+func getFakeIMDS() *testhelpers.FakeIMDS {
+	return testhelpers.NewFakeIMDS(map[string]string{
+		"placement/availability-zone": "us-west-1a",
+		"instance-id":                 "i-1234",
+		"mac":                         "06:1d:ea:6f:8c:6e",
+		"local-ipv4":                  "10.0.0.5",
+		"network/interfaces/macs/":    "06:1d:ea:6f:8c:6e/\n06:1d:ea:6f:8c:6f/",
+		"network/interfaces/macs/06:1d:ea:6f:8c:6e/subnet-id":     "subnet-28b0e940",
+		"network/interfaces/macs/06:1d:ea:6f:8c:6e/vpc-id":        "vpc-9496cffc",
+		"network/interfaces/macs/06:1d:ea:6f:8c:6e/interface-id":  "eni-09472250",
+		"network/interfaces/macs/06:1d:ea:6f:8c:6e/device-number": "0",
+		"network/interfaces/macs/06:1d:ea:6f:8c:6e/local-ipv4s":   "10.0.0.5\n10.0.0.6",
+		"network/interfaces/macs/06:1d:ea:6f:8c:6e/ipv6s":         "2600:1f14::5",
+		"network/interfaces/macs/06:1d:ea:6f:8c:6f/subnet-id":     "subnet-3fb0e957",
+		"network/interfaces/macs/06:1d:ea:6f:8c:6f/vpc-id":        "vpc-9496cffc",
+		"network/interfaces/macs/06:1d:ea:6f:8c:6f/interface-id":  "eni-ea8a9cac",
+		"network/interfaces/macs/06:1d:ea:6f:8c:6f/device-number": "1",
+		"network/interfaces/macs/06:1d:ea:6f:8c:6f/local-ipv4s":   "10.0.1.5",
+		"identity-credentials/ec2/info":                           `{"Code": "Success", "AccountId": "613514870339"}`,
+	})
+}
+
+func TestClientGetMetadata(t *testing.T) {
+	imds := getFakeIMDS()
+	defer imds.Close()
+	c := NewClient(imds.URL(), 0, true)
+	assert.Equal(t, c.Timeout, DefaultTimeout)
+	v, err := c.GetMetadata("instance-id")
+	assert.Nil(t, err)
+	assert.Equal(t, v, "i-1234")
+	v, err = c.GetMetadata("local-ipv4")
+	assert.Nil(t, err)
+	assert.Equal(t, v, "10.0.0.5")
+	assert.Equal(t, imds.TokenRequests, 1, "Token should be reused")
+	assert.Equal(t, c.Available(), true)
+}
+
+func TestClientGetMetadataNotFound(t *testing.T) {
+	imds := getFakeIMDS()
+	defer imds.Close()
+	c := NewClient(imds.URL(), 0, false)
+	_, err := c.GetMetadata("doesnotexist")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Error getting metadata doesnotexist: status 404")
+	}
+}
+
+func TestClientTokenRevoked(t *testing.T) {
+	imds := getFakeIMDS()
+	defer imds.Close()
+	c := NewClient(imds.URL(), 0, false)
+	_, err := c.GetMetadata("instance-id")
+	assert.Nil(t, err)
+	imds.RevokeTokens()
+	v, err := c.GetMetadata("instance-id")
+	assert.Nil(t, err)
+	assert.Equal(t, v, "i-1234")
+	assert.Equal(t, imds.TokenRequests, 2)
+}
+
+func TestClientTokenRefreshedBeforeExpiry(t *testing.T) {
+	imds := getFakeIMDS()
+	defer imds.Close()
+	c := NewClient(imds.URL(), 0, false)
+	c.TokenTTL = tokenRefreshMargin
+	_, err := c.GetMetadata("instance-id")
+	assert.Nil(t, err)
+	_, err = c.GetMetadata("instance-id")
+	assert.Nil(t, err)
+	assert.Equal(t, imds.TokenRequests, 2)
+}
+
+func TestClientUnavailable(t *testing.T) {
+	imds := getFakeIMDS()
+	imds.Close()
+	c := NewClient(imds.URL(), 10*time.Millisecond, false)
+	assert.Equal(t, c.Available(), false)
+}
+
+func TestClientFetchMetadata(t *testing.T) {
+	imds := getFakeIMDS()
+	defer imds.Close()
+	m, err := FetchMetadata(NewClient(imds.URL(), 0, false))
+	if assert.Nil(t, err) {
+		assert.Equal(t, m.Instance, "i-1234")
+		assert.Equal(t, m.Subnet, "subnet-28b0e940")
+		assert.Equal(t, m.Region, "us-west-1")
+		assert.Equal(t, m.VpcId, "vpc-9496cffc")
+		assert.Equal(t, m.AccountId, "613514870339")
+		assert.Equal(t, m.IPv6Address, "2600:1f14::5")
+		if assert.Equal(t, len(m.Interfaces), 2) {
+			assert.Equal(t, m.Interfaces[0].InterfaceId, "eni-09472250")
+			assert.Equal(t, m.Interfaces[0].IPAddresses, []string{"10.0.0.5", "10.0.0.6"})
+			assert.Equal(t, m.Interfaces[1].Subnet, "subnet-3fb0e957")
+			assert.Equal(t, m.Interfaces[1].DeviceNumber, "1")
+			assert.Equal(t, len(m.Interfaces[1].IPv6Addresses), 0)
+		}
+	}
+}
+
+func TestFetchMetadataWithRetry(t *testing.T) {
+	backoff := initialRetryBackoff
+	initialRetryBackoff = time.Millisecond
+	defer func() { initialRetryBackoff = backoff }()
+	imds := getFakeIMDS()
+	defer imds.Close()
+	imds.FailRequests = 3
+	m, err := FetchMetadataWithRetry(NewClient(imds.URL(), 0, false), time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, m.Instance, "i-1234")
+}
+
+func TestFetchMetadataWithRetryGivesUp(t *testing.T) {
+	backoff := initialRetryBackoff
+	initialRetryBackoff = time.Millisecond
+	defer func() { initialRetryBackoff = backoff }()
+	imds := getFakeIMDS()
+	defer imds.Close()
+	imds.FailRequests = 1000
+	_, err := FetchMetadataWithRetry(NewClient(imds.URL(), 0, false), 10*time.Millisecond)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "No metadata service")
+	}
+}
@@ -1,12 +1,12 @@
 package instancemetadata
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/ec2metadata"
-	"github.com/aws/aws-sdk-go/aws/session"
 	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
 )
 
 type MetadataFetcher interface {
@@ -15,11 +15,17 @@ type MetadataFetcher interface {
 }
 
 func New(debug bool) MetadataFetcher {
-	sess := session.New()
-	if debug {
-		sess.Config.LogLevel = aws.LogLevel(aws.LogDebug)
-	}
-	return ec2metadata.New(sess)
+	return NewClient(DefaultEndpoint, DefaultTimeout, debug)
+}
+
+type NetworkInterface struct {
+	Mac           string
+	InterfaceId   string
+	DeviceNumber  string
+	Subnet        string
+	VpcId         string
+	IPAddresses   []string
+	IPv6Addresses []string
 }
 
 type InstanceMetadata struct {
@@ -28,6 +34,55 @@ type InstanceMetadata struct {
 	AvailabilityZone string
 	Region           string
 	IPAddress        string
+	VpcId            string
+	AccountId        string
+	IPv6Address      string
+	Interfaces       []NetworkInterface
+}
+
+// Lookup returns the value of a metadata field by the name used for it in
+// the EC2 metadata service, for example "availability-zone".
+func (m InstanceMetadata) Lookup(key string) (string, bool) {
+	switch key {
+	case "instance-id":
+		return m.Instance, true
+	case "availability-zone":
+		return m.AvailabilityZone, true
+	case "region":
+		return m.Region, true
+	case "subnet-id":
+		return m.Subnet, true
+	case "local-ipv4":
+		return m.IPAddress, true
+	case "vpc-id":
+		return m.VpcId, true
+	case "account-id":
+		return m.AccountId, true
+	case "ipv6":
+		return m.IPv6Address, true
+	}
+	return "", false
+}
+
+// CompleteStatic fills in and checks metadata which has been supplied by the
+// user rather than fetched from the metadata service, for example when
+// running outside EC2. The instance ID may be left empty (if this machine
+// is not itself a router), but the region must be known.
+func (m InstanceMetadata) CompleteStatic() (InstanceMetadata, error) {
+	if m.Region == "" && m.AvailabilityZone != "" {
+		m.Region = m.AvailabilityZone[:len(m.AvailabilityZone)-1]
+	}
+	if m.Region == "" {
+		return m, errors.New("A region or availability zone must be given when not using the metadata service")
+	}
+	log.WithFields(log.Fields{
+		"subnet_id":         m.Subnet,
+		"availability_zone": m.AvailabilityZone,
+		"instance_id":       m.Instance,
+		"region":            m.Region,
+		"ip":                m.IPAddress,
+	}).Info("Using static instance metadata")
+	return m, nil
 }
 
 func FetchMetadata(mdf MetadataFetcher) (InstanceMetadata, error) {
@@ -59,17 +114,127 @@ func FetchMetadata(mdf MetadataFetcher) (InstanceMetadata, error) {
 	}
 	m.Subnet = subnet
 
+	fetchOptionalMetadata(mdf, &m)
+
 	log.WithFields(log.Fields{
 		"subnet_id":         subnet,
 		"availability_zone": az,
 		"instance_id":       instanceId,
 		"region":            m.Region,
 		"ip":                m.IPAddress,
+		"vpc_id":            m.VpcId,
+		"account_id":        m.AccountId,
+		"ipv6":              m.IPv6Address,
+		"interfaces":        len(m.Interfaces),
 	}).Info("Got instance metadata")
 
 	return m, nil
 }
 
+// fetchOptionalMetadata fills in the fields which AWSnycast can run without.
+// Failures are logged rather than returned.
+func fetchOptionalMetadata(mdf MetadataFetcher, m *InstanceMetadata) {
+	contextLogger := log.WithFields(log.Fields{"instance_id": m.Instance})
+	interfaces, err := fetchInterfaces(mdf)
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Error getting network interfaces from metadata")
+	}
+	m.Interfaces = interfaces
+	for _, iface := range interfaces {
+		if iface.Subnet == m.Subnet || iface.DeviceNumber == "0" {
+			m.VpcId = iface.VpcId
+			if len(iface.IPv6Addresses) > 0 {
+				m.IPv6Address = iface.IPv6Addresses[0]
+			}
+			break
+		}
+	}
+	info, err := mdf.GetMetadata("identity-credentials/ec2/info")
+	if err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Error getting account id from metadata")
+		return
+	}
+	var identity struct {
+		AccountId string
+	}
+	if err := json.Unmarshal([]byte(info), &identity); err != nil {
+		contextLogger.WithFields(log.Fields{"err": err.Error()}).Warn("Error parsing account id from metadata")
+		return
+	}
+	m.AccountId = identity.AccountId
+}
+
+func splitLines(s string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func fetchInterfaces(mdf MetadataFetcher) ([]NetworkInterface, error) {
+	interfaces := make([]NetworkInterface, 0)
+	macs, err := mdf.GetMetadata("network/interfaces/macs/")
+	if err != nil {
+		return interfaces, err
+	}
+	for _, mac := range splitLines(macs) {
+		mac = strings.TrimSuffix(mac, "/")
+		prefix := fmt.Sprintf("network/interfaces/macs/%s/", mac)
+		iface := NetworkInterface{Mac: mac}
+		fields := map[string]*string{
+			"interface-id":  &iface.InterfaceId,
+			"device-number": &iface.DeviceNumber,
+			"subnet-id":     &iface.Subnet,
+			"vpc-id":        &iface.VpcId,
+		}
+		for k, v := range fields {
+			if *v, err = mdf.GetMetadata(prefix + k); err != nil {
+				return interfaces, err
+			}
+		}
+		if ips, err := mdf.GetMetadata(prefix + "local-ipv4s"); err == nil {
+			iface.IPAddresses = splitLines(ips)
+		}
+		// Only present if the interface has IPv6 addresses
+		if ips, err := mdf.GetMetadata(prefix + "ipv6s"); err == nil {
+			iface.IPv6Addresses = splitLines(ips)
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces, nil
+}
+
+var (
+	initialRetryBackoff = 500 * time.Millisecond
+	maxRetryBackoff     = 10 * time.Second
+)
+
+// FetchMetadataWithRetry calls FetchMetadata, retrying with exponential
+// backoff for up to wait if the metadata service is not yet reachable
+// (for example if AWSnycast is started very early during boot).
+func FetchMetadataWithRetry(mdf MetadataFetcher, wait time.Duration) (InstanceMetadata, error) {
+	deadline := time.Now().Add(wait)
+	backoff := initialRetryBackoff
+	for {
+		m, err := FetchMetadata(mdf)
+		if err == nil || time.Now().Add(backoff).After(deadline) {
+			return m, err
+		}
+		log.WithFields(log.Fields{
+			"err":   err.Error(),
+			"retry": backoff,
+		}).Warn("Error fetching instance metadata, retrying")
+		time.Sleep(backoff)
+		backoff = backoff * 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
 func getSubnetId(mdf MetadataFetcher) (string, error) {
 	mac, err := mdf.GetMetadata("mac")
 	if err != nil {
@@ -77,3 +242,25 @@ func getSubnetId(mdf MetadataFetcher) (string, error) {
 	}
 	return mdf.GetMetadata(fmt.Sprintf("network/interfaces/macs/%s/subnet-id", mac))
 }
+
+// FetchInstanceTags reads this instance's tags from the metadata service.
+// This only works if access to tags in instance metadata has been enabled
+// for the instance.
+func FetchInstanceTags(mdf MetadataFetcher) (map[string]string, error) {
+	tags := make(map[string]string)
+	keys, err := mdf.GetMetadata("tags/instance")
+	if err != nil {
+		return tags, errors.New(fmt.Sprintf("Error getting instance tags: %s", err.Error()))
+	}
+	for _, key := range strings.Split(keys, "\n") {
+		if key == "" {
+			continue
+		}
+		value, err := mdf.GetMetadata("tags/instance/" + key)
+		if err != nil {
+			return tags, errors.New(fmt.Sprintf("Error getting instance tag %s: %s", key, err.Error()))
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
@@ -101,3 +101,52 @@ func TestFetchMetadata(t *testing.T) {
 	assert.Equal(t, m.AvailabilityZone, "us-west-1a")
 	assert.Equal(t, m.Region, "us-west-1")
 }
+
+func TestLookup(t *testing.T) {
+	m, err := FetchMetadata(getFakeMetadataFetcher(true))
+	assert.Nil(t, err)
+	v, ok := m.Lookup("availability-zone")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, v, "us-west-1a")
+	v, ok = m.Lookup("local-ipv4")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, v, "127.0.0.1")
+	_, ok = m.Lookup("doesnotexist")
+	assert.Equal(t, ok, false)
+}
+
+func TestFetchInstanceTags(t *testing.T) {
+	mdf := getFakeMetadataFetcher(true)
+	mdf.(FakeMetadataFetcher).Meta["tags/instance"] = "Name\nawsnycast:route:0.0.0.0/0"
+	mdf.(FakeMetadataFetcher).Meta["tags/instance/Name"] = "nat-a"
+	mdf.(FakeMetadataFetcher).Meta["tags/instance/awsnycast:route:0.0.0.0/0"] = "healthcheck=public"
+	tags, err := FetchInstanceTags(mdf)
+	if assert.Nil(t, err) {
+		assert.Equal(t, len(tags), 2)
+		assert.Equal(t, tags["Name"], "nat-a")
+		assert.Equal(t, tags["awsnycast:route:0.0.0.0/0"], "healthcheck=public")
+	}
+}
+
+func TestFetchInstanceTagsNotEnabled(t *testing.T) {
+	_, err := FetchInstanceTags(getFakeMetadataFetcher(true))
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Error getting instance tags: Key tags/instance unknown")
+	}
+}
+
+func TestCompleteStatic(t *testing.T) {
+	m, err := InstanceMetadata{Instance: "i-1234", AvailabilityZone: "eu-west-1b"}.CompleteStatic()
+	assert.Nil(t, err)
+	assert.Equal(t, m.Region, "eu-west-1")
+	m, err = InstanceMetadata{Region: "us-east-1"}.CompleteStatic()
+	assert.Nil(t, err)
+	assert.Equal(t, m.Region, "us-east-1")
+}
+
+func TestCompleteStaticNoRegion(t *testing.T) {
+	_, err := InstanceMetadata{Instance: "i-1234"}.CompleteStatic()
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "A region or availability zone must be given when not using the metadata service")
+	}
+}
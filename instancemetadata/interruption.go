@@ -0,0 +1,123 @@
+package instancemetadata
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bobtfish/AWSnycast/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultInterruptionCheckEvery = 5 * time.Second
+	DefaultScheduledEventLead     = 10 * time.Minute
+	// The format of times in scheduled maintenance events
+	scheduledEventTimeFormat = "2 Jan 2006 15:04:05 GMT"
+)
+
+// InterruptionNotice says that this instance is going to be stopped,
+// terminated or rebooted soon, either because it is a Spot instance being
+// reclaimed, or because of scheduled maintenance.
+type InterruptionNotice struct {
+	Source string // spot or scheduled
+	Action string // The spot instance action, or the scheduled event code
+	Time   time.Time
+}
+
+// FetchInterruptionNotice returns a notice if there is a spot instance
+// action, or an active scheduled event starting within lead of now, or nil.
+func FetchInterruptionNotice(mdf MetadataFetcher, now time.Time, lead time.Duration) (*InterruptionNotice, error) {
+	// This is only present once the instance has been told it is being
+	// reclaimed, and is otherwise not found.
+	if action, err := mdf.GetMetadata("spot/instance-action"); err == nil {
+		var spot struct {
+			Action string    `json:"action"`
+			Time   time.Time `json:"time"`
+		}
+		if err := json.Unmarshal([]byte(action), &spot); err != nil {
+			return nil, errors.New(fmt.Sprintf("Error parsing spot instance action: %s", err.Error()))
+		}
+		return &InterruptionNotice{Source: "spot", Action: spot.Action, Time: spot.Time}, nil
+	}
+	scheduled, err := mdf.GetMetadata("events/maintenance/scheduled")
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error getting scheduled events: %s", err.Error()))
+	}
+	var events []struct {
+		Code      string
+		NotBefore string
+		State     string
+	}
+	if err := json.Unmarshal([]byte(scheduled), &events); err != nil {
+		return nil, errors.New(fmt.Sprintf("Error parsing scheduled events: %s", err.Error()))
+	}
+	for _, event := range events {
+		if event.State != "active" {
+			continue // completed or canceled
+		}
+		notBefore, err := time.Parse(scheduledEventTimeFormat, event.NotBefore)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error parsing time of scheduled event %s: %s", event.Code, err.Error()))
+		}
+		if notBefore.Sub(now) <= lead {
+			return &InterruptionNotice{Source: "scheduled", Action: event.Code, Time: notBefore}, nil
+		}
+	}
+	return nil, nil
+}
+
+// InterruptionWatcher checks the metadata service for interruption notices
+// every Every, and calls a function with the first notice it finds.
+type InterruptionWatcher struct {
+	Every    time.Duration
+	Lead     time.Duration // How long before scheduled events to act on them
+	mdf      MetadataFetcher
+	clock    clock.Clock
+	quitChan chan bool
+}
+
+func NewInterruptionWatcher(mdf MetadataFetcher, c clock.Clock) *InterruptionWatcher {
+	return &InterruptionWatcher{
+		Every: DefaultInterruptionCheckEvery,
+		Lead:  DefaultScheduledEventLead,
+		mdf:   mdf,
+		clock: c,
+	}
+}
+
+func (w *InterruptionWatcher) Start(f func(InterruptionNotice)) {
+	w.quitChan = make(chan bool, 1)
+	ticker := w.clock.NewTicker(w.Every)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.quitChan:
+				return
+			case <-ticker.C():
+				notice, err := FetchInterruptionNotice(w.mdf, w.clock.Now(), w.Lead)
+				if err != nil {
+					log.WithFields(log.Fields{"err": err.Error()}).Warn("Error checking for interruption notices")
+					continue
+				}
+				if notice != nil {
+					log.WithFields(log.Fields{
+						"source": notice.Source,
+						"action": notice.Action,
+						"at":     notice.Time,
+					}).Warn("Instance is going to be interrupted")
+					f(*notice)
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (w *InterruptionWatcher) Stop() {
+	if w.quitChan != nil {
+		w.quitChan <- true
+	}
+}
@@ -0,0 +1,113 @@
+package instancemetadata
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bobtfish/AWSnycast/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+var interruptionNow = time.Date(2019, 1, 21, 9, 0, 0, 0, time.UTC)
+
+func getInterruptionMetadataFetcher(scheduled string) FakeMetadataFetcher {
+	return FakeMetadataFetcher{
+		FAvailable: true,
+		Meta:       map[string]string{"events/maintenance/scheduled": scheduled},
+	}
+}
+
+func TestFetchInterruptionNoticeNone(t *testing.T) {
+	n, err := FetchInterruptionNotice(getInterruptionMetadataFetcher("[]"), interruptionNow, time.Minute)
+	assert.Nil(t, err)
+	assert.Nil(t, n)
+}
+
+func TestFetchInterruptionNoticeSpot(t *testing.T) {
+	mdf := getInterruptionMetadataFetcher("[]")
+	mdf.Meta["spot/instance-action"] = `{"action": "terminate", "time": "2019-01-21T09:02:00Z"}`
+	n, err := FetchInterruptionNotice(mdf, interruptionNow, time.Minute)
+	assert.Nil(t, err)
+	if assert.NotNil(t, n) {
+		assert.Equal(t, n.Source, "spot")
+		assert.Equal(t, n.Action, "terminate")
+		assert.Equal(t, n.Time, interruptionNow.Add(2*time.Minute))
+	}
+}
+
+func TestFetchInterruptionNoticeSpotInvalid(t *testing.T) {
+	mdf := getInterruptionMetadataFetcher("[]")
+	mdf.Meta["spot/instance-action"] = "not json"
+	_, err := FetchInterruptionNotice(mdf, interruptionNow, time.Minute)
+	assert.NotNil(t, err)
+}
+
+const scheduledEvents = `[
+  {"NotBefore": "21 Jan 2019 09:00:43 GMT", "Code": "system-reboot", "Description": "scheduled reboot", "EventId": "instance-event-1", "NotAfter": "21 Jan 2019 09:17:23 GMT", "State": "completed"},
+  {"NotBefore": "21 Jan 2019 10:00:00 GMT", "Code": "instance-stop", "Description": "scheduled stop", "EventId": "instance-event-2", "State": "active"}
+]`
+
+func TestFetchInterruptionNoticeScheduled(t *testing.T) {
+	mdf := getInterruptionMetadataFetcher(scheduledEvents)
+	n, err := FetchInterruptionNotice(mdf, interruptionNow, 10*time.Minute)
+	assert.Nil(t, err)
+	assert.Nil(t, n)
+	n, err = FetchInterruptionNotice(mdf, interruptionNow.Add(55*time.Minute), 10*time.Minute)
+	assert.Nil(t, err)
+	if assert.NotNil(t, n) {
+		assert.Equal(t, n.Source, "scheduled")
+		assert.Equal(t, n.Action, "instance-stop")
+		assert.Equal(t, n.Time, interruptionNow.Add(time.Hour))
+	}
+}
+
+func TestFetchInterruptionNoticeScheduledFail(t *testing.T) {
+	_, err := FetchInterruptionNotice(FakeMetadataFetcher{Meta: map[string]string{}}, interruptionNow, time.Minute)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Error getting scheduled events: Key events/maintenance/scheduled unknown")
+	}
+	_, err = FetchInterruptionNotice(getInterruptionMetadataFetcher("{"), interruptionNow, time.Minute)
+	assert.NotNil(t, err)
+}
+
+// lockedMetadataFetcher can be changed while a watcher is using it.
+type lockedMetadataFetcher struct {
+	FakeMetadataFetcher
+	lock sync.Mutex
+}
+
+func (m *lockedMetadataFetcher) GetMetadata(key string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.FakeMetadataFetcher.GetMetadata(key)
+}
+
+func (m *lockedMetadataFetcher) Set(key string, value string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Meta[key] = value
+}
+
+func TestInterruptionWatcher(t *testing.T) {
+	c := clock.NewFake(interruptionNow)
+	mdf := &lockedMetadataFetcher{FakeMetadataFetcher: getInterruptionMetadataFetcher("[]")}
+	w := NewInterruptionWatcher(mdf, c)
+	notices := make(chan InterruptionNotice, 1)
+	w.Start(func(n InterruptionNotice) { notices <- n })
+	defer w.Stop()
+	c.Advance(DefaultInterruptionCheckEvery)
+	select {
+	case <-notices:
+		t.Fatal("Got an interruption notice when there is none")
+	case <-time.After(10 * time.Millisecond):
+	}
+	mdf.Set("spot/instance-action", `{"action": "stop", "time": "2019-01-21T09:02:00Z"}`)
+	c.Advance(DefaultInterruptionCheckEvery)
+	select {
+	case n := <-notices:
+		assert.Equal(t, n.Action, "stop")
+	case <-time.After(time.Second):
+		t.Fatal("Did not get interruption notice")
+	}
+}
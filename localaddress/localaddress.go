@@ -0,0 +1,131 @@
+// Package localaddress adds the addresses of routes which are routed to this
+// instance to one of its network interfaces, so that the traffic for them is
+// accepted.
+package localaddress
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultInterface is the interface addresses are added to if none is
+// configured.
+const DefaultInterface = "lo"
+
+// Addresser adds and removes addresses on network interfaces. Adding an
+// address which is already there, or removing one which isn't, is not an
+// error.
+type Addresser interface {
+	AddAddress(iface string, addr *net.IPNet) error
+	RemoveAddress(iface string, addr *net.IPNet) error
+}
+
+// System changes the addresses of the interfaces of this machine.
+var System Addresser = netlinkAddresser{}
+
+// Config is which addresses to add to which interface whilst a route is
+// routed to this instance.
+type Config struct {
+	Interface string   `yaml:"interface"`
+	Addresses []string `yaml:"addresses"` // Defaults to the route's cidr, if it is a single address
+	addrs     []*net.IPNet
+	addresser Addresser
+}
+
+// Validate checks the config for the route to cidr, filling in the
+// defaults.
+func (c *Config) Validate(cidr string) error {
+	var result *multierror.Error
+	if c.Interface == "" {
+		c.Interface = DefaultInterface
+	}
+	if len(c.Addresses) == 0 {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		if ones, bits := n.Mask.Size(); ones != bits {
+			return errors.New(fmt.Sprintf("manage_local_address needs addresses, as %s is not a single address", cidr))
+		}
+		c.Addresses = []string{cidr}
+	}
+	c.addrs = make([]*net.IPNet, 0, len(c.Addresses))
+	for _, address := range c.Addresses {
+		cidr := address
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() == nil {
+				cidr = cidr + "/128"
+			} else {
+				cidr = cidr + "/32"
+			}
+		}
+		ip, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("manage_local_address address '%s' is not an IP address", address)))
+			continue
+		}
+		n.IP = ip
+		c.addrs = append(c.addrs, n)
+	}
+	return result.ErrorOrNil()
+}
+
+// Equal is if two configs add the same addresses to the same interface.
+func (c *Config) Equal(o *Config) bool {
+	if c == nil || o == nil {
+		return c == o
+	}
+	if c.Interface != o.Interface || len(c.Addresses) != len(o.Addresses) {
+		return false
+	}
+	for i, address := range c.Addresses {
+		if address != o.Addresses[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// SetAddresser sets what changes the addresses, which is System by
+// default.
+func (c *Config) SetAddresser(a Addresser) {
+	c.addresser = a
+}
+
+func (c *Config) getAddresser() Addresser {
+	if c.addresser == nil {
+		return System
+	}
+	return c.addresser
+}
+
+// Add adds all of the addresses to the interface.
+func (c *Config) Add() error {
+	var result *multierror.Error
+	for _, addr := range c.addrs {
+		if err := c.getAddresser().AddAddress(c.Interface, addr); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Could not add %s to %s: %s", addr, c.Interface, err.Error())))
+			continue
+		}
+		log.WithFields(log.Fields{"interface": c.Interface, "address": addr.String()}).Info("Added local address")
+	}
+	return result.ErrorOrNil()
+}
+
+// Remove removes all of the addresses from the interface.
+func (c *Config) Remove() error {
+	var result *multierror.Error
+	for _, addr := range c.addrs {
+		if err := c.getAddresser().RemoveAddress(c.Interface, addr); err != nil {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("Could not remove %s from %s: %s", addr, c.Interface, err.Error())))
+			continue
+		}
+		log.WithFields(log.Fields{"interface": c.Interface, "address": addr.String()}).Info("Removed local address")
+	}
+	return result.ErrorOrNil()
+}
@@ -0,0 +1,90 @@
+package localaddress
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAddresser struct {
+	addresses map[string]bool
+	err       error
+}
+
+func newFakeAddresser() *fakeAddresser {
+	return &fakeAddresser{addresses: make(map[string]bool)}
+}
+
+func (f *fakeAddresser) AddAddress(iface string, addr *net.IPNet) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.addresses[iface+" "+addr.String()] = true
+	return nil
+}
+
+func (f *fakeAddresser) RemoveAddress(iface string, addr *net.IPNet) error {
+	if f.err != nil {
+		return f.err
+	}
+	delete(f.addresses, iface+" "+addr.String())
+	return nil
+}
+
+func TestValidateDefaults(t *testing.T) {
+	c := Config{}
+	assert.Nil(t, c.Validate("192.168.1.1/32"))
+	assert.Equal(t, c.Interface, "lo")
+	assert.Equal(t, c.Addresses, []string{"192.168.1.1/32"})
+}
+
+func TestValidateNotSingleAddress(t *testing.T) {
+	c := Config{}
+	err := c.Validate("192.168.1.0/24")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "manage_local_address needs addresses, as 192.168.1.0/24 is not a single address")
+	}
+	c = Config{Addresses: []string{"192.168.1.1"}}
+	assert.Nil(t, c.Validate("192.168.1.0/24"))
+}
+
+func TestValidateBadAddress(t *testing.T) {
+	c := Config{Addresses: []string{"192.168.1.1", "nonsense"}}
+	err := c.Validate("192.168.1.0/24")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "manage_local_address address 'nonsense' is not an IP address")
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	f := newFakeAddresser()
+	c := Config{Interface: "dummy0", Addresses: []string{"192.168.1.1", "10.0.0.1/24", "fd00::1"}}
+	assert.Nil(t, c.Validate("192.168.1.0/24"))
+	c.SetAddresser(f)
+	assert.Nil(t, c.Add())
+	assert.Equal(t, f.addresses, map[string]bool{
+		"dummy0 192.168.1.1/32": true,
+		"dummy0 10.0.0.1/24":    true,
+		"dummy0 fd00::1/128":    true,
+	})
+	assert.Nil(t, c.Remove())
+	assert.Equal(t, f.addresses, map[string]bool{})
+}
+
+func TestAddRemoveFail(t *testing.T) {
+	f := newFakeAddresser()
+	f.err = errors.New("Operation not permitted")
+	c := Config{}
+	assert.Nil(t, c.Validate("192.168.1.1/32"))
+	c.SetAddresser(f)
+	err := c.Add()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Could not add 192.168.1.1/32 to lo: Operation not permitted")
+	}
+	err = c.Remove()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Could not remove 192.168.1.1/32 from lo: Operation not permitted")
+	}
+}
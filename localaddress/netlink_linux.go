@@ -0,0 +1,112 @@
+package localaddress
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// netlinkAddresser changes addresses with rtnetlink requests, as ip addr
+// does.
+type netlinkAddresser struct{}
+
+func (netlinkAddresser) AddAddress(iface string, addr *net.IPNet) error {
+	err := changeAddress(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, iface, addr)
+	if err == syscall.EEXIST {
+		return nil
+	}
+	return err
+}
+
+func (netlinkAddresser) RemoveAddress(iface string, addr *net.IPNet) error {
+	err := changeAddress(syscall.RTM_DELADDR, 0, iface, addr)
+	if err == syscall.EADDRNOTAVAIL {
+		return nil
+	}
+	return err
+}
+
+func changeAddress(msgType uint16, flags uint16, iface string, addr *net.IPNet) error {
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	family, ip := syscall.AF_INET, addr.IP.To4()
+	if ip == nil {
+		family, ip = syscall.AF_INET6, addr.IP.To16()
+	}
+	if ip == nil {
+		return errors.New(fmt.Sprintf("%s is not an IP address", addr))
+	}
+	ones, _ := addr.Mask.Size()
+	msg := syscall.IfAddrmsg{
+		Family:    uint8(family),
+		Prefixlen: uint8(ones),
+		Index:     uint32(i.Index),
+	}
+	data := (*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&msg))[:]
+	data = appendAttribute(data, syscall.IFA_LOCAL, ip)
+	data = appendAttribute(data, syscall.IFA_ADDRESS, ip)
+	return request(msgType, flags, data)
+}
+
+func appendAttribute(b []byte, attrType uint16, value []byte) []byte {
+	attr := syscall.RtAttr{Len: uint16(syscall.SizeofRtAttr + len(value)), Type: attrType}
+	b = append(b, (*[syscall.SizeofRtAttr]byte)(unsafe.Pointer(&attr))[:]...)
+	b = append(b, value...)
+	for len(b)%syscall.NLMSG_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+var sequence uint32
+
+// request sends a request to the kernel, and waits for it to be
+// acknowledged.
+func request(msgType uint16, flags uint16, data []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	header := syscall.NlMsghdr{
+		Len:   uint32(syscall.NLMSG_HDRLEN + len(data)),
+		Type:  msgType,
+		Flags: syscall.NLM_F_REQUEST | syscall.NLM_F_ACK | flags,
+		Seq:   atomic.AddUint32(&sequence, 1),
+	}
+	msg := append((*[syscall.NLMSG_HDRLEN]byte)(unsafe.Pointer(&header))[:], data...)
+	if err := syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if reply.Header.Seq != header.Seq || reply.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(reply.Data) < 4 {
+				return errors.New("Short netlink error message")
+			}
+			if errno := -*(*int32)(unsafe.Pointer(&reply.Data[0])); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			return nil
+		}
+	}
+}
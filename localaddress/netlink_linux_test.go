@@ -0,0 +1,109 @@
+package localaddress
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// inNetworkNamespace runs f on a thread in a new network namespace, which
+// is thrown away afterwards. The test is skipped if the namespace cannot be
+// made (e.g. when not running as root), or if f returns an error.
+func inNetworkNamespace(t *testing.T, f func() error) {
+	skip := make(chan error, 1)
+	go func() {
+		// The thread is never unlocked, so it exits (leaving the
+		// namespace) when this goroutine does.
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			skip <- err
+			return
+		}
+		skip <- f()
+	}()
+	if err := <-skip; err != nil {
+		t.Skipf("Cannot test in a network namespace: %s", err)
+	}
+}
+
+// addDummyInterface adds a dummy interface, as ip link add name type dummy
+// does.
+func addDummyInterface(name string) error {
+	msg := syscall.IfInfomsg{Family: syscall.AF_UNSPEC}
+	data := append([]byte{}, (*[syscall.SizeofIfInfomsg]byte)(unsafe.Pointer(&msg))[:]...)
+	data = appendAttribute(data, syscall.IFLA_IFNAME, append([]byte(name), 0))
+	kind := appendAttribute(nil, 1, []byte("dummy")) // IFLA_INFO_KIND
+	data = appendAttribute(data, syscall.IFLA_LINKINFO, kind)
+	return request(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, data)
+}
+
+func interfaceAddresses(t *testing.T, name string) []string {
+	i, err := net.InterfaceByName(name)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	addrs, err := i.Addrs()
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	s := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip, ok := addr.(*net.IPNet); ok && ip.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		s = append(s, addr.String())
+	}
+	return s
+}
+
+// testAddresses adds and removes addresses on an interface.
+func testAddresses(t *testing.T, iface string) {
+	c := Config{Interface: iface, Addresses: []string{"192.168.1.1", "10.0.0.1/24", "fd00::1"}}
+	assert.Nil(t, c.Validate("192.168.1.1/32"))
+	before := interfaceAddresses(t, iface)
+	assert.NotContains(t, before, "192.168.1.1/32")
+
+	assert.Nil(t, c.Add())
+	after := interfaceAddresses(t, iface)
+	assert.Subset(t, after, []string{"192.168.1.1/32", "10.0.0.1/24", "fd00::1/128"})
+	assert.Equal(t, len(after), len(before)+3)
+	assert.Nil(t, c.Add(), "Adding addresses which are already there is not an error")
+	assert.Equal(t, len(interfaceAddresses(t, iface)), len(before)+3)
+
+	assert.Nil(t, c.Remove())
+	assert.Equal(t, interfaceAddresses(t, iface), before)
+	assert.Nil(t, c.Remove(), "Removing addresses which are not there is not an error")
+}
+
+func TestNetlinkAddresserDummy(t *testing.T) {
+	inNetworkNamespace(t, func() error {
+		if err := addDummyInterface("awsnycast0"); err != nil {
+			return err
+		}
+		testAddresses(t, "awsnycast0")
+		return nil
+	})
+}
+
+func TestNetlinkAddresserLoopback(t *testing.T) {
+	inNetworkNamespace(t, func() error {
+		testAddresses(t, "lo")
+		return nil
+	})
+}
+
+func TestNetlinkAddresserNoInterface(t *testing.T) {
+	inNetworkNamespace(t, func() error {
+		c := Config{Interface: "awsnycast0"}
+		assert.Nil(t, c.Validate("192.168.1.1/32"))
+		err := c.Add()
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "Could not add 192.168.1.1/32 to awsnycast0: ")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package localaddress
+
+import (
+	"errors"
+	"net"
+)
+
+var errUnsupported = errors.New("Managing local addresses is only supported on Linux")
+
+type netlinkAddresser struct{}
+
+func (netlinkAddresser) AddAddress(iface string, addr *net.IPNet) error {
+	return errUnsupported
+}
+
+func (netlinkAddresser) RemoveAddress(iface string, addr *net.IPNet) error {
+	return errUnsupported
+}
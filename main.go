@@ -3,21 +3,40 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/bobtfish/AWSnycast/aws"
 	"github.com/bobtfish/AWSnycast/daemon"
+	"github.com/bobtfish/AWSnycast/instancemetadata"
 	"github.com/bobtfish/AWSnycast/version"
 	log "github.com/sirupsen/logrus"
 	logrus_syslog "github.com/sirupsen/logrus/hooks/syslog"
 	"log/syslog"
 	"os"
+	"time"
 )
 
 var (
-	debug        = flag.Bool("debug", false, "Enable debugging")
-	f            = flag.String("f", "/etc/awsnycast.yaml", "Configration file")
-	oneshot      = flag.Bool("oneshot", false, "Run route table manipulation exactly once, ignoring healthchecks, then exit")
-	noop         = flag.Bool("noop", false, "Don't actually *do* anything, just print what would be done")
-	printVersion = flag.Bool("version", false, "Print the version number")
-	logToSyslog  = flag.Bool("syslog", false, "Log to syslog")
+	debug            = flag.Bool("debug", false, "Enable debugging")
+	f                = flag.String("f", "/etc/awsnycast.yaml", "Configration file")
+	oneshot          = flag.Bool("oneshot", false, "Run route table manipulation exactly once, ignoring healthchecks, then exit")
+	noop             = flag.Bool("noop", false, "Don't actually *do* anything, just print what would be done")
+	printVersion     = flag.Bool("version", false, "Print the version number")
+	logToSyslog      = flag.Bool("syslog", false, "Log to syslog")
+	metadataTimeout  = flag.Duration("metadata-timeout", time.Second, "Timeout for each request to the instance metadata service")
+	metadataWait     = flag.Duration("metadata-wait", time.Minute, "How long to keep retrying at startup if the instance metadata service is unavailable")
+	ec2Endpoint      = flag.String("ec2-endpoint", "", "URL of the EC2 API to use, instead of the default for the region")
+	ec2RateLimit     = flag.Float64("ec2-rate-limit", aws.DefaultEC2RateLimit, "Maximum EC2 API calls per second, 0 for no limit")
+	ec2RateBurst     = flag.Int("ec2-rate-burst", aws.DefaultEC2RateBurst, "Number of EC2 API calls which can be made at once before being rate limited")
+	sqsQueueURL      = flag.String("sqs-queue-url", "", "URL of an SQS queue receiving EC2 events from EventBridge, to react to route and instance changes straight away")
+	interruptEvery   = flag.Duration("interruption-check", instancemetadata.DefaultInterruptionCheckEvery, "How often to check the metadata service for spot interruption and scheduled maintenance notices, 0 to not check")
+	instanceID       = flag.String("instance-id", "", "Instance ID to use instead of fetching it from the metadata service")
+	region           = flag.String("region", "", "Region to use instead of fetching it from the metadata service")
+	availabilityZone = flag.String("availability-zone", "", "Availability zone to use instead of fetching it from the metadata service")
+	subnetID         = flag.String("subnet-id", "", "Subnet ID to use instead of fetching it from the metadata service")
+	ipAddress        = flag.String("ip", "", "IP address to use instead of fetching it from the metadata service")
+	ssmParameter     = flag.String("ssm-parameter", os.Getenv("AWSNYCAST_SSM_PARAMETER"), "SSM parameter to read the config from, instead of the configuration file")
+	auditLog         = flag.String("audit-log", "", "File to record every route change in, as JSON lines")
+	auditLogMaxSize  = flag.Int64("audit-log-max-size", aws.DefaultAuditLogMaxSize/(1024*1024), "Size in MB at which to rotate the audit log, 0 to never rotate it")
+	auditLogBackups  = flag.Int("audit-log-backups", aws.DefaultAuditLogBackups, "Number of rotated audit logs to keep")
 )
 
 func main() {
@@ -38,5 +57,25 @@ func main() {
 	}
 	d.Debug = *debug
 	d.ConfigFile = *f
+	d.SSMParameter = *ssmParameter
+	d.MetadataTimeout = *metadataTimeout
+	d.EC2Endpoint = *ec2Endpoint
+	d.EC2RateLimit = *ec2RateLimit
+	d.EC2RateBurst = *ec2RateBurst
+	d.SQSQueueURL = *sqsQueueURL
+	d.InterruptEvery = *interruptEvery
+	d.MetadataWait = *metadataWait
+	d.AuditLogFile = *auditLog
+	d.AuditLogMaxSize = *auditLogMaxSize * 1024 * 1024
+	d.AuditLogBackups = *auditLogBackups
+	if *instanceID != "" || *region != "" || *availabilityZone != "" || *subnetID != "" || *ipAddress != "" {
+		d.StaticMetadata = &instancemetadata.InstanceMetadata{
+			Instance:         *instanceID,
+			Region:           *region,
+			AvailabilityZone: *availabilityZone,
+			Subnet:           *subnetID,
+			IPAddress:        *ipAddress,
+		}
+	}
 	os.Exit(d.Run(*oneshot, *noop))
 }
@@ -0,0 +1,197 @@
+// Package notify tells people (or other systems) when routes change or
+// healthchecks change state.
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bobtfish/AWSnycast/clock"
+	"github.com/hashicorp/go-multierror"
+	log "github.com/sirupsen/logrus"
+)
+
+// The types of notification
+const (
+	RouteCreated         = "route_created"
+	RouteReplaced        = "route_replaced"
+	RouteDeleted         = "route_deleted"
+	RouteFailed          = "route_failed"
+	HealthcheckHealthy   = "healthcheck_healthy"
+	HealthcheckUnhealthy = "healthcheck_unhealthy"
+	// Sent when an instance stops changing routes, as it is fighting
+	// another instance over one
+	CircuitBreakerTripped = "circuit_breaker_tripped"
+)
+
+// How many notifications can be waiting to be sent before new ones are
+// dropped, so that slow sinks never hold up managing routes.
+const queueSize = 100
+
+// Notification describes something which happened. Fields which don't apply
+// to it are empty.
+type Notification struct {
+	Type           string    `json:"type"`
+	Time           time.Time `json:"time"`
+	Instance       string    `json:"instance_id,omitempty"` // The instance sending the notification
+	Cidr           string    `json:"cidr,omitempty"`
+	RouteTable     string    `json:"rtb,omitempty"`
+	PreviousTarget string    `json:"previous_target,omitempty"`
+	NewTarget      string    `json:"new_target,omitempty"`
+	Reason         string    `json:"reason,omitempty"`
+	Healthcheck    string    `json:"healthcheck,omitempty"`
+	Destination    string    `json:"destination,omitempty"` // What the healthcheck checks
+}
+
+// String describes the notification in a sentence, for people to read.
+func (n Notification) String() string {
+	var s string
+	switch n.Type {
+	case RouteCreated:
+		s = fmt.Sprintf("Created route %s in %s to %s", n.Cidr, n.RouteTable, n.NewTarget)
+	case RouteReplaced:
+		s = fmt.Sprintf("Replaced route %s in %s from %s to %s", n.Cidr, n.RouteTable, n.PreviousTarget, n.NewTarget)
+	case RouteDeleted:
+		s = fmt.Sprintf("Deleted route %s in %s to %s", n.Cidr, n.RouteTable, n.PreviousTarget)
+	case RouteFailed:
+		s = fmt.Sprintf("Failed to change route %s in %s", n.Cidr, n.RouteTable)
+	case HealthcheckHealthy:
+		s = fmt.Sprintf("Healthcheck %s of %s is healthy", n.Healthcheck, n.Destination)
+	case HealthcheckUnhealthy:
+		s = fmt.Sprintf("Healthcheck %s of %s is unhealthy", n.Healthcheck, n.Destination)
+	case CircuitBreakerTripped:
+		s = "Circuit breaker tripped, not changing any more routes"
+	default:
+		s = n.Type
+	}
+	if n.Reason != "" {
+		s = s + ": " + n.Reason
+	}
+	if n.Instance != "" {
+		s = s + " (from " + n.Instance + ")"
+	}
+	return s
+}
+
+// Sink sends notifications somewhere.
+type Sink interface {
+	Name() string
+	Send(Notification) error
+}
+
+// Config is the notifications config key. Each sink is enabled by being
+// present.
+type Config struct {
+	Webhook *WebhookConfig `yaml:"webhook"`
+	SNS     *SNSConfig     `yaml:"sns"`
+	Slack   *SlackConfig   `yaml:"slack"`
+}
+
+func (c *Config) Validate() error {
+	var result *multierror.Error
+	if c.Webhook != nil {
+		if err := validateURL(c.Webhook.URL); err != nil {
+			result = multierror.Append(result, errors.New("notifications webhook "+err.Error()))
+		}
+	}
+	if c.SNS != nil {
+		if !strings.HasPrefix(c.SNS.TopicArn, "arn:") {
+			result = multierror.Append(result, errors.New(fmt.Sprintf("notifications sns topic_arn '%s' is not an ARN", c.SNS.TopicArn)))
+		}
+		if c.SNS.Region == "" {
+			result = multierror.Append(result, errors.New("notifications sns has no region"))
+		}
+	}
+	if c.Slack != nil {
+		if err := validateURL(c.Slack.URL); err != nil {
+			result = multierror.Append(result, errors.New("notifications slack "+err.Error()))
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// Sinks makes the sinks which are enabled. Sinks which wait between retries
+// do so on clk.
+func (c *Config) Sinks(clk clock.Clock) []Sink {
+	sinks := make([]Sink, 0)
+	if c == nil {
+		return sinks
+	}
+	if c.Webhook != nil {
+		sinks = append(sinks, NewWebhookSink(*c.Webhook, clk))
+	}
+	if c.SNS != nil {
+		sinks = append(sinks, NewSNSSink(*c.SNS))
+	}
+	if c.Slack != nil {
+		sinks = append(sinks, NewSlackSink(*c.Slack))
+	}
+	return sinks
+}
+
+// Notifier sends notifications to sinks in the background. A nil Notifier
+// can be used, and drops all notifications.
+type Notifier struct {
+	Instance string // Set as the Instance of every notification
+	sinks    []Sink
+	clock    clock.Clock
+	queue    chan Notification
+	quitChan chan bool
+}
+
+func NewNotifier(sinks []Sink, instance string, c clock.Clock) *Notifier {
+	n := &Notifier{
+		Instance: instance,
+		sinks:    sinks,
+		clock:    c,
+		queue:    make(chan Notification, queueSize),
+		quitChan: make(chan bool),
+	}
+	go n.run()
+	return n
+}
+
+func (n *Notifier) run() {
+	for {
+		select {
+		case <-n.quitChan:
+			return
+		case notification := <-n.queue:
+			for _, sink := range n.sinks {
+				if err := sink.Send(notification); err != nil {
+					log.WithFields(log.Fields{
+						"sink": sink.Name(),
+						"type": notification.Type,
+						"err":  err.Error(),
+					}).Warn("Error sending notification")
+				}
+			}
+		}
+	}
+}
+
+// Notify queues a notification to be sent to every sink. It never blocks;
+// if too many notifications are waiting to be sent, it is dropped.
+func (n *Notifier) Notify(notification Notification) {
+	if n == nil || len(n.sinks) == 0 {
+		return
+	}
+	notification.Instance = n.Instance
+	if notification.Time.IsZero() {
+		notification.Time = n.clock.Now()
+	}
+	select {
+	case n.queue <- notification:
+	default:
+		log.WithFields(log.Fields{"type": notification.Type}).Warn("Too many notifications waiting to be sent, dropping notification")
+	}
+}
+
+// Stop stops sending notifications. Any which are waiting are not sent.
+func (n *Notifier) Stop() {
+	if n != nil {
+		close(n.quitChan)
+	}
+}
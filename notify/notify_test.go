@@ -0,0 +1,124 @@
+package notify
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/bobtfish/AWSnycast/clock"
+	"github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingSink struct {
+	sent chan Notification
+	err  error
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{sent: make(chan Notification, 10)}
+}
+
+func (s *recordingSink) Name() string {
+	return "recording"
+}
+
+func (s *recordingSink) Send(n Notification) error {
+	s.sent <- n
+	return s.err
+}
+
+func (s *recordingSink) next(t *testing.T) Notification {
+	select {
+	case n := <-s.sent:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notification not sent")
+	}
+	return Notification{}
+}
+
+func TestNotificationString(t *testing.T) {
+	for _, tc := range []struct {
+		n        Notification
+		expected string
+	}{
+		{Notification{Type: RouteCreated, Cidr: "0.0.0.0/0", RouteTable: "rtb-1", NewTarget: "i-1"}, "Created route 0.0.0.0/0 in rtb-1 to i-1"},
+		{Notification{Type: RouteReplaced, Cidr: "0.0.0.0/0", RouteTable: "rtb-1", PreviousTarget: "i-1", NewTarget: "i-2", Reason: "current route is blackhole", Instance: "i-2"}, "Replaced route 0.0.0.0/0 in rtb-1 from i-1 to i-2: current route is blackhole (from i-2)"},
+		{Notification{Type: RouteDeleted, Cidr: "0.0.0.0/0", RouteTable: "rtb-1", PreviousTarget: "i-1"}, "Deleted route 0.0.0.0/0 in rtb-1 to i-1"},
+		{Notification{Type: RouteFailed, Cidr: "0.0.0.0/0", RouteTable: "rtb-1", Reason: "Whoops"}, "Failed to change route 0.0.0.0/0 in rtb-1: Whoops"},
+		{Notification{Type: HealthcheckHealthy, Healthcheck: "public", Destination: "8.8.8.8"}, "Healthcheck public of 8.8.8.8 is healthy"},
+		{Notification{Type: HealthcheckUnhealthy, Healthcheck: "public", Destination: "8.8.8.8"}, "Healthcheck public of 8.8.8.8 is unhealthy"},
+		{Notification{Type: CircuitBreakerTripped, Reason: "fought over 0.0.0.0/0 in rtb-1 4 times"}, "Circuit breaker tripped, not changing any more routes: fought over 0.0.0.0/0 in rtb-1 4 times"},
+	} {
+		assert.Equal(t, tc.n.String(), tc.expected)
+	}
+}
+
+func TestNotifierSendsToAllSinks(t *testing.T) {
+	s1 := newRecordingSink()
+	s1.err = errors.New("Whoops")
+	s2 := newRecordingSink()
+	c := clock.NewFake(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC))
+	n := NewNotifier([]Sink{s1, s2}, "i-1234", c)
+	defer n.Stop()
+	n.Notify(Notification{Type: RouteCreated, Cidr: "0.0.0.0/0"})
+	for _, s := range []*recordingSink{s1, s2} {
+		got := s.next(t)
+		assert.Equal(t, got.Type, RouteCreated)
+		assert.Equal(t, got.Cidr, "0.0.0.0/0")
+		assert.Equal(t, got.Instance, "i-1234")
+		assert.Equal(t, got.Time, c.Now())
+	}
+}
+
+func TestNotifierNil(t *testing.T) {
+	var n *Notifier
+	n.Notify(Notification{Type: RouteCreated})
+	n.Stop()
+}
+
+func TestNotifierDropsWhenFull(t *testing.T) {
+	s := &recordingSink{sent: make(chan Notification)} // Blocks until read
+	n := NewNotifier([]Sink{s}, "i-1234", clock.Real)
+	defer n.Stop()
+	for i := 0; i < queueSize+10; i++ {
+		n.Notify(Notification{Type: RouteFailed})
+	}
+	assert.Equal(t, s.next(t).Type, RouteFailed)
+}
+
+func TestConfigSinks(t *testing.T) {
+	var c *Config
+	assert.Equal(t, len(c.Sinks(clock.Real)), 0)
+	c = &Config{
+		Webhook: &WebhookConfig{URL: "http://127.0.0.1/notify"},
+		SNS:     &SNSConfig{TopicArn: "arn:aws:sns:us-west-1:123456789012:awsnycast", Region: "us-west-1"},
+		Slack:   &SlackConfig{URL: "https://hooks.slack.com/services/T/B/X"},
+	}
+	assert.Nil(t, c.Validate())
+	sinks := c.Sinks(clock.Real)
+	if assert.Equal(t, len(sinks), 3) {
+		assert.Equal(t, sinks[0].Name(), "webhook")
+		assert.Equal(t, sinks[1].Name(), "sns")
+		assert.Equal(t, sinks[2].Name(), "slack")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := &Config{
+		Webhook: &WebhookConfig{URL: "ftp://127.0.0.1/"},
+		SNS:     &SNSConfig{TopicArn: "awsnycast"},
+		Slack:   &SlackConfig{},
+	}
+	err := c.Validate()
+	if assert.NotNil(t, err) {
+		merr := err.(*multierror.Error)
+		if assert.Equal(t, len(merr.Errors), 4) {
+			assert.Equal(t, merr.Errors[0].Error(), "notifications webhook url 'ftp://127.0.0.1/' is not http or https")
+			assert.Equal(t, merr.Errors[1].Error(), "notifications sns topic_arn 'awsnycast' is not an ARN")
+			assert.Equal(t, merr.Errors[2].Error(), "notifications sns has no region")
+			assert.Equal(t, merr.Errors[3].Error(), "notifications slack url '' is not http or https")
+		}
+	}
+}
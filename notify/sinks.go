@@ -0,0 +1,206 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/bobtfish/AWSnycast/clock"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultWebhookRetries = 3
+	DefaultSinkTimeout    = 10 * time.Second
+	// How long to wait before the first retry; this doubles for each retry
+	webhookRetryBackoff = time.Second
+	// SNS subjects can be at most 100 characters
+	maxSNSSubject = 100
+)
+
+func validateURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return errors.New(fmt.Sprintf("url '%s' does not parse: %s", u, err.Error()))
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return errors.New(fmt.Sprintf("url '%s' is not http or https", u))
+	}
+	return nil
+}
+
+// postJSON POSTs v as JSON to a URL, failing unless it gets a 2xx response.
+func postJSON(client *http.Client, u string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(fmt.Sprintf("Got status %s", resp.Status))
+	}
+	return nil
+}
+
+type WebhookConfig struct {
+	URL     string `yaml:"url"`
+	Retries *int   `yaml:"retries"` // Defaults to DefaultWebhookRetries
+	Timeout uint   `yaml:"timeout"` // Seconds, for each attempt
+}
+
+// WebhookSink POSTs each notification as JSON to a URL, retrying with
+// exponential backoff if that fails.
+type WebhookSink struct {
+	URL     string
+	Retries int
+	Backoff time.Duration // How long to wait before the first retry
+	client  *http.Client
+	clock   clock.Clock
+}
+
+func NewWebhookSink(c WebhookConfig, clk clock.Clock) *WebhookSink {
+	s := &WebhookSink{
+		URL:     c.URL,
+		Retries: DefaultWebhookRetries,
+		Backoff: webhookRetryBackoff,
+		client:  &http.Client{Timeout: DefaultSinkTimeout},
+		clock:   clk,
+	}
+	if c.Retries != nil {
+		s.Retries = *c.Retries
+	}
+	if c.Timeout != 0 {
+		s.client.Timeout = time.Duration(c.Timeout) * time.Second
+	}
+	return s
+}
+
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *WebhookSink) Send(n Notification) error {
+	backoff := s.Backoff
+	var err error
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		if attempt > 0 {
+			log.WithFields(log.Fields{
+				"url":     s.URL,
+				"attempt": attempt,
+				"err":     err.Error(),
+			}).Debug("Retrying webhook notification")
+			clock.Sleep(s.clock, backoff)
+			backoff = backoff * 2
+		}
+		if err = postJSON(s.client, s.URL, n); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+type SlackConfig struct {
+	URL      string `yaml:"url"`
+	Channel  string `yaml:"channel"`
+	Username string `yaml:"username"`
+}
+
+// SlackSink posts a message describing each notification to a Slack (or
+// Slack-compatible, e.g. Mattermost) incoming webhook.
+type SlackSink struct {
+	SlackConfig
+	client *http.Client
+}
+
+func NewSlackSink(c SlackConfig) *SlackSink {
+	return &SlackSink{
+		SlackConfig: c,
+		client:      &http.Client{Timeout: DefaultSinkTimeout},
+	}
+}
+
+func (s *SlackSink) Name() string {
+	return "slack"
+}
+
+func (s *SlackSink) Send(n Notification) error {
+	return postJSON(s.client, s.URL, struct {
+		Text     string `json:"text"`
+		Channel  string `json:"channel,omitempty"`
+		Username string `json:"username,omitempty"`
+	}{
+		Text:     "AWSnycast: " + n.String(),
+		Channel:  s.Channel,
+		Username: s.Username,
+	})
+}
+
+type MySNSConn interface {
+	Publish(*sns.PublishInput) (*sns.PublishOutput, error)
+}
+
+type SNSConfig struct {
+	TopicArn string `yaml:"topic_arn"`
+	Region   string `yaml:"region"`
+}
+
+// SNSSink publishes each notification as JSON to an SNS topic, with the
+// description of it as the subject.
+type SNSSink struct {
+	TopicArn string
+	conn     MySNSConn
+}
+
+func NewSNSSink(c SNSConfig) *SNSSink {
+	return &SNSSink{
+		TopicArn: c.TopicArn,
+		conn:     sns.New(session.New(&aws.Config{Region: aws.String(c.Region)})),
+	}
+}
+
+func (s *SNSSink) Name() string {
+	return "sns"
+}
+
+func (s *SNSSink) Send(n Notification) error {
+	message, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.Publish(&sns.PublishInput{
+		TopicArn: aws.String(s.TopicArn),
+		Subject:  aws.String(snsSubject("AWSnycast: " + n.String())),
+		Message:  aws.String(string(message)),
+	})
+	return err
+}
+
+// snsSubject makes s into a valid SNS subject, which must be printable
+// ASCII and at most maxSNSSubject characters.
+func snsSubject(s string) string {
+	subject := []rune(strings.Map(func(r rune) rune {
+		if r < ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, s))
+	if len(subject) > maxSNSSubject {
+		return string(subject[:maxSNSSubject-3]) + "..."
+	}
+	return string(subject)
+}
@@ -0,0 +1,165 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/bobtfish/AWSnycast/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+var testNotification = Notification{
+	Type:           RouteReplaced,
+	Time:           time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+	Instance:       "i-2",
+	Cidr:           "0.0.0.0/0",
+	RouteTable:     "rtb-1",
+	PreviousTarget: "i-1",
+	NewTarget:      "i-2",
+	Reason:         "current instance unhealthy",
+}
+
+// testServer records the bodies of requests, responding to the first
+// failures of them with a 500.
+type testServer struct {
+	sync.Mutex
+	*httptest.Server
+	failures int
+	bodies   [][]byte
+}
+
+func newTestServer(failures int) *testServer {
+	s := &testServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Lock()
+		defer s.Unlock()
+		var body json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		s.bodies = append(s.bodies, body)
+		if len(s.bodies) <= s.failures {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	return s
+}
+
+// sendWaiting sends n to s, advancing c past each retry backoff as the sink
+// starts waiting for it, and returns the error from sending.
+func sendWaiting(t *testing.T, s *WebhookSink, c *clock.Fake, n Notification) error {
+	result := make(chan error, 1)
+	go func() { result <- s.Send(n) }()
+	backoff := s.Backoff
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		select {
+		case err := <-result:
+			return err
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Webhook notification not sent")
+		}
+		if c.Timers() == 1 {
+			c.Advance(backoff)
+			backoff = backoff * 2
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+	s := NewWebhookSink(WebhookConfig{URL: ts.URL}, clock.Real)
+	assert.Nil(t, s.Send(testNotification))
+	if assert.Equal(t, len(ts.bodies), 1) {
+		var got Notification
+		assert.Nil(t, json.Unmarshal(ts.bodies[0], &got))
+		assert.Equal(t, got, testNotification)
+		assert.Contains(t, string(ts.bodies[0]), `"type":"route_replaced"`)
+		assert.Contains(t, string(ts.bodies[0]), `"previous_target":"i-1"`)
+	}
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	ts := newTestServer(2)
+	defer ts.Close()
+	c := clock.NewFake(testNotification.Time)
+	s := NewWebhookSink(WebhookConfig{URL: ts.URL}, c)
+	assert.Nil(t, sendWaiting(t, s, c, testNotification))
+	assert.Equal(t, len(ts.bodies), 3)
+	// Waited for the backoff, then twice it
+	assert.Equal(t, c.Now(), testNotification.Time.Add(3*webhookRetryBackoff))
+}
+
+func TestWebhookSinkGivesUp(t *testing.T) {
+	ts := newTestServer(10)
+	defer ts.Close()
+	retries := 1
+	c := clock.NewFake(testNotification.Time)
+	s := NewWebhookSink(WebhookConfig{URL: ts.URL, Retries: &retries}, c)
+	err := sendWaiting(t, s, c, testNotification)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, err.Error(), "Got status 500 Internal Server Error")
+	}
+	assert.Equal(t, len(ts.bodies), 2)
+}
+
+func TestSlackSink(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+	s := NewSlackSink(SlackConfig{URL: ts.URL, Channel: "#ops"})
+	assert.Nil(t, s.Send(testNotification))
+	if assert.Equal(t, len(ts.bodies), 1) {
+		var got map[string]string
+		assert.Nil(t, json.Unmarshal(ts.bodies[0], &got))
+		assert.Equal(t, got, map[string]string{
+			"text":    "AWSnycast: Replaced route 0.0.0.0/0 in rtb-1 from i-1 to i-2: current instance unhealthy (from i-2)",
+			"channel": "#ops",
+		})
+	}
+}
+
+type FakeSNSConn struct {
+	PublishInput *sns.PublishInput
+	PublishError error
+}
+
+func (f *FakeSNSConn) Publish(i *sns.PublishInput) (*sns.PublishOutput, error) {
+	f.PublishInput = i
+	return &sns.PublishOutput{}, f.PublishError
+}
+
+func TestSNSSink(t *testing.T) {
+	conn := &FakeSNSConn{}
+	n := testNotification
+	n.Reason = "current route is blackhole, as the instance it pointed to was terminated"
+	s := NewSNSSink(SNSConfig{TopicArn: "arn:aws:sns:us-west-1:123456789012:awsnycast", Region: "us-west-1"})
+	s.conn = conn
+	assert.Nil(t, s.Send(n))
+	if assert.NotNil(t, conn.PublishInput) {
+		assert.Equal(t, *conn.PublishInput.TopicArn, "arn:aws:sns:us-west-1:123456789012:awsnycast")
+		assert.Equal(t, len(*conn.PublishInput.Subject), maxSNSSubject)
+		assert.True(t, strings.HasSuffix(*conn.PublishInput.Subject, "..."))
+		var got Notification
+		assert.Nil(t, json.Unmarshal([]byte(*conn.PublishInput.Message), &got))
+		assert.Equal(t, got, n)
+	}
+	conn.PublishError = errors.New("Whoops")
+	assert.NotNil(t, s.Send(testNotification))
+}
+
+func TestSNSSubject(t *testing.T) {
+	assert.Equal(t, snsSubject("Route 0.0.0.0/0 replaced"), "Route 0.0.0.0/0 replaced")
+	assert.Equal(t, snsSubject("Healthcheck café\nfailed"), "Healthcheck caf??failed")
+	long := snsSubject(strings.Repeat("é", maxSNSSubject+10))
+	assert.Equal(t, long, strings.Repeat("?", maxSNSSubject-3)+"...")
+	assert.Equal(t, len(long), maxSNSSubject)
+}
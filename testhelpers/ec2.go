@@ -0,0 +1,758 @@
+package testhelpers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/private/protocol/xml/xmlutil"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const ec2Namespace = "http://ec2.amazonaws.com/doc/2016-11-15/"
+
+// FakeInstance is an instance known to FakeEC2. Each instance has a single
+// network interface. Note that unlike in EC2, instances default to having
+// source/destination checking disabled, as they're expected to be routers.
+type FakeInstance struct {
+	InstanceId         string
+	NetworkInterfaceId string
+	PrivateIpAddress   string
+	SubnetId           string
+	VpcId              string
+	AvailabilityZone   string
+	SourceDestCheck    bool
+	// One of pending, running, stopping, stopped, shutting-down or terminated
+	State string
+	// ok or impaired, as returned by DescribeInstanceStatus
+	InstanceStatus string
+	SystemStatus   string
+	Tags           map[string]string
+}
+
+// FakeEC2 is a local, stateful stand-in for the EC2 API. It speaks the EC2
+// query protocol for the calls AWSnycast makes, so that real daemons (using
+// the real AWS SDK) can be run against shared, simulated route tables. It
+// also implements the same calls as methods, so can be used directly as an
+// in-memory EC2 connection.
+type FakeEC2 struct {
+	Server      *httptest.Server
+	OwnerId     string
+	lock        sync.Mutex
+	routeTables map[string]*ec2.RouteTable
+	instances   map[string]*FakeInstance
+	calls       map[string]int
+}
+
+func NewFakeEC2() *FakeEC2 {
+	f := &FakeEC2{
+		OwnerId:     "123456789012",
+		routeTables: make(map[string]*ec2.RouteTable),
+		instances:   make(map[string]*FakeInstance),
+		calls:       make(map[string]int),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *FakeEC2) URL() string {
+	return f.Server.URL
+}
+
+func (f *FakeEC2) Close() {
+	f.Server.Close()
+}
+
+// AddRouteTable adds a copy of rtb to the simulated account.
+func (f *FakeEC2) AddRouteTable(rtb *ec2.RouteTable) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.routeTables[*rtb.RouteTableId] = copyRouteTable(rtb)
+}
+
+// AddInstance adds an instance to the simulated account. The network
+// interface ID, state and statuses are defaulted if not set.
+func (f *FakeEC2) AddInstance(i *FakeInstance) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if i.NetworkInterfaceId == "" {
+		i.NetworkInterfaceId = "eni-" + strings.TrimPrefix(i.InstanceId, "i-")
+	}
+	if i.State == "" {
+		i.State = "running"
+	}
+	if i.InstanceStatus == "" {
+		i.InstanceStatus = "ok"
+	}
+	if i.SystemStatus == "" {
+		i.SystemStatus = "ok"
+	}
+	f.instances[i.InstanceId] = i
+}
+
+// IMDS returns a FakeIMDS serving the metadata of one of the instances, so
+// that a daemon can be run as if it were on that instance.
+func (f *FakeEC2) IMDS(instanceId string) *FakeIMDS {
+	f.lock.Lock()
+	i := f.instances[instanceId]
+	f.lock.Unlock()
+	mac := "06:00:00:" + strings.TrimPrefix(i.NetworkInterfaceId, "eni-")
+	prefix := "network/interfaces/macs/" + mac + "/"
+	return NewFakeIMDS(map[string]string{
+		"instance-id":                 i.InstanceId,
+		"placement/availability-zone": i.AvailabilityZone,
+		"local-ipv4":                  i.PrivateIpAddress,
+		"mac":                         mac,
+		"network/interfaces/macs/":    mac + "/",
+		prefix + "interface-id":       i.NetworkInterfaceId,
+		prefix + "device-number":      "0",
+		prefix + "subnet-id":          i.SubnetId,
+		prefix + "vpc-id":             i.VpcId,
+		prefix + "local-ipv4s":        i.PrivateIpAddress,
+	})
+}
+
+// SetInstanceState changes the state of an instance. Routes through
+// instances which are not running become blackholes, as they do in EC2.
+func (f *FakeEC2) SetInstanceState(instanceId string, state string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.instances[instanceId].State = state
+	routeState := "active"
+	if state != "running" {
+		routeState = "blackhole"
+	}
+	for _, rtb := range f.routeTables {
+		for _, route := range rtb.Routes {
+			if route.InstanceId != nil && *route.InstanceId == instanceId {
+				route.State = aws.String(routeState)
+			}
+		}
+	}
+}
+
+// SetInstanceStatus sets the instance and system status checks of an
+// instance to ok or impaired.
+func (f *FakeEC2) SetInstanceStatus(instanceId string, instanceStatus string, systemStatus string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.instances[instanceId].InstanceStatus = instanceStatus
+	f.instances[instanceId].SystemStatus = systemStatus
+}
+
+func (f *FakeEC2) SetSourceDestCheck(instanceId string, enabled bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.instances[instanceId].SourceDestCheck = enabled
+}
+
+// RouteTable returns a copy of the current state of a route table.
+func (f *FakeEC2) RouteTable(rtbId string) *ec2.RouteTable {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if rtb, ok := f.routeTables[rtbId]; ok {
+		return copyRouteTable(rtb)
+	}
+	return nil
+}
+
+// RouteTarget returns the instance a route points to, and the state of the
+// route, or empty strings if there is no such route.
+func (f *FakeEC2) RouteTarget(rtbId string, cidr string) (string, string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	rtb, ok := f.routeTables[rtbId]
+	if !ok {
+		return "", ""
+	}
+	if route := findRoute(rtb, cidr); route != nil {
+		return aws.StringValue(route.InstanceId), aws.StringValue(route.State)
+	}
+	return "", ""
+}
+
+// CallCount returns the number of times an API action has been called.
+func (f *FakeEC2) CallCount(action string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[action]
+}
+
+// Calls returns the total number of API calls made.
+func (f *FakeEC2) Calls() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	total := 0
+	for _, n := range f.calls {
+		total += n
+	}
+	return total
+}
+
+func copyRouteTable(rtb *ec2.RouteTable) *ec2.RouteTable {
+	c := *rtb
+	c.Routes = make([]*ec2.Route, len(rtb.Routes))
+	for i, route := range rtb.Routes {
+		r := *route
+		c.Routes[i] = &r
+	}
+	return &c
+}
+
+func findRoute(rtb *ec2.RouteTable, cidr string) *ec2.Route {
+	for _, route := range rtb.Routes {
+		if aws.StringValue(route.DestinationCidrBlock) == cidr {
+			return route
+		}
+	}
+	return nil
+}
+
+// listParam returns the values of an EC2 query list parameter, for example
+// RouteTableId.1, RouteTableId.2...
+func listParam(form url.Values, name string) []*string {
+	values := make([]*string, 0)
+	for i := 1; ; i++ {
+		v, ok := form[fmt.Sprintf("%s.%d", name, i)]
+		if !ok {
+			return values
+		}
+		values = append(values, aws.String(v[0]))
+	}
+}
+
+func filterParams(form url.Values) []*ec2.Filter {
+	filters := make([]*ec2.Filter, 0)
+	for i := 1; ; i++ {
+		name := form.Get(fmt.Sprintf("Filter.%d.Name", i))
+		if name == "" {
+			return filters
+		}
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String(name),
+			Values: listParam(form, fmt.Sprintf("Filter.%d.Value", i)),
+		})
+	}
+}
+
+func tagParams(form url.Values) []*ec2.Tag {
+	tags := make([]*ec2.Tag, 0)
+	for i := 1; ; i++ {
+		key, ok := form[fmt.Sprintf("Tag.%d.Key", i)]
+		if !ok {
+			return tags
+		}
+		tags = append(tags, &ec2.Tag{
+			Key:   aws.String(key[0]),
+			Value: aws.String(form.Get(fmt.Sprintf("Tag.%d.Value", i))),
+		})
+	}
+}
+
+func stringParam(form url.Values, name string) *string {
+	if v, ok := form[name]; ok {
+		return aws.String(v[0])
+	}
+	return nil
+}
+
+func boolParam(form url.Values, name string) *bool {
+	if v, ok := form[name]; ok {
+		b, _ := strconv.ParseBool(v[0])
+		return aws.Bool(b)
+	}
+	return nil
+}
+
+// filterValues returns the values for each filter name, so that a missing
+// filter (which matches everything) can be told apart from one with no
+// values.
+func filterValues(filters []*ec2.Filter) map[string][]string {
+	values := make(map[string][]string)
+	for _, f := range filters {
+		values[aws.StringValue(f.Name)] = append(make([]string, 0), aws.StringValueSlice(f.Values)...)
+	}
+	return values
+}
+
+func matches(wanted []string, value string) bool {
+	if wanted == nil {
+		return true
+	}
+	for _, w := range wanted {
+		if w == value {
+			return true
+		}
+	}
+	return false
+}
+
+func ec2Error(status int, code string, format string, args ...interface{}) error {
+	return awserr.NewRequestFailure(awserr.New(code, fmt.Sprintf(format, args...), nil), status, "fake")
+}
+
+func notFound(code string, format string, args ...interface{}) error {
+	return ec2Error(http.StatusBadRequest, code, format, args...)
+}
+
+func dryRun(dryRun *bool) error {
+	if aws.BoolValue(dryRun) {
+		return ec2Error(http.StatusPreconditionFailed, "DryRunOperation", "Request would have succeeded, but DryRun flag is set.")
+	}
+	return nil
+}
+
+func (f *FakeEC2) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	action := r.Form.Get("Action")
+	out, err := f.dispatch(action, r.Form)
+	var body bytes.Buffer
+	if err == nil {
+		err = encodeResponse(&body, action, out)
+	}
+	if err != nil {
+		status, code := http.StatusInternalServerError, "InternalError"
+		if rf, ok := err.(awserr.RequestFailure); ok {
+			status, code = rf.StatusCode(), rf.Code()
+		}
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "<Response><Errors><Error><Code>%s</Code><Message>%s</Message></Error></Errors><RequestID>fake</RequestID></Response>", code, err.(awserr.Error).Message())
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(body.Bytes())
+}
+
+// dispatch decodes the parameters AWSnycast uses for each call from the
+// query, and calls the matching method.
+func (f *FakeEC2) dispatch(action string, form url.Values) (interface{}, error) {
+	switch action {
+	case "DescribeRouteTables":
+		return f.DescribeRouteTables(&ec2.DescribeRouteTablesInput{
+			RouteTableIds: listParam(form, "RouteTableId"),
+			Filters:       filterParams(form),
+		})
+	case "CreateRoute":
+		return f.CreateRoute(&ec2.CreateRouteInput{
+			RouteTableId:         stringParam(form, "RouteTableId"),
+			DestinationCidrBlock: stringParam(form, "DestinationCidrBlock"),
+			InstanceId:           stringParam(form, "InstanceId"),
+			NetworkInterfaceId:   stringParam(form, "NetworkInterfaceId"),
+			DryRun:               boolParam(form, "DryRun"),
+		})
+	case "ReplaceRoute":
+		return f.ReplaceRoute(&ec2.ReplaceRouteInput{
+			RouteTableId:         stringParam(form, "RouteTableId"),
+			DestinationCidrBlock: stringParam(form, "DestinationCidrBlock"),
+			InstanceId:           stringParam(form, "InstanceId"),
+			NetworkInterfaceId:   stringParam(form, "NetworkInterfaceId"),
+			DryRun:               boolParam(form, "DryRun"),
+		})
+	case "DeleteRoute":
+		return f.DeleteRoute(&ec2.DeleteRouteInput{
+			RouteTableId:         stringParam(form, "RouteTableId"),
+			DestinationCidrBlock: stringParam(form, "DestinationCidrBlock"),
+			DryRun:               boolParam(form, "DryRun"),
+		})
+	case "DescribeNetworkInterfaces":
+		return f.DescribeNetworkInterfaces(&ec2.DescribeNetworkInterfacesInput{
+			NetworkInterfaceIds: listParam(form, "NetworkInterfaceId"),
+			Filters:             filterParams(form),
+		})
+	case "DescribeInstanceAttribute":
+		return f.DescribeInstanceAttribute(&ec2.DescribeInstanceAttributeInput{
+			InstanceId: stringParam(form, "InstanceId"),
+			Attribute:  stringParam(form, "Attribute"),
+			DryRun:     boolParam(form, "DryRun"),
+		})
+	case "DescribeInstanceStatus":
+		return f.DescribeInstanceStatus(&ec2.DescribeInstanceStatusInput{
+			InstanceIds:         listParam(form, "InstanceId"),
+			IncludeAllInstances: boolParam(form, "IncludeAllInstances"),
+		})
+	case "DescribeTags":
+		return f.DescribeTags(&ec2.DescribeTagsInput{
+			Filters: filterParams(form),
+		})
+	case "ModifyNetworkInterfaceAttribute":
+		return f.ModifyNetworkInterfaceAttribute(&ec2.ModifyNetworkInterfaceAttributeInput{
+			NetworkInterfaceId: stringParam(form, "NetworkInterfaceId"),
+			SourceDestCheck:    &ec2.AttributeBooleanValue{Value: boolParam(form, "SourceDestCheck.Value")},
+			DryRun:             boolParam(form, "DryRun"),
+		})
+	case "CreateTags":
+		return f.CreateTags(&ec2.CreateTagsInput{
+			Resources: listParam(form, "ResourceId"),
+			Tags:      tagParams(form),
+			DryRun:    boolParam(form, "DryRun"),
+		})
+	}
+	return nil, ec2Error(http.StatusBadRequest, "InvalidAction", "The action %s is not valid for this web service.", action)
+}
+
+// encodeResponse writes out as an EC2 query protocol response. xmlutil only
+// builds the first member of a structure at the top level, so each member is
+// wrapped and built on its own.
+func encodeResponse(body *bytes.Buffer, action string, out interface{}) error {
+	fmt.Fprintf(body, `<%sResponse xmlns="%s"><requestId>fake</requestId>`, action, ec2Namespace)
+	e := xml.NewEncoder(body)
+	v := reflect.ValueOf(out).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" || v.Field(i).IsNil() {
+			continue
+		}
+		wrapper := reflect.New(reflect.StructOf([]reflect.StructField{{Name: field.Name, Type: field.Type, Tag: field.Tag}}))
+		wrapper.Elem().Field(0).Set(v.Field(i))
+		if err := xmlutil.BuildXML(wrapper.Interface(), e); err != nil {
+			return err
+		}
+	}
+	e.Flush()
+	fmt.Fprintf(body, "</%sResponse>", action)
+	return nil
+}
+
+func (f *FakeEC2) sortedRouteTableIds() []string {
+	ids := make([]string, 0, len(f.routeTables))
+	for id := range f.routeTables {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (f *FakeEC2) DescribeRouteTables(i *ec2.DescribeRouteTablesInput) (*ec2.DescribeRouteTablesOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["DescribeRouteTables"]++
+	ids := aws.StringValueSlice(i.RouteTableIds)
+	for _, id := range ids {
+		if _, ok := f.routeTables[id]; !ok {
+			return nil, notFound("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", id)
+		}
+	}
+	filters := filterValues(i.Filters)
+	out := &ec2.DescribeRouteTablesOutput{RouteTables: make([]*ec2.RouteTable, 0)}
+	for _, id := range f.sortedRouteTableIds() {
+		rtb := f.routeTables[id]
+		if len(ids) > 0 && !matches(ids, id) {
+			continue
+		}
+		if !matches(filters["route-table-id"], id) || !matches(filters["vpc-id"], aws.StringValue(rtb.VpcId)) {
+			continue
+		}
+		out.RouteTables = append(out.RouteTables, copyRouteTable(rtb))
+	}
+	return out, nil
+}
+
+// routeTarget finds the route table and target instance for a Create or
+// ReplaceRoute call.
+func (f *FakeEC2) routeTarget(rtbId *string, instanceId *string, eniId *string) (*ec2.RouteTable, *FakeInstance, error) {
+	rtb, ok := f.routeTables[aws.StringValue(rtbId)]
+	if !ok {
+		return nil, nil, notFound("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", aws.StringValue(rtbId))
+	}
+	if instanceId != nil {
+		if i, ok := f.instances[*instanceId]; ok {
+			return rtb, i, nil
+		}
+		return nil, nil, notFound("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", *instanceId)
+	}
+	if eniId != nil {
+		for _, i := range f.instances {
+			if i.NetworkInterfaceId == *eniId {
+				return rtb, i, nil
+			}
+		}
+		return nil, nil, notFound("InvalidNetworkInterfaceID.NotFound", "The networkInterface ID '%s' does not exist", *eniId)
+	}
+	return nil, nil, ec2Error(http.StatusBadRequest, "MissingParameter", "A route target is required")
+}
+
+func (f *FakeEC2) setRouteTarget(route *ec2.Route, i *FakeInstance) {
+	route.InstanceId = aws.String(i.InstanceId)
+	route.InstanceOwnerId = aws.String(f.OwnerId)
+	route.NetworkInterfaceId = aws.String(i.NetworkInterfaceId)
+	route.GatewayId = nil
+	route.Origin = aws.String("CreateRoute")
+	if i.State == "running" {
+		route.State = aws.String("active")
+	} else {
+		route.State = aws.String("blackhole")
+	}
+}
+
+func isLocalRoute(route *ec2.Route) bool {
+	return aws.StringValue(route.GatewayId) == "local"
+}
+
+func (f *FakeEC2) CreateRoute(i *ec2.CreateRouteInput) (*ec2.CreateRouteOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["CreateRoute"]++
+	rtb, instance, err := f.routeTarget(i.RouteTableId, i.InstanceId, i.NetworkInterfaceId)
+	if err != nil {
+		return nil, err
+	}
+	if err := dryRun(i.DryRun); err != nil {
+		return nil, err
+	}
+	cidr := aws.StringValue(i.DestinationCidrBlock)
+	if findRoute(rtb, cidr) != nil {
+		return nil, ec2Error(http.StatusBadRequest, "RouteAlreadyExists", "The route identified by %s already exists.", cidr)
+	}
+	route := &ec2.Route{DestinationCidrBlock: aws.String(cidr)}
+	f.setRouteTarget(route, instance)
+	rtb.Routes = append(rtb.Routes, route)
+	return &ec2.CreateRouteOutput{Return: aws.Bool(true)}, nil
+}
+
+func (f *FakeEC2) ReplaceRoute(i *ec2.ReplaceRouteInput) (*ec2.ReplaceRouteOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["ReplaceRoute"]++
+	rtb, instance, err := f.routeTarget(i.RouteTableId, i.InstanceId, i.NetworkInterfaceId)
+	if err != nil {
+		return nil, err
+	}
+	if err := dryRun(i.DryRun); err != nil {
+		return nil, err
+	}
+	cidr := aws.StringValue(i.DestinationCidrBlock)
+	route := findRoute(rtb, cidr)
+	if route == nil {
+		return nil, ec2Error(http.StatusBadRequest, "InvalidParameterValue", "There is no route defined for '%s' in the route table.", cidr)
+	}
+	if isLocalRoute(route) {
+		return nil, ec2Error(http.StatusBadRequest, "InvalidParameterValue", "Cannot replace local route %s", cidr)
+	}
+	f.setRouteTarget(route, instance)
+	return &ec2.ReplaceRouteOutput{}, nil
+}
+
+func (f *FakeEC2) DeleteRoute(i *ec2.DeleteRouteInput) (*ec2.DeleteRouteOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["DeleteRoute"]++
+	rtbId := aws.StringValue(i.RouteTableId)
+	rtb, ok := f.routeTables[rtbId]
+	if !ok {
+		return nil, notFound("InvalidRouteTableID.NotFound", "The routeTable ID '%s' does not exist", rtbId)
+	}
+	if err := dryRun(i.DryRun); err != nil {
+		return nil, err
+	}
+	cidr := aws.StringValue(i.DestinationCidrBlock)
+	for n, route := range rtb.Routes {
+		if aws.StringValue(route.DestinationCidrBlock) != cidr {
+			continue
+		}
+		if isLocalRoute(route) {
+			return nil, ec2Error(http.StatusBadRequest, "InvalidParameterValue", "Cannot delete local route %s", cidr)
+		}
+		rtb.Routes = append(rtb.Routes[:n], rtb.Routes[n+1:]...)
+		return &ec2.DeleteRouteOutput{}, nil
+	}
+	return nil, notFound("InvalidRoute.NotFound", "no route with destination-cidr-block %s in route table %s", cidr, rtbId)
+}
+
+// The WithContext variants of the route changes let FakeEC2 be used
+// directly as a connection. Request options are ignored.
+
+func (f *FakeEC2) CreateRouteWithContext(ctx aws.Context, i *ec2.CreateRouteInput, opts ...request.Option) (*ec2.CreateRouteOutput, error) {
+	return f.CreateRoute(i)
+}
+
+func (f *FakeEC2) ReplaceRouteWithContext(ctx aws.Context, i *ec2.ReplaceRouteInput, opts ...request.Option) (*ec2.ReplaceRouteOutput, error) {
+	return f.ReplaceRoute(i)
+}
+
+func (f *FakeEC2) DeleteRouteWithContext(ctx aws.Context, i *ec2.DeleteRouteInput, opts ...request.Option) (*ec2.DeleteRouteOutput, error) {
+	return f.DeleteRoute(i)
+}
+
+func (f *FakeEC2) sortedInstances() []*FakeInstance {
+	ids := make([]string, 0, len(f.instances))
+	for id := range f.instances {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	instances := make([]*FakeInstance, len(ids))
+	for n, id := range ids {
+		instances[n] = f.instances[id]
+	}
+	return instances
+}
+
+func (f *FakeEC2) DescribeNetworkInterfaces(i *ec2.DescribeNetworkInterfacesInput) (*ec2.DescribeNetworkInterfacesOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["DescribeNetworkInterfaces"]++
+	ids := aws.StringValueSlice(i.NetworkInterfaceIds)
+	filters := filterValues(i.Filters)
+	out := &ec2.DescribeNetworkInterfacesOutput{NetworkInterfaces: make([]*ec2.NetworkInterface, 0)}
+	for _, instance := range f.sortedInstances() {
+		if len(ids) > 0 && !matches(ids, instance.NetworkInterfaceId) {
+			continue
+		}
+		if !matches(filters["attachment.instance-id"], instance.InstanceId) {
+			continue
+		}
+		out.NetworkInterfaces = append(out.NetworkInterfaces, &ec2.NetworkInterface{
+			NetworkInterfaceId: aws.String(instance.NetworkInterfaceId),
+			PrivateIpAddress:   aws.String(instance.PrivateIpAddress),
+			SourceDestCheck:    aws.Bool(instance.SourceDestCheck),
+			SubnetId:           aws.String(instance.SubnetId),
+			VpcId:              aws.String(instance.VpcId),
+			Attachment: &ec2.NetworkInterfaceAttachment{
+				InstanceId:  aws.String(instance.InstanceId),
+				DeviceIndex: aws.Int64(0),
+				Status:      aws.String("attached"),
+			},
+		})
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) DescribeInstanceAttribute(i *ec2.DescribeInstanceAttributeInput) (*ec2.DescribeInstanceAttributeOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["DescribeInstanceAttribute"]++
+	instanceId := aws.StringValue(i.InstanceId)
+	instance, ok := f.instances[instanceId]
+	if !ok {
+		return nil, notFound("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", instanceId)
+	}
+	if attribute := aws.StringValue(i.Attribute); attribute != "sourceDestCheck" {
+		return nil, ec2Error(http.StatusBadRequest, "InvalidParameterValue", "Attribute %s is not supported by the simulator", attribute)
+	}
+	if err := dryRun(i.DryRun); err != nil {
+		return nil, err
+	}
+	return &ec2.DescribeInstanceAttributeOutput{
+		InstanceId:      aws.String(instanceId),
+		SourceDestCheck: &ec2.AttributeBooleanValue{Value: aws.Bool(instance.SourceDestCheck)},
+	}, nil
+}
+
+func (f *FakeEC2) DescribeInstanceStatus(i *ec2.DescribeInstanceStatusInput) (*ec2.DescribeInstanceStatusOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["DescribeInstanceStatus"]++
+	ids := aws.StringValueSlice(i.InstanceIds)
+	for _, id := range ids {
+		if _, ok := f.instances[id]; !ok {
+			return nil, notFound("InvalidInstanceID.NotFound", "The instance ID '%s' does not exist", id)
+		}
+	}
+	out := &ec2.DescribeInstanceStatusOutput{InstanceStatuses: make([]*ec2.InstanceStatus, 0)}
+	for _, instance := range f.sortedInstances() {
+		if len(ids) > 0 && !matches(ids, instance.InstanceId) {
+			continue
+		}
+		if instance.State != "running" && !aws.BoolValue(i.IncludeAllInstances) {
+			continue
+		}
+		out.InstanceStatuses = append(out.InstanceStatuses, &ec2.InstanceStatus{
+			InstanceId:       aws.String(instance.InstanceId),
+			AvailabilityZone: aws.String(instance.AvailabilityZone),
+			InstanceState:    &ec2.InstanceState{Name: aws.String(instance.State)},
+			InstanceStatus:   &ec2.InstanceStatusSummary{Status: aws.String(instance.InstanceStatus)},
+			SystemStatus:     &ec2.InstanceStatusSummary{Status: aws.String(instance.SystemStatus)},
+		})
+	}
+	return out, nil
+}
+
+func (f *FakeEC2) DescribeTags(i *ec2.DescribeTagsInput) (*ec2.DescribeTagsOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["DescribeTags"]++
+	filters := filterValues(i.Filters)
+	out := &ec2.DescribeTagsOutput{Tags: make([]*ec2.TagDescription, 0)}
+	if !matches(filters["resource-type"], "instance") {
+		return out, nil
+	}
+	for _, instance := range f.sortedInstances() {
+		if !matches(filters["resource-id"], instance.InstanceId) {
+			continue
+		}
+		keys := make([]string, 0, len(instance.Tags))
+		for k := range instance.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			out.Tags = append(out.Tags, &ec2.TagDescription{
+				Key:          aws.String(k),
+				Value:        aws.String(instance.Tags[k]),
+				ResourceId:   aws.String(instance.InstanceId),
+				ResourceType: aws.String("instance"),
+			})
+		}
+	}
+	return out, nil
+}
+
+// CreateTags only supports tagging instances.
+func (f *FakeEC2) CreateTags(i *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["CreateTags"]++
+	for _, id := range aws.StringValueSlice(i.Resources) {
+		if _, ok := f.instances[id]; !ok {
+			return nil, notFound("InvalidID", "The ID '%s' is not valid", id)
+		}
+	}
+	if err := dryRun(i.DryRun); err != nil {
+		return nil, err
+	}
+	for _, id := range aws.StringValueSlice(i.Resources) {
+		instance := f.instances[id]
+		if instance.Tags == nil {
+			instance.Tags = make(map[string]string)
+		}
+		for _, tag := range i.Tags {
+			instance.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// ModifyNetworkInterfaceAttribute only supports changing SourceDestCheck.
+func (f *FakeEC2) ModifyNetworkInterfaceAttribute(i *ec2.ModifyNetworkInterfaceAttributeInput) (*ec2.ModifyNetworkInterfaceAttributeOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls["ModifyNetworkInterfaceAttribute"]++
+	eniId := aws.StringValue(i.NetworkInterfaceId)
+	for _, instance := range f.instances {
+		if instance.NetworkInterfaceId != eniId {
+			continue
+		}
+		if i.SourceDestCheck == nil || i.SourceDestCheck.Value == nil {
+			return nil, ec2Error(http.StatusBadRequest, "InvalidParameterCombination", "Attribute is not supported by the simulator")
+		}
+		if err := dryRun(i.DryRun); err != nil {
+			return nil, err
+		}
+		instance.SourceDestCheck = *i.SourceDestCheck.Value
+		return &ec2.ModifyNetworkInterfaceAttributeOutput{}, nil
+	}
+	return nil, notFound("InvalidNetworkInterfaceID.NotFound", "The networkInterface ID '%s' does not exist", eniId)
+}
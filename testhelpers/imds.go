@@ -0,0 +1,88 @@
+package testhelpers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// FakeIMDS is a local HTTP stand-in for the EC2 instance metadata service,
+// which (like a real instance enforcing IMDSv2) only answers requests made
+// with a session token.
+type FakeIMDS struct {
+	Server *httptest.Server
+	// Meta maps paths below /latest/meta-data/ to their values
+	Meta          map[string]string
+	TokenRequests int
+	// Requests to return 503 for before starting to work, to simulate
+	// the metadata service not being ready yet.
+	FailRequests int
+	lock         sync.Mutex
+	tokens       map[string]bool
+}
+
+func NewFakeIMDS(meta map[string]string) *FakeIMDS {
+	f := &FakeIMDS{
+		Meta:   meta,
+		tokens: make(map[string]bool),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *FakeIMDS) URL() string {
+	return f.Server.URL
+}
+
+func (f *FakeIMDS) Close() {
+	f.Server.Close()
+}
+
+// RevokeTokens invalidates all issued tokens, as if they had expired.
+func (f *FakeIMDS) RevokeTokens() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.tokens = make(map[string]bool)
+}
+
+func (f *FakeIMDS) Set(path string, value string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.Meta[path] = value
+}
+
+func (f *FakeIMDS) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.FailRequests > 0 {
+		f.FailRequests--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path == "/latest/api/token" {
+		if r.Method != "PUT" || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.TokenRequests++
+		token := strings.Repeat("t", f.TokenRequests)
+		f.tokens[token] = true
+		w.Write([]byte(token))
+		return
+	}
+	if !f.tokens[r.Header.Get("X-aws-ec2-metadata-token")] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/latest/meta-data/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	v, ok := f.Meta[strings.TrimPrefix(r.URL.Path, "/latest/meta-data/")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(v))
+}